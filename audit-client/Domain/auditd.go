@@ -1,14 +1,87 @@
 package Domain
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
 type AuditDaemon interface {
 	ListRules() []string
 	Init(string, bool) error
 	GetStatus() (AuditStatus, error)
 	Close()
 	SetRule(string) error
+	InsertRule(string, RulePosition) (int, error)
 	DeleteRule(string) error
-	StopAudit()
-	StartAudit()
+	StopAudit() error
+	StartAudit() error
+	SetAuditParams(AuditParams) error
+	Reload() (ReloadReport, error)
+	ApplyRules([]string) (RuleSnapshot, error)
+	RestoreRules(RuleSnapshot) error
+	RestoreHost() error
+	KernelRules() ([]string, error)
+	RuleState() RuleSetState
+}
+
+// RuleSetState identifies the rules the agent loaded and tells whether the
+// kernel still holds them. Version counts the changes the agent made, Hash
+// covers the rules as the agent recorded them, the texts the control server
+// keeps, in any order. Missing and Unexpected are empty while the kernel
+// matches, Error is set when its rules couldnt be read.
+type RuleSetState struct {
+	Version    uint64
+	Hash       string
+	KernelHash string   `json:",omitempty"`
+	Missing    []string `json:",omitempty"`
+	Unexpected []string `json:",omitempty"`
+	Error      string   `json:",omitempty"`
+}
+
+// RulePosition places a new rule right before or after a loaded one. The
+// zero value appends it, or prepends it to its filter list for -A rules.
+type RulePosition struct {
+	Before string `json:",omitempty"`
+	After  string `json:",omitempty"`
+}
+
+// RuleSnapshot is the rule set loaded at one point, ApplyRules takes one to go
+// back to. Rules are the recorded rules, Kernel the ones the kernel held, it
+// is empty when its rules couldnt be read. Both are in load order.
+type RuleSnapshot struct {
+	Rules  []string
+	Kernel []string `json:",omitempty"`
+}
+
+// HostAudit is the audit configuration the host had before the agent took the
+// kernel over: the kernel rules in load order and the audit status. The agent
+// puts it back when it leaves.
+type HostAudit struct {
+	Kernel []string
+	Status AuditStatus
+	Taken  time.Time
+}
+
+// ReloadReport is the outcome of re-reading the rules file: the rules that
+// were added and deleted to match it, the ones that failed and the rules
+// loaded afterwards.
+type ReloadReport struct {
+	Source  string
+	Added   []string
+	Deleted []string
+	Failed  []RuleFailure `json:",omitempty"`
+	Error   string        `json:",omitempty"`
+	Rules   []string
+	// RolledBack is the ApplyRuleSet job whose rules were taken back.
+	RolledBack string `json:",omitempty"`
+}
+
+// RuleFailure is a rule a reload or a rule set couldnt add or delete.
+type RuleFailure struct {
+	Rule    string
+	Code    ErrorCode
+	Message string
 }
 
 type HostInfo interface {
@@ -23,6 +96,39 @@ type Host struct {
 	CPUusage      float64 `json:"cpuSage"`
 }
 
+// AuditParams are the kernel audit settings a SetAuditParams job changes, the
+// ones left out stay as they are. Failure is 0 silent, 1 printk or 2 panic,
+// Enabled 0 disabled, 1 enabled or 2 enabled and immutable until reboot.
+type AuditParams struct {
+	RateLimit       *int `json:",omitempty"`
+	BacklogLimit    *int `json:",omitempty"`
+	BacklogWaitTime *int `json:",omitempty"`
+	Failure         *int `json:",omitempty"`
+	Enabled         *int `json:",omitempty"`
+}
+
+// Validate checks p before any of it reaches the kernel.
+func (p AuditParams) Validate() error {
+	invalid := func(format string, args ...interface{}) error {
+		return &RuleError{Code: CodeParse, Err: fmt.Errorf(format, args...)}
+	}
+	if p.RateLimit == nil && p.BacklogLimit == nil && p.BacklogWaitTime == nil && p.Failure == nil && p.Enabled == nil {
+		return &RuleError{Code: CodeParse, Err: errors.New("no audit setting to change")}
+	}
+	for name, value := range map[string]*int{"rate limit": p.RateLimit, "backlog limit": p.BacklogLimit, "backlog wait time": p.BacklogWaitTime} {
+		if value != nil && *value < 0 {
+			return invalid("%s cant be negative", name)
+		}
+	}
+	if p.Failure != nil && (*p.Failure < 0 || *p.Failure > 2) {
+		return invalid("failure mode %d isnt 0 silent, 1 printk or 2 panic", *p.Failure)
+	}
+	if p.Enabled != nil && (*p.Enabled < 0 || *p.Enabled > 2) {
+		return invalid("enabled %d isnt 0, 1 or 2 immutable", *p.Enabled)
+	}
+	return nil
+}
+
 type AuditStatusMask uint32
 
 // Mask types for AuditStatus.
@@ -0,0 +1,71 @@
+package Domain
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorCode tells the control server why a job failed. The server keeps the
+// same list and decides from it whether a job is worth retrying.
+type ErrorCode string
+
+const (
+	CodeParse          ErrorCode = "parse_error"
+	CodeBuild          ErrorCode = "build_error"
+	CodeKernelRejected ErrorCode = "kernel_rejected"
+	CodeDuplicate      ErrorCode = "duplicate"
+	CodeNotFound       ErrorCode = "not_found"
+	CodePermission     ErrorCode = "permission_denied"
+	CodeUnavailable    ErrorCode = "unavailable"
+	CodeIO             ErrorCode = "io_error"
+	CodeUnsupported    ErrorCode = "unsupported"
+	CodeInternal       ErrorCode = "internal"
+)
+
+// RuleError is an error of the audit daemon carrying its ErrorCode.
+type RuleError struct {
+	Code ErrorCode
+	Rule string
+	Err  error
+}
+
+func (e *RuleError) Error() string {
+	if e.Rule == "" {
+		return fmt.Sprintf("%s: %v", e.Code, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %v", e.Code, e.Rule, e.Err)
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
+// RuleSetError rejects a rule set as a whole, Failed lists every rule at
+// fault. Its code is the one of the first failure.
+type RuleSetError struct {
+	Failed []RuleFailure
+}
+
+func (e *RuleSetError) Error() string {
+	if len(e.Failed) == 0 {
+		return "rule set was rejected"
+	}
+	first := e.Failed[0]
+	return fmt.Sprintf("%d rules of the set failed, first %s: %s: %s", len(e.Failed), first.Code, first.Rule, first.Message)
+}
+
+// CodeOf returns the ErrorCode of err, errors without one are internal.
+func CodeOf(err error) ErrorCode {
+	if err == nil {
+		return ""
+	}
+	var ruleErr *RuleError
+	if errors.As(err, &ruleErr) {
+		return ruleErr.Code
+	}
+	var setErr *RuleSetError
+	if errors.As(err, &setErr) && len(setErr.Failed) > 0 {
+		return setErr.Failed[0].Code
+	}
+	return CodeInternal
+}
@@ -10,6 +10,7 @@ import(
 	"net"
 	"crypto/tls"
 	"errors"
+	"strconv"
 
 	"audit-client/Interfaces"
 
@@ -20,34 +21,42 @@ import(
 type HTTPClient struct{
 	BaseURL		*url.URL
 	client		*http.Client
+	//stream shares the transport of client without its timeout, a job stream stays open as long as it works
+	stream		*http.Client
 }
 
 
-func NewClient(host string) HTTPClient{
+func NewClient(host string, creds *CertStore) HTTPClient{
 
 	TLSConfig := &tls.Config{
-		MinVersion:         tls.VersionTLS12,
-		InsecureSkipVerify: true, 
+		MinVersion:           tls.VersionTLS12,
+		RootCAs:              creds.RootCAs(),
+		GetClientCertificate: creds.GetClientCertificate,
 		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
 			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
 			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
 		},
-		NextProtos: []string{"https"},
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	transport := &http.Transport{
+		Dial: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+		}).Dial,
+		MaxIdleConns:        30,
+		MaxIdleConnsPerHost: 30,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		TLSClientConfig: TLSConfig,
+		ForceAttemptHTTP2: true,
 	}
 
 	h := &http.Client{
 		Timeout: time.Second * 10,
-		Transport: &http.Transport{
-			Dial: (&net.Dialer{
-					Timeout:   30 * time.Second,
-					KeepAlive: 30 * time.Second,
-			}).Dial,
-			MaxIdleConns:        30,
-			MaxIdleConnsPerHost: 30,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ResponseHeaderTimeout: 10 * time.Second,
-			TLSClientConfig: TLSConfig,
-		},
+		Transport: transport,
 	}
 
 	c := HTTPClient{
@@ -56,6 +65,7 @@ func NewClient(host string) HTTPClient{
 			Host :	host,
 		},
 		client : h,
+		stream : &http.Client{Transport: transport},
 	}
 
 	return c
@@ -97,7 +107,7 @@ func (c *HTTPClient)SendMessage(data []byte, endpoint string, drain bool, uid st
 	if resp.StatusCode != http.StatusOK{
 		io.Copy(ioutil.Discard, resp.Body)
 		resp.Body.Close()
-		return nil, &Interfaces.APIStatusError{StatusCode: resp.StatusCode}
+		return nil, &Interfaces.APIStatusError{Action: endpoint, StatusCode: resp.StatusCode}
 	}
 
 	if drain{
@@ -110,6 +120,89 @@ func (c *HTTPClient)SendMessage(data []byte, endpoint string, drain bool, uid st
 }
 
 
+//OpenStream starts a full duplex request: what is written to the returned writer reaches the server while the
+//response is still being read. It only works over HTTP/2, an HTTP/1 connection is refused with a 505.
+func (c *HTTPClient)OpenStream(endpoint string, uid string) (io.WriteCloser, io.ReadCloser, error){
+	reader, writer := io.Pipe()
+
+	rel := &url.URL{Path: endpoint}
+	req, errR := http.NewRequest("POST", c.BaseURL.ResolveReference(rel).String(), reader)
+	if errR != nil{
+		return nil, nil, &Interfaces.APIClientError{Action: "NewRequest", Err: errR}
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Auth",uid)
+
+	resp, errD := c.stream.Do(req)
+	if errD != nil{
+		writer.Close()
+		var u *url.Error
+		if errors.As(errD, &u){
+			return nil, nil, &Interfaces.APIClientError{Action: "DoRequest", Err: errD, Op:"ServerIssues"}
+		}
+		return nil, nil, errD
+	}
+
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor < 2{
+		writer.Close()
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK{
+			return nil, nil, &Interfaces.APIStatusError{Action: endpoint, StatusCode: http.StatusHTTPVersionNotSupported}
+		}
+		return nil, nil, &Interfaces.APIStatusError{Action: endpoint, StatusCode: resp.StatusCode}
+	}
+
+	return writer, resp.Body, nil
+}
+
+
+//SendBatch uploads a gzip compressed NDJSON batch of events and returns the acknowledgement body with the Retry-After
+//hint of the server, which comes with a truncated ack. A 429 or 503 carries the hint in the APIStatusError.
+func (c *HTTPClient)SendBatch(endpoint string, uid string, batchID string, data []byte) (io.ReadCloser, time.Duration, error){
+	req, errR := c.NewRequest("POST", endpoint, data)
+	if errR != nil{
+		return nil, 0, errR
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Batch-ID", batchID)
+	req.Header.Set("Auth",uid)
+
+	resp, err := c.Do(req, false)
+	if err != nil{
+		return nil, 0, err
+	}
+
+	if resp.StatusCode != http.StatusOK{
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		statusErr := &Interfaces.APIStatusError{Action: endpoint, StatusCode: resp.StatusCode}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable{
+			statusErr.RetryAfter = retryAfter(resp.Header.Get("Retry-After"))
+		}
+		return nil, 0, statusErr
+	}
+	return resp.Body, retryAfter(resp.Header.Get("Retry-After")), nil
+}
+
+//retryAfter reads a Retry-After header given in seconds or as an HTTP date
+func retryAfter(value string) time.Duration{
+	if value == ""{
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0{
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil{
+		if wait := time.Until(date); wait > 0{
+			return wait
+		}
+	}
+	return 0
+}
+
+
 func (c *HTTPClient) NewRequest(method string, path string, body []byte) (*http.Request, error) {
 	
 	rel := &url.URL{Path: path}
@@ -135,6 +228,13 @@ func (c *HTTPClient) NewRequest(method string, path string, body []byte) (*http.
 }
 
 
+//CloseIdleConnections drops the kept alive connections, the next request does a new handshake with the current
+//client certificate
+func (c *HTTPClient)CloseIdleConnections(){
+	c.client.CloseIdleConnections()
+}
+
+
 func(c *HTTPClient) Do(req *http.Request, drain bool) (*http.Response, error){
 	resp, errR := c.client.Do(req)
 	if errR != nil {
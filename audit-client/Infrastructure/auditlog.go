@@ -0,0 +1,307 @@
+package Infrastructure
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"audit-client/Domain"
+	"audit-client/Usecases"
+
+	"audit-log"
+)
+
+var (
+	logPollInterval = 250 * time.Millisecond
+	logMaxLine      = 1 << 20
+
+	errLogMode = errors.New("rules are managed by the system auditd while the agent reads its log")
+)
+
+// LogPosition is where a LogTailer stopped reading: the file it read and the
+// offset of the first line it didnt hand out.
+type LogPosition struct {
+	file   os.FileInfo
+	offset int64
+}
+
+// LogTailer follows an auditd log the way tail -F does. When the file is
+// rotated the rest of the old file is read before the new one is opened,
+// when it is truncated reading starts over.
+type LogTailer struct {
+	path      string
+	fromStart bool
+	// resume is where an earlier tailer stopped, reading picks up there
+	// unless the log was rotated or truncated since
+	resume  *LogPosition
+	file    *os.File
+	info    os.FileInfo
+	reader  *bufio.Reader
+	partial string
+	offset  int64
+}
+
+func NewLogTailer(path string, fromStart bool) *LogTailer {
+	return &LogTailer{path: path, fromStart: fromStart}
+}
+
+// ResumeLogTailer returns a tailer that goes on where another one stopped.
+func ResumeLogTailer(path string, at LogPosition) *LogTailer {
+	return &LogTailer{path: path, resume: &at}
+}
+
+// Position returns where the tailer got to, ok is false when it never opened
+// the log.
+func (t *LogTailer) Position() (LogPosition, bool) {
+	if t.info == nil {
+		return LogPosition{}, false
+	}
+	return LogPosition{file: t.info, offset: t.offset}, true
+}
+
+func (t *LogTailer) open(seekEnd bool) error {
+	file, err := os.Open(t.path)
+	if err != nil {
+		return fmt.Errorf("couldnt open the audit log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("couldnt stat the audit log: %v", err)
+	}
+
+	var offset int64
+	whence := io.SeekStart
+	switch {
+	case t.resume != nil:
+		if os.SameFile(t.resume.file, info) && info.Size() >= t.resume.offset {
+			offset = t.resume.offset
+		} else {
+			log.Printf("audit log %s was rotated or truncated while it wasnt read, reading it from the start", t.path)
+		}
+		t.resume = nil
+	case seekEnd:
+		whence = io.SeekEnd
+	}
+	if offset, err = file.Seek(offset, whence); err != nil {
+		file.Close()
+		return fmt.Errorf("couldnt seek the audit log: %v", err)
+	}
+
+	t.file = file
+	t.info = info
+	t.offset = offset
+	t.reader = bufio.NewReaderSize(file, 64*1024)
+	t.partial = ""
+	return nil
+}
+
+func (t *LogTailer) close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// readLines hands every complete line read so far to handle, a line still
+// being written is kept until its newline arrives.
+func (t *LogTailer) readLines(handle func(string)) {
+	for {
+		line, err := t.reader.ReadString('\n')
+		if err != nil {
+			t.partial += line
+			if len(t.partial) > logMaxLine {
+				log.Printf("dropping an audit log line longer than %d bytes", logMaxLine)
+				t.offset += int64(len(t.partial))
+				t.partial = ""
+			}
+			return
+		}
+		handle(t.partial + strings.TrimRight(line, "\r\n"))
+		t.offset += int64(len(t.partial) + len(line))
+		t.partial = ""
+	}
+}
+
+// rotated reopens the log after a rotation or truncation, it reports whether
+// reading starts over.
+func (t *LogTailer) rotated(handle func(string)) bool {
+	current, errS := t.file.Stat()
+	info, errP := os.Stat(t.path)
+	if errS != nil || errP != nil {
+		// the new file isnt there yet, keep the old one
+		return false
+	}
+	if !os.SameFile(current, info) {
+		// the old file may have grown since it was last read
+		t.readLines(handle)
+		if t.partial != "" {
+			handle(t.partial)
+		}
+		t.close()
+		if err := t.open(false); err != nil {
+			log.Print(err)
+			return false
+		}
+		log.Printf("audit log %s was rotated, reading the new file", t.path)
+		return true
+	}
+	read, err := t.file.Seek(0, io.SeekCurrent)
+	if err == nil && info.Size() < read {
+		t.file.Seek(0, io.SeekStart)
+		t.reader.Reset(t.file)
+		t.partial = ""
+		t.offset = 0
+		log.Printf("audit log %s was truncated, reading it from the start", t.path)
+		return true
+	}
+	return false
+}
+
+// Run reads the log until done, handing every line to handle and calling
+// idle whenever it waits for the log to grow. A line still being written when
+// done arrives is left for a tailer resuming at Position.
+func (t *LogTailer) Run(done <-chan bool, handle func(string), idle func()) error {
+	if err := t.open(!t.fromStart); err != nil {
+		return err
+	}
+	defer t.close()
+
+	poll := time.NewTicker(logPollInterval)
+	defer poll.Stop()
+	for {
+		t.readLines(handle)
+		if t.rotated(handle) {
+			continue
+		}
+		idle()
+		select {
+		case <-done:
+			return nil
+		case <-poll.C:
+		}
+	}
+}
+
+// LogAuditHandler reads events from the log of a system auditd instead of the
+// audit netlink socket, so it needs no audit privileges. auditd owns the
+// kernel audit configuration: rules cant be changed and the status calls do
+// nothing.
+type LogAuditHandler struct {
+	path      string
+	fromStart bool
+	wg        *sync.WaitGroup
+	jobQueue  chan<- Usecases.Event
+	skipped   uint64
+	// last is where the previous reader stopped, the next one resumes there
+	last *LogPosition
+	// stopped is closed once the reader GetAuditEvent started has returned
+	stopped chan struct{}
+}
+
+func NewLogAuditHandler(path string, fromStart bool, wait *sync.WaitGroup, jobQueue chan<- Usecases.Event) *LogAuditHandler {
+	return &LogAuditHandler{path: path, fromStart: fromStart, wg: wait, jobQueue: jobQueue}
+}
+
+func (l *LogAuditHandler) AddRule(r string) error {
+	return &Domain.RuleError{Code: Domain.CodeUnsupported, Rule: r, Err: errLogMode}
+}
+
+func (l *LogAuditHandler) DeleteRule(r string) error {
+	return &Domain.RuleError{Code: Domain.CodeUnsupported, Rule: r, Err: errLogMode}
+}
+
+func (l *LogAuditHandler) GetRules() ([]string, error) {
+	return nil, &Domain.RuleError{Code: Domain.CodeUnsupported, Err: errLogMode}
+}
+
+func (l *LogAuditHandler) NormalizeRule(r string) (string, error) {
+	return r, nil
+}
+
+func (l *LogAuditHandler) GetStatus() ([]byte, error) {
+	return json.Marshal(Domain.AuditStatus{})
+}
+
+func (l *LogAuditHandler) SetEnabled(bool) error        { return nil }
+func (l *LogAuditHandler) SetImmutable() error          { return nil }
+func (l *LogAuditHandler) SetRateLimit(int) error       { return nil }
+func (l *LogAuditHandler) SetBackLogLimit(int) error    { return nil }
+func (l *LogAuditHandler) SetBacklogWaitTime(int) error { return nil }
+func (l *LogAuditHandler) SetFailure(int) error         { return nil }
+func (l *LogAuditHandler) SetPID() error                { return nil }
+func (l *LogAuditHandler) DeleteRules() error           { return nil }
+func (l *LogAuditHandler) Close()                       {}
+
+func (l *LogAuditHandler) publish(info Usecases.GeneralInfo) {
+	l.wg.Add(1)
+	defer l.wg.Done()
+	data, err := json.Marshal(info)
+	if err != nil {
+		log.Printf("could not marshal the event : %v", err)
+		return
+	}
+	l.jobQueue <- Usecases.Event{Data: data, ID: strconv.FormatUint(info.Serial, 10)}
+}
+
+func (l *LogAuditHandler) GetAuditEvent(done <-chan bool) {
+	hostname, _ := os.Hostname()
+	assembler := auditlog.NewAssembler(func(event auditlog.Event) {
+		l.publish(Usecases.GeneralInfo{Serial: event.Serial, Data: event.Data, Hostname: hostname})
+	})
+	handle := func(line string) {
+		msgs, err := auditlog.ParseLine(line)
+		if err != nil {
+			if l.skipped++; l.skipped == 1 || l.skipped%1000 == 0 {
+				log.Printf("skipping audit log lines that dont parse (%d so far): %v", l.skipped, err)
+			}
+			return
+		}
+		now := time.Now()
+		for _, msg := range msgs {
+			if err := assembler.Add(msg, now); err != nil {
+				log.Printf("skipping %v", err)
+			}
+		}
+	}
+	idle := func() {
+		assembler.Expire(time.Now())
+	}
+
+	// fromStart only applies to the first reader, the ones after it resume
+	// where the last one stopped
+	tailer := NewLogTailer(l.path, l.fromStart)
+	if l.last != nil {
+		tailer = ResumeLogTailer(l.path, *l.last)
+	}
+	stopped := make(chan struct{})
+	l.stopped = stopped
+
+	go func() {
+		defer close(stopped)
+		err := tailer.Run(done, handle, idle)
+		assembler.Expire(time.Time{})
+		if position, ok := tailer.Position(); ok {
+			l.last = &position
+		}
+		if err != nil {
+			log.Printf("stopped reading the audit log: %v", err)
+		}
+	}()
+}
+
+// WaitReader returns once the reader the last GetAuditEvent started has
+// handed out its events and returned.
+func (l *LogAuditHandler) WaitReader() {
+	if l.stopped != nil {
+		<-l.stopped
+	}
+}
@@ -0,0 +1,182 @@
+package Infrastructure
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// tailLines gathers what a tailer hands out.
+type tailLines []string
+
+func (l *tailLines) handle(line string) { *l = append(*l, line) }
+
+func appendLog(t *testing.T, path string, text string) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(text); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTailerReadsTheRotatedFileToTheEnd writes to the log after it was last
+// read and renames it, the tailer reads those lines before the new file.
+func TestTailerReadsTheRotatedFileToTheEnd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	appendLog(t, path, "old 1\n")
+	tailer := NewLogTailer(path, true)
+	if err := tailer.open(false); err != nil {
+		t.Fatal(err)
+	}
+	defer tailer.close()
+
+	var lines tailLines
+	tailer.readLines(lines.handle)
+	appendLog(t, path, "old 2\nold 3 without a newline")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if tailer.rotated(lines.handle) {
+		t.Fatalf("rotated before the new file was there")
+	}
+	appendLog(t, path, "new 1\n")
+
+	if !tailer.rotated(lines.handle) {
+		t.Fatalf("rotation wasnt noticed")
+	}
+	tailer.readLines(lines.handle)
+	want := tailLines{"old 1", "old 2", "old 3 without a newline", "new 1"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("read %q, want %q", lines, want)
+	}
+}
+
+func TestTailerStartsOverAfterTruncation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	appendLog(t, path, "line 1\nline 2\n")
+	tailer := NewLogTailer(path, true)
+	if err := tailer.open(false); err != nil {
+		t.Fatal(err)
+	}
+	defer tailer.close()
+
+	var lines tailLines
+	tailer.readLines(lines.handle)
+	if tailer.rotated(lines.handle) {
+		t.Fatalf("unchanged log reported as rotated")
+	}
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendLog(t, path, "line 3\n")
+
+	if !tailer.rotated(lines.handle) {
+		t.Fatalf("truncation wasnt noticed")
+	}
+	tailer.readLines(lines.handle)
+	want := tailLines{"line 1", "line 2", "line 3"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("read %q, want %q", lines, want)
+	}
+}
+
+// TestTailerRun follows a log through a rotation with Run.
+func TestTailerRun(t *testing.T) {
+	defer func(interval time.Duration) { logPollInterval = interval }(logPollInterval)
+	logPollInterval = 5 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	appendLog(t, path, "skipped\n")
+	tailer := NewLogTailer(path, false)
+
+	got := make(chan string, 10)
+	idle := make(chan struct{}, 1)
+	done := make(chan bool)
+	stopped := make(chan error)
+	go func() {
+		stopped <- tailer.Run(done, func(line string) { got <- line }, func() {
+			select {
+			case idle <- struct{}{}:
+			default:
+			}
+		})
+	}()
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case line := <-got:
+			if line != want {
+				t.Fatalf("read %q, want %q", line, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q wasnt read", want)
+		}
+	}
+	<-idle
+	appendLog(t, path, "line 1\n")
+	expect("line 1")
+	os.Rename(path, path+".1")
+	appendLog(t, path, "line 2\n")
+	expect("line 2")
+
+	close(done)
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case line := <-got:
+		t.Errorf("read %q as well", line)
+	default:
+	}
+}
+
+// TestTailerResumes stops a tailer inside a line being written, the next one
+// picks up at that line. After a rotation it reads the new file instead.
+func TestTailerResumes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	appendLog(t, path, "line 1\nline 2 half")
+	first := NewLogTailer(path, true)
+	if err := first.open(false); err != nil {
+		t.Fatal(err)
+	}
+	var lines tailLines
+	first.readLines(lines.handle)
+	first.close()
+	at, ok := first.Position()
+	if !ok || at.offset != int64(len("line 1\n")) {
+		t.Fatalf("stopped at %+v, %v", at, ok)
+	}
+
+	appendLog(t, path, " done\nline 3\n")
+	second := ResumeLogTailer(path, at)
+	if err := second.open(true); err != nil {
+		t.Fatal(err)
+	}
+	second.readLines(lines.handle)
+	second.close()
+	want := tailLines{"line 1", "line 2 half done", "line 3"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("read %q, want %q", lines, want)
+	}
+
+	at, _ = second.Position()
+	os.Rename(path, path+".1")
+	appendLog(t, path, "new 1\n")
+	third := ResumeLogTailer(path, at)
+	if err := third.open(true); err != nil {
+		t.Fatal(err)
+	}
+	defer third.close()
+	lines = nil
+	third.readLines(lines.handle)
+	if !reflect.DeepEqual(lines, tailLines{"new 1"}) {
+		t.Errorf("after a rotation read %q", lines)
+	}
+}
@@ -0,0 +1,218 @@
+package Infrastructure
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertStore keeps the agent's client certificate in the state directory and
+// the control server CA the agent pins. The certificate and its key share one
+// file so a crash cant leave a key behind that doesnt match the certificate.
+// The certificate is swapped in place on renewal, new connections pick it up
+// through GetClientCertificate.
+type CertStore struct {
+	dir   string
+	id    string
+	roots *x509.CertPool
+
+	lock       sync.RWMutex
+	cert       *tls.Certificate
+	pendingKey *ecdsa.PrivateKey
+}
+
+// NewCertStore loads the pinned server CA from caFile and the agent
+// certificate from stateDir if the agent was enrolled before.
+func NewCertStore(stateDir string, caFile string, id string) (*CertStore, error) {
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldnt read the control server ca, copy it from the server's ca directory: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+
+	c := &CertStore{dir: stateDir, id: id, roots: roots}
+
+	// a missing or broken certificate means the agent enrolls again
+	cert, err := c.load()
+	if err == nil {
+		leaf, errP := x509.ParseCertificate(cert.Certificate[0])
+		if errP == nil {
+			cert.Leaf = leaf
+			c.cert = &cert
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("ignoring the stored agent certificate: %v", err)
+	}
+	return c, nil
+}
+
+// load reads the certificate and key, agents enrolled before they shared a
+// file still have them in two.
+func (c *CertStore) load() (tls.Certificate, error) {
+	data, err := ioutil.ReadFile(c.pairFile())
+	if os.IsNotExist(err) {
+		if _, errS := os.Stat(c.legacyCertFile()); errS != nil {
+			return tls.Certificate{}, err
+		}
+		return tls.LoadX509KeyPair(c.legacyCertFile(), c.legacyKeyFile())
+	}
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(data, data)
+}
+
+func (c *CertStore) pairFile() string {
+	return filepath.Join(c.dir, "agent.pem")
+}
+
+func (c *CertStore) legacyCertFile() string {
+	return filepath.Join(c.dir, "agent.crt")
+}
+
+func (c *CertStore) legacyKeyFile() string {
+	return filepath.Join(c.dir, "agent.key")
+}
+
+// RootCAs returns the pinned control server CA.
+func (c *CertStore) RootCAs() *x509.CertPool {
+	return c.roots
+}
+
+// GetClientCertificate is meant for tls.Config.GetClientCertificate. Until
+// the agent is enrolled, or once its certificate expired, no certificate is
+// sent and only registration with the enrollment token works.
+func (c *CertStore) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.cert == nil || time.Now().After(c.cert.Leaf.NotAfter) {
+		return &tls.Certificate{}, nil
+	}
+	return c.cert, nil
+}
+
+// NeedsRenewal reports whether the agent has no usable certificate or less
+// than a third of its lifetime is left.
+func (c *CertStore) NeedsRenewal() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.cert == nil {
+		return true
+	}
+	leaf := c.cert.Leaf
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	return time.Until(leaf.NotAfter) < lifetime/3
+}
+
+// CSR creates a new key and returns a PEM certificate request for it. The
+// key is only kept in memory until Install stores the issued certificate.
+func (c *CertStore) CSR() (string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("couldnt generate a key: %v", err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: c.id},
+	}, key)
+	if err != nil {
+		return "", fmt.Errorf("couldnt create the certificate request: %v", err)
+	}
+
+	c.lock.Lock()
+	c.pendingKey = key
+	c.lock.Unlock()
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), nil
+}
+
+// Install verifies the issued certificate against the pinned CA and the key
+// of the last CSR, stores both and starts using them.
+func (c *CertStore) Install(certPEM string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.pendingKey == nil {
+		return errors.New("no certificate was requested")
+	}
+
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return errors.New("no certificate found in the response")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("couldnt parse the issued certificate: %v", err)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:     c.roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return fmt.Errorf("issued certificate isnt signed by the pinned ca: %v", err)
+	}
+	if leaf.Subject.CommonName != c.id {
+		return fmt.Errorf("issued certificate is for %s, not for this agent", leaf.Subject.CommonName)
+	}
+	pub, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok || !pub.Equal(&c.pendingKey.PublicKey) {
+		return errors.New("issued certificate doesnt match the requested key")
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(c.pendingKey)
+	if err != nil {
+		return err
+	}
+	pair := append([]byte(strings.TrimSpace(certPEM)+"\n"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+	if err := writeAtomic(c.pairFile(), pair); err != nil {
+		return fmt.Errorf("couldnt store the agent certificate: %v", err)
+	}
+	os.Remove(c.legacyCertFile())
+	os.Remove(c.legacyKeyFile())
+
+	c.cert = &tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  c.pendingKey,
+		Leaf:        leaf,
+	}
+	c.pendingKey = nil
+	return nil
+}
+
+// writeAtomic replaces filename with data, a crash leaves either the old or
+// the new content behind.
+func writeAtomic(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
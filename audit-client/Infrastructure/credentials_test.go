@@ -0,0 +1,147 @@
+package Infrastructure
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA signs the CSRs of a CertStore the way the control server does.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	file := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+func (ca *testCA) sign(t *testing.T, csrPEM string) string {
+	t.Helper()
+	block, _ := pem.Decode([]byte(csrPEM))
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func enroll(t *testing.T, store *CertStore, ca *testCA) {
+	t.Helper()
+	csr, err := store.CSR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Install(ca.sign(t, csr)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertStoreKeepsTheKeyWithTheCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	store, err := NewCertStore(dir, ca.file, "agent-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.NeedsRenewal() {
+		t.Fatal("a store without certificate doesnt ask for one")
+	}
+	enroll(t, store, ca)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "agent*"))
+	if len(files) != 1 || filepath.Base(files[0]) != "agent.pem" {
+		t.Fatalf("the agent's credentials are in %v, want them together in agent.pem", files)
+	}
+
+	reopened, err := NewCertStore(dir, ca.file, "agent-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := reopened.GetClientCertificate(nil)
+	if len(cert.Certificate) == 0 || reopened.NeedsRenewal() {
+		t.Fatal("the stored certificate wasnt loaded")
+	}
+	if !cert.PrivateKey.(*ecdsa.PrivateKey).PublicKey.Equal(cert.Leaf.PublicKey) {
+		t.Error("the loaded key doesnt match the certificate")
+	}
+}
+
+func TestCertStoreLoadsAndReplacesSeparateFiles(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	store, err := NewCertStore(dir, ca.file, "agent-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enroll(t, store, ca)
+
+	// an agent enrolled before the key moved in with the certificate
+	data, err := ioutil.ReadFile(filepath.Join(dir, "agent.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certBlock, rest := pem.Decode(data)
+	keyBlock, _ := pem.Decode(rest)
+	ioutil.WriteFile(filepath.Join(dir, "agent.crt"), pem.EncodeToMemory(certBlock), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "agent.key"), pem.EncodeToMemory(keyBlock), 0600)
+	os.Remove(filepath.Join(dir, "agent.pem"))
+
+	legacy, err := NewCertStore(dir, ca.file, "agent-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legacy.NeedsRenewal() {
+		t.Fatal("the certificate in separate files wasnt loaded")
+	}
+
+	enroll(t, legacy, ca)
+	files, _ := filepath.Glob(filepath.Join(dir, "agent*"))
+	if len(files) != 1 || filepath.Base(files[0]) != "agent.pem" {
+		t.Errorf("after renewal the agent's credentials are in %v", files)
+	}
+}
@@ -0,0 +1,287 @@
+package Infrastructure
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"audit-client/Domain"
+	"audit-client/Usecases"
+)
+
+var fakeScriptBuffer = 1024
+
+// FakeAuditdHandler is an in-memory audit daemon. Rules go through the same
+// flags.Parse and rule.Build path as on the netlink socket and the built rules
+// are kept the way the kernel keeps them, so duplicates and unknown rules fail
+// with the same error codes. Events handed to Script are published as if the
+// kernel had sent them. It needs neither root nor a netlink socket.
+type FakeAuditdHandler struct {
+	lock     sync.Mutex
+	rules    []string
+	wire     [][]byte
+	status   Domain.AuditStatus
+	closed   bool
+	script   chan Usecases.GeneralInfo
+	wg       *sync.WaitGroup
+	jobQueue chan<- Usecases.Event
+	failures map[string]error
+}
+
+func NewFakeAuditHandler(wait *sync.WaitGroup, jobQueue chan<- Usecases.Event) *FakeAuditdHandler {
+	return &FakeAuditdHandler{
+		script:   make(chan Usecases.GeneralInfo, fakeScriptBuffer),
+		wg:       wait,
+		jobQueue: jobQueue,
+		failures: map[string]error{},
+	}
+}
+
+// FailNext makes the next call of the named method, such as "AddRule" or
+// "SetPID", return err instead of doing anything. Errnos passed to AddRule and
+// DeleteRule get the error code the netlink handler would give them.
+func (f *FakeAuditdHandler) FailNext(method string, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failures[method] = err
+}
+
+// fail returns and forgets the error set for method, the lock is held.
+func (f *FakeAuditdHandler) fail(method string) error {
+	err, ok := f.failures[method]
+	if ok {
+		delete(f.failures, method)
+	}
+	return err
+}
+
+func (f *FakeAuditdHandler) find(data []byte) int {
+	for i, w := range f.wire {
+		if bytes.Equal(w, data) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *FakeAuditdHandler) AddRule(rule string) error {
+	data, errC := convertRule(rule)
+	if errC != nil {
+		return errC
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.fail("AddRule"); err != nil {
+		return kernelError(rule, fmt.Errorf("Audit daemon could not add the rule: %w", err))
+	}
+	if f.find(data) >= 0 {
+		return kernelError(rule, fmt.Errorf("Audit daemon could not add the rule: %w", syscall.EEXIST))
+	}
+	// like the kernel, -A rules go in front of their filter list
+	i := len(f.rules)
+	if Usecases.IsPrepend(rule) {
+		list := Usecases.RuleList(rule)
+		for j, r := range f.rules {
+			if Usecases.RuleList(r) == list {
+				i = j
+				break
+			}
+		}
+	}
+	f.rules = append(f.rules[:i], append([]string{rule}, f.rules[i:]...)...)
+	f.wire = append(f.wire[:i], append([][]byte{data}, f.wire[i:]...)...)
+	return nil
+}
+
+func (f *FakeAuditdHandler) DeleteRule(rule string) error {
+	data, errC := convertRule(rule)
+	if errC != nil {
+		return errC
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.fail("DeleteRule"); err != nil {
+		return kernelError(rule, fmt.Errorf("Audit daemon could not delete the rule: %w", err))
+	}
+	i := f.find(data)
+	if i < 0 {
+		return kernelError(rule, fmt.Errorf("Audit daemon could not delete the rule: %w", syscall.ENOENT))
+	}
+	f.rules = append(f.rules[:i], f.rules[i+1:]...)
+	f.wire = append(f.wire[:i], f.wire[i+1:]...)
+	return nil
+}
+
+func (f *FakeAuditdHandler) DeleteRules() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.fail("DeleteRules"); err != nil {
+		return err
+	}
+	f.rules = nil
+	f.wire = nil
+	return nil
+}
+
+// GetRules lists the loaded rules converted back from their wire format, the
+// way the netlink handler does.
+func (f *FakeAuditdHandler) GetRules() ([]string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.fail("GetRules"); err != nil {
+		return nil, kernelError("", fmt.Errorf("Audit daemon could not list the rules: %w", err))
+	}
+	rules := make([]string, 0, len(f.wire))
+	for _, data := range f.wire {
+		text, err := ruleText(data)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, text)
+	}
+	return rules, nil
+}
+
+func (f *FakeAuditdHandler) NormalizeRule(r string) (string, error) {
+	return normalizeRule(r)
+}
+
+// Rules returns the rules loaded in the fake kernel in the order the kernel
+// lists them.
+func (f *FakeAuditdHandler) Rules() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string(nil), f.rules...)
+}
+
+func (f *FakeAuditdHandler) GetStatus() ([]byte, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.fail("GetStatus"); err != nil {
+		return nil, fmt.Errorf("fakeaudit: GetStatus : %v", err)
+	}
+	return json.Marshal(f.status)
+}
+
+func (f *FakeAuditdHandler) set(method string, apply func(*Domain.AuditStatus)) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.fail(method); err != nil {
+		return err
+	}
+	apply(&f.status)
+	return nil
+}
+
+func (f *FakeAuditdHandler) SetEnabled(enabled bool) error {
+	return f.set("SetEnabled", func(s *Domain.AuditStatus) {
+		// an immutable configuration stays as it is, like in the kernel
+		if s.Enabled == 2 {
+			return
+		}
+		s.Enabled = 0
+		if enabled {
+			s.Enabled = 1
+		}
+		s.Mask |= Domain.AuditStatusEnabled
+	})
+}
+
+func (f *FakeAuditdHandler) SetImmutable() error {
+	return f.set("SetImmutable", func(s *Domain.AuditStatus) {
+		s.Enabled = 2
+		s.Mask |= Domain.AuditStatusEnabled
+	})
+}
+
+func (f *FakeAuditdHandler) SetFailure(mode int) error {
+	return f.set("SetFailure", func(s *Domain.AuditStatus) {
+		s.Failure = uint32(mode)
+		s.Mask |= Domain.AuditStatusFailure
+	})
+}
+
+func (f *FakeAuditdHandler) SetBacklogWaitTime(wait int) error {
+	return f.set("SetBacklogWaitTime", func(s *Domain.AuditStatus) {
+		s.BacklogWaitTime = uint32(wait)
+		s.Mask |= Domain.AuditStatusBacklogWaitTime
+	})
+}
+
+func (f *FakeAuditdHandler) SetRateLimit(rate int) error {
+	return f.set("SetRateLimit", func(s *Domain.AuditStatus) {
+		s.RateLimit = uint32(rate)
+		s.Mask |= Domain.AuditStatusRateLimit
+	})
+}
+
+func (f *FakeAuditdHandler) SetBackLogLimit(backlog int) error {
+	return f.set("SetBackLogLimit", func(s *Domain.AuditStatus) {
+		s.BacklogLimit = uint32(backlog)
+		s.Mask |= Domain.AuditStatusBacklogLimit
+	})
+}
+
+func (f *FakeAuditdHandler) SetPID() error {
+	return f.set("SetPID", func(s *Domain.AuditStatus) {
+		s.PID = uint32(os.Getpid())
+		s.Mask |= Domain.AuditStatusPID
+	})
+}
+
+func (f *FakeAuditdHandler) Close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+}
+
+// Closed reports whether the agent closed the audit daemon.
+func (f *FakeAuditdHandler) Closed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.closed
+}
+
+// Script queues events to be published once GetAuditEvent runs, in order.
+func (f *FakeAuditdHandler) Script(events ...Usecases.GeneralInfo) error {
+	for _, event := range events {
+		select {
+		case f.script <- event:
+		default:
+			return errors.New("fakeaudit: too many scripted events waiting")
+		}
+	}
+	return nil
+}
+
+func (f *FakeAuditdHandler) publish(info Usecases.GeneralInfo) {
+	f.wg.Add(1)
+	defer f.wg.Done()
+	data, err := json.Marshal(info)
+	if err != nil {
+		log.Printf("could not marshal the event : %v", err)
+		return
+	}
+	f.jobQueue <- Usecases.Event{Data: data, ID: strconv.FormatUint(info.Serial, 10)}
+}
+
+func (f *FakeAuditdHandler) GetAuditEvent(done <-chan bool) {
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case info := <-f.script:
+				f.publish(info)
+			}
+		}
+	}()
+}
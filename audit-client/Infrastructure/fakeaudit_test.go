@@ -0,0 +1,39 @@
+package Infrastructure
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"audit-client/Usecases"
+)
+
+func TestFakeAuditdPrependsToTheList(t *testing.T) {
+	f := NewFakeAuditHandler(&sync.WaitGroup{}, make(chan Usecases.Event, 1))
+	rules := []string{
+		"-a always,exit -F arch=b64 -S open -k files",
+		"-w /etc/passwd -p wa -k identity",
+		"-a never,exclude -F msgtype=CWD",
+		// in front of the exit list, the watch is an exit rule too
+		"-A always,exit -F arch=b64 -S ptrace -k tracing",
+		// in front of the exclude list only
+		"-A never,exclude -F msgtype=PATH",
+	}
+	for _, rule := range rules {
+		if err := f.AddRule(rule); err != nil {
+			t.Fatalf("%s: %v", rule, err)
+		}
+	}
+	want := []string{rules[3], rules[0], rules[1], rules[4], rules[2]}
+	if got := f.Rules(); !reflect.DeepEqual(got, want) {
+		t.Errorf("kernel has %q, want %q", got, want)
+	}
+
+	// an -A rule added as -a goes to the end of its list
+	if err := f.AddRule(Usecases.AsAppend("-A always,exit -F arch=b64 -S mkdir -k files")); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.Rules(); got[len(got)-1] != "-a always,exit -F arch=b64 -S mkdir -k files" {
+		t.Errorf("kernel has %q", got)
+	}
+}
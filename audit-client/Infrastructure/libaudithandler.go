@@ -8,7 +8,9 @@ import (
 	"os"
 	"reflect"
 	"sync"
+	"syscall"
 
+	"audit-client/Domain"
 	"audit-client/Usecases"
 
 	"github.com/elastic/go-libaudit"
@@ -42,19 +44,79 @@ func NewLibauditHandler(wait *sync.WaitGroup, jobQueue chan<- Usecases.Event) (L
 }
 
 func (l *LibauditdHandler) ConvertRule(r string) ([]byte, error) {
+	return convertRule(r)
+}
+
+// convertRule builds the wire format of an auditctl rule.
+func convertRule(r string) ([]byte, error) {
 	d, errP := flags.Parse(r)
 	if errP != nil {
-		return nil, fmt.Errorf("Parse error: %v", errP)
+		return nil, &Domain.RuleError{Code: Domain.CodeParse, Rule: r, Err: fmt.Errorf("Parse error: %v", errP)}
 	}
 
 	data, errB := rule.Build(d)
 	if errB != nil {
-		return nil, fmt.Errorf("Build error: %v", errB)
+		return nil, &Domain.RuleError{Code: Domain.CodeBuild, Rule: r, Err: fmt.Errorf("Build error: %v", errB)}
 	}
 	return data, nil
 
 }
 
+// NormalizeRule returns rule the way the kernel lists it back.
+func (l *LibauditdHandler) NormalizeRule(r string) (string, error) {
+	return normalizeRule(r)
+}
+
+func normalizeRule(r string) (string, error) {
+	data, err := convertRule(r)
+	if err != nil {
+		return "", err
+	}
+	return ruleText(data)
+}
+
+// ruleText turns the wire format of a rule back into auditctl syntax. User
+// and group IDs stay numeric so the text doesnt depend on the passwd file.
+func ruleText(data []byte) (string, error) {
+	text, err := rule.ToCommandLine(rule.WireFormat(data), false)
+	if err != nil {
+		return "", &Domain.RuleError{Code: Domain.CodeBuild, Err: fmt.Errorf("couldnt convert the kernel rule: %v", err)}
+	}
+	return text, nil
+}
+
+// kernelError gives an error of the audit netlink socket its ErrorCode. Errors
+// without an errno never reached the kernel and are worth a retry.
+func kernelError(r string, err error) error {
+	code := Domain.CodeUnavailable
+	var errno syscall.Errno
+	switch {
+	case ruleExists(err):
+		code = Domain.CodeDuplicate
+	case !errors.As(err, &errno):
+	case errno == syscall.EEXIST:
+		code = Domain.CodeDuplicate
+	case errno == syscall.ENOENT:
+		code = Domain.CodeNotFound
+	case errno == syscall.EPERM || errno == syscall.EACCES:
+		code = Domain.CodePermission
+	case errno == syscall.EINVAL || errno == syscall.EOPNOTSUPP:
+		code = Domain.CodeKernelRejected
+	}
+	return &Domain.RuleError{Code: code, Rule: r, Err: err}
+}
+
+// ruleExists reports whether err wraps the error go-libaudit replaces EEXIST
+// with, it has no type to match so the message is compared.
+func ruleExists(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if err.Error() == "rule exists" {
+			return true
+		}
+	}
+	return false
+}
+
 func (l *LibauditdHandler) AddRule(rule string) error {
 	data, errC := l.ConvertRule(rule)
 	if errC != nil {
@@ -63,7 +125,7 @@ func (l *LibauditdHandler) AddRule(rule string) error {
 
 	errR := l.daemon.AddRule(data)
 	if errR != nil {
-		return fmt.Errorf("Audit daemon could not add the rule: %s, err: %v", rule, errR)
+		return kernelError(rule, fmt.Errorf("Audit daemon could not add the rule: %w", errR))
 	}
 
 	return nil
@@ -77,7 +139,7 @@ func (l *LibauditdHandler) DeleteRule(rule string) error {
 	}
 
 	if errD := l.daemon.DeleteRule(data); errD != nil {
-		return fmt.Errorf("Audit daemon could not delete the rule: %s, err: %v", rule, errD)
+		return kernelError(rule, fmt.Errorf("Audit daemon could not delete the rule: %w", errD))
 	}
 	return nil
 }
@@ -94,7 +156,14 @@ func (l *LibauditdHandler) GetStatus() ([]byte, error) {
 	return data, nil
 }
 
-func (l *LibauditdHandler) SetEnabled() error {
+func (l *LibauditdHandler) SetEnabled(enabled bool) error {
+	if !enabled {
+		fmt.Println("disabling auditing in the kernel")
+		if err := l.daemon.SetEnabled(false, libaudit.WaitForReply); err != nil {
+			return fmt.Errorf("there was an error disabling the audit:\r\n%w", err)
+		}
+		return nil
+	}
 	fmt.Println("enabling auditing in the kernel")
 	if err := l.daemon.SetEnabled(true, libaudit.WaitForReply); err != nil {
 		return fmt.Errorf("there was an error enabling the audit:\r\n%w", err)
@@ -102,8 +171,33 @@ func (l *LibauditdHandler) SetEnabled() error {
 	return nil
 }
 
+// SetImmutable locks the audit configuration until the next reboot.
+func (l *LibauditdHandler) SetImmutable() error {
+	fmt.Println("locking the audit configuration in the kernel")
+	if err := l.daemon.SetImmutable(libaudit.WaitForReply); err != nil {
+		return fmt.Errorf("there was an error locking the audit configuration:\r\n%w", err)
+	}
+	return nil
+}
+
+// SetFailure sets what the kernel does on critical audit errors: 0 silent,
+// 1 printk, 2 panic.
+func (l *LibauditdHandler) SetFailure(mode int) error {
+	if err := l.daemon.SetFailure(libaudit.FailureMode(mode), libaudit.WaitForReply); err != nil {
+		return fmt.Errorf("there was an error setting the failure mode:\r\n%w", err)
+	}
+	return nil
+}
+
+func (l *LibauditdHandler) SetBacklogWaitTime(wait int) error {
+	if err := l.daemon.SetBacklogWaitTime(int32(wait), libaudit.WaitForReply); err != nil {
+		return fmt.Errorf("there was an error setting the backlog wait time:\r\n%w", err)
+	}
+	return nil
+}
+
 func (l *LibauditdHandler) SetRateLimit(rate int) error {
-	fmt.Println("setting rate limit to : %v", rate)
+	fmt.Printf("setting rate limit to : %v\n", rate)
 	if err := l.daemon.SetRateLimit(uint32(rate), libaudit.WaitForReply); err != nil {
 		return fmt.Errorf("there was an error setting the rate limit:\r\n%s", err)
 	}
@@ -111,7 +205,7 @@ func (l *LibauditdHandler) SetRateLimit(rate int) error {
 }
 
 func (l *LibauditdHandler) SetBackLogLimit(backlog int) error {
-	fmt.Println("setting rate limit to : %v", backlog)
+	fmt.Printf("setting rate limit to : %v\n", backlog)
 	if err := l.daemon.SetBacklogLimit(uint32(backlog), libaudit.WaitForReply); err != nil {
 		return fmt.Errorf("there was an error setting backlog limit:\r\n%s", err)
 	}
@@ -123,13 +217,30 @@ func (l *LibauditdHandler) Close() {
 }
 
 func (l *LibauditdHandler) SetPID() error {
-	fmt.Println("sending message to kernel registering our PID (%v) as the audit daemon", os.Getpid())
+	fmt.Printf("sending message to kernel registering our PID (%v) as the audit daemon\n", os.Getpid())
 	if err := l.daemon.SetPID(libaudit.WaitForReply); err != nil {
 		return fmt.Errorf("there was an error registering the pid:\r\n%s", err)
 	}
 	return nil
 }
 
+// GetRules lists the rules loaded in the kernel, the way auditctl -l does.
+func (l *LibauditdHandler) GetRules() ([]string, error) {
+	wire, err := l.daemon.GetRules()
+	if err != nil {
+		return nil, kernelError("", fmt.Errorf("Audit daemon could not list the rules: %w", err))
+	}
+	rules := make([]string, 0, len(wire))
+	for _, data := range wire {
+		text, err := ruleText(data)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, text)
+	}
+	return rules, nil
+}
+
 func (l *LibauditdHandler) DeleteRules() error {
 	_, errD := l.daemon.DeleteRules()
 	if errD != nil {
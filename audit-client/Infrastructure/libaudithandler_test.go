@@ -0,0 +1,34 @@
+package Infrastructure
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"audit-client/Domain"
+)
+
+func TestKernelError(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		err  error
+		want Domain.ErrorCode
+	}{
+		{"go-libaudit duplicate", errors.New("rule exists"), Domain.CodeDuplicate},
+		{"EEXIST", syscall.EEXIST, Domain.CodeDuplicate},
+		{"ENOENT", syscall.ENOENT, Domain.CodeNotFound},
+		{"EPERM", syscall.EPERM, Domain.CodePermission},
+		{"EACCES", syscall.EACCES, Domain.CodePermission},
+		{"EINVAL", syscall.EINVAL, Domain.CodeKernelRejected},
+		{"EOPNOTSUPP", syscall.EOPNOTSUPP, Domain.CodeKernelRejected},
+		{"other errno", syscall.EIO, Domain.CodeUnavailable},
+		{"no errno", errors.New("netlink socket closed"), Domain.CodeUnavailable},
+	} {
+		// the handlers wrap what the daemon returns before classifying it
+		err := kernelError("-w /etc/passwd -p wa", fmt.Errorf("Audit daemon could not add the rule: %w", c.err))
+		if got := Domain.CodeOf(err); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
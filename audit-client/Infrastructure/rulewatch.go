@@ -0,0 +1,92 @@
+package Infrastructure
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// DefaultRulesSettle is how long the rules have to stay unchanged before a
+// change is reported, editors and package managers write in several steps.
+var DefaultRulesSettle = 500 * time.Millisecond
+
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE
+
+// WatchRules watches the rules at path, a file or a rules.d directory, with
+// inotify. The directory holding a file is watched rather than the file itself
+// so editors that save by renaming a new file over it are noticed too. A burst
+// of changes is reported once, after the rules stayed unchanged for settle.
+// The watch lasts as long as the process.
+func WatchRules(path string, settle time.Duration) (<-chan struct{}, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("cant watch the rules: %w", err)
+	}
+	dir, match := path, func(name string) bool { return strings.HasSuffix(name, ".rules") }
+	if !info.IsDir() {
+		base := filepath.Base(path)
+		dir, match = filepath.Dir(path), func(name string) bool { return name == base }
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify init failed: %w", err)
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, watchMask); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("cant watch %s: %w", dir, err)
+	}
+
+	touched := make(chan struct{}, 1)
+	changed := make(chan struct{}, 1)
+	go readInotify(fd, match, touched)
+	go func() {
+		timer := time.NewTimer(settle)
+		timer.Stop()
+		for {
+			select {
+			case <-touched:
+				timer.Reset(settle)
+			case <-timer.C:
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changed, nil
+}
+
+// readInotify signals touched for every event on a name match accepts.
+func readInotify(fd int, match func(string) bool, touched chan<- struct{}) {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			fmt.Fprintf(os.Stderr, "Rules watch stopped: %v\n", err)
+			syscall.Close(fd)
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[start:start+int(event.Len)]), "\x00")
+			offset = start + int(event.Len)
+			if !match(name) {
+				continue
+			}
+			select {
+			case touched <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package Infrastructure
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"audit-client/Usecases"
+)
+
+var (
+	sinkDialTimeout = 5 * time.Second
+	sinkFlushSize   = 3500
+	fileMaxSize     = int64(100 << 20)
+	fileMaxBackups  = 5
+)
+
+// NewEventSink builds the sink described by cfg. Server sinks upload to the
+// control server through client as the agent uid.
+func NewEventSink(cfg Usecases.SinkConfig, client *HTTPClient, uid string) (Usecases.EventSink, error) {
+	switch cfg.Type {
+	case "server":
+		return NewServerSink(client, uid, cfg.BatchSize), nil
+	case "unix", "tcp":
+		if cfg.Address == "" {
+			return nil, fmt.Errorf("%s sink needs an address", cfg.Type)
+		}
+		return &StreamSink{network: cfg.Type, address: cfg.Address}, nil
+	case "udp":
+		if cfg.Address == "" {
+			return nil, fmt.Errorf("udp sink needs an address")
+		}
+		return &DatagramSink{address: cfg.Address}, nil
+	case "file":
+		if cfg.Address == "" {
+			return nil, fmt.Errorf("file sink needs a path")
+		}
+		return NewFileSink(cfg.Address, cfg.MaxSize, cfg.MaxBackups)
+	case "stdout":
+		return &StdoutSink{writer: bufio.NewWriter(os.Stdout)}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink type: %q", cfg.Type)
+	}
+}
+
+// StreamSink writes newline delimited events to a unix or tcp socket. The
+// connection is dialed lazily and re-dialed after a write error.
+type StreamSink struct {
+	network string
+	address string
+	conn    net.Conn
+	writer  *bufio.Writer
+}
+
+func (s *StreamSink) Name() string {
+	return s.network + ":" + s.address
+}
+
+func (s *StreamSink) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+	c, err := net.DialTimeout(s.network, s.address, sinkDialTimeout)
+	if err != nil {
+		return fmt.Errorf("couldnt open the socket: %v", err)
+	}
+	s.conn = c
+	s.writer = bufio.NewWriter(c)
+	return nil
+}
+
+func (s *StreamSink) reset() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn = nil
+	s.writer = nil
+}
+
+func (s *StreamSink) Write(event []byte) error {
+	if err := s.connect(); err != nil {
+		return err
+	}
+	s.writer.Write(event)
+	s.writer.WriteByte('\n')
+	return nil
+}
+
+// Full asks the sink queue to flush once sinkFlushSize bytes are buffered.
+func (s *StreamSink) Full() bool {
+	return s.writer != nil && s.writer.Buffered() >= sinkFlushSize
+}
+
+func (s *StreamSink) Flush() error {
+	if s.writer == nil {
+		return nil
+	}
+	if err := s.writer.Flush(); err != nil {
+		s.reset()
+		return fmt.Errorf("couldnt flush the socket: %v", err)
+	}
+	return nil
+}
+
+func (s *StreamSink) Close() error {
+	errF := s.Flush()
+	s.reset()
+	return errF
+}
+
+// DatagramSink sends one event per udp datagram, so there is nothing to buffer.
+type DatagramSink struct {
+	address string
+	conn    net.Conn
+}
+
+func (s *DatagramSink) Name() string {
+	return "udp:" + s.address
+}
+
+func (s *DatagramSink) Write(event []byte) error {
+	if s.conn == nil {
+		c, err := net.DialTimeout("udp", s.address, sinkDialTimeout)
+		if err != nil {
+			return fmt.Errorf("couldnt open the socket: %v", err)
+		}
+		s.conn = c
+	}
+	if _, err := s.conn.Write(event); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return fmt.Errorf("couldnt send the datagram: %v", err)
+	}
+	return nil
+}
+
+func (s *DatagramSink) Flush() error {
+	return nil
+}
+
+func (s *DatagramSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// FileSink appends events to a local file and rotates it once it grows past
+// maxSize, keeping maxBackups old files as path.1, path.2, ...
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	writer     *bufio.Writer
+	size       int64
+}
+
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	if maxSize <= 0 {
+		maxSize = fileMaxSize
+	}
+	if maxBackups <= 0 {
+		maxBackups = fileMaxBackups
+	}
+	f := &FileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileSink) Name() string {
+	return "file:" + f.path
+}
+
+func (f *FileSink) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("couldnt open/create the file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("couldnt stat the file: %v", err)
+	}
+	f.file = file
+	f.writer = bufio.NewWriter(file)
+	f.size = info.Size()
+	return nil
+}
+
+func (f *FileSink) rotate() error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	for i := f.maxBackups - 1; i > 0; i-- {
+		os.Rename(f.path+"."+strconv.Itoa(i), f.path+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return fmt.Errorf("couldnt rotate the file: %v", err)
+	}
+	return f.open()
+}
+
+func (f *FileSink) Write(event []byte) error {
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	if f.size+int64(len(event))+1 > f.maxSize && f.size > 0 {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.writer.Write(event)
+	f.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if err := f.writer.WriteByte('\n'); err != nil {
+		return err
+	}
+	f.size++
+	return nil
+}
+
+func (f *FileSink) Flush() error {
+	if f.writer == nil {
+		return nil
+	}
+	return f.writer.Flush()
+}
+
+func (f *FileSink) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	errF := f.writer.Flush()
+	errC := f.file.Close()
+	f.file = nil
+	f.writer = nil
+	if errF != nil {
+		return errF
+	}
+	return errC
+}
+
+type StdoutSink struct {
+	writer *bufio.Writer
+}
+
+func (s *StdoutSink) Name() string {
+	return "stdout"
+}
+
+func (s *StdoutSink) Write(event []byte) error {
+	s.writer.Write(event)
+	return s.writer.WriteByte('\n')
+}
+
+func (s *StdoutSink) Flush() error {
+	return s.writer.Flush()
+}
+
+func (s *StdoutSink) Close() error {
+	return s.writer.Flush()
+}
@@ -0,0 +1,398 @@
+package Infrastructure
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	spoolMaxSize     = int64(100 << 20)
+	spoolSegmentSize = int64(4 << 20)
+	spoolHeaderSize  = 8
+	spoolMaxRecord   = uint32(16 << 20)
+
+	errSpoolCorrupt = errors.New("spool record is corrupt")
+)
+
+type segment struct {
+	id      int64
+	size    int64
+	records int
+}
+
+type spoolCursor struct {
+	Segment int64 `json:"segment"`
+	Offset  int64 `json:"offset"`
+	Count   int   `json:"count"`
+}
+
+// DiskSpool is a bounded on-disk FIFO of events. Records are appended to
+// numbered segment files as [length][crc32][payload]; a torn or corrupt tail
+// is truncated when the spool is reopened. The read position is persisted in a
+// cursor file on every Commit so a restarted agent resumes where it stopped.
+// When the spool outgrows its size cap the oldest segment is evicted.
+type DiskSpool struct {
+	dir         string
+	maxSize     int64
+	segmentSize int64
+
+	lock     sync.Mutex
+	segments []*segment
+	writer   *os.File
+	cursor   spoolCursor
+	peeked   spoolCursor
+	evicted  uint64
+}
+
+func NewDiskSpool(dir string, maxSize int64) (*DiskSpool, error) {
+	if maxSize <= 0 {
+		maxSize = spoolMaxSize
+	}
+	segmentSize := spoolSegmentSize
+	if maxSize/4 < segmentSize {
+		segmentSize = maxSize / 4
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("couldnt create the spool directory: %v", err)
+	}
+
+	s := &DiskSpool{dir: dir, maxSize: maxSize, segmentSize: segmentSize}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SpoolDirName turns a sink name such as "tcp:10.0.0.1:5044" into something
+// usable as a directory name.
+func SpoolDirName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == ':' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func (s *DiskSpool) segmentPath(id int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d.seg", id))
+}
+
+func (s *DiskSpool) load() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("couldnt read the spool directory: %v", err)
+	}
+
+	var ids []int64
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".seg") {
+			continue
+		}
+		id, errP := strconv.ParseInt(strings.TrimSuffix(f.Name(), ".seg"), 10, 64)
+		if errP != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	if data, errR := ioutil.ReadFile(filepath.Join(s.dir, "cursor")); errR == nil {
+		if errU := json.Unmarshal(data, &s.cursor); errU != nil {
+			log.Printf("spool %s: ignoring unreadable cursor: %v", s.dir, errU)
+			s.cursor = spoolCursor{}
+		}
+	}
+	// recounted by scan from the offset
+	s.cursor.Count = 0
+
+	for i, id := range ids {
+		if id < s.cursor.Segment {
+			os.Remove(s.segmentPath(id))
+			continue
+		}
+		seg, errS := s.scan(id, i == len(ids)-1)
+		if errS != nil {
+			return errS
+		}
+		s.segments = append(s.segments, seg)
+	}
+
+	if len(s.segments) == 0 {
+		s.cursor = spoolCursor{}
+		return s.roll(0)
+	}
+	if s.segments[0].id != s.cursor.Segment || s.cursor.Offset > s.segments[0].size {
+		s.cursor = spoolCursor{Segment: s.segments[0].id}
+	}
+	s.peeked = s.cursor
+
+	last := s.segments[len(s.segments)-1]
+	writer, err := os.OpenFile(s.segmentPath(last.id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("couldnt open the spool segment: %v", err)
+	}
+	s.writer = writer
+	return nil
+}
+
+// scan counts the valid records of a segment. A bad record in the last
+// segment is a torn write and gets truncated, in older segments everything
+// after it is unreachable and is dropped when the segment is read.
+func (s *DiskSpool) scan(id int64, last bool) (*segment, error) {
+	f, err := os.Open(s.segmentPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("couldnt open the spool segment: %v", err)
+	}
+	defer f.Close()
+
+	seg := &segment{id: id}
+	r := bufio.NewReader(f)
+	for {
+		payload, errR := readRecord(r)
+		if errR == io.EOF {
+			break
+		}
+		if errR != nil {
+			log.Printf("spool %s: segment %d is damaged after %d records: %v", s.dir, id, seg.records, errR)
+			if last {
+				if errT := os.Truncate(s.segmentPath(id), seg.size); errT != nil {
+					return nil, fmt.Errorf("couldnt truncate the spool segment: %v", errT)
+				}
+			}
+			break
+		}
+		if id == s.cursor.Segment && seg.size < s.cursor.Offset {
+			s.cursor.Count = seg.records + 1
+		}
+		seg.size += int64(spoolHeaderSize + len(payload))
+		seg.records++
+	}
+	return seg, nil
+}
+
+func readRecord(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, spoolHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: short header (%d bytes)", errSpoolCorrupt, n)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > spoolMaxRecord {
+		return nil, fmt.Errorf("%w: invalid length %d", errSpoolCorrupt, length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("%w: short payload", errSpoolCorrupt)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", errSpoolCorrupt)
+	}
+	return payload, nil
+}
+
+func (s *DiskSpool) roll(id int64) error {
+	if s.writer != nil {
+		s.writer.Sync()
+		s.writer.Close()
+	}
+	writer, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("couldnt create the spool segment: %v", err)
+	}
+	s.writer = writer
+	s.segments = append(s.segments, &segment{id: id})
+	return nil
+}
+
+func (s *DiskSpool) totalSize() int64 {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	return total
+}
+
+// evict drops the oldest segment to make room, moving the cursor past it.
+func (s *DiskSpool) evict() {
+	oldest := s.segments[0]
+	lost := oldest.records
+	if s.cursor.Segment == oldest.id {
+		lost -= s.cursor.Count
+	}
+	s.evicted += uint64(lost)
+	os.Remove(s.segmentPath(oldest.id))
+	s.segments = s.segments[1:]
+	s.cursor = spoolCursor{Segment: s.segments[0].id}
+	s.saveCursor()
+}
+
+func (s *DiskSpool) Append(event []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if uint32(len(event)) > spoolMaxRecord {
+		return fmt.Errorf("event is too large to spool: %d bytes", len(event))
+	}
+
+	last := s.segments[len(s.segments)-1]
+	if last.size >= s.segmentSize {
+		if err := s.roll(last.id + 1); err != nil {
+			return err
+		}
+		last = s.segments[len(s.segments)-1]
+	}
+
+	record := make([]byte, spoolHeaderSize+len(event))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(event)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(event))
+	copy(record[spoolHeaderSize:], event)
+
+	if _, err := s.writer.Write(record); err != nil {
+		return fmt.Errorf("couldnt write to the spool: %v", err)
+	}
+	last.size += int64(len(record))
+	last.records++
+
+	for s.totalSize() > s.maxSize && len(s.segments) > 1 {
+		s.evict()
+	}
+	return nil
+}
+
+// Peek returns up to max of the oldest events without removing them. The
+// events are removed by the following Commit.
+func (s *DiskSpool) Peek(max int) ([][]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var events [][]byte
+	pos := s.cursor
+	for _, seg := range s.segments {
+		if seg.id < pos.Segment {
+			continue
+		}
+		if seg.id > pos.Segment {
+			pos = spoolCursor{Segment: seg.id}
+		}
+		if pos.Offset >= seg.size {
+			continue
+		}
+
+		f, err := os.Open(s.segmentPath(seg.id))
+		if err != nil {
+			return nil, fmt.Errorf("couldnt open the spool segment: %v", err)
+		}
+		if _, err := f.Seek(pos.Offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("couldnt seek the spool segment: %v", err)
+		}
+
+		r := bufio.NewReader(f)
+		for len(events) < max && pos.Offset < seg.size {
+			payload, errR := readRecord(r)
+			if errR != nil {
+				// the rest of this segment cant be trusted, skip to the next one
+				log.Printf("spool %s: skipping the rest of segment %d: %v", s.dir, seg.id, errR)
+				pos.Offset = seg.size
+				pos.Count = seg.records
+				break
+			}
+			events = append(events, payload)
+			pos.Offset += int64(spoolHeaderSize + len(payload))
+			pos.Count++
+		}
+		f.Close()
+
+		if len(events) >= max {
+			break
+		}
+	}
+
+	s.peeked = pos
+	return events, nil
+}
+
+// Commit removes the events returned by the last Peek.
+func (s *DiskSpool) Commit() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// the peeked segment may have been evicted in the meantime
+	if s.peeked.Segment < s.segments[0].id {
+		return nil
+	}
+	s.cursor = s.peeked
+
+	for len(s.segments) > 1 && s.segments[0].id < s.cursor.Segment {
+		os.Remove(s.segmentPath(s.segments[0].id))
+		s.segments = s.segments[1:]
+	}
+	return s.saveCursor()
+}
+
+func (s *DiskSpool) saveCursor() error {
+	data, err := json.Marshal(s.cursor)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, "cursor.tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("couldnt write the spool cursor: %v", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, "cursor")); err != nil {
+		return fmt.Errorf("couldnt write the spool cursor: %v", err)
+	}
+	return nil
+}
+
+// Depth returns the number of events and bytes waiting in the spool.
+func (s *DiskSpool) Depth() (int, int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	events := -s.cursor.Count
+	size := -s.cursor.Offset
+	for _, seg := range s.segments {
+		events += seg.records
+		size += seg.size
+	}
+	return events, size
+}
+
+func (s *DiskSpool) Evicted() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.evicted
+}
+
+func (s *DiskSpool) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.writer == nil {
+		return nil
+	}
+	s.writer.Sync()
+	err := s.writer.Close()
+	s.writer = nil
+	return err
+}
@@ -0,0 +1,180 @@
+package Infrastructure
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func appendEvents(t *testing.T, s *DiskSpool, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := s.Append([]byte(fmt.Sprintf("event-%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// expectEvents peeks max events and checks they are from..to-1 in order.
+func expectEvents(t *testing.T, s *DiskSpool, max, from, to int) {
+	t.Helper()
+	events, err := s.Peek(max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != to-from {
+		t.Fatalf("peeked %d events, want %d", len(events), to-from)
+	}
+	for i, event := range events {
+		if want := fmt.Sprintf("event-%03d", from+i); string(event) != want {
+			t.Fatalf("event %d is %q, want %q", i, event, want)
+		}
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// every record is 8 bytes of header and 9 of payload, a 680 byte spool has
+// 170 byte segments holding 10 records each
+const testSpoolSize = 680
+
+func TestDiskSpoolResumesAfterReopening(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDiskSpool(dir, testSpoolSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEvents(t, s, 0, 25)
+	if n := len(segmentFiles(t, dir)); n != 3 {
+		t.Fatalf("25 events were written to %d segments, want 3", n)
+	}
+
+	expectEvents(t, s, 12, 0, 12)
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// peeked but not committed, these come again after the restart
+	expectEvents(t, s, 5, 12, 17)
+	s.Close()
+
+	s, err = NewDiskSpool(dir, testSpoolSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if events, _ := s.Depth(); events != 13 {
+		t.Errorf("reopened spool holds %d events, want 13", events)
+	}
+	// the committed first segment is gone
+	if n := len(segmentFiles(t, dir)); n != 2 {
+		t.Errorf("%d segments are left, want 2", n)
+	}
+	appendEvents(t, s, 25, 30)
+	expectEvents(t, s, 100, 12, 30)
+}
+
+func TestDiskSpoolTruncatesATornTail(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDiskSpool(dir, testSpoolSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEvents(t, s, 0, 5)
+	s.Close()
+
+	// a crash in the middle of the sixth record leaves half of it behind
+	files := segmentFiles(t, dir)
+	f, err := os.OpenFile(files[len(files)-1], os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 9, 1, 2})
+	f.Close()
+
+	s, err = NewDiskSpool(dir, testSpoolSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if events, size := s.Depth(); events != 5 || size != 5*17 {
+		t.Errorf("reopened spool holds %d events in %d bytes, want 5 in %d", events, size, 5*17)
+	}
+	// new records go where the torn one was cut off
+	appendEvents(t, s, 5, 7)
+	expectEvents(t, s, 100, 0, 7)
+}
+
+func TestDiskSpoolRejectsCorruptRecords(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDiskSpool(dir, testSpoolSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEvents(t, s, 0, 15)
+	s.Close()
+
+	// flip a payload byte of the fourth record of the first segment and of
+	// the second record of the last one
+	files := segmentFiles(t, dir)
+	for _, c := range []struct {
+		file   string
+		offset int64
+	}{{files[0], 3*17 + 10}, {files[1], 17 + 10}} {
+		data, err := ioutil.ReadFile(c.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[c.offset] ^= 0xff
+		if err := ioutil.WriteFile(c.file, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err = NewDiskSpool(dir, testSpoolSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the rest of the first segment cant be trusted and is skipped
+	expectEvents(t, s, 3, 0, 3)
+	events, err := s.Peek(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 4 || string(events[3]) != "event-010" {
+		t.Fatalf("peeked %q, want three events and then the first of the last segment", events)
+	}
+	// the last segment was truncated before its corrupt record when reopened
+	if info, err := os.Stat(files[1]); err != nil || info.Size() != 17 {
+		t.Errorf("last segment wasnt truncated to its first record: %v %v", info.Size(), err)
+	}
+}
+
+func TestDiskSpoolEvictsTheOldestSegment(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDiskSpool(dir, testSpoolSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// 41 records dont fit into 680 bytes, the first segment has to go
+	appendEvents(t, s, 0, 41)
+	if s.Evicted() != 10 {
+		t.Errorf("evicted %d events, want 10", s.Evicted())
+	}
+	if events, size := s.Depth(); events != 31 || size > testSpoolSize {
+		t.Errorf("spool holds %d events in %d bytes, want 31 in at most %d", events, size, testSpoolSize)
+	}
+	expectEvents(t, s, 100, 10, 41)
+}
@@ -0,0 +1,138 @@
+package Infrastructure
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"audit-client/Interfaces"
+	"audit-client/Usecases"
+
+	"github.com/google/uuid"
+)
+
+var defaultBatchSize = 500
+
+// batchAck is the answer of the control server to an uploaded batch.
+type batchAck struct {
+	Batch     string
+	Accepted  int
+	Rejected  int
+	Truncated bool
+}
+
+// ServerSink uploads events to the control server as gzip compressed NDJSON
+// batches. The sink queue sends a batch once it holds batchSize events and
+// every flush_interval, which bounds how old a batch can get. While the
+// server asks agents to back off every write fails and the events wait in
+// the spool. A batch the server cut off at its full event queue counts as
+// delivered up to the cut, the events after it are spooled.
+type ServerSink struct {
+	client    *HTTPClient
+	uid       string
+	batchSize int
+	buf       bytes.Buffer
+	gz        *gzip.Writer
+	count     int
+	until     time.Time
+}
+
+func NewServerSink(client *HTTPClient, uid string, batchSize int) *ServerSink {
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	s := &ServerSink{client: client, uid: uid, batchSize: batchSize}
+	s.gz = gzip.NewWriter(&s.buf)
+	return s
+}
+
+func (s *ServerSink) Name() string {
+	return "server:" + s.client.BaseURL.Host
+}
+
+// reset drops the pending batch, the sink queue spools its events when a
+// write or flush fails.
+func (s *ServerSink) reset() {
+	s.buf.Reset()
+	s.gz.Reset(&s.buf)
+	s.count = 0
+}
+
+func (s *ServerSink) Write(event []byte) error {
+	if wait := time.Until(s.until); wait > 0 {
+		s.reset()
+		return fmt.Errorf("control server asked to retry in %v", wait.Round(time.Second))
+	}
+	if _, err := s.gz.Write(event); err != nil {
+		s.reset()
+		return fmt.Errorf("couldnt compress the event: %v", err)
+	}
+	if _, err := s.gz.Write([]byte{'\n'}); err != nil {
+		s.reset()
+		return fmt.Errorf("couldnt compress the event: %v", err)
+	}
+	s.count++
+	return nil
+}
+
+// Full asks the sink queue to flush once the batch holds batchSize events.
+func (s *ServerSink) Full() bool {
+	return s.count >= s.batchSize
+}
+
+func (s *ServerSink) Flush() error {
+	if s.count == 0 {
+		return nil
+	}
+	defer s.reset()
+	if err := s.gz.Close(); err != nil {
+		return fmt.Errorf("couldnt compress the batch: %v", err)
+	}
+
+	id := uuid.New().String()
+	body, wait, err := s.client.SendBatch("SyscallBatch", s.uid, id, s.buf.Bytes())
+	if err != nil {
+		var status *Interfaces.APIStatusError
+		if errors.As(err, &status) && status.RetryAfter > 0 {
+			s.until = time.Now().Add(status.RetryAfter)
+		}
+		return fmt.Errorf("couldnt upload %d events: %v", s.count, err)
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("couldnt read the ack of batch %s: %v", id, err)
+	}
+	var ack batchAck
+	if err := json.Unmarshal(data, &ack); err != nil {
+		return fmt.Errorf("couldnt read the ack of batch %s: %v", id, err)
+	}
+	if ack.Batch != id {
+		return fmt.Errorf("batch %s was acknowledged as %q", id, ack.Batch)
+	}
+	// a batch cut off at a full event queue comes with a Retry-After hint,
+	// the events after the cut are spooled and sent once it passed
+	if ack.Truncated && wait > 0 {
+		s.until = time.Now().Add(wait)
+		return &Usecases.PartialFlushError{
+			Delivered: ack.Accepted + ack.Rejected,
+			Err:       fmt.Errorf("control server cut batch %s off and asked to retry in %v", id, wait.Round(time.Second)),
+		}
+	}
+	// rejected events dont parse and the rest of a batch cut off at the size
+	// limit wouldnt fit either, sending them again wouldnt help
+	if ack.Rejected > 0 || ack.Truncated {
+		log.Printf("control server took %d of %d events of batch %s", ack.Accepted, s.count, id)
+	}
+	return nil
+}
+
+func (s *ServerSink) Close() error {
+	return s.Flush()
+}
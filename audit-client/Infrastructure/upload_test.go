@@ -0,0 +1,38 @@
+package Infrastructure
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"audit-client/Usecases"
+)
+
+func TestServerSinkSpoolsWhatATruncatedAckCutOff(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Retry-After", "5")
+		fmt.Fprintf(res, `{"Batch":%q,"Accepted":2,"Truncated":true}`, req.Header.Get("Batch-ID"))
+	}))
+	defer srv.Close()
+
+	base, _ := url.Parse(srv.URL)
+	client := &HTTPClient{BaseURL: base, client: srv.Client()}
+	sink := NewServerSink(client, "agent", 10)
+	for i := 0; i < 3; i++ {
+		if err := sink.Write([]byte(`{"Serial":1}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var partial *Usecases.PartialFlushError
+	if err := sink.Flush(); !errors.As(err, &partial) || partial.Delivered != 2 {
+		t.Fatalf("flush returned %v, want 2 of 3 events delivered", err)
+	}
+	// the sink backs off for the Retry-After of the ack
+	if err := sink.Write([]byte(`{"Serial":2}`)); err == nil {
+		t.Error("write went through while the server asked to retry later")
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"os"
+	"strings"
+	"time"
 
 	"audit-client/Domain"
 	"audit-client/Usecases"
@@ -24,15 +26,27 @@ type AuditdHandler interface {
 	AddRule(string) error
 	DeleteRule(string) error
 	GetStatus() ([]byte, error)
-	SetEnabled() error
+	SetEnabled(bool) error
+	SetImmutable() error
 	GetAuditEvent(<-chan bool)
 	SetRateLimit(int) error
 	DeleteRules() error
 	SetBackLogLimit(int) error
+	SetBacklogWaitTime(int) error
+	SetFailure(int) error
 	SetPID() error
+	GetRules() ([]string, error)
+	NormalizeRule(string) (string, error)
 	Close()
 }
 
+// readerWaiter is a handler whose event reader can be waited for, StopAudit
+// returns only once the reader stopped so a StartAudit right after it cant
+// run two of them.
+type readerWaiter interface {
+	WaitReader()
+}
+
 type Event struct {
 	Data []byte
 	ID   string
@@ -43,6 +57,18 @@ type AuditdRepo struct {
 	ruleChanged bool
 	done        chan bool
 	rules       []string
+	filename    string
+	isManager   bool
+	// version counts the changes to rules, it goes into every status report
+	version uint64
+	// HostFile keeps the audit configuration the host had before Init, so it
+	// can be put back after a crash too. Empty keeps it in memory only.
+	HostFile string
+	host     *Domain.HostAudit
+	// receiving is set while audit events are read, paused when StopAudit
+	// disabled the kernel audit
+	receiving bool
+	paused    bool
 }
 
 type AuditRules struct {
@@ -57,6 +83,15 @@ func NewAuditd(auditdHandler AuditdHandler, done chan bool) AuditdRepo {
 }
 
 func (auditR *AuditdRepo) Init(filename string, isManager bool) error {
+	auditR.filename = filename
+	auditR.isManager = isManager
+
+	if isManager {
+		if err := auditR.keepHost(); err != nil {
+			return err
+		}
+	}
+
 	errS := auditR.auditd.DeleteRules()
 	if errS != nil {
 		return errS
@@ -77,6 +112,93 @@ func (auditR *AuditdRepo) Init(filename string, isManager bool) error {
 
 }
 
+// keepHost records the audit configuration of the host before Init replaces
+// it and keeps it in HostFile. A configuration an earlier run left there is
+// used instead, the kernel holds that run's rules by now.
+func (auditR *AuditdRepo) keepHost() error {
+	if auditR.HostFile != "" {
+		host, err := Usecases.LoadHostAudit(auditR.HostFile)
+		if err != nil {
+			return err
+		}
+		if host != nil {
+			fmt.Printf("WARNING: the agent didnt stop cleanly, keeping the host audit configuration from %v\n", host.Taken)
+			auditR.host = host
+			return nil
+		}
+	}
+
+	host := Domain.HostAudit{Taken: time.Now().UTC()}
+	kernel, err := auditR.KernelRules()
+	if err != nil {
+		return fmt.Errorf("couldnt read the host audit rules: %w", err)
+	}
+	host.Kernel = kernel
+	if host.Status, err = auditR.GetStatus(); err != nil {
+		return fmt.Errorf("couldnt read the host audit status: %w", err)
+	}
+	if auditR.HostFile != "" {
+		if err := Usecases.SaveHostAudit(auditR.HostFile, host); err != nil {
+			return err
+		}
+	}
+	auditR.host = &host
+	return nil
+}
+
+// RestoreHost puts back the audit configuration the host had before Init:
+// its rules, rate and backlog limits, backlog wait time, failure mode and
+// whether auditing was enabled. The kept configuration is removed once all of
+// it is back, otherwise it stays for another try. The audit PID is released
+// when the handler is closed, a daemon the agent replaced has to register
+// again.
+func (auditR *AuditdRepo) RestoreHost() error {
+	host := auditR.host
+	if host == nil {
+		return nil
+	}
+
+	var failed []string
+	if err := auditR.RestoreRules(Domain.RuleSnapshot{Kernel: host.Kernel}); err != nil {
+		failed = append(failed, fmt.Sprintf("rules: %v", err))
+	}
+	// only what differs is set, old kernels reject settings they dont have
+	kept := host.Status
+	current, errS := auditR.GetStatus()
+	for _, setting := range []struct {
+		name    string
+		changed bool
+		apply   func() error
+	}{
+		{"rate limit", current.RateLimit != kept.RateLimit, func() error { return auditR.auditd.SetRateLimit(int(kept.RateLimit)) }},
+		{"backlog limit", current.BacklogLimit != kept.BacklogLimit, func() error { return auditR.auditd.SetBackLogLimit(int(kept.BacklogLimit)) }},
+		{"backlog wait time", current.BacklogWaitTime != kept.BacklogWaitTime, func() error { return auditR.auditd.SetBacklogWaitTime(int(kept.BacklogWaitTime)) }},
+		{"failure mode", current.Failure != kept.Failure, func() error { return auditR.auditd.SetFailure(int(kept.Failure)) }},
+		{"enabled", current.Enabled != kept.Enabled, func() error { return auditR.auditd.SetEnabled(kept.Enabled != 0) }},
+	} {
+		if !setting.changed && errS == nil {
+			continue
+		}
+		if err := setting.apply(); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", setting.name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("couldnt restore the host audit configuration: %s", strings.Join(failed, "; "))
+	}
+
+	if kept.PID != 0 && int(kept.PID) != os.Getpid() {
+		fmt.Printf("Audit daemon %d was registered before the agent, restart it to get the audit events again\n", kept.PID)
+	}
+	if auditR.HostFile != "" {
+		if err := os.Remove(auditR.HostFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("host audit configuration is back but couldnt be removed: %v", err)
+		}
+	}
+	auditR.host = nil
+	return nil
+}
+
 func (auditR *AuditdRepo) Close() {
 	auditR.auditd.Close()
 }
@@ -108,7 +230,7 @@ func (auditR *AuditdRepo) SetStatus() error {
 	}
 
 	if status.Enabled == 0 {
-		err = auditR.auditd.SetEnabled()
+		err = auditR.auditd.SetEnabled(true)
 		if err != nil {
 			return err
 		}
@@ -145,18 +267,116 @@ func (auditR *AuditdRepo) RuleExists(rule string) bool {
 	return false
 }
 
+// index returns the position of rule in the loaded rules or -1.
+func (auditR *AuditdRepo) index(rule string) int {
+	for i, r := range auditR.rules {
+		if r == rule {
+			return i
+		}
+	}
+	return -1
+}
+
+// appendIndex is where rule goes when it is loaded after rules: at the end,
+// or in front of the first rule of its filter list for -A rules.
+func appendIndex(rules []string, rule string) int {
+	if Usecases.IsPrepend(rule) {
+		list := Usecases.RuleList(rule)
+		for i, r := range rules {
+			if Usecases.RuleList(r) == list {
+				return i
+			}
+		}
+	}
+	return len(rules)
+}
+
+// addRule adds rule behind the rules of its filter list. The order of the
+// rules is worked out here, so -A rules, which the kernel would put in front of
+// their list, are added as -a rules.
+func (auditR *AuditdRepo) addRule(rule string) error {
+	return auditR.auditd.AddRule(Usecases.AsAppend(rule))
+}
+
+// SetRule appends rule, -A rules go in front of their filter list.
 func (auditR *AuditdRepo) SetRule(rule string) error {
-	if !auditR.RuleExists(rule) {
-		err := auditR.auditd.AddRule(rule)
+	_, err := auditR.InsertRule(rule, Domain.RulePosition{})
+	return err
+}
+
+// InsertRule loads rule at the given position and returns its index in the
+// loaded rules.
+func (auditR *AuditdRepo) InsertRule(rule string, at Domain.RulePosition) (int, error) {
+	if auditR.RuleExists(rule) {
+		return -1, &Domain.RuleError{Code: Domain.CodeDuplicate, Rule: rule, Err: errors.New("rule already exists")}
+	}
+
+	i := appendIndex(auditR.rules, rule)
+	anchor := at.Before
+	if at.After != "" {
+		anchor = at.After
+	}
+	if at.Before != "" && at.After != "" {
+		return -1, &Domain.RuleError{Code: Domain.CodeParse, Rule: rule, Err: errors.New("a rule goes either before or after another one")}
+	}
+	if anchor != "" {
+		i = auditR.index(anchor)
+		if i < 0 {
+			return -1, &Domain.RuleError{Code: Domain.CodeNotFound, Rule: anchor, Err: fmt.Errorf("cant place the rule next to it: %w", Usecases.ErrRuleNotFound)}
+		}
+		if at.After != "" {
+			i++
+		}
+	}
+
+	if err := auditR.insertAt(rule, i, true); err != nil {
+		return -1, err
+	}
+	auditR.version++
+	return i, nil
+}
+
+// insertAt loads rule at index i. The kernel only appends to its lists, so the
+// rules of the same list from i on are taken out and added back after the new
+// one, they miss events for that long. Rules that cant be added back are
+// dropped with a warning, the next status report shows them missing. With
+// kernel false only the recorded order changes.
+func (auditR *AuditdRepo) insertAt(rule string, i int, kernel bool) error {
+	if kernel {
+		list := Usecases.RuleList(rule)
+		var moved []string
+		for _, r := range auditR.rules[i:] {
+			if Usecases.RuleList(r) == list {
+				moved = append(moved, r)
+			}
+		}
+		for n, r := range moved {
+			if err := auditR.auditd.DeleteRule(r); err != nil {
+				auditR.restore(moved[:n])
+				return err
+			}
+		}
+		err := auditR.addRule(rule)
+		auditR.restore(moved)
 		if err != nil {
 			return err
 		}
-		auditR.rules = append(auditR.rules, rule)
-		return nil
-	} else {
-		return fmt.Errorf("Rule already exists : %s", rule)
 	}
 
+	auditR.rules = append(auditR.rules, "")
+	copy(auditR.rules[i+1:], auditR.rules[i:])
+	auditR.rules[i] = rule
+	return nil
+}
+
+// restore adds rules taken out by insertAt back in order.
+func (auditR *AuditdRepo) restore(rules []string) {
+	for _, r := range rules {
+		if err := auditR.addRule(r); err != nil {
+			fmt.Println(fmt.Errorf("WARNING: Rule: %s was lost while reordering the rules = %v", r, err).Error())
+			auditR.DeleteFromSlice(r)
+		}
+	}
 }
 
 func (auditR *AuditdRepo) DeleteRule(rule string) error {
@@ -167,58 +387,422 @@ func (auditR *AuditdRepo) DeleteRule(rule string) error {
 		}
 		fmt.Println("peki burdamıyım")
 		auditR.DeleteFromSlice(rule)
+		auditR.version++
 		return nil
 
 	} else {
-		return Usecases.ErrRuleNotFound
+		return &Domain.RuleError{Code: Domain.CodeNotFound, Rule: rule, Err: Usecases.ErrRuleNotFound}
 	}
 
 }
 
+// SetRules loads the rules and control lines of an auditctl rules file, a
+// rules.d directory or a JSON rule list. Rules that fail are skipped with a
+// warning. -e is applied once all rules are in, like augenrules does, so -e 2
+// doesnt lock the kernel before the rules are loaded.
 func (auditR *AuditdRepo) SetRules(filename string, isManager bool) error {
-	var ar AuditRules
-	buf, err := ioutil.ReadFile(filename)
+	lines, err := Usecases.LoadRules(filename)
 	if err != nil {
-		return fmt.Errorf("cant ReadFile: %w\n", err)
+		return err
+	}
+
+	var enable *Usecases.RuleLine
+	for i, line := range lines {
+		if line.Control != "" {
+			if !isManager {
+				continue
+			}
+			if line.Control == "-e" {
+				enable = &lines[i]
+				continue
+			}
+			if err := auditR.applyControl(line); err != nil {
+				fmt.Println(fmt.Errorf("WARNING: %v: %s couldnt be applied due to = %v", line, line.Control, err).Error())
+			}
+			continue
+		}
+
+		if auditR.RuleExists(line.Rule) {
+			fmt.Println(fmt.Errorf("WARNING: %v: Rule: %s is already loaded", line, line.Rule).Error())
+			continue
+		}
+		err := auditR.insertAt(line.Rule, appendIndex(auditR.rules, line.Rule), isManager)
+		if err != nil {
+			fmt.Println(fmt.Errorf("WARNING: Rule: %s couldnt be added due to = %v", line.Rule, err).Error())
+		}
+	}
+
+	if enable != nil {
+		if err := auditR.applyControl(*enable); err != nil {
+			fmt.Println(fmt.Errorf("WARNING: %v: -e couldnt be applied due to = %v", *enable, err).Error())
+		}
+	}
+
+	auditR.version++
+	if !(len(auditR.rules) > 0) {
+		return errors.New("No rules were able to added to audit daemon")
+	}
+	return nil
+}
+
+// applyControl applies a control line of a rules file to the kernel.
+func (auditR *AuditdRepo) applyControl(line Usecases.RuleLine) error {
+	switch line.Control {
+	case "-D":
+		if err := auditR.auditd.DeleteRules(); err != nil {
+			return err
+		}
+		auditR.rules = nil
+		auditR.version++
+	case "-b":
+		return auditR.auditd.SetBackLogLimit(line.Value)
+	case "-r":
+		return auditR.auditd.SetRateLimit(line.Value)
+	case "-f":
+		return auditR.auditd.SetFailure(line.Value)
+	case "--backlog_wait_time":
+		return auditR.auditd.SetBacklogWaitTime(line.Value)
+	case "-e":
+		if line.Value == 2 {
+			return auditR.auditd.SetImmutable()
+		}
+		return auditR.auditd.SetEnabled(line.Value == 1)
+	case "-c", "-i":
+		// failing rules are always skipped
 	}
+	return nil
+}
 
-	err = json.Unmarshal(buf, &ar)
+// Reload re-reads the rules file Init loaded and brings the kernel in line
+// with it. Only the rules missing from the file are deleted and only the new
+// ones added, in the place the file gives them. The other rules stay loaded,
+// only the ones a new rule goes in front of are taken out for a moment.
+// Loaded rules the file reorders keep their order. Control
+// lines are applied again except -D, which would flush every rule.
+func (auditR *AuditdRepo) Reload() (Domain.ReloadReport, error) {
+	report := Domain.ReloadReport{}
+	lines, err := Usecases.LoadRules(auditR.filename)
 	if err != nil {
-		return fmt.Errorf("cant unmarshal: %w\n", err)
+		report.Rules = append([]string(nil), auditR.rules...)
+		return report, err
+	}
+
+	var (
+		wanted   []string
+		inFile   = map[string]bool{}
+		controls []Usecases.RuleLine
+	)
+	for _, line := range lines {
+		if line.Control != "" {
+			controls = append(controls, line)
+			continue
+		}
+		if inFile[line.Rule] {
+			continue
+		}
+		inFile[line.Rule] = true
+		// the order the rules would have loaded in from scratch
+		i := appendIndex(wanted, line.Rule)
+		wanted = append(wanted[:i], append([]string{line.Rule}, wanted[i:]...)...)
+	}
+
+	failed := func(rule string, err error) {
+		report.Failed = append(report.Failed, Domain.RuleFailure{Rule: rule, Code: Domain.CodeOf(err), Message: err.Error()})
+	}
+
+	// deletions go first, DeleteRule changes the slice we range over
+	for _, rule := range append([]string(nil), auditR.rules...) {
+		if inFile[rule] {
+			continue
+		}
+		if auditR.isManager {
+			if err := auditR.auditd.DeleteRule(rule); err != nil {
+				failed(rule, err)
+				continue
+			}
+		}
+		auditR.DeleteFromSlice(rule)
+		report.Deleted = append(report.Deleted, rule)
 	}
 
-	for _, rule := range ar.AuditRules {
-		if isManager {
-			err := auditR.auditd.AddRule(rule)
-			if err != nil {
-				fmt.Println(fmt.Errorf("WARNING: Rule: %s couldnt be added due to = %v", rule, err).Error())
+	for n, rule := range wanted {
+		if auditR.RuleExists(rule) {
+			continue
+		}
+		// in front of the next rule of the file that is loaded already
+		i := len(auditR.rules)
+		for _, next := range wanted[n+1:] {
+			if j := auditR.index(next); j >= 0 {
+				i = j
+				break
+			}
+		}
+		if err := auditR.insertAt(rule, i, auditR.isManager); err != nil {
+			failed(rule, err)
+			continue
+		}
+		report.Added = append(report.Added, rule)
+	}
+
+	if auditR.isManager {
+		var enable *Usecases.RuleLine
+		for i, line := range controls {
+			switch line.Control {
+			case "-D":
+				continue
+			case "-e":
+				enable = &controls[i]
 				continue
 			}
+			if err := auditR.applyControl(line); err != nil {
+				fmt.Println(fmt.Errorf("WARNING: %v: %s couldnt be applied due to = %v", line, line.Control, err).Error())
+			}
+		}
+		if enable != nil {
+			if err := auditR.applyControl(*enable); err != nil {
+				fmt.Println(fmt.Errorf("WARNING: %v: -e couldnt be applied due to = %v", *enable, err).Error())
+			}
+		}
+	}
+
+	if len(report.Added) > 0 || len(report.Deleted) > 0 {
+		auditR.version++
+	}
+	report.Rules = append([]string(nil), auditR.rules...)
+	return report, nil
+}
+
+// ApplyRules replaces the loaded rules with rules as one change. Every rule is
+// checked and the set put in load order before the kernel is touched, a set
+// with an invalid or duplicate rule is rejected as a whole. The kernel rules
+// are then flushed and the set loaded, when a rule fails the rules from
+// before are restored. The returned snapshot holds those rules, the caller
+// can still go back to them with RestoreRules.
+func (auditR *AuditdRepo) ApplyRules(rules []string) (Domain.RuleSnapshot, error) {
+	var (
+		ordered []string
+		seen    = map[string]string{}
+		failed  []Domain.RuleFailure
+	)
+	for _, rule := range rules {
+		normal, err := auditR.auditd.NormalizeRule(rule)
+		if err != nil {
+			failed = append(failed, Domain.RuleFailure{Rule: rule, Code: Domain.CodeOf(err), Message: err.Error()})
+			continue
+		}
+		if first, ok := seen[normal]; ok {
+			failed = append(failed, Domain.RuleFailure{Rule: rule, Code: Domain.CodeDuplicate, Message: "same rule as " + first})
+			continue
+		}
+		seen[normal] = rule
+		i := appendIndex(ordered, rule)
+		ordered = append(ordered[:i], append([]string{rule}, ordered[i:]...)...)
+	}
+	if len(failed) > 0 {
+		return Domain.RuleSnapshot{}, &Domain.RuleSetError{Failed: failed}
+	}
+
+	previous := auditR.snapshot()
+	if err := auditR.loadRules(ordered); err != nil {
+		if errR := auditR.RestoreRules(previous); errR != nil {
+			return previous, fmt.Errorf("%w, restoring the previous rules failed too: %v", err, errR)
+		}
+		return previous, err
+	}
+	auditR.version++
+	return previous, nil
+}
+
+// snapshot records the rules loaded now.
+func (auditR *AuditdRepo) snapshot() Domain.RuleSnapshot {
+	s := Domain.RuleSnapshot{Rules: append([]string(nil), auditR.rules...)}
+	if kernel, err := auditR.KernelRules(); err == nil {
+		s.Kernel = kernel
+	}
+	return s
+}
+
+// loadRules flushes the kernel rules and loads rules in order, it stops at
+// the first rule that fails.
+func (auditR *AuditdRepo) loadRules(rules []string) error {
+	if err := auditR.auditd.DeleteRules(); err != nil {
+		return err
+	}
+	auditR.rules = nil
+	for _, rule := range rules {
+		if err := auditR.addRule(rule); err != nil {
+			return err
 		}
 		auditR.rules = append(auditR.rules, rule)
 	}
+	return nil
+}
 
-	if !(len(auditR.rules) > 0) {
-		return errors.New("No rules were able to added to audit daemon")
+// RestoreRules goes back to the rules of s. The kernel gets the rules it held
+// then and s.Rules are recorded again. Every rule is tried, the error lists
+// the ones that couldnt be added back.
+func (auditR *AuditdRepo) RestoreRules(s Domain.RuleSnapshot) error {
+	kernel := auditR.kernelOf(s)
+	if err := auditR.auditd.DeleteRules(); err != nil {
+		return err
+	}
+	var failed []Domain.RuleFailure
+	for _, rule := range kernel {
+		if err := auditR.addRule(rule); err != nil {
+			failed = append(failed, Domain.RuleFailure{Rule: rule, Code: Domain.CodeOf(err), Message: err.Error()})
+		}
+	}
+	auditR.rules = append([]string(nil), s.Rules...)
+	auditR.version++
+	if len(failed) > 0 {
+		return &Domain.RuleSetError{Failed: failed}
 	}
 	return nil
 }
 
-func (auditR *AuditdRepo) DeleteFromSlice(rule string) {
-	for i, r := range auditR.rules {
-		if r == rule {
-			auditR.rules[i] = auditR.rules[len(auditR.rules)-1]
-			auditR.rules[len(auditR.rules)-1] = ""
-			auditR.rules = auditR.rules[:len(auditR.rules)-1]
-			return
+// kernelOf returns the rules to load to get the kernel of s back. While the
+// kernel held just the recorded rules in their order those are loaded as they
+// were written, otherwise the kernel's own listing.
+func (auditR *AuditdRepo) kernelOf(s Domain.RuleSnapshot) []string {
+	if len(s.Kernel) == 0 {
+		return s.Rules
+	}
+	if len(s.Kernel) != len(s.Rules) {
+		return s.Kernel
+	}
+	for i, rule := range s.Rules {
+		if normal, err := auditR.auditd.NormalizeRule(rule); err != nil || normal != s.Kernel[i] {
+			return s.Kernel
+		}
+	}
+	return s.Rules
+}
+
+// KernelRules reads the rules loaded in the kernel, in auditctl syntax.
+func (auditR *AuditdRepo) KernelRules() ([]string, error) {
+	return auditR.auditd.GetRules()
+}
+
+// RuleState compares the recorded rules with the ones the kernel holds. Both
+// are compared in the form the kernel gives back, a rule can be written in
+// more than one way.
+func (auditR *AuditdRepo) RuleState() Domain.RuleSetState {
+	state := Domain.RuleSetState{Version: auditR.version, Hash: Usecases.RulesHash(auditR.rules)}
+	kernel, err := auditR.KernelRules()
+	if err != nil {
+		state.Error = err.Error()
+		return state
+	}
+	state.KernelHash = Usecases.RulesHash(kernel)
+
+	loaded := make(map[string]bool, len(kernel))
+	for _, rule := range kernel {
+		loaded[rule] = true
+	}
+	recorded := make(map[string]bool, len(auditR.rules))
+	for _, rule := range auditR.rules {
+		normal, err := auditR.auditd.NormalizeRule(rule)
+		if err != nil {
+			normal = rule
+		}
+		recorded[normal] = true
+		if !loaded[normal] {
+			state.Missing = append(state.Missing, rule)
+		}
+	}
+	for _, rule := range kernel {
+		if !recorded[rule] {
+			state.Unexpected = append(state.Unexpected, rule)
 		}
 	}
+	return state
 }
 
-func (auditR *AuditdRepo) StartAudit() {
+// DeleteFromSlice removes rule keeping the order of the others, it is the
+// order the kernel evaluates them in.
+func (auditR *AuditdRepo) DeleteFromSlice(rule string) {
+	if i := auditR.index(rule); i >= 0 {
+		copy(auditR.rules[i:], auditR.rules[i+1:])
+		auditR.rules[len(auditR.rules)-1] = ""
+		auditR.rules = auditR.rules[:len(auditR.rules)-1]
+	}
+}
+
+// StartAudit starts reading audit events. A kernel audit StopAudit disabled
+// is enabled again first.
+func (auditR *AuditdRepo) StartAudit() error {
+	if auditR.receiving {
+		return Usecases.ErrAuditRunning
+	}
+	if auditR.paused {
+		if err := auditR.auditd.SetEnabled(true); err != nil {
+			return err
+		}
+		auditR.paused = false
+	}
 	auditR.auditd.GetAuditEvent(auditR.done)
+	auditR.receiving = true
+	return nil
 }
 
-func (auditR *AuditdRepo) StopAudit() {
+// StopAudit stops reading audit events. The kernel audit is disabled too,
+// with nobody reading them the events would fill the backlog and hold up the
+// processes causing them. An immutable one stays as it is.
+func (auditR *AuditdRepo) StopAudit() error {
+	if !auditR.receiving {
+		return Usecases.ErrAuditStopped
+	}
+	if auditR.isManager {
+		if status, err := auditR.GetStatus(); err == nil && status.Enabled == 1 {
+			if err := auditR.auditd.SetEnabled(false); err != nil {
+				return err
+			}
+			auditR.paused = true
+		}
+	}
 	auditR.done <- true
+	if w, ok := auditR.auditd.(readerWaiter); ok {
+		w.WaitReader()
+	}
+	auditR.receiving = false
+	return nil
+}
+
+// SetAuditParams changes the kernel audit settings p gives, all of them are
+// checked first. Enabled goes last, like -e in a rules file, so an immutable
+// configuration doesnt lock the other settings out. A setting that fails
+// stops the ones after it.
+func (auditR *AuditdRepo) SetAuditParams(p Domain.AuditParams) error {
+	if !auditR.isManager {
+		return &Domain.RuleError{Code: Domain.CodeUnsupported, Err: errors.New("the agent reads the audit log, the kernel audit settings are auditd's")}
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	var lines []Usecases.RuleLine
+	for _, setting := range []struct {
+		control string
+		value   *int
+	}{
+		{"-r", p.RateLimit},
+		{"-b", p.BacklogLimit},
+		{"--backlog_wait_time", p.BacklogWaitTime},
+		{"-f", p.Failure},
+		{"-e", p.Enabled},
+	} {
+		if setting.value != nil {
+			lines = append(lines, Usecases.RuleLine{Control: setting.control, Value: *setting.value})
+		}
+	}
+	for _, line := range lines {
+		if err := auditR.applyControl(line); err != nil {
+			return fmt.Errorf("couldnt apply %s %d: %w", line.Control, line.Value, err)
+		}
+	}
+	if p.Enabled != nil {
+		// StartAudit leaves the kernel audit as the job set it
+		auditR.paused = false
+	}
+	return nil
 }
@@ -2,8 +2,8 @@ package Interfaces
 
 import(
 
-	"audit-client/Usecases"
 	"audit-client/Domain"
+	"audit-client/Usecases"
 
 	"encoding/json"
 	"fmt"
@@ -11,23 +11,49 @@ import(
 	"io/ioutil"
 	"errors"
 	"strconv"
+	"time"
 )
 
+//streamIdleTimeout closes a job stream the server went silent on, the server sends a Status line every 20 seconds
+var streamIdleTimeout = time.Minute
+
+
 
 type ExternalServiceHandler interface{
 	SendMessage([]byte, string, bool, string, string) (io.ReadCloser, error)
+	OpenStream(string, string) (io.WriteCloser, io.ReadCloser, error)
 	Ping() error
+	CloseIdleConnections()
+}
+
+//CredentialStore holds the client certificate the agent authenticates with
+type CredentialStore interface{
+	NeedsRenewal() bool
+	CSR() (string, error)
+	Install(string) error
 }
 
 type APIClient struct{
 	ExtServ	 		ExternalServiceHandler
+	Creds			CredentialStore
 	failedCheckin 	int
 	uid				string
 }
 
+type CertificateMessage struct{
+	Certificate	string
+	CA			string
+}
+
+type CertificateRequest struct{
+	CSR		string
+}
+
 type APIStatusError struct{
 	Action			string
 	StatusCode 		int
+	//RetryAfter is the Retry-After hint of a 429 or 503, zero when the server gave none
+	RetryAfter		time.Duration
 }
 
 func (a *APIStatusError)Error() string{
@@ -50,15 +76,15 @@ type BaseMessage struct{
 }
 
 
-func NewAPIClient(client ExternalServiceHandler, id string) APIClient{
-	return APIClient{ExtServ: client, failedCheckin: 0, uid: id}
+func NewAPIClient(client ExternalServiceHandler, creds CredentialStore, id string) APIClient{
+	return APIClient{ExtServ: client, Creds: creds, failedCheckin: 0, uid: id}
 }
 
 
 func (e *APIClient)PollJOB() (Usecases.Job, error){
 	if e.failedCheckin>10{
 		if err := e.ExtServ.Ping(); err != nil{
-			return Usecases.Job{}, err
+			return Usecases.Job{}, fmt.Errorf("%w: %v", Usecases.ErrServerUnreachable, err)
 		}else{
 			e.failedCheckin = 0
 		}
@@ -71,6 +97,7 @@ func (e *APIClient)PollJOB() (Usecases.Job, error){
 		if errors.As(errJ, &c){
 			if c.Op == "ServerIssues"{
 				e.failedCheckin++
+				return Usecases.Job{}, fmt.Errorf("%w: %v", Usecases.ErrServerUnreachable, errJ)
 			}
 		}else if errors.As(errJ, &a){
 			if a.StatusCode == 404{
@@ -79,6 +106,8 @@ func (e *APIClient)PollJOB() (Usecases.Job, error){
 		}
 		return Usecases.Job{}, errJ
 	}
+	defer body.Close()
+	e.failedCheckin = 0
 
 	data, errB := ioutil.ReadAll(body)
 	if errB != nil{
@@ -89,9 +118,9 @@ func (e *APIClient)PollJOB() (Usecases.Job, error){
 	var j BaseMessage
 
 	errM := json.Unmarshal(data, &j)
-	if errB != nil{
+	if errM != nil{
 		fmt.Println(fmt.Errorf("Unmarshal fail : %v", errM).Error())
-		return Usecases.Job{}, errB
+		return Usecases.Job{}, errM
 	}
 
 	if j.MessageType == "Job"{
@@ -102,6 +131,55 @@ func (e *APIClient)PollJOB() (Usecases.Job, error){
 	
 }
 
+/*
+StreamJobs holds a job stream to the control server open. Every job arriving on it is handed to handle and the result
+is written back on the same stream. It blocks until the stream breaks, Usecases.ErrStreamUnsupported tells the
+caller the server cant stream jobs and polling is all there is.
+*/
+func (e *APIClient)StreamJobs(handle func(Usecases.Job) Usecases.Job) error{
+	writer, body, errO := e.ExtServ.OpenStream("JobStream", e.uid)
+	if errO != nil{
+		var c *APIClientError
+		var a *APIStatusError
+		if errors.As(errO, &c){
+			if c.Op == "ServerIssues"{
+				return fmt.Errorf("%w: %v", Usecases.ErrServerUnreachable, errO)
+			}
+		}else if errors.As(errO, &a){
+			switch a.StatusCode{
+			case 404:
+				return Usecases.ErrAgentNotRegistered
+			case 501, 505:
+				return fmt.Errorf("%w: %v", Usecases.ErrStreamUnsupported, errO)
+			}
+		}
+		return errO
+	}
+	defer writer.Close()
+	defer body.Close()
+
+	idle := time.AfterFunc(streamIdleTimeout, func(){ body.Close() })
+	defer idle.Stop()
+
+	decoder := json.NewDecoder(body)
+	encoder := json.NewEncoder(writer)
+	for{
+		var m BaseMessage
+		if errD := decoder.Decode(&m); errD != nil{
+			return fmt.Errorf("job stream closed: %v", errD)
+		}
+		idle.Reset(streamIdleTimeout)
+		if m.MessageType != "Job"{
+			continue
+		}
+
+		result := handle(m.Data)
+		if errE := encoder.Encode(result); errE != nil{
+			return fmt.Errorf("couldnt send the result of job %s: %v", result.JobID, errE)
+		}
+	}
+}
+
 func (e *APIClient)SendMessage(data interface{}, action string) error{
 	
 	if e.failedCheckin>10{
@@ -119,9 +197,11 @@ func (e *APIClient)SendMessage(data interface{}, action string) error{
 	case "SendJobResult":
 		err = e.SendJobResult(data.(Usecases.Job), e.uid)
 	case "SendAuditStatus":
-		err = e.SendAuditStatus(data.(Domain.AuditStatus), e.uid)
+		err = e.SendAuditStatus(data.(Usecases.StatusReport), e.uid)
 	case "SendAuditEvent":
 		err = e.SendAuditEvent(data.([]byte), e.uid)
+	case "SendReload":
+		err = e.SendReload(data.(Domain.ReloadReport), e.uid)
 	case "DeRegister":
 		err = e.DeRegister(e.uid)
 	case "Register":
@@ -135,16 +215,21 @@ func (e *APIClient)SendMessage(data interface{}, action string) error{
 		if errors.As(err, &s){
 			if s.StatusCode == 404{
 				return Usecases.ErrAgentNotRegistered
-			}	
+			}
+			//the server knows the ID but the agent has no valid certificate for it
+			if s.StatusCode == 401 && action == "Register"{
+				return fmt.Errorf("%w: %v", Usecases.ErrReenrollmentRequired, err)
+			}
 		}else{
 			var c *APIClientError
 			if errors.As(err, &c){
 				if c.Op == "ServerIssues"{
 					e.failedCheckin++
+					return fmt.Errorf("%w: %v", Usecases.ErrServerUnreachable, err)
 				}
 			}
-		return err
 		}
+		return err
 	}
 
 	e.failedCheckin = 0
@@ -178,7 +263,7 @@ func (e *APIClient)SendJobResult(j Usecases.Job, uid string) error{
 	
 }
 
-func (e *APIClient)SendAuditStatus(status Domain.AuditStatus, uid string) error{
+func (e *APIClient)SendAuditStatus(status Usecases.StatusReport, uid string) error{
 
 	data, errJ := json.Marshal(status)
 	if errJ != nil{
@@ -193,6 +278,20 @@ func (e *APIClient)SendAuditStatus(status Domain.AuditStatus, uid string) error{
 		
 }
 
+//SendReload reports the rules a reload added and deleted along with the rules loaded now
+func (e *APIClient)SendReload(report Domain.ReloadReport, uid string) error{
+	data, errJ := json.Marshal(report)
+	if errJ != nil{
+		return errJ
+	}
+	_, errJ = e.ExtServ.SendMessage(data, "RulesReloaded", true, uid, "POST")
+	if errJ != nil{
+		return errJ
+	}
+
+	return nil
+}
+
 func (e *APIClient)SendAuditEvent(event []byte, uid string)error{
 	_, errJ := e.ExtServ.SendMessage(event, "Syscall", true, uid, "POST")
 	if errJ != nil{
@@ -202,16 +301,72 @@ func (e *APIClient)SendAuditEvent(event []byte, uid string)error{
 	return nil
 }
 
+//Register enrolls the agent, asking for a client certificate when it has none or the current one is about to expire
 func (e *APIClient)Register(agent Usecases.MessageAgent, uid string)error{
+	if e.Creds != nil && e.Creds.NeedsRenewal(){
+		csr, errC := e.Creds.CSR()
+		if errC != nil{
+			return errC
+		}
+		agent.CSR = csr
+	}
+
 	data, errJ := json.Marshal(agent)
 	if errJ != nil{
 		return errJ
 	}
-	_, errJ = e.ExtServ.SendMessage(data, "Register",true, uid, "POST")
+	body, errJ := e.ExtServ.SendMessage(data, "Register", agent.CSR == "", uid, "POST")
 	if errJ != nil{
 		return errJ
 	}
 
+	if agent.CSR != ""{
+		return e.installCertificate(body)
+	}
+	return nil
+}
+
+//RenewCredentials replaces the client certificate once less than a third of its lifetime is left
+func (e *APIClient)RenewCredentials() error{
+	if e.Creds == nil || !e.Creds.NeedsRenewal(){
+		return nil
+	}
+
+	csr, errC := e.Creds.CSR()
+	if errC != nil{
+		return errC
+	}
+	data, errJ := json.Marshal(CertificateRequest{CSR: csr})
+	if errJ != nil{
+		return errJ
+	}
+	body, errJ := e.ExtServ.SendMessage(data, "RenewCertificate", false, e.uid, "POST")
+	if errJ != nil{
+		var s *APIStatusError
+		if errors.As(errJ, &s) && s.StatusCode == 404{
+			return Usecases.ErrAgentNotRegistered
+		}
+		return errJ
+	}
+	return e.installCertificate(body)
+}
+
+//installCertificate closes body, the connection it came on has to be idle to be dropped
+func (e *APIClient)installCertificate(body io.ReadCloser) error{
+	data, errB := ioutil.ReadAll(body)
+	body.Close()
+	if errB != nil{
+		return fmt.Errorf("body read fail : %v", errB)
+	}
+	var cert CertificateMessage
+	if errM := json.Unmarshal(data, &cert); errM != nil{
+		return fmt.Errorf("couldnt read the issued certificate: %v", errM)
+	}
+	if errI := e.Creds.Install(cert.Certificate); errI != nil{
+		return errI
+	}
+	//connections kept alive from before were set up without the new certificate
+	e.ExtServ.CloseIdleConnections()
 	return nil
 }
 
@@ -1,14 +1,17 @@
 package Usecases
 
 import (
-	"encoding/json"
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"audit-client/Domain"
 
@@ -19,12 +22,34 @@ var ErrRuleNotFound = errors.New("Rule not found")
 var ErrUnknownAction = errors.New("Action was not found")
 var ErrServerUnreachable = errors.New("Server is un reachable")
 var ErrAgentNotRegistered = errors.New("Response status code was not 200 OK")
+var ErrStreamUnsupported = errors.New("Control server cant stream jobs")
+var ErrAuditRunning = errors.New("Audit events are already read")
+var ErrAuditStopped = errors.New("Audit events arent read")
+var ErrAgentStopping = errors.New("Agent is shutting down")
+var ErrReenrollmentRequired = errors.New("certificate expired, re-enrollment required")
+
+var (
+	DefaultPollInterval  = 10 * time.Second
+	DefaultMaxBackoff    = 5 * time.Minute
+	DefaultConfirmWindow = 2 * time.Minute
+)
 
 type MessageAgent struct {
-	Rules    []string
-	Hostname string
-	ID       uuid.UUID
-	HostInfo Domain.HostInfo
+	Rules       []string
+	Hostname    string
+	ID          uuid.UUID
+	HostInfo    Domain.HostInfo
+	Labels      map[string]string `json:",omitempty"`
+	EnrollToken string
+	CSR         string `json:",omitempty"`
+}
+
+// StatusReport is what the agent sends on every heartbeat: the kernel audit
+// status, the state of the rule set plus the health of the event sinks.
+type StatusReport struct {
+	Domain.AuditStatus
+	RuleSet *Domain.RuleSetState `json:",omitempty"`
+	Sinks   []SinkStats
 }
 
 type Logger interface {
@@ -37,15 +62,64 @@ type Agent struct {
 	IsRegistered bool
 	AuditclientS Domain.AuditDaemon
 	HostInfo     Domain.HostInfo
+	Pool         *WorkerPool
+	EnrollToken  string
+	Labels       map[string]string
 	jobManager   JobManager
 	WaitGroup    *sync.WaitGroup
 	logger       Logger
 	verbose      bool
+	PollInterval time.Duration
+	MaxBackoff   time.Duration
+	failures     int
+	random       *rand.Rand
+	shutdown     sync.Once
+	// Stream has jobs pushed over a long-lived connection, polling is only
+	// used while the stream is down.
+	Stream      bool
+	streaming   int32
+	streamLock  sync.Mutex
+	streamRetry time.Time
+	jobLock     sync.Mutex
+	// Exit ends the process once the agent deregistered, os.Exit unless the
+	// agent runs embedded.
+	Exit func(int)
+	// RulesChanged, when set, reloads the rules file like SIGHUP does.
+	RulesChanged <-chan struct{}
+	// pendingReload is the last reload the control server didnt get yet
+	pendingReload *Domain.ReloadReport
+	// drifted is the kernel rule hash last logged as drifted
+	drifted string
+	// reenrollLogged is set once a refused re-enrollment was logged, until a
+	// registration goes through again
+	reenrollLogged bool
+	// ConfirmWindow is how long an applied rule set waits for a status report
+	// to reach the control server before it is rolled back.
+	ConfirmWindow time.Duration
+	// applied is the rule set applied last while no status report went
+	// through since, unconfirmed gets it when its window is over.
+	applied     *ruleApply
+	unconfirmed chan *ruleApply
+	// done is closed once the agent starts shutting down, no work is taken
+	// on after that, stopped once it deregistered. stopLock keeps
+	// WaitGroup.Add from racing the Wait of deRegister.
+	done     chan struct{}
+	stopped  chan struct{}
+	stopLock sync.Mutex
+}
+
+// ruleApply keeps the rules from before an ApplyRuleSet job until the control
+// server saw the new ones.
+type ruleApply struct {
+	job      uuid.UUID
+	previous Domain.RuleSnapshot
 }
 
 type JobManager interface {
 	PollJOB() (Job, error)
 	SendMessage(interface{}, string) error
+	RenewCredentials() error
+	StreamJobs(func(Job) Job) error
 }
 
 type Job struct {
@@ -54,7 +128,21 @@ type Job struct {
 	Retry   int
 	Status  string
 	Message string
+	Code    Domain.ErrorCode `json:",omitempty"`
 	JobID   uuid.UUID
+	// Before and After place an AddRule rule next to a loaded one, Position
+	// reports the index it was loaded at.
+	Before   string `json:",omitempty"`
+	After    string `json:",omitempty"`
+	Position *int   `json:",omitempty"`
+	// Rules is the set an ApplyRuleSet job loads, the result has them in load
+	// order. Confirm overrides the confirmation window in seconds, Failed
+	// lists the rules that made the job fail.
+	Rules   []string             `json:",omitempty"`
+	Confirm int                  `json:",omitempty"`
+	Failed  []Domain.RuleFailure `json:",omitempty"`
+	// Params are the kernel audit settings of a SetAuditParams job.
+	Params *Domain.AuditParams `json:",omitempty"`
 }
 
 func NewAgent(auditDS Domain.AuditDaemon, j JobManager, wait *sync.WaitGroup, l Logger, uid uuid.UUID) (*Agent, error) {
@@ -65,7 +153,17 @@ func NewAgent(auditDS Domain.AuditDaemon, j JobManager, wait *sync.WaitGroup, l
 		jobManager:   j,
 		WaitGroup:    wait,
 		logger:       l,
+		PollInterval: DefaultPollInterval,
+		MaxBackoff:   DefaultMaxBackoff,
+		random:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		Stream:       true,
+		Exit:         os.Exit,
 	}
+	a.ConfirmWindow = DefaultConfirmWindow
+	// rollbacks wait for Run, it owns the pending reload report
+	a.unconfirmed = make(chan *ruleApply)
+	a.done = make(chan struct{})
+	a.stopped = make(chan struct{})
 
 	//a.UndeliveredJobs = make(chan JobResultMessage, 10)
 
@@ -78,55 +176,209 @@ func NewAgent(auditDS Domain.AuditDaemon, j JobManager, wait *sync.WaitGroup, l
 	return a, nil
 }
 
-func (a *Agent) SendStatus() {
+func (a *Agent) SendStatus() error {
 	status, errS := a.AuditclientS.GetStatus()
 	if errS != nil {
 		a.logger.Log(fmt.Errorf("couldnt get the audit status: %v", errS).Error(), ERROR)
-		return
+		return nil
+	}
+
+	// jobs from the stream change the rules meanwhile
+	a.jobLock.Lock()
+	ruleSet := a.AuditclientS.RuleState()
+	applied := a.applied
+	a.jobLock.Unlock()
+	drifted := ""
+	if len(ruleSet.Missing) > 0 || len(ruleSet.Unexpected) > 0 {
+		drifted = ruleSet.KernelHash
+	}
+	if drifted != "" && drifted != a.drifted {
+		a.logger.Log(fmt.Sprintf("Kernel rules drifted from the loaded ones: %d missing, %d unexpected", len(ruleSet.Missing), len(ruleSet.Unexpected)), WARN)
+	}
+	a.drifted = drifted
+
+	report := StatusReport{AuditStatus: status, RuleSet: &ruleSet}
+	if a.Pool != nil && a.Pool.Sinks != nil {
+		report.Sinks = a.Pool.Sinks.Stats()
 	}
 
-	errC := a.jobManager.SendMessage(status, "SendAuditStatus")
+	errC := a.jobManager.SendMessage(report, "SendAuditStatus")
 	if errC != nil {
-		if errors.Is(errC, ErrAgentNotRegistered) {
-			a.Register()
-		}
 		if a.verbose {
-			a.logger.Log(fmt.Errorf("couldnt report the job result: %v", errC).Error(), ERROR)
+			a.logger.Log(fmt.Errorf("couldnt report the audit status: %v", errC).Error(), ERROR)
 		}
+		return errC
+	}
+	a.confirm(applied)
+	return nil
+}
 
+// confirm keeps an applied rule set for good once a status report showing it
+// reached the control server.
+func (a *Agent) confirm(applied *ruleApply) {
+	if applied == nil {
 		return
 	}
-
+	a.jobLock.Lock()
+	defer a.jobLock.Unlock()
+	if a.applied == applied {
+		a.applied = nil
+		a.logger.Log(fmt.Sprintf("Control server saw the rule set of job %s, it is kept", applied.job), INFO)
+	}
 }
 
-func (a *Agent) StatusCheck() {
+// track counts a piece of work deRegister waits for. It returns false once
+// the agent is shutting down, the work must not start then.
+func (a *Agent) track() bool {
+	a.stopLock.Lock()
+	defer a.stopLock.Unlock()
+	select {
+	case <-a.done:
+		return false
+	default:
+	}
 	a.WaitGroup.Add(1)
+	return true
+}
+
+func (a *Agent) StatusCheck() error {
+	if !a.track() {
+		return ErrAgentStopping
+	}
 	defer a.WaitGroup.Done()
 
-	a.SendStatus()
+	errS := a.SendStatus()
+	if errors.Is(errS, ErrAgentNotRegistered) || errors.Is(errS, ErrServerUnreachable) {
+		return errS
+	}
+
+	// jobs arrive on the stream while it is up, the heartbeat only reports the status
+	if atomic.LoadInt32(&a.streaming) == 1 {
+		return nil
+	}
+
 	job, errC := a.jobManager.PollJOB()
 	if errC != nil {
-		if errors.Is(errC, ErrAgentNotRegistered) {
-			a.logger.Log(fmt.Errorf("Server was restarted : %v, re-registering.. ", errC).Error(), INFO)
-			a.Register()
-			return
-		} else if errors.Is(errC, ErrServerUnreachable) {
-			//?? what do you do if server is unreachable
-		}
-		a.logger.Log(fmt.Errorf("Statuscheck fail : %v", errC).Error(), ERROR)
-		return
+		return errC
 	}
 
-	if job != (Job{}) {
-		j := a.JobHandler(job)
-		fmt.Println("Jobresult is getting prep")
-		fmt.Println(j)
+	if job.JobType != "" {
+		j := a.runJob(job)
 		errJ := a.jobManager.SendMessage(j, "SendJobResult")
 		if errJ != nil {
 			a.logger.Log(fmt.Errorf("Couldnt send job result due to: %v", errJ).Error(), ERROR)
 		}
 	}
+	return nil
+}
 
+// heartbeat registers the agent if needed and polls the control server for a job.
+func (a *Agent) heartbeat() error {
+	select {
+	case <-a.done:
+		return ErrAgentStopping
+	default:
+	}
+	if !a.IsRegistered {
+		return a.Register()
+	}
+
+	err := a.StatusCheck()
+	if err == nil {
+		// the certificate is tried again on the next heartbeat, the current
+		// one is still good for the reload report and the stream
+		err = a.jobManager.RenewCredentials()
+		if err != nil && !errors.Is(err, ErrAgentNotRegistered) && !errors.Is(err, ErrServerUnreachable) {
+			a.logger.Log(fmt.Errorf("couldnt renew the client certificate: %v", err).Error(), WARN)
+			err = nil
+		}
+	}
+	if err == nil {
+		a.sendReload()
+		a.openStream()
+	}
+	if errors.Is(err, ErrAgentNotRegistered) {
+		a.logger.Log("Control server doesnt know this agent anymore, re-registering..", INFO)
+		a.IsRegistered = false
+		return a.Register()
+	}
+	return err
+}
+
+// runJob executes a job. Jobs from the stream and from polling never run at
+// the same time.
+func (a *Agent) runJob(j Job) Job {
+	a.jobLock.Lock()
+	defer a.jobLock.Unlock()
+	return a.JobHandler(j)
+}
+
+// openStream opens the job stream unless it is already up or disabled. A
+// stream that broke is retried on a later heartbeat, a server that cant stream
+// at all is asked again after MaxBackoff.
+func (a *Agent) openStream() {
+	if !a.Stream {
+		return
+	}
+	a.streamLock.Lock()
+	retry := a.streamRetry
+	a.streamLock.Unlock()
+	if time.Now().Before(retry) || !atomic.CompareAndSwapInt32(&a.streaming, 0, 1) {
+		return
+	}
+
+	go func() {
+		a.logger.Log("Opening the job stream", INFO)
+		err := a.jobManager.StreamJobs(func(j Job) Job {
+			if !a.track() {
+				j.Status = "JobFailed"
+				j.Code = Domain.CodeUnavailable
+				j.Message = ErrAgentStopping.Error()
+				return j
+			}
+			defer a.WaitGroup.Done()
+			return a.runJob(j)
+		})
+
+		wait := a.PollInterval
+		if errors.Is(err, ErrStreamUnsupported) {
+			wait = a.MaxBackoff
+			a.logger.Log(fmt.Sprintf("Control server cant stream jobs, polling for them, next try in %v", wait), INFO)
+		} else {
+			a.logger.Log(fmt.Errorf("Job stream is down, polling for jobs until it is back: %v", err).Error(), WARN)
+		}
+		a.streamLock.Lock()
+		a.streamRetry = time.Now().Add(wait)
+		a.streamLock.Unlock()
+		atomic.StoreInt32(&a.streaming, 0)
+	}()
+}
+
+// nextPoll returns how long to wait before the next heartbeat. While the server
+// stays unreachable the interval doubles up to MaxBackoff and is jittered so a
+// fleet of agents doesnt hit a recovering server at the same moment.
+func (a *Agent) nextPoll(err error) time.Duration {
+	// only an operator can let the agent back in, ask seldom meanwhile
+	if errors.Is(err, ErrReenrollmentRequired) {
+		return a.MaxBackoff
+	}
+	if !errors.Is(err, ErrServerUnreachable) {
+		a.failures = 0
+		return a.PollInterval
+	}
+
+	a.failures++
+	backoff := a.PollInterval
+	for i := 0; i < a.failures && backoff < a.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > a.MaxBackoff {
+		backoff = a.MaxBackoff
+	}
+
+	// equal jitter: half of the backoff is fixed, the other half random
+	half := backoff / 2
+	return half + time.Duration(a.random.Int63n(int64(half)+1))
 }
 
 // func (a *Agent)SendProcesses(){
@@ -151,52 +403,105 @@ func (a *Agent) JobHandler(j Job) Job {
 		errD := a.AuditclientS.DeleteRule(j.Rule)
 		if errD != nil {
 			j.Status = "JobFailed"
+			j.Code = Domain.CodeOf(errD)
 			j.Message = fmt.Errorf("couldnt delete the rule: %v", errD).Error()
 			return j
 		}
 		j.Status = "JobSuccess"
 		return j
 	case "AddRule":
-		errD := a.AuditclientS.SetRule(j.Rule)
+		position, errD := a.AuditclientS.InsertRule(j.Rule, Domain.RulePosition{Before: j.Before, After: j.After})
 		if errD != nil {
 			j.Status = "JobFailed"
+			j.Code = Domain.CodeOf(errD)
 			j.Message = fmt.Errorf("couldnt add the rule: %v", errD).Error()
 			return j
 		}
 
+		j.Position = &position
 		j.Status = "JobSuccess"
 		return j
+	case "ApplyRuleSet":
+		return a.applyRuleSet(j)
 	case "SaveConfig":
 		errS := a.SaveConfig()
 		if errS != nil {
 			j.Status = "JobFailed"
+			j.Code = Domain.CodeIO
 			j.Message = fmt.Errorf("couldnt save the rules: %v", errS).Error()
 			return j
 		}
 		j.Status = "JobSuccess"
 		return j
-	// case "StopAudit":
-	// 	a.Auditclient.StopAudit()
-	// 	j.Status = "JobSuccess"
-	// 	return j
-	// case "StartAudit":
-	// 	a.Auditclient.StartAudit()
-	// 	j.Status = "JobSuccess"
-	// 	return j
+	case "StopAudit":
+		errS := a.AuditclientS.StopAudit()
+		if errS != nil && !errors.Is(errS, ErrAuditStopped) {
+			j.Status = "JobFailed"
+			j.Code = Domain.CodeOf(errS)
+			j.Message = fmt.Errorf("couldnt stop the audit: %v", errS).Error()
+			return j
+		}
+		if errS != nil {
+			j.Message = "audit was stopped already"
+		}
+		j.Status = "JobSuccess"
+		return j
+	case "StartAudit":
+		errS := a.AuditclientS.StartAudit()
+		if errS != nil && !errors.Is(errS, ErrAuditRunning) {
+			j.Status = "JobFailed"
+			j.Code = Domain.CodeOf(errS)
+			j.Message = fmt.Errorf("couldnt start the audit: %v", errS).Error()
+			return j
+		}
+		if errS != nil {
+			j.Message = "audit was running already"
+		}
+		j.Status = "JobSuccess"
+		return j
+	case "SetAuditParams":
+		if j.Params == nil {
+			j.Status = "JobFailed"
+			j.Code = Domain.CodeParse
+			j.Message = "SetAuditParams job carries no audit settings"
+			return j
+		}
+		errS := a.AuditclientS.SetAuditParams(*j.Params)
+		if errS != nil {
+			j.Status = "JobFailed"
+			j.Code = Domain.CodeOf(errS)
+			j.Message = fmt.Errorf("couldnt change the audit settings: %v", errS).Error()
+			return j
+		}
+		j.Status = "JobSuccess"
+		return j
 	case "ShutDown":
 		go a.DeRegister()
 		j.Status = "JobSuccess"
 		return j
+	case "Uninstall":
+		// the agent only leaves once the host has its audit configuration back
+		errR := a.AuditclientS.RestoreHost()
+		if errR != nil {
+			j.Status = "JobFailed"
+			j.Code = Domain.CodeOf(errR)
+			j.Message = errR.Error()
+			return j
+		}
+		go a.DeRegister()
+		j.Status = "JobSuccess"
+		return j
 	case "Purge":
-		rules := a.AuditclientS.ListRules()
-		var err error
+		// ListRules returns the repo's own slice, DeleteRule shrinks it while we range over it
+		rules := append([]string(nil), a.AuditclientS.ListRules()...)
 		counter := 0
 		for _, rule := range rules {
-			err = a.AuditclientS.DeleteRule(rule)
+			err := a.AuditclientS.DeleteRule(rule)
 			if err != nil {
-				fmt.Println(rule)
 				a.logger.Log(err.Error(), WARN)
-				err = nil
+				if j.Code == "" {
+					j.Code = Domain.CodeOf(err)
+				}
 				continue
 			}
 			counter++
@@ -204,6 +509,7 @@ func (a *Agent) JobHandler(j Job) Job {
 
 		if counter == len(rules) {
 			j.Status = "JobSuccess"
+			j.Code = ""
 			return j
 		}
 
@@ -212,76 +518,271 @@ func (a *Agent) JobHandler(j Job) Job {
 		return j
 	default:
 		a.logger.Log("Unsupported job type : "+j.JobType, WARN)
-		return Job{}
+		j.Status = "JobFailed"
+		j.Code = Domain.CodeUnsupported
+		j.Message = "this agent doesnt support " + j.JobType + " jobs"
+		return j
 
 	}
 }
 
-func (a *Agent) SaveConfig() error {
-	if _, err := os.Stat("./auditrules.json"); !os.IsNotExist(err) {
-		errR := os.Remove("./auditrules.json")
-		if errR != nil {
-			return fmt.Errorf("Error deleting the old config file: %v", errR)
+// applyRuleSet loads the rule set of j in place of the loaded rules, all of
+// them or none. The rules from before are kept until a status report showing
+// the new set reaches the control server, when none does within the window
+// they are restored. A set applied while the last one wasnt confirmed yet
+// rolls back to the rules the server saw last.
+func (a *Agent) applyRuleSet(j Job) Job {
+	previous, err := a.AuditclientS.ApplyRules(j.Rules)
+	if err != nil {
+		j.Status = "JobFailed"
+		j.Code = Domain.CodeOf(err)
+		j.Message = fmt.Errorf("couldnt apply the rule set: %v", err).Error()
+		var setErr *Domain.RuleSetError
+		var ruleErr *Domain.RuleError
+		if errors.As(err, &setErr) {
+			j.Failed = setErr.Failed
+		} else if errors.As(err, &ruleErr) {
+			j.Failed = []Domain.RuleFailure{{Rule: ruleErr.Rule, Code: ruleErr.Code, Message: ruleErr.Err.Error()}}
 		}
+		return j
 	}
-	data, errM := json.Marshal(a.AuditclientS.ListRules())
-	if errM != nil {
-		return fmt.Errorf("Error marshaling rules to save in config file: %v", errM)
+
+	if a.applied != nil {
+		previous = a.applied.previous
 	}
-	err := ioutil.WriteFile("auditrules.json", data, 0755)
-	if err != nil {
-		return fmt.Errorf("Error writing rules to the specified file: %v", errM)
+	window := a.ConfirmWindow
+	if j.Confirm > 0 {
+		window = time.Duration(j.Confirm) * time.Second
+	}
+	apply := &ruleApply{job: j.JobID, previous: previous}
+	a.applied = apply
+	time.AfterFunc(window, func() {
+		// the run loop is gone once the agent shuts down, nobody rolls back then
+		select {
+		case a.unconfirmed <- apply:
+		case <-a.done:
+		}
+	})
+	a.logger.Log(fmt.Sprintf("Applied the rule set of job %s, it is rolled back unless a status report goes through within %v", j.JobID, window), INFO)
+
+	j.Rules = append([]string(nil), a.AuditclientS.ListRules()...)
+	j.Status = "JobSuccess"
+	return j
+}
+
+// rollback restores the rules from before an applied rule set whose window
+// ran out and reports them to the control server like a reload.
+func (a *Agent) rollback(apply *ruleApply) {
+	if !a.track() {
+		return
+	}
+	defer a.WaitGroup.Done()
+
+	a.jobLock.Lock()
+	if a.applied != apply {
+		a.jobLock.Unlock()
+		return
+	}
+	a.applied = nil
+	applied := append([]string(nil), a.AuditclientS.ListRules()...)
+	err := a.AuditclientS.RestoreRules(apply.previous)
+	report := Domain.ReloadReport{Source: "rollback", RolledBack: apply.job.String()}
+	report.Rules = append([]string(nil), a.AuditclientS.ListRules()...)
+	a.jobLock.Unlock()
+
+	report.Added, report.Deleted = ruleDiff(applied, report.Rules)
+	a.logger.Log(fmt.Sprintf("No status report went through since the rule set of job %s was applied, restored the rules from before it", apply.job), WARN)
+	var setErr *Domain.RuleSetError
+	if errors.As(err, &setErr) {
+		report.Failed = setErr.Failed
+		a.logger.Log(fmt.Errorf("some rules couldnt be restored: %v", err).Error(), ERROR)
+	} else if err != nil {
+		report.Error = err.Error()
+		a.logger.Log(fmt.Errorf("couldnt restore the rules, keeping the applied ones: %v", err).Error(), ERROR)
+	}
+
+	a.pendingReload = &report
+	a.sendReload()
+}
+
+// ruleDiff returns the rules of after missing from before and the ones of
+// before missing from after.
+func ruleDiff(before, after []string) (added, deleted []string) {
+	in := func(rules []string, rule string) bool {
+		for _, r := range rules {
+			if r == rule {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rule := range after {
+		if !in(before, rule) {
+			added = append(added, rule)
+		}
+	}
+	for _, rule := range before {
+		if !in(after, rule) {
+			deleted = append(deleted, rule)
+		}
+	}
+	return added, deleted
+}
+
+// SaveConfig writes the loaded rules and the kernel tuning to SavedRulesFile
+// in the auditctl format, so the agent can be started with it.
+func (a *Agent) SaveConfig() error {
+	var status *Domain.AuditStatus
+	// the log input mode has no kernel status to save
+	if s, err := a.AuditclientS.GetStatus(); err == nil && s != (Domain.AuditStatus{}) {
+		status = &s
+	}
+
+	var buf bytes.Buffer
+	if err := WriteRules(&buf, status, a.AuditclientS.ListRules()); err != nil {
+		return fmt.Errorf("Error formatting the rules to save in config file: %v", err)
+	}
+	tmp := SavedRulesFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("Error writing rules to the specified file: %v", err)
+	}
+	if err := os.Rename(tmp, SavedRulesFile); err != nil {
+		return fmt.Errorf("Error replacing the old config file: %v", err)
 	}
 	return nil
 }
 
-func (a *Agent) Register() {
+// Reload applies the changes of the rules file without stopping the audit
+// events and reports them to the control server. source says what triggered
+// the reload and is only used in the report.
+func (a *Agent) Reload(source string) {
+	if !a.track() {
+		return
+	}
+	defer a.WaitGroup.Done()
+
+	a.jobLock.Lock()
+	report, err := a.AuditclientS.Reload()
+	a.jobLock.Unlock()
+	report.Source = source
+	if err != nil {
+		report.Error = err.Error()
+		a.logger.Log(fmt.Errorf("couldnt reload the rules, keeping the loaded ones: %v", err).Error(), ERROR)
+	} else {
+		a.logger.Log(fmt.Sprintf("Reloaded the rules on %s: %d added, %d deleted, %d failed", source, len(report.Added), len(report.Deleted), len(report.Failed)), INFO)
+	}
+	for _, f := range report.Failed {
+		a.logger.Log(fmt.Sprintf("Reload couldnt apply %s: %s", f.Rule, f.Message), WARN)
+	}
+
+	a.pendingReload = &report
+	a.sendReload()
+}
+
+// sendReload reports the last reload to the control server. A report that
+// couldnt be sent is tried again on the next heartbeat, a newer reload
+// replaces it since it carries every loaded rule.
+func (a *Agent) sendReload() {
+	if a.pendingReload == nil || !a.IsRegistered {
+		return
+	}
+	err := a.jobManager.SendMessage(*a.pendingReload, "SendReload")
+	if err != nil {
+		a.logger.Log(fmt.Errorf("couldnt report the reload, retrying on the next heartbeat: %v", err).Error(), WARN)
+		return
+	}
+	a.pendingReload = nil
+}
+
+func (a *Agent) Register() error {
 	a.logger.Log("Registering agent: "+a.Hostname, INFO)
+	a.jobLock.Lock()
+	rules := append([]string(nil), a.AuditclientS.ListRules()...)
+	a.jobLock.Unlock()
 	message := MessageAgent{
-		Rules:    a.AuditclientS.ListRules(),
-		Hostname: a.Hostname,
-		ID:       a.ID,
-		HostInfo: a.HostInfo,
+		Rules:       rules,
+		Hostname:    a.Hostname,
+		ID:          a.ID,
+		HostInfo:    a.HostInfo,
+		Labels:      a.Labels,
+		EnrollToken: a.EnrollToken,
 	}
 	// check if server is responding ? and increase the counter by one
 	err := a.jobManager.SendMessage(message, "Register")
-	if err != nil {
-		if errors.Is(err, ErrServerUnreachable) {
-			//send to kibana
-			a.logger.Log("Control server is currenty unreachable, retry in 10 seconds", INFO)
+	if errors.Is(err, ErrReenrollmentRequired) {
+		// retrying wont help until an operator approved it, say so once
+		if !a.reenrollLogged {
+			a.logger.Log(fmt.Sprintf("%v: the control server knows agent %s but it has no valid certificate anymore, an operator has to approve re-enrolling it", ErrReenrollmentRequired, a.ID), WARN)
+			a.reenrollLogged = true
 		}
-		return
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("couldnt register the agent: %w", err)
 	}
 
+	a.reenrollLogged = false
 	a.IsRegistered = true
+	return nil
 }
 
 func (a *Agent) DeRegister() {
+	a.shutdown.Do(a.deRegister)
+}
+
+func (a *Agent) deRegister() {
+	a.stopLock.Lock()
+	close(a.done)
+	a.stopLock.Unlock()
+
 	fmt.Println("Shutting down audit daemon")
-	a.AuditclientS.StopAudit()
+	a.jobLock.Lock()
+	errS := a.AuditclientS.StopAudit()
+	a.jobLock.Unlock()
+	if errS != nil && !errors.Is(errS, ErrAuditStopped) {
+		a.logger.Log(fmt.Errorf("couldnt stop the audit: %v", errS).Error(), WARN)
+	}
 	fmt.Println("Waiting for all workers to finish their job")
 	a.WaitGroup.Wait()
+	if a.Pool != nil {
+		fmt.Println("Flushing event sinks")
+		a.Pool.ShutDown()
+	}
+	fmt.Println("Restoring the audit configuration of the host")
+	a.jobLock.Lock()
+	errR := a.AuditclientS.RestoreHost()
+	a.jobLock.Unlock()
+	if errR != nil {
+		a.logger.Log(fmt.Errorf("%v, it is tried again on the next clean shutdown", errR).Error(), ERROR)
+	}
 	fmt.Println("Closing audit sockets")
 	//a.Auditclient.Close()
 	a.AuditclientS.Close()
-	// fmt.Println("Deregistering from the control server")
-	// err := a.jobManager.SendMessage(nil, "DeRegister")
-	// if err != nil {
-	// 	if errors.Is(err, ErrServerUnreachable) {
-	// 		a.logger.Log("Control server is currenty unreachable", INFO)
-	// 	} else if errors.Is(err, ErrAgentNotRegistered) {
-	// 		a.logger.Log("Control server was restarted", INFO)
-	// 	}
-
-	// }
+	if a.IsRegistered {
+		fmt.Println("Deregistering from the control server")
+		err := a.jobManager.SendMessage(nil, "DeRegister")
+		if err != nil {
+			if errors.Is(err, ErrServerUnreachable) {
+				a.logger.Log("Control server is currenty unreachable", INFO)
+			} else if errors.Is(err, ErrAgentNotRegistered) {
+				a.logger.Log("Control server was restarted", INFO)
+			}
+		}
+	}
 
-	os.Exit(1)
+	close(a.stopped)
+	a.Exit(0)
 
 }
 
 func (a *Agent) Run() {
 
-	a.AuditclientS.StartAudit()
+	a.jobLock.Lock()
+	errS := a.AuditclientS.StartAudit()
+	a.jobLock.Unlock()
+	if errS != nil {
+		a.logger.Log(fmt.Errorf("couldnt start the audit: %v", errS).Error(), ERROR)
+	}
 
 	fmt.Println(a.AuditclientS.ListRules())
 	status, err := a.AuditclientS.GetStatus()
@@ -298,26 +799,44 @@ func (a *Agent) Run() {
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 
+	poll := time.NewTimer(0)
 	for {
 		select {
-		case <-sigc:
+		case sig := <-sigc:
+			if sig == syscall.SIGHUP {
+				a.Reload("SIGHUP")
+				continue
+			}
+			poll.Stop()
 			a.DeRegister()
+			return
+		case <-a.done:
+			// a ShutDown or Uninstall job deregisters the agent, the process
+			// ends when Run returns so it waits for that to finish
+			poll.Stop()
+			<-a.stopped
+			return
+		case <-a.RulesChanged:
+			a.Reload("rules file change")
+		case apply := <-a.unconfirmed:
+			a.rollback(apply)
+		case <-poll.C:
+			err := a.heartbeat()
+			if errors.Is(err, ErrAgentStopping) {
+				<-a.stopped
+				return
+			}
+			wait := a.nextPoll(err)
+			if errors.Is(err, ErrServerUnreachable) {
+				a.logger.Log(fmt.Sprintf("Control server is currenty unreachable, retry in %v", wait), INFO)
+			} else if err != nil && !errors.Is(err, ErrReenrollmentRequired) {
+				a.logger.Log(fmt.Errorf("Statuscheck fail : %v", err).Error(), ERROR)
+			}
+			poll.Reset(wait)
 		}
-		// default:
-		// 	if !a.IsRegistered {
-		// 		a.Register()
-		// 	} else {
-		// 		go a.StatusCheck()
-		// 		//go a.SendProcesses()
-		// 	}
-		// 	time.Sleep(10 * time.Second)
-		// }
-
 	}
 
 }
 
 //TO-DO
 //improve logging and error handling - in progress
-//Decide what to do in case of a server failure - in-progress
-//Sleep for how long ??
@@ -0,0 +1,246 @@
+package Usecases
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"audit-client/Domain"
+
+	"github.com/google/uuid"
+)
+
+// calls records what the agent asked of its daemon and the control server,
+// in order.
+type calls struct {
+	lock sync.Mutex
+	list []string
+}
+
+func (c *calls) add(call string) {
+	c.lock.Lock()
+	c.list = append(c.list, call)
+	c.lock.Unlock()
+}
+
+func (c *calls) has(call string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, made := range c.list {
+		if made == call {
+			return true
+		}
+	}
+	return false
+}
+
+// stubDaemon implements what Run and deRegister use, anything else panics.
+type stubDaemon struct {
+	Domain.AuditDaemon
+	calls *calls
+}
+
+func (d *stubDaemon) StartAudit() error                      { return nil }
+func (d *stubDaemon) StopAudit() error                       { d.calls.add("StopAudit"); return nil }
+func (d *stubDaemon) ListRules() []string                    { return nil }
+func (d *stubDaemon) GetStatus() (Domain.AuditStatus, error) { return Domain.AuditStatus{}, nil }
+func (d *stubDaemon) RuleState() Domain.RuleSetState         { return Domain.RuleSetState{} }
+func (d *stubDaemon) Close()                                 { d.calls.add("Close") }
+
+func (d *stubDaemon) RestoreHost() error {
+	// restoring takes a while, Run must not return meanwhile
+	time.Sleep(50 * time.Millisecond)
+	d.calls.add("RestoreHost")
+	return nil
+}
+
+// stubJobs hands out a single job and records the messages sent.
+type stubJobs struct {
+	calls *calls
+	job   chan Job
+}
+
+func (j *stubJobs) PollJOB() (Job, error) {
+	select {
+	case job := <-j.job:
+		return job, nil
+	default:
+		return Job{}, nil
+	}
+}
+
+func (j *stubJobs) SendMessage(message interface{}, kind string) error {
+	j.calls.add(kind)
+	return nil
+}
+
+func (j *stubJobs) RenewCredentials() error        { return nil }
+func (j *stubJobs) StreamJobs(func(Job) Job) error { return ErrStreamUnsupported }
+
+func TestRunWaitsForDeRegister(t *testing.T) {
+	made := &calls{}
+	jobs := &stubJobs{calls: made, job: make(chan Job, 1)}
+	jobs.job <- Job{JobType: "ShutDown", JobID: uuid.New()}
+
+	var wait sync.WaitGroup
+	logger := LoggerInit(discard{}, discard{}, discard{})
+	agent, err := NewAgent(&stubDaemon{calls: made}, jobs, &wait, &logger, uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.IsRegistered = true
+	agent.Stream = false
+	exited := make(chan int, 1)
+	agent.Exit = func(code int) { exited <- code }
+
+	returned := make(chan struct{})
+	go func() {
+		agent.Run()
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didnt return after a ShutDown job")
+	}
+
+	for _, call := range []string{"StopAudit", "RestoreHost", "Close", "DeRegister"} {
+		if !made.has(call) {
+			t.Errorf("Run returned before %s, the process would end without it", call)
+		}
+	}
+	select {
+	case code := <-exited:
+		if code != 0 {
+			t.Errorf("exit status %d", code)
+		}
+	default:
+		t.Error("the agent didnt exit")
+	}
+}
+
+// refusingJobs answers every registration like a server the agent lost its
+// certificate for.
+type refusingJobs struct {
+	stubJobs
+}
+
+func (j *refusingJobs) SendMessage(message interface{}, kind string) error {
+	return fmt.Errorf("%w: 401 Unauthorized", ErrReenrollmentRequired)
+}
+
+// warnings counts the WARN lines logged.
+type warnings struct {
+	count int
+}
+
+func (w *warnings) Log(message string, level string) {
+	if level == WARN {
+		w.count++
+	}
+}
+
+func TestRegisterReportsReenrollmentOnce(t *testing.T) {
+	logged := &warnings{}
+	agent, err := NewAgent(&stubDaemon{calls: &calls{}}, &refusingJobs{}, &sync.WaitGroup{}, logged, uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := agent.heartbeat(); !errors.Is(err, ErrReenrollmentRequired) {
+			t.Fatalf("heartbeat returned %v", err)
+		}
+	}
+	if logged.count != 1 {
+		t.Errorf("logged %d warnings, want the refusal once", logged.count)
+	}
+	if wait := agent.nextPoll(ErrReenrollmentRequired); wait != agent.MaxBackoff {
+		t.Errorf("next registration attempt in %v, want %v", wait, agent.MaxBackoff)
+	}
+}
+
+// renewFailingJobs cant renew the certificate and records the job streams
+// opened.
+type renewFailingJobs struct {
+	stubJobs
+}
+
+func (j *renewFailingJobs) RenewCredentials() error {
+	return errors.New("certificate request rejected")
+}
+
+func (j *renewFailingJobs) StreamJobs(func(Job) Job) error {
+	j.calls.add("StreamJobs")
+	return ErrStreamUnsupported
+}
+
+func TestHeartbeatGoesOnWhenRenewalFails(t *testing.T) {
+	made := &calls{}
+	logged := &warnings{}
+	jobs := &renewFailingJobs{stubJobs{calls: made}}
+	agent, err := NewAgent(&stubDaemon{calls: made}, jobs, &sync.WaitGroup{}, logged, uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.IsRegistered = true
+	agent.Stream = true
+	agent.pendingReload = &Domain.ReloadReport{Source: "SIGHUP"}
+
+	if err := agent.heartbeat(); err != nil {
+		t.Fatalf("heartbeat returned %v", err)
+	}
+	if logged.count != 1 {
+		t.Errorf("logged %d warnings, want the failed renewal", logged.count)
+	}
+	if !made.has("SendReload") || agent.pendingReload != nil {
+		t.Errorf("the pending reload wasnt reported")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !made.has("StreamJobs") {
+		if time.Now().After(deadline) {
+			t.Fatal("the job stream wasnt opened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) { return len(p), nil }
+
+func TestNextPollBacksOff(t *testing.T) {
+	agent := &Agent{
+		PollInterval: 10 * time.Second,
+		MaxBackoff:   5 * time.Minute,
+		random:       rand.New(rand.NewSource(1)),
+	}
+	unreachable := fmt.Errorf("heartbeat failed: %w", ErrServerUnreachable)
+
+	// 20s, 40s, 80s, 160s and then the 5m cap
+	want := []time.Duration{20 * time.Second, 40 * time.Second, 80 * time.Second, 160 * time.Second, 5 * time.Minute, 5 * time.Minute}
+	for failure, backoff := range want {
+		waits := make(map[time.Duration]bool)
+		for sample := 0; sample < 100; sample++ {
+			agent.failures = failure
+			wait := agent.nextPoll(unreachable)
+			if wait < backoff/2 || wait > backoff {
+				t.Fatalf("failure %d: waiting %v, want within [%v, %v]", failure+1, wait, backoff/2, backoff)
+			}
+			waits[wait] = true
+		}
+		// agents failing together mustnt retry together
+		if len(waits) < 2 {
+			t.Errorf("failure %d: every wait is %v, there is no jitter", failure+1, backoff)
+		}
+	}
+
+	if wait := agent.nextPoll(nil); wait != agent.PollInterval {
+		t.Fatalf("after a successful poll waiting %v, want %v", wait, agent.PollInterval)
+	}
+	if wait := agent.nextPoll(unreachable); wait > want[0] {
+		t.Errorf("the backoff wasnt reset by the successful poll, waiting %v", wait)
+	}
+}
@@ -0,0 +1,53 @@
+package Usecases
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"audit-client/Domain"
+)
+
+// HostAuditFile is where the audit configuration the host had before the
+// agent started is kept, in the state directory.
+var HostAuditFile = "host-audit.json"
+
+// LoadHostAudit reads the audit configuration kept in path. It returns nil
+// when there is none, a file left there means the agent didnt stop cleanly
+// and the configuration wasnt put back yet.
+func LoadHostAudit(path string) (*Domain.HostAudit, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldnt read the kept host audit configuration: %v", err)
+	}
+	var host Domain.HostAudit
+	if err := json.Unmarshal(data, &host); err != nil {
+		return nil, fmt.Errorf("kept host audit configuration in %s is corrupt, it cant be restored until it is removed: %v", path, err)
+	}
+	return &host, nil
+}
+
+// SaveHostAudit keeps host in path, replacing it in one step so a crash
+// doesnt leave half a file behind.
+func SaveHostAudit(path string, host Domain.HostAudit) error {
+	data, err := json.MarshalIndent(host, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldnt encode the host audit configuration: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("couldnt create the state directory: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("couldnt keep the host audit configuration: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("couldnt keep the host audit configuration: %v", err)
+	}
+	return nil
+}
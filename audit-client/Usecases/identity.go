@@ -0,0 +1,69 @@
+package Usecases
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+var DefaultStateDir = "/var/lib/go-audit"
+
+// LoadAgentID returns the agent ID stored in stateDir, creating and storing a
+// new one on first start. The control server knows an agent by this ID, so a
+// restarted agent has to come back with the same one.
+func LoadAgentID(stateDir string) (uuid.UUID, error) {
+	idFile := filepath.Join(stateDir, "agent-id")
+
+	data, err := ioutil.ReadFile(idFile)
+	if err == nil {
+		uid, errP := uuid.Parse(strings.TrimSpace(string(data)))
+		if errP != nil {
+			return uuid.Nil, fmt.Errorf("agent id in %s is corrupt, remove it to enroll as a new agent: %v", idFile, errP)
+		}
+		return uid, nil
+	}
+	if !os.IsNotExist(err) {
+		return uuid.Nil, fmt.Errorf("couldnt read the agent id: %v", err)
+	}
+
+	if errM := os.MkdirAll(stateDir, 0700); errM != nil {
+		return uuid.Nil, fmt.Errorf("couldnt create the state directory: %v", errM)
+	}
+
+	uid := uuid.New()
+	tmp := idFile + ".tmp"
+	if errW := ioutil.WriteFile(tmp, []byte(uid.String()+"\n"), 0600); errW != nil {
+		return uuid.Nil, fmt.Errorf("couldnt write the agent id: %v", errW)
+	}
+	if errR := os.Rename(tmp, idFile); errR != nil {
+		return uuid.Nil, fmt.Errorf("couldnt write the agent id: %v", errR)
+	}
+	return uid, nil
+}
+
+// ParseLabels reads labels such as "env=prod,role=db,dc=ams1". The control
+// server matches them against the selectors of its groups and rule sets.
+// hostname and id are set by the server and cant be declared.
+func ParseLabels(value string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("label %q is not in key=value form", pair)
+		}
+		key, val := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if key == "hostname" || key == "id" {
+			return nil, fmt.Errorf("label %s is reserved", key)
+		}
+		labels[key] = val
+	}
+	return labels, nil
+}
@@ -0,0 +1,233 @@
+package Usecases
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"audit-client/Domain"
+)
+
+// SavedRulesFile is where SaveConfig writes the loaded rules, in the auditctl
+// format the agent reads at startup.
+var SavedRulesFile = "auditrules.rules"
+
+// RuleLine is a line of an auditctl rules file. Rule lines carry the rule,
+// control lines such as "-b 8192" carry the option in Control and its value.
+type RuleLine struct {
+	File    string
+	Line    int
+	Rule    string
+	Control string
+	Value   int
+}
+
+func (l RuleLine) String() string {
+	return l.File + ":" + strconv.Itoa(l.Line)
+}
+
+// controls are the auditctl options allowed in a rules file besides rules,
+// mapped to the highest value they take. -1 means the option has no value.
+var controls = map[string]int{
+	"-D":                  -1,
+	"-b":                  1<<31 - 1,
+	"-r":                  1<<31 - 1,
+	"-f":                  2,
+	"-e":                  2,
+	"--backlog_wait_time": 1<<31 - 1,
+	"-c":                  -1,
+	"-i":                  -1,
+}
+
+// ParseRules reads a rules file in the format of auditctl -R and augenrules:
+// one rule or control option per line, blank lines and lines starting with #
+// are skipped. name is only used in error messages.
+func ParseRules(r io.Reader, name string) ([]RuleLine, error) {
+	var lines []RuleLine
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		line := RuleLine{File: name, Line: n}
+		fields := strings.Fields(text)
+		switch fields[0] {
+		case "-a", "-A", "-w":
+			line.Rule = text
+			lines = append(lines, line)
+			continue
+		}
+
+		max, ok := controls[fields[0]]
+		if !ok {
+			return nil, fmt.Errorf("%v: unsupported option %s", line, fields[0])
+		}
+		line.Control = fields[0]
+		if max < 0 {
+			if len(fields) != 1 {
+				return nil, fmt.Errorf("%v: %s takes no value", line, fields[0])
+			}
+			lines = append(lines, line)
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%v: %s needs a single value", line, fields[0])
+		}
+		value, err := strconv.Atoi(fields[1])
+		if err != nil || value < 0 || value > max {
+			return nil, fmt.Errorf("%v: invalid %s value %q", line, fields[0], fields[1])
+		}
+		line.Value = value
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("couldnt read %s: %v", name, err)
+	}
+	return lines, nil
+}
+
+// LoadRules reads the rules at path. A directory such as /etc/audit/rules.d
+// is read the way augenrules does, all its *.rules files merged in lexical
+// order. Files holding JSON, either {"audit_rules": [...]} or a bare array
+// from older SaveConfig versions, are read as a list of rules.
+func LoadRules(path string) ([]RuleLine, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("cant ReadFile: %w", err)
+	}
+	if !info.IsDir() {
+		return loadRuleFile(path)
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "*.rules"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .rules files found in %s", path)
+	}
+	var lines []RuleLine
+	for _, file := range files {
+		fileLines, err := loadRuleFile(file)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, fileLines...)
+	}
+	return lines, nil
+}
+
+func loadRuleFile(filename string) ([]RuleLine, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cant ReadFile: %w", err)
+	}
+	trimmed := strings.TrimSpace(string(buf))
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		return ParseRules(strings.NewReader(string(buf)), filename)
+	}
+
+	var rules []string
+	if strings.HasPrefix(trimmed, "{") {
+		var doc struct {
+			AuditRules []string `json:"audit_rules"`
+		}
+		err = json.Unmarshal(buf, &doc)
+		rules = doc.AuditRules
+	} else {
+		err = json.Unmarshal(buf, &rules)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cant unmarshal: %w", err)
+	}
+	lines := make([]RuleLine, 0, len(rules))
+	for i, rule := range rules {
+		lines = append(lines, RuleLine{File: filename, Line: i + 1, Rule: rule})
+	}
+	return lines, nil
+}
+
+// RuleList returns the kernel filter list rule goes to, such as exit or
+// exclude, watches are exit rules. The kernel keeps the order of every list,
+// rules of different lists dont affect each other.
+func RuleList(rule string) string {
+	fields := strings.Fields(rule)
+	if len(fields) == 0 {
+		return ""
+	}
+	switch fields[0] {
+	case "-w":
+		return "exit"
+	case "-a", "-A":
+		if len(fields) < 2 {
+			return ""
+		}
+		for _, part := range strings.Split(fields[1], ",") {
+			if part != "always" && part != "never" {
+				return part
+			}
+		}
+	}
+	return ""
+}
+
+// IsPrepend tells whether rule is an -A rule, loaded in front of its list.
+func IsPrepend(rule string) bool {
+	return strings.HasPrefix(strings.TrimSpace(rule), "-A ")
+}
+
+// AsAppend returns an -A rule as the -a rule appending it to its list, other
+// rules as they are. Both build the same kernel rule.
+func AsAppend(rule string) string {
+	if !IsPrepend(rule) {
+		return rule
+	}
+	return "-a " + strings.TrimSpace(rule)[len("-A "):]
+}
+
+// RulesHash is the hex SHA-256 of a rule set. The rules are sorted first so
+// the order they were loaded in doesnt change it, the control server hashes
+// the rules it recorded for an agent the same way.
+func RulesHash(rules []string) string {
+	sorted := append([]string(nil), rules...)
+	sort.Strings(sorted)
+	h := sha256.New()
+	for _, rule := range sorted {
+		io.WriteString(h, rule)
+		io.WriteString(h, "\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// WriteRules writes rules as an auditctl rules file LoadRules reads back. With
+// a status the kernel tuning goes in as control lines before the rules.
+func WriteRules(w io.Writer, status *Domain.AuditStatus, rules []string) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "## Saved by the go-audit agent at %s\n", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintln(b, "-D")
+	if status != nil {
+		fmt.Fprintf(b, "-b %d\n", status.BacklogLimit)
+		fmt.Fprintf(b, "-f %d\n", status.Failure)
+		fmt.Fprintf(b, "-r %d\n", status.RateLimit)
+		if status.BacklogWaitTime != 0 {
+			fmt.Fprintf(b, "--backlog_wait_time %d\n", status.BacklogWaitTime)
+		}
+	}
+	for _, rule := range rules {
+		fmt.Fprintln(b, rule)
+	}
+	return b.Flush()
+}
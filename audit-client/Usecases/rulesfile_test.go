@@ -0,0 +1,153 @@
+package Usecases
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"audit-client/Domain"
+)
+
+// summary writes the lines back the way they were read, without where they
+// came from.
+func summary(lines []RuleLine) []string {
+	var out []string
+	for _, line := range lines {
+		switch {
+		case line.Rule != "":
+			out = append(out, line.Rule)
+		case controls[line.Control] < 0:
+			out = append(out, line.Control)
+		default:
+			out = append(out, line.Control+" "+strconv.Itoa(line.Value))
+		}
+	}
+	return out
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteRulesRoundTrip(t *testing.T) {
+	status := &Domain.AuditStatus{BacklogLimit: 8192, Failure: 2, RateLimit: 100, BacklogWaitTime: 60000}
+	rules := []string{
+		"-A exclude,always -F msgtype=CWD",
+		"-w /etc/passwd -p wa -k identity",
+		"-a always,exit -F arch=b64 -S execve -k exec",
+	}
+
+	var buf bytes.Buffer
+	if err := WriteRules(&buf, status, rules); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "audit.rules")
+	writeFile(t, path, buf.String())
+
+	lines, err := LoadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]string{"-D", "-b 8192", "-f 2", "-r 100", "--backlog_wait_time 60000"}, rules...)
+	if got := summary(lines); !reflect.DeepEqual(got, want) {
+		t.Fatalf("read back %q, want %q", got, want)
+	}
+	// the comment WriteRules starts with takes the first line
+	if lines[0].Line != 2 || lines[0].File != path {
+		t.Errorf("first line is %v", lines[0])
+	}
+
+	// without a status only the rules follow -D
+	buf.Reset()
+	WriteRules(&buf, nil, rules)
+	writeFile(t, path, buf.String())
+	lines, err = LoadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := summary(lines); !reflect.DeepEqual(got, append([]string{"-D"}, rules...)) {
+		t.Errorf("read back %q", got)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	text := strings.Join([]string{
+		"# comment",
+		"",
+		"  ## indented comment",
+		"-D",
+		"-e 2",
+		"-f 1",
+		"  -w /etc/shadow -p r  ",
+	}, "\n")
+	lines, err := ParseRules(strings.NewReader(text), "test.rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"-D", "-e 2", "-f 1", "-w /etc/shadow -p r"}
+	if got := summary(lines); !reflect.DeepEqual(got, want) {
+		t.Fatalf("parsed %q, want %q", got, want)
+	}
+	if lines[1].String() != "test.rules:5" {
+		t.Errorf("-e 2 came from %v", lines[1])
+	}
+
+	for _, bad := range []string{"-f 3", "-e 3", "-e", "-b -1", "-b many", "-D now", "-l"} {
+		if _, err := ParseRules(strings.NewReader(bad), "bad.rules"); err == nil {
+			t.Errorf("%q parsed", bad)
+		} else if !strings.HasPrefix(err.Error(), "bad.rules:1: ") {
+			t.Errorf("%q failed with %v", bad, err)
+		}
+	}
+}
+
+// TestLoadRulesDirectory merges a rules.d directory the way augenrules does.
+func TestLoadRulesDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "99-finalize.rules"), "-e 2\n")
+	writeFile(t, filepath.Join(dir, "10-base.rules"), "-D\n-b 8192\n")
+	writeFile(t, filepath.Join(dir, "30-identity.rules"), "# identity\n-w /etc/passwd -p wa\n")
+	writeFile(t, filepath.Join(dir, "README"), "-w /not/a/rule\n")
+
+	lines, err := LoadRules(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"-D", "-b 8192", "-w /etc/passwd -p wa", "-e 2"}
+	if got := summary(lines); !reflect.DeepEqual(got, want) {
+		t.Fatalf("merged %q, want %q", got, want)
+	}
+	if got := lines[2].String(); got != filepath.Join(dir, "30-identity.rules")+":2" {
+		t.Errorf("watch came from %s", got)
+	}
+
+	if _, err := LoadRules(t.TempDir()); err == nil {
+		t.Errorf("empty directory loaded")
+	}
+}
+
+func TestLoadRulesJSON(t *testing.T) {
+	rules := []string{"-w /etc/passwd -p wa", "-a always,exit -S execve"}
+	for name, content := range map[string]string{
+		"array":  `["-w /etc/passwd -p wa", "-a always,exit -S execve"]`,
+		"object": `{"audit_rules": ["-w /etc/passwd -p wa", "-a always,exit -S execve"]}`,
+	} {
+		path := filepath.Join(t.TempDir(), "auditrules.rules")
+		writeFile(t, path, "\n"+content+"\n")
+		lines, err := LoadRules(path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got := summary(lines); !reflect.DeepEqual(got, rules) {
+			t.Errorf("%s read %q", name, got)
+		}
+	}
+}
@@ -0,0 +1,509 @@
+package Usecases
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	defaultSinkBuffer        = 1000
+	defaultSinkFlushInterval = time.Second
+	spoolReplayBatch         = 500
+	maxSpoolRetryInterval    = 30 * time.Second
+)
+
+// EventSink is a destination for audit events. A sink is only ever used from
+// the goroutine of its own queue so implementations dont need to lock.
+type EventSink interface {
+	Name() string
+	Write([]byte) error
+	Flush() error
+	Close() error
+}
+
+// batchSink is a sink that collects events until it is flushed. Full tells
+// the queue a batch is complete, the queue then flushes it itself so it knows
+// which of its events were delivered.
+type batchSink interface {
+	Full() bool
+}
+
+// PartialFlushError is returned by a sink that delivered only the first
+// Delivered events written since its last flush. The queue spools the rest.
+type PartialFlushError struct {
+	Delivered int
+	Err       error
+}
+
+func (e *PartialFlushError) Error() string {
+	return fmt.Sprintf("only %d events were delivered: %v", e.Delivered, e.Err)
+}
+
+func (e *PartialFlushError) Unwrap() error {
+	return e.Err
+}
+
+// delivered returns how many of the events written since the last flush a
+// failed write or flush still delivered.
+func delivered(err error, events int) int {
+	var partial *PartialFlushError
+	if !errors.As(err, &partial) || partial.Delivered < 0 {
+		return 0
+	}
+	if partial.Delivered > events {
+		return events
+	}
+	return partial.Delivered
+}
+
+// Spool holds events on disk while a sink is unavailable. It is consumed in
+// order: Peek returns the oldest events and Commit removes what was peeked.
+// Publish appends to it from the workers while the queue reads it, so
+// implementations must be safe for concurrent use.
+type Spool interface {
+	Append([]byte) error
+	Peek(int) ([][]byte, error)
+	Commit() error
+	Depth() (int, int64)
+	Evicted() uint64
+	Close() error
+}
+
+type SinkConfig struct {
+	Type          string `json:"type"`
+	Address       string `json:"address"`
+	Buffer        int    `json:"buffer"`
+	FlushInterval string `json:"flush_interval"`
+	MaxSize       int64  `json:"max_size"`
+	MaxBackups    int    `json:"max_backups"`
+	Spool         bool   `json:"spool"`
+	SpoolMaxSize  int64  `json:"spool_max_size"`
+	BatchSize     int    `json:"batch_size"`
+}
+
+type SinkStats struct {
+	Name        string
+	Queued      int
+	Written     uint64
+	Dropped     uint64
+	Errors      uint64
+	SpoolEvents int
+	SpoolBytes  int64
+	Evicted     uint64
+}
+
+// DefaultSinkConfigs keeps the behaviour the agent had before sinks were
+// configurable: events go to filebeat and are echoed on stdout.
+func DefaultSinkConfigs() []SinkConfig {
+	return []SinkConfig{
+		{Type: "unix", Address: "/var/run/filebeat.sock", Spool: true},
+		{Type: "stdout"},
+	}
+}
+
+// LoadSinkConfigs reads a JSON array of sink configurations. An empty
+// filename returns the default sinks.
+func LoadSinkConfigs(filename string) ([]SinkConfig, error) {
+	if filename == "" {
+		return DefaultSinkConfigs(), nil
+	}
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cant read sink config: %w", err)
+	}
+
+	var configs []SinkConfig
+	if err := json.Unmarshal(buf, &configs); err != nil {
+		return nil, fmt.Errorf("cant unmarshal sink config: %w", err)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no sinks were configured in %s", filename)
+	}
+	return configs, nil
+}
+
+type sinkQueue struct {
+	sink          EventSink
+	spool         Spool
+	queue         chan []byte
+	flushInterval time.Duration
+	written       uint64
+	dropped       uint64
+	failed        uint64
+	quit          chan bool
+	done          chan bool
+
+	// lock orders what Publish and the queue append to the spool
+	lock sync.Mutex
+	// set while the spool holds events, Publish then appends new events to
+	// it directly so they go behind them and the queue stays empty
+	spooling bool
+	// failed events that are older than what Publish spooled in the
+	// meantime, replay sends them before the spool
+	retry [][]byte
+
+	// events written to the sink since the last successful flush, they are
+	// spooled if the flush fails
+	unflushed [][]byte
+	retries   int
+	nextRetry time.Time
+}
+
+func (q *sinkQueue) run() {
+	defer close(q.done)
+	ticker := time.NewTicker(q.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-q.queue:
+			q.write(event)
+		case <-ticker.C:
+			q.flush()
+			q.replay()
+		case <-q.quit:
+			for {
+				select {
+				case event := <-q.queue:
+					q.write(event)
+				default:
+					q.flush()
+					q.close()
+					return
+				}
+			}
+		}
+	}
+}
+
+// close gives the sink one more chance to take the events replay would have
+// sent before the spool. What it doesnt take is spooled behind the newer
+// events, the spool cant put them in front.
+func (q *sinkQueue) close() {
+	if len(q.retry) > 0 {
+		n, err := q.send(q.retry)
+		if err != nil {
+			q.fail(err)
+		}
+		q.lock.Lock()
+		for _, event := range q.retry[n:] {
+			q.append(event)
+		}
+		q.retry = nil
+		q.lock.Unlock()
+	}
+	if err := q.sink.Close(); err != nil {
+		log.Printf("couldnt close sink %s: %v", q.sink.Name(), err)
+	}
+	if q.spool != nil {
+		q.spool.Close()
+	}
+}
+
+// publish queues the event without waiting for the sink. When the queue is
+// full the event is spooled behind the queued ones, it is only dropped for a
+// sink without a spool.
+func (q *sinkQueue) publish(event []byte) {
+	if q.spool == nil {
+		select {
+		case q.queue <- event:
+		default:
+			atomic.AddUint64(&q.dropped, 1)
+		}
+		return
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.spooling {
+		select {
+		case q.queue <- event:
+			return
+		default:
+			q.spoolQueued()
+		}
+	}
+	q.append(event)
+}
+
+// spoolQueued moves the queued events to the spool and has Publish append to
+// it from then on. Callers hold q.lock.
+func (q *sinkQueue) spoolQueued() {
+	for {
+		select {
+		case event := <-q.queue:
+			q.append(event)
+		default:
+			q.spooling = true
+			return
+		}
+	}
+}
+
+// append adds an event to the spool. Callers hold q.lock.
+func (q *sinkQueue) append(event []byte) {
+	if err := q.spool.Append(event); err != nil {
+		atomic.AddUint64(&q.dropped, 1)
+		q.fail(err)
+	}
+}
+
+func (q *sinkQueue) fail(err error) {
+	if n := atomic.AddUint64(&q.failed, 1); n == 1 || n%1000 == 0 {
+		log.Printf("sink %s failed (%d errors so far): %v", q.sink.Name(), n, err)
+	}
+}
+
+// write sends a queued event to the sink. Queued events are older than
+// everything in the spool: the queue is emptied into the spool before
+// anything else is appended to it.
+func (q *sinkQueue) write(event []byte) {
+	if err := q.sink.Write(event); err != nil {
+		q.fail(err)
+		events := append(q.unflushed, event)
+		q.unflushed = nil
+		q.keep(events[delivered(err, len(events)):])
+		return
+	}
+	if q.spool != nil {
+		q.unflushed = append(q.unflushed, event)
+	}
+	atomic.AddUint64(&q.written, 1)
+	if q.full() {
+		q.flush()
+	}
+}
+
+func (q *sinkQueue) full() bool {
+	b, ok := q.sink.(batchSink)
+	return ok && b.Full()
+}
+
+func (q *sinkQueue) flush() {
+	if err := q.sink.Flush(); err != nil {
+		q.fail(err)
+		q.keep(q.unflushed[delivered(err, len(q.unflushed)):])
+	}
+	q.unflushed = nil
+}
+
+// keep holds on to the events the sink failed to take, they are dropped for
+// a sink without a spool. While the spool is empty they go to it followed by
+// the queued events. Otherwise Publish already spooled newer events and
+// replay sends them first.
+func (q *sinkQueue) keep(events [][]byte) {
+	if len(events) == 0 {
+		return
+	}
+	if q.spool == nil {
+		atomic.AddUint64(&q.dropped, uint64(len(events)))
+		return
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.spooling {
+		q.retry = append(q.retry, events...)
+		return
+	}
+	for _, event := range events {
+		q.append(event)
+	}
+	q.spoolQueued()
+}
+
+// send writes events to the sink and flushes them, flushing in between
+// whenever a batch is full. When that fails it returns how many of them were
+// delivered.
+func (q *sinkQueue) send(events [][]byte) (int, error) {
+	var err error
+	written, flushed := 0, 0
+	for _, event := range events {
+		written++
+		if err = q.sink.Write(event); err != nil {
+			break
+		}
+		if q.full() {
+			if err = q.sink.Flush(); err != nil {
+				break
+			}
+			flushed = written
+		}
+	}
+	if err == nil {
+		err = q.sink.Flush()
+	}
+	if err != nil {
+		return flushed + delivered(err, written-flushed), err
+	}
+	return len(events), nil
+}
+
+// retryLater backs off after a failed replay so a dead sink isnt redialed
+// every flush.
+func (q *sinkQueue) retryLater(err error) {
+	q.fail(err)
+	q.retries++
+	delay := q.flushInterval * time.Duration(q.retries)
+	if delay > maxSpoolRetryInterval {
+		delay = maxSpoolRetryInterval
+	}
+	q.nextRetry = time.Now().Add(delay)
+}
+
+// replay sends the failed events kept in memory and then the spooled ones to
+// the sink in order. A failed attempt is retried with a growing delay.
+func (q *sinkQueue) replay() {
+	if q.spool == nil || time.Now().Before(q.nextRetry) {
+		return
+	}
+	q.lock.Lock()
+	spooling := q.spooling
+	q.lock.Unlock()
+	if !spooling && len(q.retry) == 0 {
+		return
+	}
+
+	if len(q.retry) > 0 {
+		n, err := q.send(q.retry)
+		atomic.AddUint64(&q.written, uint64(n))
+		q.retry = q.retry[n:]
+		if err != nil {
+			q.retryLater(err)
+			return
+		}
+		q.retry = nil
+	}
+
+	for {
+		events, err := q.spool.Peek(spoolReplayBatch)
+		if err != nil {
+			q.fail(err)
+			return
+		}
+		if len(events) == 0 {
+			// Publish appends under the lock, once the spool is still empty
+			// with it held new events can take the queue again
+			q.lock.Lock()
+			if depth, _ := q.spool.Depth(); depth == 0 {
+				q.spooling = false
+				q.retries = 0
+			}
+			q.lock.Unlock()
+			return
+		}
+
+		n, err := q.send(events)
+		if n > 0 {
+			// take the events the sink delivered off the spool
+			if n < len(events) {
+				if _, errP := q.spool.Peek(n); errP != nil {
+					q.fail(errP)
+					return
+				}
+			}
+			if errC := q.spool.Commit(); errC != nil {
+				q.fail(errC)
+				return
+			}
+			atomic.AddUint64(&q.written, uint64(n))
+		}
+		if err != nil {
+			q.retryLater(err)
+			return
+		}
+	}
+}
+
+// SinkDispatcher fans every event out to all configured sinks. Each sink has
+// its own bounded queue so a slow or broken sink cant hold up the others.
+type SinkDispatcher struct {
+	queues []*sinkQueue
+	once   sync.Once
+}
+
+func NewSinkDispatcher() *SinkDispatcher {
+	return &SinkDispatcher{}
+}
+
+// Add starts a queue for the sink using the buffer and flush interval of cfg.
+// Events the sink cant take are kept in spool, which may be nil.
+func (d *SinkDispatcher) Add(sink EventSink, cfg SinkConfig, spool Spool) error {
+	buffer := cfg.Buffer
+	if buffer <= 0 {
+		buffer = defaultSinkBuffer
+	}
+
+	interval := defaultSinkFlushInterval
+	if cfg.FlushInterval != "" {
+		i, err := time.ParseDuration(cfg.FlushInterval)
+		if err != nil || i <= 0 {
+			return fmt.Errorf("invalid flush interval for sink %s: %q", sink.Name(), cfg.FlushInterval)
+		}
+		interval = i
+	}
+
+	q := &sinkQueue{
+		sink:          sink,
+		spool:         spool,
+		queue:         make(chan []byte, buffer),
+		flushInterval: interval,
+		quit:          make(chan bool),
+		done:          make(chan bool),
+	}
+	if spool != nil {
+		events, _ := spool.Depth()
+		q.spooling = events > 0
+	}
+	d.queues = append(d.queues, q)
+	go q.run()
+	return nil
+}
+
+// Publish hands the event to every sink without waiting for a slow one. When
+// a sink's queue is full the queued events and this one are appended to its
+// spool in order, it is dropped and counted only for sinks without a spool or
+// when the spool fails.
+func (d *SinkDispatcher) Publish(event []byte) {
+	for _, q := range d.queues {
+		q.publish(event)
+	}
+}
+
+func (d *SinkDispatcher) Stats() []SinkStats {
+	stats := make([]SinkStats, 0, len(d.queues))
+	for _, q := range d.queues {
+		stat := SinkStats{
+			Name:    q.sink.Name(),
+			Queued:  len(q.queue),
+			Written: atomic.LoadUint64(&q.written),
+			Dropped: atomic.LoadUint64(&q.dropped),
+			Errors:  atomic.LoadUint64(&q.failed),
+		}
+		if q.spool != nil {
+			stat.SpoolEvents, stat.SpoolBytes = q.spool.Depth()
+			stat.Evicted = q.spool.Evicted()
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+// Close drains every queue, flushes and closes the sinks.
+func (d *SinkDispatcher) Close() {
+	d.once.Do(func() {
+		for _, q := range d.queues {
+			close(q.quit)
+		}
+		for _, q := range d.queues {
+			<-q.done
+		}
+	})
+}
@@ -0,0 +1,255 @@
+package Usecases
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockedSink doesnt return from its first Write until release is closed, so
+// its queue fills up.
+type blockedSink struct {
+	release chan struct{}
+	lock    sync.Mutex
+	written int
+}
+
+func (s *blockedSink) Name() string { return "blocked" }
+func (s *blockedSink) Flush() error { return nil }
+func (s *blockedSink) Close() error { return nil }
+
+func (s *blockedSink) Write([]byte) error {
+	<-s.release
+	s.lock.Lock()
+	s.written++
+	s.lock.Unlock()
+	return nil
+}
+
+// memorySpool keeps the spooled events in memory.
+type memorySpool struct {
+	lock   sync.Mutex
+	events [][]byte
+	peeked int
+}
+
+func (s *memorySpool) Append(event []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *memorySpool) Peek(max int) ([][]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if max > len(s.events) {
+		max = len(s.events)
+	}
+	s.peeked = max
+	return append([][]byte(nil), s.events[:max]...), nil
+}
+
+func (s *memorySpool) Commit() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.events = s.events[s.peeked:]
+	s.peeked = 0
+	return nil
+}
+
+func (s *memorySpool) Depth() (int, int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.events), 0
+}
+
+func (s *memorySpool) Evicted() uint64 { return 0 }
+func (s *memorySpool) Close() error    { return nil }
+
+func TestPublishSpoolsWhenTheQueueIsFull(t *testing.T) {
+	spooled := &blockedSink{release: make(chan struct{})}
+	plain := &blockedSink{release: make(chan struct{})}
+	spool := &memorySpool{}
+
+	d := NewSinkDispatcher()
+	cfg := SinkConfig{Buffer: 2, FlushInterval: "1h"}
+	if err := d.Add(spooled, cfg, spool); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Add(plain, cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// one event is stuck in Write, two wait in the queue, the rest dont fit
+	const events = 10
+	for i := 0; i < events; i++ {
+		d.Publish([]byte("event"))
+	}
+
+	stats := d.Stats()
+	if stats[0].Dropped != 0 {
+		t.Errorf("the spooled sink dropped %d events", stats[0].Dropped)
+	}
+	if depth, _ := spool.Depth(); depth < events-3 {
+		t.Errorf("the spool holds %d events, want at least %d", depth, events-3)
+	}
+	if stats[1].Dropped < events-3 {
+		t.Errorf("the sink without spool dropped %d events, want at least %d", stats[1].Dropped, events-3)
+	}
+
+	close(spooled.release)
+	close(plain.release)
+	d.Close()
+
+	// Close doesnt replay, what isnt written yet stays in the spool
+	depth, _ := spool.Depth()
+	if spooled.written+depth != events {
+		t.Errorf("%d events written and %d spooled, want %d", spooled.written, depth, events)
+	}
+}
+
+// cutSink takes every write and then delivers only the first events of the
+// batch when it is flushed.
+type cutSink struct {
+	delivered int
+}
+
+func (s *cutSink) Name() string       { return "cut" }
+func (s *cutSink) Write([]byte) error { return nil }
+func (s *cutSink) Close() error       { return nil }
+
+func (s *cutSink) Flush() error {
+	return &PartialFlushError{Delivered: s.delivered, Err: errors.New("batch was cut off")}
+}
+
+func TestPartialFlushSpoolsTheEventsAfterTheCut(t *testing.T) {
+	spool := &memorySpool{}
+	q := &sinkQueue{sink: &cutSink{delivered: 1}, spool: spool, flushInterval: time.Hour}
+	for _, event := range []string{"a", "b", "c"} {
+		q.write([]byte(event))
+	}
+	q.flush()
+
+	events, _ := spool.Peek(10)
+	if len(events) != 2 || string(events[0]) != "b" || string(events[1]) != "c" {
+		t.Fatalf("spooled %q, want the two events after the cut", events)
+	}
+	if !q.spooling {
+		t.Error("the queue didnt switch over to the spool")
+	}
+}
+
+// batchingSink is full after every two writes and fails its flushes once
+// down is set.
+type batchingSink struct {
+	pending   int
+	delivered []string
+	batch     []string
+	down      bool
+}
+
+func (s *batchingSink) Name() string { return "batching" }
+func (s *batchingSink) Close() error { return nil }
+func (s *batchingSink) Full() bool   { return s.pending >= 2 }
+
+func (s *batchingSink) Write(event []byte) error {
+	s.pending++
+	s.batch = append(s.batch, string(event))
+	return nil
+}
+
+func (s *batchingSink) Flush() error {
+	batch := s.batch
+	s.pending, s.batch = 0, nil
+	if s.down {
+		return errors.New("sink is down")
+	}
+	s.delivered = append(s.delivered, batch...)
+	return nil
+}
+
+func TestFlushedBatchesArentSpooledAgain(t *testing.T) {
+	spool := &memorySpool{}
+	sink := &batchingSink{}
+	q := &sinkQueue{sink: sink, spool: spool, flushInterval: time.Hour}
+	q.write([]byte("a"))
+	q.write([]byte("b"))
+	if len(q.unflushed) != 0 {
+		t.Fatalf("%d events are unflushed after the batch went out", len(q.unflushed))
+	}
+
+	sink.down = true
+	q.write([]byte("c"))
+	q.flush()
+
+	events, _ := spool.Peek(10)
+	if len(events) != 1 || string(events[0]) != "c" {
+		t.Fatalf("spooled %q, want only the event of the failed batch", events)
+	}
+	if len(sink.delivered) != 2 {
+		t.Errorf("delivered %q", sink.delivered)
+	}
+}
+
+// recordingSink keeps what it was sent, its first Write waits for release.
+type recordingSink struct {
+	release chan struct{}
+	lock    sync.Mutex
+	events  []string
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+func (s *recordingSink) Flush() error { return nil }
+func (s *recordingSink) Close() error { return nil }
+
+func (s *recordingSink) Write(event []byte) error {
+	<-s.release
+	s.lock.Lock()
+	s.events = append(s.events, string(event))
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *recordingSink) sent() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.events...)
+}
+
+func TestOverflowedEventsAreReplayedInOrder(t *testing.T) {
+	sink := &recordingSink{release: make(chan struct{})}
+	spool := &memorySpool{}
+	d := NewSinkDispatcher()
+	if err := d.Add(sink, SinkConfig{Buffer: 2, FlushInterval: "10ms"}, spool); err != nil {
+		t.Fatal(err)
+	}
+
+	const events = 10
+	var want []string
+	for i := 0; i < events; i++ {
+		event := strconv.Itoa(i)
+		want = append(want, event)
+		d.Publish([]byte(event))
+	}
+	close(sink.release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.sent()) < events && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the spool switched over, new events go behind it
+	d.Publish([]byte("new"))
+	d.Close()
+
+	got := sink.sent()
+	if len(got) < events || !reflect.DeepEqual(got[:events], want) {
+		t.Fatalf("sink got %q, want %q in order", got, want)
+	}
+	if depth, _ := spool.Depth(); len(got)+depth != events+1 {
+		t.Errorf("%d events sent and %d spooled, want %d", len(got), depth, events+1)
+	}
+}
@@ -1,15 +1,11 @@
 package Usecases
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
-	"log"
-	"net"
+	"sync"
 )
 
-var auditlog chan []byte
-
 type GeneralInfo struct {
 	Serial   uint64
 	Data     map[string]*json.RawMessage
@@ -25,92 +21,83 @@ type WorkerPool struct {
 	Pool       chan chan Event
 	JobQueue   chan Event
 	MaxWorkers int
+	Sinks      *SinkDispatcher
 	workers    []*Worker
+	// running counts the workers that didnt return yet
+	running sync.WaitGroup
+	// dispatching counts the events handed to a worker that it didnt take yet
+	dispatching sync.WaitGroup
+	quit        chan bool
+	drained     chan bool
+	stop        sync.Once
 }
 
 func NewPool(maxWorkers int, queue chan Event) *WorkerPool {
 	pool := make(chan chan Event, maxWorkers)
-	return &WorkerPool{Pool: pool, JobQueue: queue, MaxWorkers: maxWorkers}
+	return &WorkerPool{Pool: pool, JobQueue: queue, MaxWorkers: maxWorkers, quit: make(chan bool), drained: make(chan bool)}
 }
 
+// ShutDown hands the queued events to the workers, stops them once they took
+// every one and closes the sinks when none of them publishes anymore. Whoever
+// fills JobQueue has to be stopped first.
 func (p *WorkerPool) ShutDown() {
-	for _, w := range p.workers {
-		w.Stop()
-	}
+	p.stop.Do(func() {
+		close(p.quit)
+		if len(p.workers) > 0 {
+			<-p.drained
+		}
+		for _, w := range p.workers {
+			w.Stop()
+		}
+		p.running.Wait()
+		if p.Sinks != nil {
+			p.Sinks.Close()
+		}
+	})
 }
 
-func (p *WorkerPool) InitializeWorkers(j JobManager) {
+func (p *WorkerPool) InitializeWorkers(j JobManager, sinks *SinkDispatcher) {
+	p.Sinks = sinks
 	for i := 0; i < p.MaxWorkers; i++ {
-		worker := NewWorker(p.Pool, j)
+		worker := NewWorker(p.Pool, j, sinks)
+		worker.running = &p.running
 		p.workers = append(p.workers, worker)
+		p.running.Add(1)
 		worker.Start()
 	}
-	auditlog = make(chan []byte)
 
-	go logUnixSocket()
 	go p.ExecuteQueue()
 }
 
+// ExecuteQueue hands every queued event to the next idle worker. On ShutDown
+// it empties the queue and returns once the workers took all of it.
 func (p *WorkerPool) ExecuteQueue() {
+	defer close(p.drained)
 	for {
 		select {
 		case e := <-p.JobQueue:
-			go func(e Event) {
-				worker := <-p.Pool
-				worker <- e
-			}(e)
-		}
-	}
-}
-
-// func Logaudit() {
-// 	var auditWriter *bufio.Writer
-
-// 	logfile, errP := os.OpenFile("/var/log/audit-data.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-// 	if errP != nil {
-// 		log.Printf("Couldnt open/create the file: " + errP.Error())
-// 		return
-// 	}
-
-// 	auditWriter = bufio.NewWriter(logfile)
-
-// 	for event := range auditlog {
-// 		auditWriter.Write(event)
-// 		auditWriter.Write([]byte("\n"))
-// 		unflushedBufferSize := auditWriter.Buffered()
-// 		if unflushedBufferSize >= 3500 {
-// 			errF := auditWriter.Flush()
-// 			if errF != nil {
-// 				log.Printf("couldnt write buffered process names to disk: " + errF.Error())
-// 			}
-// 		}
-// 	}
-// }
-
-func logUnixSocket() {
-
-	var auditWriter *bufio.Writer
-
-	c, err := net.Dial("unix", "/var/run/filebeat.sock")
-	if err != nil {
-		log.Printf("Couldnt open the unix socket: " + err.Error())
-	}
-	defer c.Close()
-
-	auditWriter = bufio.NewWriter(c)
-
-	for event := range auditlog {
-		auditWriter.Write(event)
-		auditWriter.Write([]byte("\n"))
-		unflushedBufferSize := auditWriter.Buffered()
-		if unflushedBufferSize >= 3500 {
-			errF := auditWriter.Flush()
-			if errF != nil {
-				log.Printf("couldnt write buffered process names to disk: " + errF.Error())
+			p.dispatch(e)
+		case <-p.quit:
+			for {
+				select {
+				case e := <-p.JobQueue:
+					p.dispatch(e)
+				default:
+					p.dispatching.Wait()
+					return
+				}
 			}
 		}
 	}
+}
 
+func (p *WorkerPool) dispatch(e Event) {
+	p.dispatching.Add(1)
+	go func() {
+		defer p.dispatching.Done()
+		worker := <-p.Pool
+		worker <- e
+	}()
 }
 
 type Worker struct {
@@ -118,20 +105,29 @@ type Worker struct {
 	JobChannel  chan Event
 	QuitChannel chan bool
 	jobManager  JobManager
+	sinks       *SinkDispatcher
+	// running is told when the worker returns
+	running *sync.WaitGroup
 }
 
 func (w *Worker) Start() {
 	go func() {
 		defer func() {
-			fmt.Println("Worker is getting killed which is not anticipated.")
+			select {
+			case <-w.QuitChannel:
+			default:
+				fmt.Println("Worker is getting killed which is not anticipated.")
+			}
 		}()
+		if w.running != nil {
+			defer w.running.Done()
+		}
 		//buf := new(bytes.Buffer)
 		for {
 			w.WorkerPool <- w.JobChannel
 			select {
 			case e := <-w.JobChannel:
-				auditlog <- e.Data
-				fmt.Println(string(e.Data))
+				w.sinks.Publish(e.Data)
 				//send log to kibana
 				// buf.Write(e.Data)
 				// fmt.Println(buf.Len())
@@ -160,12 +156,12 @@ func (w *Worker) Start() {
 	}()
 }
 
+// Stop tells the worker to return, an event it is publishing is finished
+// first.
 func (w *Worker) Stop() {
-	go func() {
-		w.QuitChannel <- true
-	}()
+	close(w.QuitChannel)
 }
 
-func NewWorker(Pool chan chan Event, c JobManager) *Worker {
-	return &Worker{WorkerPool: Pool, JobChannel: make(chan Event), QuitChannel: make(chan bool), jobManager: c}
+func NewWorker(Pool chan chan Event, c JobManager, sinks *SinkDispatcher) *Worker {
+	return &Worker{WorkerPool: Pool, JobChannel: make(chan Event), QuitChannel: make(chan bool), jobManager: c, sinks: sinks}
 }
@@ -0,0 +1,42 @@
+package Usecases
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestShutDownPublishesTheQueuedEvents(t *testing.T) {
+	sink := &recordingSink{release: make(chan struct{})}
+	close(sink.release)
+	sinks := NewSinkDispatcher()
+	if err := sinks.Add(sink, SinkConfig{Buffer: 1000, FlushInterval: "1h"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	const events = 500
+	queue := make(chan Event, events)
+	pool := NewPool(4, queue)
+	pool.InitializeWorkers(nil, sinks)
+	for i := 0; i < events; i++ {
+		queue <- Event{Data: []byte(strconv.Itoa(i))}
+	}
+
+	done := make(chan bool)
+	go func() {
+		pool.ShutDown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ShutDown didnt return")
+	}
+
+	if sent := len(sink.sent()); sent != events {
+		t.Errorf("%d of %d queued events reached the sink", sent, events)
+	}
+	if stats := sinks.Stats(); stats[0].Dropped != 0 {
+		t.Errorf("the sink dropped %d events", stats[0].Dropped)
+	}
+}
@@ -4,45 +4,90 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"audit-client/Infrastructure"
 	"audit-client/Interfaces"
 	"audit-client/Usecases"
-
-	"github.com/google/uuid"
 )
 
 func connCreator() (net.Conn, error) {
 	return net.Dial("udp", "go-logcentral2.jotservers.com:5548")
 }
 
+// durationFromEnv reads a time.Duration such as "30s" from the environment,
+// falling back to def when the variable is unset or invalid.
+func durationFromEnv(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		fmt.Fprintf(os.Stderr, "Ignoring invalid %s=%q, using %v\n", key, value, def)
+		return def
+	}
+	return d
+}
+
 func main() {
 
 	var wait sync.WaitGroup
 	eventQueue := make(chan Usecases.Event, 100)
 	doneCh := make(chan bool, 1)
 
-	uid := uuid.New()
+	stateDir := os.Getenv("state_dir")
+	if stateDir == "" {
+		stateDir = Usecases.DefaultStateDir
+	}
+	uid, errU := Usecases.LoadAgentID(stateDir)
+	if errU != nil {
+		fmt.Fprintf(os.Stderr, "Error loading agent id: %v\n", errU)
+		os.Exit(1)
+	}
 
-	client := Infrastructure.NewClient(os.Getenv("host"))
-	auditDaemon, errA := Infrastructure.NewLibauditHandler(&wait, eventQueue)
-	if errA != nil {
-		fmt.Fprintf(os.Stderr, "Error auditclient: %v\n", errA)
+	caFile := os.Getenv("ca_cert")
+	if caFile == "" {
+		caFile = filepath.Join(stateDir, "ca.crt")
+	}
+	creds, errT := Infrastructure.NewCertStore(stateDir, caFile, uid.String())
+	if errT != nil {
+		fmt.Fprintf(os.Stderr, "Error loading credentials: %v\n", errT)
 		os.Exit(1)
 	}
 
+	client := Infrastructure.NewClient(os.Getenv("host"), creds)
+	// audit_log makes the agent read the log of a system auditd instead of
+	// becoming the audit daemon itself
+	auditLog := os.Getenv("audit_log")
+	var auditDaemon Interfaces.AuditdHandler
+	if auditLog != "" {
+		auditDaemon = Infrastructure.NewLogAuditHandler(auditLog, os.Getenv("audit_log_from_start") == "true", &wait, eventQueue)
+	} else {
+		netlinkDaemon, errA := Infrastructure.NewLibauditHandler(&wait, eventQueue)
+		if errA != nil {
+			fmt.Fprintf(os.Stderr, "Error auditclient: %v\n", errA)
+			os.Exit(1)
+		}
+		auditDaemon = &netlinkDaemon
+	}
+
 	// auditDaemonS, errS := Infrastructure.NewLibauditHandler(&wait, eventQueue)
 	// if errS != nil {
 	// 	fmt.Fprintf(os.Stderr, "Error auditclient: %v\n", errA)
 	// 	os.Exit(1)
 	// }
 
-	auditManager := Interfaces.NewAuditd(&auditDaemon, doneCh)
+	auditManager := Interfaces.NewAuditd(auditDaemon, doneCh)
+	// the audit configuration the host had is put back on shutdown, even after a crash
+	auditManager.HostFile = filepath.Join(stateDir, Usecases.HostAuditFile)
 	//auditManagerS := Interfaces.NewAuditd(&auditDaemonS, doneCh)
-	jobManager := Interfaces.NewAPIClient(&client, uid.String())
+	jobManager := Interfaces.NewAPIClient(&client, creds, uid.String())
 
-	errI := auditManager.Init(os.Args[1], true)
+	// the rules are an auditctl rules file, a rules.d directory or a JSON rule list
+	errI := auditManager.Init(os.Args[1], auditLog == "")
 	if errI != nil {
 		fmt.Fprintf(os.Stderr, "Error audit init failed: %v\n", errI)
 		os.Exit(1)
@@ -54,8 +99,39 @@ func main() {
 	// 	os.Exit(1)
 	//}
 
+	sinkConfigs, errL := Usecases.LoadSinkConfigs(os.Getenv("sinks"))
+	if errL != nil {
+		fmt.Fprintf(os.Stderr, "Error loading sink config: %v\n", errL)
+		os.Exit(1)
+	}
+	spoolDir := os.Getenv("spool_dir")
+	if spoolDir == "" {
+		spoolDir = filepath.Join(stateDir, "spool")
+	}
+	sinks := Usecases.NewSinkDispatcher()
+	for _, cfg := range sinkConfigs {
+		sink, errK := Infrastructure.NewEventSink(cfg, &client, uid.String())
+		if errK != nil {
+			fmt.Fprintf(os.Stderr, "Error creating %s sink: %v\n", cfg.Type, errK)
+			os.Exit(1)
+		}
+		var spool Usecases.Spool
+		if cfg.Spool {
+			diskSpool, errP := Infrastructure.NewDiskSpool(filepath.Join(spoolDir, Infrastructure.SpoolDirName(sink.Name())), cfg.SpoolMaxSize)
+			if errP != nil {
+				fmt.Fprintf(os.Stderr, "Running %s without a spool: %v\n", sink.Name(), errP)
+			} else {
+				spool = diskSpool
+			}
+		}
+		if errK = sinks.Add(sink, cfg, spool); errK != nil {
+			fmt.Fprintf(os.Stderr, "Error adding sink: %v\n", errK)
+			os.Exit(1)
+		}
+	}
+
 	workerPool := Usecases.NewPool(30, eventQueue)
-	workerPool.InitializeWorkers(&jobManager)
+	workerPool.InitializeWorkers(&jobManager, sinks)
 
 	// errC := Usecases.NewConnectionPool(20, connCreator, 10)
 	// if errC != nil{
@@ -69,6 +145,28 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Could not get hostname: %v\n", errN)
 		os.Exit(1)
 	}
+	agent.Pool = workerPool
+	agent.EnrollToken = os.Getenv("enroll_token")
+	agent.Labels, errN = Usecases.ParseLabels(os.Getenv("labels"))
+	if errN != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing labels: %v\n", errN)
+		os.Exit(1)
+	}
+	agent.PollInterval = durationFromEnv("poll_interval", Usecases.DefaultPollInterval)
+	agent.MaxBackoff = durationFromEnv("max_backoff", Usecases.DefaultMaxBackoff)
+	// an applied rule set is rolled back unless a status report goes through within confirm_window
+	agent.ConfirmWindow = durationFromEnv("confirm_window", Usecases.DefaultConfirmWindow)
+	// job_stream=false keeps the agent on polling StatusCheck for jobs
+	agent.Stream = os.Getenv("job_stream") != "false"
+	// SIGHUP reloads the rules, watch_rules=true reloads them on every change as well
+	if os.Getenv("watch_rules") == "true" {
+		changed, errW := Infrastructure.WatchRules(os.Args[1], Infrastructure.DefaultRulesSettle)
+		if errW != nil {
+			fmt.Fprintf(os.Stderr, "Reloading the rules only on SIGHUP: %v\n", errW)
+		} else {
+			agent.RulesChanged = changed
+		}
+	}
 	agent.Run()
 
 }
@@ -1,6 +1,7 @@
 module audit-client
 
 require (
+	audit-log v0.0.0-00010101000000-000000000000
 	github.com/elastic/go-libaudit v1.0.0
 	github.com/google/uuid v1.1.1
 	github.com/lunixbochs/struc v0.0.0-20200521075829-a4cb8d33dbbe // indirect
@@ -10,3 +11,5 @@ require (
 go 1.15
 
 replace github.com/elastic/go-libaudit => /root/elastic/go-libaudit
+
+replace audit-log => ../audit-log
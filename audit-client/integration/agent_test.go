@@ -0,0 +1,953 @@
+//go:build integration
+// +build integration
+
+// Package integration is the agent's integration test. It runs an agent
+// against an in-process stand-in for the control server with the fake audit
+// daemon in place of the kernel, so the agent's side of the job path can be
+// checked without root or a netlink socket:
+//
+//	go test -tags integration ./integration [-v]
+//
+// The control server is faked here, so the job details it has no handler for
+// can be checked. The agent is run against the real control server router in
+// the audit-integration module at the root of the repository.
+//
+// The agent enrolls, polls its jobs, runs AddRule, Delete, SaveConfig and
+// Purge, reports its rule set and kernel drift and uploads scripted events. It
+// reloads its rules on SIGHUP and when the rules.d directory changes, stops
+// and starts the audit and changes the kernel audit settings. It applies rule
+// sets and rolls back the ones no status report confirms. It shuts down on a
+// ShutDown job and puts back the audit configuration the host had, also after
+// a crash. A second agent reads an auditd log instead of managing the kernel,
+// it picks up where it stopped reading when the audit is started again. With
+// -v every check and the agent's log are shown.
+package integration
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"audit-client/Domain"
+	"audit-client/Infrastructure"
+	"audit-client/Interfaces"
+	"audit-client/Usecases"
+
+	"github.com/google/uuid"
+)
+
+var (
+	enrollToken = "integration-token"
+	stepTimeout = 10 * time.Second
+
+	initialRules = []string{
+		"-a always,exit -F arch=b64 -S execve -k exec",
+		"-w /etc/passwd -p wa -k identity",
+	}
+	addedRule  = "-a always,exit -F arch=b64 -S connect -k network"
+	shadowRule = "-w /etc/shadow -p wa -k identity"
+	ptraceRule = "-A always,exit -F arch=b64 -S ptrace -k tracing"
+	filesRule  = "-a always,exit -F arch=b64 -S open -k files"
+	// the host had its own rule and limits before the agent started
+	hostRule   = "-w /etc/hosts -p wa -k hosts"
+	hostStatus = Domain.AuditStatus{Enabled: 1, RateLimit: 50, BacklogLimit: 64, Failure: 1}
+)
+
+type harness struct {
+	t      *testing.T
+	dir    string
+	rules  string
+	host   string
+	server *controlServer
+	daemon *Infrastructure.FakeAuditdHandler
+	// logMode makes the agent read an auditd log at auditLog instead of
+	// managing the fake kernel
+	logMode  bool
+	auditLog string
+	agent    *Usecases.Agent
+	uid      uuid.UUID
+	exited   chan int
+	verbose  bool
+	wd       string
+}
+
+func TestAgent(t *testing.T) {
+	h := &harness{t: t, verbose: testing.Verbose(), exited: make(chan int, 1)}
+	defer h.stop()
+
+	if err := h.start(); err != nil {
+		t.Fatalf("couldnt start the harness: %v", err)
+	}
+	h.run()
+}
+
+// TestAgentLogMode runs an agent reading an auditd log through StopAudit and
+// StartAudit.
+func TestAgentLogMode(t *testing.T) {
+	h := &harness{t: t, verbose: testing.Verbose(), exited: make(chan int, 1), logMode: true}
+	defer h.stop()
+
+	if err := h.start(); err != nil {
+		t.Fatalf("couldnt start the harness: %v", err)
+	}
+	h.runLogMode()
+}
+
+func (h *harness) stop() {
+	if h.server != nil {
+		h.server.Close()
+	}
+	if h.wd != "" {
+		os.Chdir(h.wd)
+	}
+	os.RemoveAll(h.dir)
+}
+
+// start wires an agent the way audit.go does, with the fake audit daemon and
+// the control server of the harness.
+func (h *harness) start() error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	h.wd = wd
+	dir, err := ioutil.TempDir("", "go-audit-integration")
+	if err != nil {
+		return err
+	}
+	h.dir = dir
+	// SaveConfig writes to the working directory
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+
+	h.server, err = newControlServer(enrollToken)
+	if err != nil {
+		return fmt.Errorf("couldnt start the control server: %v", err)
+	}
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caFile, h.server.caPEM, 0600); err != nil {
+		return err
+	}
+	// a rules.d directory, merged in lexical order, the duplicate is skipped
+	rulesDir := filepath.Join(dir, "rules.d")
+	h.rules = rulesDir
+	ruleFiles := map[string]string{
+		"10-base.rules":     "## base\n-D\n-e 1\n-b 4096\n-f 2\n\n" + initialRules[0] + "\n",
+		"20-identity.rules": initialRules[1] + "\n" + initialRules[0] + "\n",
+	}
+	if err := os.Mkdir(rulesDir, 0700); err != nil {
+		return err
+	}
+	for name, content := range ruleFiles {
+		if err := ioutil.WriteFile(filepath.Join(rulesDir, name), []byte(content), 0600); err != nil {
+			return err
+		}
+	}
+
+	stateDir := filepath.Join(dir, "state")
+	h.uid, err = Usecases.LoadAgentID(stateDir)
+	if err != nil {
+		return err
+	}
+	creds, err := Infrastructure.NewCertStore(stateDir, caFile, h.uid.String())
+	if err != nil {
+		return err
+	}
+	client := Infrastructure.NewClient(h.server.Addr(), creds)
+
+	var wait sync.WaitGroup
+	eventQueue := make(chan Usecases.Event, 100)
+	var daemon Interfaces.AuditdHandler
+	if h.logMode {
+		// the event already in the log is from before the agent started
+		h.auditLog = filepath.Join(dir, "audit.log")
+		if err := ioutil.WriteFile(h.auditLog, []byte(logEvent(200)), 0600); err != nil {
+			return err
+		}
+		daemon = Infrastructure.NewLogAuditHandler(h.auditLog, false, &wait, eventQueue)
+	} else {
+		h.daemon = Infrastructure.NewFakeAuditHandler(&wait, eventQueue)
+		if err := h.seedHost(); err != nil {
+			return err
+		}
+		daemon = h.daemon
+	}
+	h.host = filepath.Join(stateDir, Usecases.HostAuditFile)
+	auditManager := Interfaces.NewAuditd(daemon, make(chan bool, 1))
+	auditManager.HostFile = h.host
+	jobManager := Interfaces.NewAPIClient(&client, creds, h.uid.String())
+	if err := auditManager.Init(rulesDir, !h.logMode); err != nil {
+		return fmt.Errorf("audit init failed: %v", err)
+	}
+
+	cfg := Usecases.SinkConfig{Type: "server", FlushInterval: "100ms"}
+	sink, err := Infrastructure.NewEventSink(cfg, &client, h.uid.String())
+	if err != nil {
+		return err
+	}
+	sinks := Usecases.NewSinkDispatcher()
+	if err := sinks.Add(sink, cfg, nil); err != nil {
+		return err
+	}
+	pool := Usecases.NewPool(4, eventQueue)
+	pool.InitializeWorkers(&jobManager, sinks)
+
+	logs := ioutil.Discard
+	if h.verbose {
+		logs = os.Stderr
+	}
+	logger := Usecases.LoggerInit(logs, logs, logs)
+	h.agent, err = Usecases.NewAgent(&auditManager, &jobManager, &wait, &logger, h.uid)
+	if err != nil {
+		return err
+	}
+	h.agent.Pool = pool
+	h.agent.EnrollToken = enrollToken
+	h.agent.PollInterval = 50 * time.Millisecond
+	h.agent.MaxBackoff = time.Second
+	h.agent.Stream = false
+	h.agent.Exit = func(code int) {
+		h.exited <- code
+	}
+	h.agent.RulesChanged, err = Infrastructure.WatchRules(rulesDir, 100*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	go h.agent.Run()
+	return nil
+}
+
+// seedHost gives the fake kernel the audit configuration of the host.
+func (h *harness) seedHost() error {
+	for _, set := range []func() error{
+		func() error { return h.daemon.AddRule(hostRule) },
+		func() error { return h.daemon.SetEnabled(hostStatus.Enabled == 1) },
+		func() error { return h.daemon.SetRateLimit(int(hostStatus.RateLimit)) },
+		func() error { return h.daemon.SetBackLogLimit(int(hostStatus.BacklogLimit)) },
+		func() error { return h.daemon.SetFailure(int(hostStatus.Failure)) },
+	} {
+		if err := set(); err != nil {
+			return fmt.Errorf("couldnt seed the host audit configuration: %v", err)
+		}
+	}
+	return nil
+}
+
+// kernelStatus returns the audit status of the fake kernel.
+func (h *harness) kernelStatus() (Domain.AuditStatus, error) {
+	var status Domain.AuditStatus
+	data, err := h.daemon.GetStatus()
+	if err != nil {
+		return status, err
+	}
+	return status, json.Unmarshal(data, &status)
+}
+
+// hostRestored checks that the fake kernel has the configuration of the host
+// back and that none is kept on disk anymore.
+func (h *harness) hostRestored() error {
+	want, err := h.daemon.NormalizeRule(hostRule)
+	if err != nil {
+		return err
+	}
+	if rules, err := h.daemon.GetRules(); err != nil || !reflect.DeepEqual(rules, []string{want}) {
+		return fmt.Errorf("kernel has %q (%v), want %q", rules, err, want)
+	}
+	status, err := h.kernelStatus()
+	if err != nil {
+		return err
+	}
+	if status.Enabled != hostStatus.Enabled || status.RateLimit != hostStatus.RateLimit ||
+		status.BacklogLimit != hostStatus.BacklogLimit || status.Failure != hostStatus.Failure {
+		return fmt.Errorf("kernel status %+v, want the host's %+v", status, hostStatus)
+	}
+	if _, err := os.Stat(h.host); !os.IsNotExist(err) {
+		return fmt.Errorf("host audit configuration is still kept: %v", err)
+	}
+	return nil
+}
+
+func (h *harness) check(name string, err error) {
+	if err != nil {
+		h.t.Errorf("%s: %v", name, err)
+		return
+	}
+	h.t.Logf("ok   %s", name)
+}
+
+// job runs a job on the agent and checks its status and error code.
+func (h *harness) job(jobType string, rule string, status string, code Domain.ErrorCode) error {
+	result, err := h.server.Run(h.uid, Usecases.Job{JobType: jobType, Rule: rule}, stepTimeout)
+	if err != nil {
+		return err
+	}
+	if result.Status != status || result.Code != code {
+		return fmt.Errorf("got %s %q (%s), want %s %q", result.Status, result.Code, result.Message, status, code)
+	}
+	return nil
+}
+
+// insert runs an AddRule job placing rule before or after another one and
+// returns the position the agent loaded it at.
+func (h *harness) insert(rule, before, after string) (int, error) {
+	result, err := h.server.Run(h.uid, Usecases.Job{JobType: "AddRule", Rule: rule, Before: before, After: after}, stepTimeout)
+	if err != nil {
+		return -1, err
+	}
+	if result.Status != "JobSuccess" || result.Position == nil {
+		return -1, fmt.Errorf("got %s %q (%s) at %v", result.Status, result.Code, result.Message, result.Position)
+	}
+	return *result.Position, nil
+}
+
+// apply runs an ApplyRuleSet job with a one second confirmation window and
+// checks its status and error code.
+func (h *harness) apply(rules []string, status string, code Domain.ErrorCode) (Usecases.Job, error) {
+	result, err := h.server.Run(h.uid, Usecases.Job{JobType: "ApplyRuleSet", Rules: rules, Confirm: 1}, stepTimeout)
+	if err != nil {
+		return result, err
+	}
+	if result.Status != status || result.Code != code {
+		return result, fmt.Errorf("got %s %q (%s), want %s %q", result.Status, result.Code, result.Message, status, code)
+	}
+	return result, nil
+}
+
+// kernelRules checks the rules of the kernel and the agent, in order: the
+// kernel keeps its rules in the order they were added, -A rules in front of
+// their filter list. The kernel lists -A rules like -a rules.
+func (h *harness) kernelRules(want []string) error {
+	listed := make([]string, 0, len(want))
+	for _, rule := range want {
+		normal, err := h.daemon.NormalizeRule(rule)
+		if err != nil {
+			return err
+		}
+		listed = append(listed, normal)
+	}
+	if got, err := h.daemon.GetRules(); err != nil || !reflect.DeepEqual(got, listed) {
+		return fmt.Errorf("kernel has %q (%v), want %q", got, err, listed)
+	}
+	if got := h.agent.AuditclientS.ListRules(); len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+		return fmt.Errorf("agent lists %q, want %q", got, want)
+	}
+	return nil
+}
+
+// sameRules compares rule lists ignoring their order.
+func sameRules(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := map[string]int{}
+	for _, r := range a {
+		seen[r]++
+	}
+	for _, r := range b {
+		if seen[r]--; seen[r] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *harness) run() {
+	h.check("register", func() error {
+		if err := h.server.waitFor(h.uid, stepTimeout, func(a *agentState) bool { return a.registrations > 0 }); err != nil {
+			return err
+		}
+		if rules := h.server.Agent(h.uid).rules; !sameRules(rules, initialRules) {
+			return fmt.Errorf("registered with %q, want %q", rules, initialRules)
+		}
+		return h.kernelRules(initialRules)
+	}())
+
+	h.check("host audit kept", func() error {
+		host, err := Usecases.LoadHostAudit(h.host)
+		if err != nil || host == nil {
+			return fmt.Errorf("nothing kept in %s: %v", h.host, err)
+		}
+		want, err := h.daemon.NormalizeRule(hostRule)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(host.Kernel, []string{want}) || host.Status.RateLimit != hostStatus.RateLimit ||
+			host.Status.BacklogLimit != hostStatus.BacklogLimit || host.Status.Failure != hostStatus.Failure {
+			return fmt.Errorf("kept %+v", *host)
+		}
+		return nil
+	}())
+
+	h.check("poll with the issued certificate", h.server.waitFor(h.uid, stepTimeout, func(a *agentState) bool {
+		return a.status != nil
+	}))
+
+	h.check("audit status", func() error {
+		status := h.server.Agent(h.uid).status
+		if status == nil {
+			return errors.New("no status reported")
+		}
+		// rate limit and pid come from Init, backlog and failure mode from the rules files
+		if status.Enabled != 1 || status.RateLimit != 1000 || status.BacklogLimit != 4096 || status.Failure != 2 || status.PID != uint32(os.Getpid()) {
+			return fmt.Errorf("unexpected status %+v", status.AuditStatus)
+		}
+		return nil
+	}())
+
+	h.check("AddRule", func() error {
+		if err := h.job("AddRule", addedRule, "JobSuccess", ""); err != nil {
+			return err
+		}
+		return h.kernelRules(append(append([]string(nil), initialRules...), addedRule))
+	}())
+
+	h.check("AddRule duplicate", h.job("AddRule", addedRule, "JobFailed", Domain.CodeDuplicate))
+	h.check("AddRule parse error", h.job("AddRule", "-a never", "JobFailed", Domain.CodeParse))
+
+	h.check("AddRule kernel rejected", func() error {
+		h.daemon.FailNext("AddRule", syscall.EINVAL)
+		if err := h.job("AddRule", "-a always,exit -F arch=b64 -S open -k files", "JobFailed", Domain.CodeKernelRejected); err != nil {
+			return err
+		}
+		return h.kernelRules(append(append([]string(nil), initialRules...), addedRule))
+	}())
+
+	h.check("AddRule before another rule", func() error {
+		position, err := h.insert(shadowRule, initialRules[1], "")
+		if err != nil {
+			return err
+		}
+		if position != 1 {
+			return fmt.Errorf("loaded at %d, want 1", position)
+		}
+		return h.kernelRules([]string{initialRules[0], shadowRule, initialRules[1], addedRule})
+	}())
+
+	h.check("AddRule prepend", func() error {
+		position, err := h.insert(ptraceRule, "", "")
+		if err != nil {
+			return err
+		}
+		if position != 0 {
+			return fmt.Errorf("loaded at %d, want 0", position)
+		}
+		return h.kernelRules([]string{ptraceRule, initialRules[0], shadowRule, initialRules[1], addedRule})
+	}())
+
+	h.check("AddRule before a prepended rule", func() error {
+		// the -A rule is taken out and added back behind the new one, the
+		// kernel would put it in front again if it was added as written
+		position, err := h.insert(filesRule, ptraceRule, "")
+		if err != nil {
+			return err
+		}
+		if position != 0 {
+			return fmt.Errorf("loaded at %d, want 0", position)
+		}
+		return h.kernelRules([]string{filesRule, ptraceRule, initialRules[0], shadowRule, initialRules[1], addedRule})
+	}())
+
+	h.check("AddRule after an unknown rule", func() error {
+		_, err := h.insert("-a always,exit -F arch=b64 -S mkdir -k files", "", "-w /nonexistent -p r")
+		if err == nil || !strings.Contains(err.Error(), string(Domain.CodeNotFound)) {
+			return fmt.Errorf("got %v, want a %s failure", err, Domain.CodeNotFound)
+		}
+		return nil
+	}())
+
+	h.check("Delete keeps the order", func() error {
+		for _, rule := range []string{ptraceRule, filesRule, shadowRule} {
+			if err := h.job("Delete", rule, "JobSuccess", ""); err != nil {
+				return err
+			}
+		}
+		return h.kernelRules(append(append([]string(nil), initialRules...), addedRule))
+	}())
+
+	h.check("Delete", func() error {
+		if err := h.job("Delete", initialRules[1], "JobSuccess", ""); err != nil {
+			return err
+		}
+		return h.kernelRules([]string{initialRules[0], addedRule})
+	}())
+
+	h.check("Delete unknown rule", h.job("Delete", initialRules[1], "JobFailed", Domain.CodeNotFound))
+
+	h.check("rule set in status", h.ruleSet(func(state *Domain.RuleSetState) bool {
+		want := []string{initialRules[0], addedRule}
+		return state.Version > 0 && state.Hash == Usecases.RulesHash(want) && state.KernelHash != "" &&
+			len(state.Missing) == 0 && len(state.Unexpected) == 0
+	}))
+
+	h.check("kernel drift", func() error {
+		// someone runs auditctl -D by hand
+		if err := h.daemon.DeleteRules(); err != nil {
+			return err
+		}
+		if err := h.ruleSet(func(state *Domain.RuleSetState) bool {
+			return sameRules(state.Missing, []string{initialRules[0], addedRule}) && len(state.Unexpected) == 0
+		}); err != nil {
+			return err
+		}
+		for _, rule := range []string{initialRules[0], addedRule} {
+			if err := h.daemon.AddRule(rule); err != nil {
+				return err
+			}
+		}
+		return h.ruleSet(func(state *Domain.RuleSetState) bool {
+			return len(state.Missing) == 0 && len(state.Unexpected) == 0
+		})
+	}())
+
+	h.check("SaveConfig", func() error {
+		if err := h.job("SaveConfig", "", "JobSuccess", ""); err != nil {
+			return err
+		}
+		lines, err := Usecases.LoadRules(filepath.Join(h.dir, Usecases.SavedRulesFile))
+		if err != nil {
+			return fmt.Errorf("saved config doesnt load: %v", err)
+		}
+		var saved []string
+		backlog := -1
+		for _, line := range lines {
+			if line.Rule != "" {
+				saved = append(saved, line.Rule)
+			} else if line.Control == "-b" {
+				backlog = line.Value
+			}
+		}
+		if !sameRules(saved, []string{initialRules[0], addedRule}) {
+			return fmt.Errorf("saved %q", saved)
+		}
+		if backlog != 4096 {
+			return fmt.Errorf("saved backlog limit %d", backlog)
+		}
+		return nil
+	}())
+
+	h.check("events", func() error {
+		events := scriptedEvents()
+		if err := h.daemon.Script(events...); err != nil {
+			return err
+		}
+		if err := h.server.waitFor(h.uid, stepTimeout, func(a *agentState) bool { return len(a.events) >= len(events) }); err != nil {
+			return err
+		}
+		got := map[uint64]bool{}
+		for _, event := range h.server.Agent(h.uid).events {
+			got[event.Serial] = true
+		}
+		for _, event := range events {
+			if !got[event.Serial] {
+				return fmt.Errorf("event %d didnt arrive", event.Serial)
+			}
+		}
+		return nil
+	}())
+
+	h.check("reload on SIGHUP", func() error {
+		// the kernel has rule0 and the added rule, the rules files rule0 and rule1
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			return err
+		}
+		report, err := h.reloaded("SIGHUP")
+		if err != nil {
+			return err
+		}
+		if !sameRules(report.Added, initialRules[1:]) || !sameRules(report.Deleted, []string{addedRule}) || len(report.Failed) > 0 {
+			return fmt.Errorf("unexpected report %+v", report)
+		}
+		if rules := h.server.Agent(h.uid).rules; !sameRules(rules, initialRules) {
+			return fmt.Errorf("server has %q, want %q", rules, initialRules)
+		}
+		return h.kernelRules(initialRules)
+	}())
+
+	h.check("reload on rules change", func() error {
+		rules := filepath.Join(h.rules, "30-network.rules")
+		if err := ioutil.WriteFile(rules, []byte(addedRule+"\n"), 0600); err != nil {
+			return err
+		}
+		report, err := h.reloaded("rules file change")
+		if err != nil {
+			return err
+		}
+		if !sameRules(report.Added, []string{addedRule}) || len(report.Deleted) > 0 {
+			return fmt.Errorf("unexpected report %+v", report)
+		}
+		return h.kernelRules(append(append([]string(nil), initialRules...), addedRule))
+	}())
+
+	h.check("events after reload", func() error {
+		before := len(h.server.Agent(h.uid).events)
+		event := scriptedEvents()[0]
+		event.Serial = 104
+		if err := h.daemon.Script(event); err != nil {
+			return err
+		}
+		return h.server.waitFor(h.uid, stepTimeout, func(a *agentState) bool { return len(a.events) > before })
+	}())
+
+	h.check("StopAudit", func() error {
+		if err := h.job("StopAudit", "", "JobSuccess", ""); err != nil {
+			return err
+		}
+		if status, err := h.kernelStatus(); err != nil || status.Enabled != 0 {
+			return fmt.Errorf("kernel audit enabled %d (%v), want it disabled", status.Enabled, err)
+		}
+		before := len(h.server.Agent(h.uid).events)
+		event := scriptedEvents()[0]
+		event.Serial = 105
+		if err := h.daemon.Script(event); err != nil {
+			return err
+		}
+		time.Sleep(200 * time.Millisecond)
+		if after := len(h.server.Agent(h.uid).events); after != before {
+			return fmt.Errorf("%d events arrived while the audit was stopped", after-before)
+		}
+		return nil
+	}())
+
+	h.check("StopAudit stopped already", func() error {
+		result, err := h.server.Run(h.uid, Usecases.Job{JobType: "StopAudit"}, stepTimeout)
+		if err != nil {
+			return err
+		}
+		if result.Status != "JobSuccess" || result.Message != "audit was stopped already" {
+			return fmt.Errorf("got %s %q", result.Status, result.Message)
+		}
+		return nil
+	}())
+
+	h.check("StartAudit", func() error {
+		before := len(h.server.Agent(h.uid).events)
+		if err := h.job("StartAudit", "", "JobSuccess", ""); err != nil {
+			return err
+		}
+		if status, err := h.kernelStatus(); err != nil || status.Enabled != 1 {
+			return fmt.Errorf("kernel audit enabled %d (%v), want it enabled again", status.Enabled, err)
+		}
+		// the event held back while the audit was stopped
+		return h.server.waitFor(h.uid, stepTimeout, func(a *agentState) bool { return len(a.events) > before })
+	}())
+
+	h.check("SetAuditParams", func() error {
+		rate, backlog, failure := 200, 512, 2
+		params := &Domain.AuditParams{RateLimit: &rate, BacklogLimit: &backlog, Failure: &failure}
+		result, err := h.server.Run(h.uid, Usecases.Job{JobType: "SetAuditParams", Params: params}, stepTimeout)
+		if err != nil {
+			return err
+		}
+		if result.Status != "JobSuccess" {
+			return fmt.Errorf("got %s %q (%s)", result.Status, result.Code, result.Message)
+		}
+		status, err := h.kernelStatus()
+		if err != nil {
+			return err
+		}
+		if status.RateLimit != uint32(rate) || status.BacklogLimit != uint32(backlog) || status.Failure != uint32(failure) || status.Enabled != 1 {
+			return fmt.Errorf("kernel status %+v", status)
+		}
+		return nil
+	}())
+
+	h.check("SetAuditParams invalid", func() error {
+		failure := 3
+		result, err := h.server.Run(h.uid, Usecases.Job{JobType: "SetAuditParams", Params: &Domain.AuditParams{Failure: &failure}}, stepTimeout)
+		if err != nil {
+			return err
+		}
+		if result.Status != "JobFailed" || result.Code != Domain.CodeParse {
+			return fmt.Errorf("got %s %q (%s), want JobFailed %q", result.Status, result.Code, result.Message, Domain.CodeParse)
+		}
+		return nil
+	}())
+
+	h.check("ApplyRuleSet", func() error {
+		set := []string{initialRules[0], shadowRule, ptraceRule}
+		want := []string{ptraceRule, initialRules[0], shadowRule}
+		result, err := h.apply(set, "JobSuccess", "")
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(result.Rules, want) {
+			return fmt.Errorf("agent loaded %q, want %q", result.Rules, want)
+		}
+		if err := h.ruleSet(func(state *Domain.RuleSetState) bool { return state.Hash == Usecases.RulesHash(want) }); err != nil {
+			return err
+		}
+		// the status report confirmed the set, the window passes without a rollback
+		time.Sleep(1500 * time.Millisecond)
+		if _, err := h.reloaded("rollback"); err == nil {
+			return errors.New("confirmed rule set was rolled back")
+		}
+		return h.kernelRules(want)
+	}())
+
+	applied := []string{ptraceRule, initialRules[0], shadowRule}
+	h.check("ApplyRuleSet invalid rules", func() error {
+		result, err := h.apply([]string{addedRule, "-a never", addedRule}, "JobFailed", Domain.CodeParse)
+		if err != nil {
+			return err
+		}
+		if len(result.Failed) != 2 || result.Failed[0].Code != Domain.CodeParse || result.Failed[1].Code != Domain.CodeDuplicate {
+			return fmt.Errorf("unexpected failures %+v", result.Failed)
+		}
+		return h.kernelRules(applied)
+	}())
+
+	h.check("ApplyRuleSet kernel rejected", func() error {
+		h.daemon.FailNext("AddRule", syscall.EINVAL)
+		if _, err := h.apply([]string{addedRule, initialRules[1]}, "JobFailed", Domain.CodeKernelRejected); err != nil {
+			return err
+		}
+		return h.kernelRules(applied)
+	}())
+
+	h.check("ApplyRuleSet rolled back unconfirmed", func() error {
+		h.server.RejectStatus(h.uid, true)
+		defer h.server.RejectStatus(h.uid, false)
+		result, err := h.apply([]string{addedRule}, "JobSuccess", "")
+		if err != nil {
+			return err
+		}
+		report, err := h.reloaded("rollback")
+		if err != nil {
+			return err
+		}
+		if report.RolledBack != result.JobID.String() || !sameRules(report.Rules, applied) ||
+			!sameRules(report.Added, applied) || !sameRules(report.Deleted, []string{addedRule}) {
+			return fmt.Errorf("unexpected report %+v", report)
+		}
+		return h.kernelRules(applied)
+	}())
+
+	h.check("Purge", func() error {
+		if err := h.job("Purge", "", "JobSuccess", ""); err != nil {
+			return err
+		}
+		return h.kernelRules(nil)
+	}())
+
+	h.check("Uninstall fails and keeps the agent", func() error {
+		h.daemon.FailNext("SetBackLogLimit", errors.New("backlog limit rejected"))
+		if err := h.job("Uninstall", "", "JobFailed", Domain.CodeInternal); err != nil {
+			return err
+		}
+		if _, err := os.Stat(h.host); err != nil {
+			return fmt.Errorf("host audit configuration wasnt kept for another try: %v", err)
+		}
+		// the agent is still there to take jobs
+		return h.job("SaveConfig", "", "JobSuccess", "")
+	}())
+
+	h.check("ShutDown", func() error {
+		if err := h.job("ShutDown", "", "JobSuccess", ""); err != nil {
+			return err
+		}
+		select {
+		case code := <-h.exited:
+			if code != 0 {
+				return fmt.Errorf("agent exited with %d", code)
+			}
+		case <-time.After(stepTimeout):
+			return errors.New("agent didnt exit")
+		}
+		if !h.server.Agent(h.uid).deregistered {
+			return errors.New("agent didnt deregister")
+		}
+		if !h.daemon.Closed() {
+			return errors.New("audit daemon wasnt closed")
+		}
+		return h.hostRestored()
+	}())
+
+	h.check("host audit restored after a crash", func() error {
+		// the first run dies without restoring, the second finds what it kept
+		for run := 0; run < 2; run++ {
+			repo := Interfaces.NewAuditd(h.daemon, make(chan bool, 1))
+			repo.HostFile = h.host
+			if err := repo.Init(h.rules, true); err != nil {
+				return fmt.Errorf("run %d: %v", run, err)
+			}
+			if run == 1 {
+				if err := repo.RestoreHost(); err != nil {
+					return err
+				}
+			}
+		}
+		return h.hostRestored()
+	}())
+}
+
+func (h *harness) runLogMode() {
+	h.check("register", h.server.waitFor(h.uid, stepTimeout, func(a *agentState) bool { return a.registrations > 0 }))
+
+	h.check("log events", func() error {
+		if err := h.writeLog(201); err != nil {
+			return err
+		}
+		return h.logEvents(map[uint64]int{201: 1})
+	}())
+
+	h.check("StopAudit log mode", func() error {
+		if err := h.job("StopAudit", "", "JobSuccess", ""); err != nil {
+			return err
+		}
+		if err := h.writeLog(202); err != nil {
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+		return h.logEvents(map[uint64]int{201: 1})
+	}())
+
+	h.check("StartAudit log mode", func() error {
+		if err := h.job("StartAudit", "", "JobSuccess", ""); err != nil {
+			return err
+		}
+		// the reader resumes where the last one stopped, the event logged
+		// while it was stopped is sent once and the one before it isnt again
+		if err := h.logEvents(map[uint64]int{201: 1, 202: 1}); err != nil {
+			return err
+		}
+		if err := h.writeLog(203); err != nil {
+			return err
+		}
+		return h.logEvents(map[uint64]int{201: 1, 202: 1, 203: 1})
+	}())
+
+	h.check("StopAudit and StartAudit right after each other", func() error {
+		for i := 0; i < 3; i++ {
+			if err := h.job("StopAudit", "", "JobSuccess", ""); err != nil {
+				return err
+			}
+			if err := h.job("StartAudit", "", "JobSuccess", ""); err != nil {
+				return err
+			}
+		}
+		// a reader left running would send the event twice
+		if err := h.writeLog(204); err != nil {
+			return err
+		}
+		want := map[uint64]int{201: 1, 202: 1, 203: 1, 204: 1}
+		if err := h.logEvents(want); err != nil {
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+		return h.logEvents(want)
+	}())
+
+	h.check("ShutDown log mode", func() error {
+		if err := h.job("ShutDown", "", "JobSuccess", ""); err != nil {
+			return err
+		}
+		select {
+		case code := <-h.exited:
+			if code != 0 {
+				return fmt.Errorf("agent exited with %d", code)
+			}
+		case <-time.After(stepTimeout):
+			return errors.New("agent didnt exit")
+		}
+		return nil
+	}())
+}
+
+// logEvent is an event in the format of an auditd log.
+func logEvent(serial int) string {
+	header := fmt.Sprintf("msg=audit(1618919474.839:%d):", serial)
+	return "type=SYSCALL " + header + ` arch=c000003e syscall=59 success=yes exit=0 a0=1 a1=2 a2=3 a3=4 items=0 ppid=1 pid=2 auid=0 uid=0 gid=0 euid=0 suid=0 fsuid=0 egid=0 sgid=0 fsgid=0 tty=(none) ses=1 comm="sleep" exe="/bin/sleep" key=(null)` + "\n" +
+		"type=EOE " + header + "\n"
+}
+
+// writeLog appends an event to the auditd log.
+func (h *harness) writeLog(serial int) error {
+	file, err := os.OpenFile(h.auditLog, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(logEvent(serial))
+	return err
+}
+
+// logEvents waits until the control server got every event of want as many
+// times as it says, and no others.
+func (h *harness) logEvents(want map[uint64]int) error {
+	var got map[uint64]int
+	err := h.server.waitFor(h.uid, stepTimeout, func(a *agentState) bool {
+		got = map[uint64]int{}
+		for _, event := range a.events {
+			got[event.Serial]++
+		}
+		return reflect.DeepEqual(got, want)
+	})
+	if err != nil {
+		return fmt.Errorf("got events %v, want %v", got, want)
+	}
+	return nil
+}
+
+// ruleSet waits for a status report whose rule set matches.
+func (h *harness) ruleSet(match func(*Domain.RuleSetState) bool) error {
+	var last *Domain.RuleSetState
+	err := h.server.waitFor(h.uid, stepTimeout, func(a *agentState) bool {
+		if a.status == nil || a.status.RuleSet == nil {
+			return false
+		}
+		last = a.status.RuleSet
+		return match(last)
+	})
+	if err != nil && last != nil {
+		return fmt.Errorf("%v, last rule set %+v", err, *last)
+	}
+	return err
+}
+
+// reloaded waits for the control server to get a reload report from source.
+func (h *harness) reloaded(source string) (Domain.ReloadReport, error) {
+	var report Domain.ReloadReport
+	err := h.server.waitFor(h.uid, stepTimeout, func(a *agentState) bool {
+		for _, r := range a.reloads {
+			if r.Source == source {
+				report = r
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return report, fmt.Errorf("no reload report: %v", err)
+	}
+	return report, nil
+}
+
+func scriptedEvents() []Usecases.GeneralInfo {
+	raw := func(s string) *json.RawMessage {
+		m := json.RawMessage(s)
+		return &m
+	}
+	return []Usecases.GeneralInfo{
+		{Serial: 101, Hostname: "integration", Data: map[string]*json.RawMessage{
+			"SYSCALL": raw(`{"syscall":"execve","uid":"0","success":"yes"}`),
+			"EXECVE":  raw(`{"argc":"2","a0":"sleep","a1":"1"}`),
+		}},
+		{Serial: 102, Hostname: "integration", Data: map[string]*json.RawMessage{
+			"SYSCALL":  raw(`{"syscall":"connect","uid":"0","success":"yes"}`),
+			"SOCKADDR": raw(`{"family":"inet","ip":"10.0.0.1","port":"443"}`),
+		}},
+		{Serial: 103, Hostname: "integration", Data: map[string]*json.RawMessage{
+			"USER_LOGIN": raw(`{"acct":"root","res":"failed"}`),
+		}},
+	}
+}
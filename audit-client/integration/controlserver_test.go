@@ -0,0 +1,422 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"audit-client/Domain"
+	"audit-client/Interfaces"
+	"audit-client/Usecases"
+
+	"github.com/google/uuid"
+)
+
+// registration is the part of Usecases.MessageAgent the control server reads.
+type registration struct {
+	ID          uuid.UUID
+	Hostname    string
+	Rules       []string
+	EnrollToken string
+	CSR         string
+}
+
+type agentState struct {
+	registrations int
+	deregistered  bool
+	rules         []string
+	status        *Usecases.StatusReport
+	jobs          []Usecases.Job
+	results       map[uuid.UUID]Usecases.Job
+	events        []Usecases.GeneralInfo
+	reloads       []Domain.ReloadReport
+	// rejectStatus fails the status reports, the agent looks cut off
+	rejectStatus bool
+}
+
+// controlServer serves the agent routes of the control server: enrollment
+// with a CSR, StatusCheck polling, job results, status and reload reports and
+// event batches. The real server is a module of its own and cant be linked
+// into the agent's, this one answers with the same messages and status codes
+// and authenticates agents by their client certificate the same way.
+type controlServer struct {
+	lock   sync.Mutex
+	token  string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	caPEM  []byte
+	agents map[uuid.UUID]*agentState
+	server *httptest.Server
+	change chan struct{}
+}
+
+func newControlServer(token string) (*controlServer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "go-audit integration ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, &x509.Certificate{Subject: pkix.Name{CommonName: "go-audit integration ca"}}, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &controlServer{
+		token:  token,
+		ca:     ca,
+		caKey:  key,
+		caPEM:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		agents: map[uuid.UUID]*agentState{},
+		change: make(chan struct{}, 1),
+	}
+
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serverDER, err := c.sign(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &serverKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	c.server = httptest.NewUnstartedServer(c.routes())
+	c.server.EnableHTTP2 = true
+	c.server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    roots,
+		MinVersion:   tls.VersionTLS12,
+	}
+	c.server.StartTLS()
+	return c, nil
+}
+
+func (c *controlServer) Addr() string {
+	return c.server.Listener.Addr().String()
+}
+
+func (c *controlServer) Close() {
+	c.server.Close()
+}
+
+func (c *controlServer) sign(template *x509.Certificate, pub interface{}) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(24 * time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	return x509.CreateCertificate(rand.Reader, template, c.ca, pub, c.caKey)
+}
+
+func (c *controlServer) signCSR(csrPEM string, id uuid.UUID) (string, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return "", errors.New("no certificate request found")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return "", err
+	}
+	der, err := c.sign(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: id.String()},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, csr.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), nil
+}
+
+// changed wakes up whoever waits for the state of an agent to change.
+func (c *controlServer) changed() {
+	select {
+	case c.change <- struct{}{}:
+	default:
+	}
+}
+
+// waitFor blocks until check holds for the state of agent uid.
+func (c *controlServer) waitFor(uid uuid.UUID, timeout time.Duration, check func(*agentState) bool) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		c.lock.Lock()
+		agent, ok := c.agents[uid]
+		done := ok && check(agent)
+		c.lock.Unlock()
+		if done {
+			return nil
+		}
+		select {
+		case <-c.change:
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline.C:
+			return fmt.Errorf("timed out after %v", timeout)
+		}
+	}
+}
+
+// Agent returns a copy of the state of agent uid.
+func (c *controlServer) Agent(uid uuid.UUID) agentState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	agent, ok := c.agents[uid]
+	if !ok {
+		return agentState{}
+	}
+	copied := *agent
+	copied.rules = append([]string(nil), agent.rules...)
+	copied.events = append([]Usecases.GeneralInfo(nil), agent.events...)
+	copied.reloads = append([]Domain.ReloadReport(nil), agent.reloads...)
+	return copied
+}
+
+// RejectStatus makes the status reports of agent uid fail or go through again.
+func (c *controlServer) RejectStatus(uid uuid.UUID, reject bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if agent, ok := c.agents[uid]; ok {
+		agent.rejectStatus = reject
+	}
+}
+
+// Run queues a job for agent uid and waits for its result.
+func (c *controlServer) Run(uid uuid.UUID, job Usecases.Job, timeout time.Duration) (Usecases.Job, error) {
+	job.JobID = uuid.New()
+	c.lock.Lock()
+	agent, ok := c.agents[uid]
+	if !ok {
+		c.lock.Unlock()
+		return Usecases.Job{}, errors.New("agent isnt registered")
+	}
+	agent.jobs = append(agent.jobs, job)
+	c.lock.Unlock()
+
+	var result Usecases.Job
+	err := c.waitFor(uid, timeout, func(a *agentState) bool {
+		result, ok = a.results[job.JobID]
+		return ok
+	})
+	if err != nil {
+		return Usecases.Job{}, fmt.Errorf("no result for %s job: %v", job.JobType, err)
+	}
+	return result, nil
+}
+
+func (c *controlServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(res http.ResponseWriter, req *http.Request) {})
+	mux.HandleFunc("/Register", c.register)
+	mux.HandleFunc("/StatusCheck", c.agentAuth(c.statusCheck))
+	mux.HandleFunc("/JobComplete", c.agentAuth(c.jobComplete))
+	mux.HandleFunc("/AuditStatus", c.agentAuth(c.auditStatus))
+	mux.HandleFunc("/Syscall", c.agentAuth(c.syscall))
+	mux.HandleFunc("/SyscallBatch", c.agentAuth(c.syscallBatch))
+	mux.HandleFunc("/DeRegister", c.agentAuth(c.deRegister))
+	mux.HandleFunc("/RulesReloaded", c.agentAuth(c.rulesReloaded))
+	mux.HandleFunc("/JobStream", c.agentAuth(func(res http.ResponseWriter, req *http.Request, agent *agentState) {
+		http.Error(res, "jobs are only polled", http.StatusHTTPVersionNotSupported)
+	}))
+	return mux
+}
+
+// agentAuth takes the agent ID from the verified client certificate, a known
+// agent that is gone gets the 404 that makes it register again.
+func (c *controlServer) agentAuth(h func(http.ResponseWriter, *http.Request, *agentState)) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			http.Error(res, "not authorized: client certificate required", http.StatusUnauthorized)
+			return
+		}
+		uid, err := uuid.Parse(req.TLS.VerifiedChains[0][0].Subject.CommonName)
+		if err != nil || (req.Header.Get("Auth") != "" && req.Header.Get("Auth") != uid.String()) {
+			http.Error(res, "not authorized: certificate doesnt match the agent", http.StatusUnauthorized)
+			return
+		}
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		agent, ok := c.agents[uid]
+		if !ok || agent.deregistered {
+			http.Error(res, "No such agent was found", http.StatusNotFound)
+			return
+		}
+		h(res, req, agent)
+		c.changed()
+	}
+}
+
+func (c *controlServer) register(res http.ResponseWriter, req *http.Request) {
+	var message registration
+	if err := json.NewDecoder(req.Body).Decode(&message); err != nil {
+		http.Error(res, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if message.EnrollToken != c.token {
+		http.Error(res, "not authorized: invalid enrollment token", http.StatusUnauthorized)
+		return
+	}
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 &&
+		req.TLS.VerifiedChains[0][0].Subject.CommonName != message.ID.String() {
+		http.Error(res, "not authorized: certificate doesnt match the agent id", http.StatusUnauthorized)
+		return
+	}
+
+	var issued string
+	if message.CSR != "" {
+		var err error
+		if issued, err = c.signCSR(message.CSR, message.ID); err != nil {
+			http.Error(res, "invalid certificate request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	c.lock.Lock()
+	agent, ok := c.agents[message.ID]
+	if !ok || agent.deregistered {
+		agent = &agentState{results: map[uuid.UUID]Usecases.Job{}}
+		c.agents[message.ID] = agent
+	}
+	agent.registrations++
+	agent.rules = message.Rules
+	c.lock.Unlock()
+	c.changed()
+
+	if issued == "" {
+		return
+	}
+	json.NewEncoder(res).Encode(Interfaces.CertificateMessage{Certificate: issued, CA: string(c.caPEM)})
+}
+
+func (c *controlServer) statusCheck(res http.ResponseWriter, req *http.Request, agent *agentState) {
+	message := Interfaces.BaseMessage{MessageType: "Status"}
+	if len(agent.jobs) > 0 {
+		message = Interfaces.BaseMessage{MessageType: "Job", Data: agent.jobs[0]}
+		agent.jobs = agent.jobs[1:]
+	}
+	json.NewEncoder(res).Encode(message)
+}
+
+func (c *controlServer) jobComplete(res http.ResponseWriter, req *http.Request, agent *agentState) {
+	var result Usecases.Job
+	if err := json.NewDecoder(req.Body).Decode(&result); err != nil {
+		http.Error(res, "invalid body", http.StatusBadRequest)
+		return
+	}
+	agent.results[result.JobID] = result
+}
+
+func (c *controlServer) auditStatus(res http.ResponseWriter, req *http.Request, agent *agentState) {
+	if agent.rejectStatus {
+		http.Error(res, "status reports are rejected", http.StatusServiceUnavailable)
+		return
+	}
+	var status Usecases.StatusReport
+	if err := json.NewDecoder(req.Body).Decode(&status); err != nil {
+		http.Error(res, "invalid body", http.StatusBadRequest)
+		return
+	}
+	agent.status = &status
+}
+
+func (c *controlServer) rulesReloaded(res http.ResponseWriter, req *http.Request, agent *agentState) {
+	var report Domain.ReloadReport
+	if err := json.NewDecoder(req.Body).Decode(&report); err != nil {
+		http.Error(res, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if report.Error == "" {
+		agent.rules = report.Rules
+	}
+	agent.reloads = append(agent.reloads, report)
+}
+
+func (c *controlServer) syscall(res http.ResponseWriter, req *http.Request, agent *agentState) {
+	var event Usecases.GeneralInfo
+	if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+		http.Error(res, "invalid body", http.StatusBadRequest)
+		return
+	}
+	agent.events = append(agent.events, event)
+}
+
+// syscallBatch takes a gzip compressed NDJSON batch and acknowledges it the
+// way the control server does.
+func (c *controlServer) syscallBatch(res http.ResponseWriter, req *http.Request, agent *agentState) {
+	body := io.Reader(req.Body)
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			http.Error(res, "invalid body", http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	ack := struct {
+		Batch    string
+		Accepted int
+		Rejected int
+	}{Batch: req.Header.Get("Batch-ID")}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		var event Usecases.GeneralInfo
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			ack.Rejected++
+			continue
+		}
+		agent.events = append(agent.events, event)
+		ack.Accepted++
+	}
+	json.NewEncoder(res).Encode(ack)
+}
+
+func (c *controlServer) deRegister(res http.ResponseWriter, req *http.Request, agent *agentState) {
+	io.Copy(ioutil.Discard, req.Body)
+	agent.deregistered = true
+}
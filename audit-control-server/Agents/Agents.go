@@ -1,127 +1,544 @@
 package Agents
 
 import(
-	
+
 	"net/http"
 	"encoding/json"
 	"strings"
 	"log"
 	"io/ioutil"
 	"reflect"
+	"sort"
 	"fmt"
 	"time"
 	"sync"
+	"crypto/subtle"
 
-	"../messages"
+	"audit-control-server/messages"
+	"audit-control-server/pkg/Utils"
+	"audit-control-server/Storage"
 
 	"github.com/google/uuid"
 )
 
+/*
+AuditAgents is the registry of enrolled agents. The map is only reached through its methods under lock, every
+agent guards its own state with its own lock. When both are needed the registry lock is taken first.
+*/
 type AuditAgents struct{
-	Agents 	map[uuid.UUID]*Agent
+	EnrollToken	string
+	CA			*Utils.CertificateAuthority
+	Repo		Storage.Repository
+
+	lock		sync.RWMutex
+	agents 		map[uuid.UUID]*Agent
+
+	groupLock	sync.RWMutex
+	groups		map[string]messages.Group
+
+	bulkLock	sync.Mutex
+	bulk		map[uuid.UUID]*BulkOperation
+	bulkOrder	[]uuid.UUID
+}
+
+func NewAuditAgents(enrollToken string, ca *Utils.CertificateAuthority, repo Storage.Repository) *AuditAgents{
+	return &AuditAgents{
+		EnrollToken: enrollToken,
+		CA: ca,
+		Repo: repo,
+		agents: make(map[uuid.UUID]*Agent),
+		groups: make(map[string]messages.Group),
+		bulk: make(map[uuid.UUID]*BulkOperation),
+	}
 }
 
+//Agent fields other than ID are guarded by lock, handlers go through the methods below
 type Agent struct{
-	Rules 			map[string]string
+	Rules 			map[string]messages.AgentRule
 	Hostname 		string
 	UserAgent		string
 	ID				uuid.UUID
-	JobCh			chan messages.Job
 	HostInfo		*messages.Host
+	Labels			map[string]string
 	AuditMessages	[]string
 	JobTrack		map[uuid.UUID]messages.Job
-	RulesLock 		sync.RWMutex
+	queue			[]uuid.UUID
+	inflight		map[uuid.UUID]bool
+	notify			chan struct{}
 	IsPurged		bool
 	AuditStatus		*messages.AuditStatus
+	LastReload		*messages.RulesReload
+	Drift			*messages.RuleDrift
+	lock	 		sync.Mutex
 	lastSeen		time.Time
+	//offline is set once the agent deregistered or stopped checking in, it is kept until an operator deletes it
+	offline			bool
+	//reenrollRequested is set when the agent tried to enroll again without its certificate, reenrollApproved lets
+	//the next such attempt through
+	reenrollRequested	bool
+	reenrollApproved	bool
+	registeredAt	time.Time
+	removed			bool
+	repo			Storage.Repository
+}
+
+func (a *Agent) storeError(err error){
+	if err != nil{
+		log.Printf("couldnt persist agent %s: %v", a.ID, err)
+	}
+}
+
+//persisted reports whether changes should reach the repository, a removed agent must not be written back
+func (a *Agent) persisted() bool{
+	return a.repo != nil && !a.removed
+}
+
+func (a *Agent) save(){
+	if !a.persisted(){
+		return
+	}
+	a.storeError(a.repo.SaveAgent(Storage.AgentRecord{
+		ID: a.ID,
+		Hostname: a.Hostname,
+		HostInfo: a.HostInfo,
+		Labels: a.Labels,
+		IsPurged: a.IsPurged,
+		RegisteredAt: a.registeredAt,
+	}))
+}
+
+//Save persists the agent itself, rules and jobs are saved as they change
+func (a *Agent) Save(){
+	a.lock.Lock()
+	a.save()
+	a.lock.Unlock()
+}
+
+func (a *Agent) saveRule(key string){
+	if a.persisted(){
+		a.storeError(a.repo.SaveRule(a.ID, key, a.Rules[key]))
+	}
+}
+
+//saveRules persists all rules of the agent in a single write, rules it no longer has are removed
+func (a *Agent) saveRules(){
+	if a.persisted(){
+		a.storeError(a.repo.ReplaceRules(a.ID, a.Rules))
+	}
 }
 
+//setRule changes the status of a rule, a new rule goes to the end of the list
+func (a *Agent) setRule(key string, value string){
+	rule, ok := a.Rules[key]
+	if !ok{
+		rule.Position = len(a.Rules)
+	}
+	rule.Status = value
+	a.Rules[key] = rule
+	a.saveRule(key)
+}
 
 func (a *Agent) SetRule(key string, value string){
-	a.RulesLock.Lock()
-	a.Rules[key] = value
-	a.RulesLock.Unlock()
+	a.lock.Lock()
+	a.setRule(key, value)
+	a.lock.Unlock()
 }
 
-func (a *Agent) DeleteRule(key string){
-	a.RulesLock.Lock()
-	if _, ok := a.Rules[key]; ok{
-		delete(a.Rules, key)
+//shiftRules moves the rules at from and after it by delta places, the caller saves them
+func (a *Agent) shiftRules(from int, delta int){
+	for key, rule := range a.Rules{
+		if rule.Position >= from{
+			rule.Position += delta
+			a.Rules[key] = rule
+		}
+	}
+}
+
+//removeRule takes a rule out of the list and closes the gap it leaves, the caller saves the rules
+func (a *Agent) removeRule(key string) bool{
+	rule, ok := a.Rules[key]
+	if !ok{
+		return false
+	}
+	delete(a.Rules, key)
+	a.shiftRules(rule.Position+1, -1)
+	return true
+}
+
+//insertRule puts a rule at position, the rules from there on move one place down. A known rule is moved there.
+func (a *Agent) insertRule(key string, value string, position int){
+	a.removeRule(key)
+	if position < 0 || position > len(a.Rules){
+		position = len(a.Rules)
 	}
-	a.RulesLock.Unlock()
+	a.shiftRules(position, 1)
+	a.Rules[key] = messages.AgentRule{Status: value, Position: position}
+	a.saveRules()
 }
 
-func (a *Agent) GetRule(key string) (string, bool){
-	a.RulesLock.RLock()
+func (a *Agent) deleteRule(key string){
+	if a.removeRule(key){
+		a.saveRules()
+	}
+}
+
+func (a *Agent) DeleteRule(key string){
+	a.lock.Lock()
+	a.deleteRule(key)
+	a.lock.Unlock()
+}
+
+func (a *Agent) GetRule(key string) (messages.AgentRule, bool){
+	a.lock.Lock()
 	value, ok := a.Rules[key]
-	a.RulesLock.RUnlock()
+	a.lock.Unlock()
 	return value, ok
 }
 
+//RulesCopy returns the rules with their status and position, safe to use after the lock is released
+func (a *Agent) RulesCopy() map[string]messages.AgentRule{
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	rules := make(map[string]messages.AgentRule, len(a.Rules))
+	for key, rule := range a.Rules{
+		rules[key] = rule
+	}
+	return rules
+}
+
+//OrderedRules returns the rules in the order the agent has them loaded
+func OrderedRules(rules map[string]messages.AgentRule) []string{
+	ordered := make([]string, 0, len(rules))
+	for key := range rules{
+		ordered = append(ordered, key)
+	}
+	sort.Slice(ordered, func(i, j int) bool{
+		if rules[ordered[i]].Position != rules[ordered[j]].Position{
+			return rules[ordered[i]].Position < rules[ordered[j]].Position
+		}
+		return ordered[i] < ordered[j]
+	})
+	return ordered
+}
+
+//renumber closes the gaps between positions, rules stored without one go last
+func renumber(rules map[string]messages.AgentRule){
+	ordered := OrderedRules(rules)
+	unplaced := 0
+	for _, key := range ordered{
+		if rules[key].Position < 0{
+			unplaced++
+		}
+	}
+	ordered = append(ordered[unplaced:], ordered[:unplaced]...)
+	for i, key := range ordered{
+		rule := rules[key]
+		rule.Position = i
+		rules[key] = rule
+	}
+}
+
+//resetRules replaces the rules with the ones the agent reported, in the order it has them loaded
+func (a *Agent) resetRules(rules []string){
+	a.Rules = make(map[string]messages.AgentRule)
+	for _, rule := range rules{
+		if _, ok := a.Rules[rule]; !ok{
+			a.Rules[rule] = messages.AgentRule{Status: "currentlyOk", Position: len(a.Rules)}
+		}
+	}
+	if a.persisted(){
+		snapshot := make(map[string]messages.AgentRule, len(a.Rules))
+		for key, rule := range a.Rules{
+			snapshot[key] = rule
+		}
+		a.storeError(a.repo.ReplaceRules(a.ID, snapshot))
+	}
+}
+
+//ResetRules replaces all rules with the ones the agent reported as loaded
+func (a *Agent) ResetRules(rules []string){
+	a.lock.Lock()
+	a.resetRules(rules)
+	a.lock.Unlock()
+}
+
+func (a *Agent) trackJob(job messages.Job){
+	a.JobTrack[job.JobID] = job
+	if a.persisted(){
+		a.storeError(a.repo.SaveJob(a.ID, job))
+	}
+	a.pruneJobs()
+}
+
+//TrackJob records the current state of a job in the agent's job history
+func (a *Agent) TrackJob(job messages.Job){
+	a.lock.Lock()
+	a.trackJob(job)
+	a.lock.Unlock()
+}
+
+//JobsCopy returns the job history, safe to use after the lock is released
+func (a *Agent) JobsCopy() map[uuid.UUID]messages.Job{
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	jobs := make(map[uuid.UUID]messages.Job, len(a.JobTrack))
+	for id, job := range a.JobTrack{
+		jobs[id] = job
+	}
+	return jobs
+}
+
+func (a *Agent) touch(){
+	a.lock.Lock()
+	a.lastSeen = time.Now()
+	if a.offline{
+		log.Printf("agent %s is back online", a.ID)
+		a.offline = false
+	}
+	a.lock.Unlock()
+}
+
+//Get returns the registered agent with the given ID
+func (a *AuditAgents) Get(uid uuid.UUID) (*Agent, bool){
+	a.lock.RLock()
+	agent, ok := a.agents[uid]
+	a.lock.RUnlock()
+	return agent, ok
+}
+
+//List returns the registered agents at the time of the call
+func (a *AuditAgents) List() []*Agent{
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	agents := make([]*Agent, 0, len(a.agents))
+	for _, agent := range a.agents{
+		agents = append(agents, agent)
+	}
+	return agents
+}
+
+//Len returns the number of registered agents
+func (a *AuditAgents) Len() int{
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return len(a.agents)
+}
+
+//remove drops the agent from the registry and the repository, the caller holds the registry lock. Only an operator
+//deleting the agent or a failed enrollment removes one, agents that went away are marked offline.
+func (a *AuditAgents) remove(uid uuid.UUID) bool{
+	agent, ok := a.agents[uid]
+	if !ok{
+		return false
+	}
+	delete(a.agents, uid)
+
+	agent.lock.Lock()
+	agent.removed = true
+	if a.Repo != nil{
+		if err := a.Repo.DeleteAgent(uid); err != nil{
+			log.Printf("couldnt remove agent %s from storage: %v", uid, err)
+		}
+	}
+	agent.lock.Unlock()
+	return true
+}
+
+func newJob(jobType string, rule string) messages.Job{
+	return messages.Job{
+		JobType: jobType,
+		Rule: rule,
+		Retry: 0,
+		JobID: uuid.New(),
+		Status: "Waiting in Job queue",
+		State: JobQueued,
+		Created: time.Now(),
+	}
+}
+
+//QueueJob queues a job that doesnt touch a single rule, such as SaveConfig or ShutDown
+func (a *AuditAgents)QueueJob(uid uuid.UUID, jobType string) (messages.Job, *APIError){
+	agent, ok := a.Get(uid)
+	if !ok{
+		return messages.Job{}, ErrAgentNotFound
+	}
+	job := newJob(jobType, "")
+	log.Println(job)
+
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	if !agent.enqueue(&job){
+		return messages.Job{}, ErrQueueFull
+	}
+	agent.trackJob(job)
+	return job, nil
+}
+
 func (a *AuditAgents)OperationalJobs(uid uuid.UUID, jobType string) http.HandlerFunc{
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
-		if agent, ok := a.Agents[uid]; ok{
-			job := messages.Job{
-				JobType: jobType,
-				Retry: 0,
-				JobID: uuid.New(),
-				Status: "Waiting in Job queue",
-			}
-			log.Println(job)
-			agent.JobTrack[job.JobID] = job
-			agent.JobCh <- job	
-		}else{
-			http.Error(res, "Agent Not Found", http.StatusBadRequest)
+		if _, err := a.QueueJob(uid, jobType); err != nil{
+			WriteError(res, req, err)
 		}
 	})
 }
 
+//HostInfo returns the processes and connections the agent reported last
+func (a *AuditAgents)HostInfo(uid uuid.UUID) (*messages.Host, *APIError){
+	agent, ok := a.Get(uid)
+	if !ok{
+		return nil, ErrAgentNotFound
+	}
+	agent.lock.Lock()
+	hostInfo := agent.HostInfo
+	agent.lock.Unlock()
+
+	if hostInfo == nil || reflect.DeepEqual(messages.Host{}, *hostInfo) {
+		return nil, ErrNotFound.Errorf("No host info available")
+	}
+	return hostInfo, nil
+}
+
 func (a *AuditAgents)GetProcesses(uid uuid.UUID) http.HandlerFunc{
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
-		if agent, ok := a.Agents[uid]; ok{
-			if reflect.DeepEqual(messages.Host{}, agent.HostInfo) {
-				log.Printf("No host info available")
-				http.Error(res,"No host info available", http.StatusBadRequest)
-			}
+		hostInfo, errH := a.HostInfo(uid)
+		if errH != nil{
+			WriteError(res, req, errH)
+			return
+		}
 
-			body, errM := json.Marshal(agent.HostInfo)
-			if errM != nil{
-				log.Printf("Error marshaling host info: %v", errM)
-				http.Error(res, "internal server error", http.StatusInternalServerError)
-			}
-			
-			res.Header().Set("Content-Type","application/json")
-			res.Write(body)
-			
-		}else{
-			http.Error(res, "Agent Not Found", http.StatusBadRequest)
+		body, errM := json.Marshal(hostInfo)
+		if errM != nil{
+			log.Printf("Error marshaling host info: %v", errM)
+			WriteError(res, req, ErrInternal)
+			return
 		}
+
+		res.Header().Set("Content-Type","application/json")
+		res.Write(body)
 	})
 }
 
+/*
+QueueSetAuditParams queues a job changing the kernel audit settings of the agent. They are checked here the way the
+agent checks them, so a job that cant succeed isnt queued.
+*/
+func (a *AuditAgents)QueueSetAuditParams(uid uuid.UUID, params messages.AuditParams) (messages.Job, *APIError){
+	agent, ok := a.Get(uid)
+	if !ok{
+		return messages.Job{}, ErrAgentNotFound
+	}
+	if params.RateLimit == nil && params.BacklogLimit == nil && params.BacklogWaitTime == nil && params.Failure == nil && params.Enabled == nil{
+		return messages.Job{}, ErrInvalidArgument.Errorf("no audit setting to change")
+	}
+	for _, limit := range []*int{params.RateLimit, params.BacklogLimit, params.BacklogWaitTime}{
+		if limit != nil && *limit < 0{
+			return messages.Job{}, ErrInvalidArgument.Errorf("rate limit, backlog limit and backlog wait time cant be negative")
+		}
+	}
+	if params.Failure != nil && (*params.Failure < 0 || *params.Failure > 2){
+		return messages.Job{}, ErrInvalidArgument.Errorf("failure mode %d isnt 0 silent, 1 printk or 2 panic", *params.Failure)
+	}
+	if params.Enabled != nil && (*params.Enabled < 0 || *params.Enabled > 2){
+		return messages.Job{}, ErrInvalidArgument.Errorf("enabled %d isnt 0, 1 or 2 immutable", *params.Enabled)
+	}
+
+	job := newJob("SetAuditParams", "")
+	job.Params = &params
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	if !agent.enqueue(&job){
+		return messages.Job{}, ErrQueueFull
+	}
+	agent.trackJob(job)
+	return job, nil
+}
+
+/*
+QueueApplyRuleSet queues a job replacing the rules of the agent with rules. The agent applies all of them or none and
+rolls the set back unless a status report goes through within confirm seconds, 0 leaves the window to the agent. No
+rule of the agent may have a job pending.
+*/
+func (a *AuditAgents)QueueApplyRuleSet(uid uuid.UUID, rules []string, confirm int) (messages.Job, *APIError){
+	agent, ok := a.Get(uid)
+	if !ok{
+		return messages.Job{}, ErrAgentNotFound
+	}
+	if confirm < 0{
+		return messages.Job{}, ErrInvalidArgument.Errorf("confirm cant be negative")
+	}
+	inSet := make(map[string]bool, len(rules))
+	for _, rule := range rules{
+		if strings.TrimSpace(rule) == ""{
+			return messages.Job{}, ErrInvalidArgument.Errorf("the rule set has an empty rule")
+		}
+		if inSet[rule]{
+			return messages.Job{}, ErrInvalidArgument.Errorf("rule %q is in the set twice", rule)
+		}
+		inSet[rule] = true
+	}
+
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	if agent.IsPurged{
+		return messages.Job{}, ErrPurging
+	}
+	for rule, current := range agent.Rules{
+		if current.Status != "currentlyOk"{
+			return messages.Job{}, ErrRuleBusy.Errorf("rule %q is currently %s", rule, current.Status)
+		}
+	}
+
+	job := newJob("ApplyRuleSet", "")
+	job.Rules = append([]string(nil), rules...)
+	job.Confirm = confirm
+	if !agent.enqueue(&job){
+		return messages.Job{}, ErrQueueFull
+	}
+	agent.trackJob(job)
+	for rule := range agent.Rules{
+		if !inSet[rule]{
+			agent.setRule(rule, "ApplyRuleSet: to be deleted")
+		}
+	}
+	for _, rule := range rules{
+		if _, ok := agent.Rules[rule]; !ok{
+			agent.setRule(rule, "ApplyRuleSet: to be added")
+		}
+	}
+	return job, nil
+}
+
+//Purge queues a job removing every rule of the agent, no other rule job is accepted until it completes
+func (a *AuditAgents)Purge(uid uuid.UUID) (messages.Job, *APIError){
+	agent, ok := a.Get(uid)
+	if !ok{
+		return messages.Job{}, ErrAgentNotFound
+	}
+
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	if len(agent.Rules) == 0{
+		return messages.Job{}, ErrNoRules
+	}
+	job := newJob("Purge", "")
+	if !agent.enqueue(&job){
+		return messages.Job{}, ErrQueueFull
+	}
+	agent.IsPurged = true
+	agent.save()
+	agent.trackJob(job)
+	for rule, current := range agent.Rules{
+		if current.Status == "currentlyOk"{
+			agent.setRule(rule, "to be deleted")
+		}
+	}
+	return job, nil
+}
+
 func (a *AuditAgents)PurgeRules(uid uuid.UUID) http.HandlerFunc{
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
-		if agent, ok := a.Agents[uid]; ok{
-			if len(agent.Rules)>0{
-				job := messages.Job{
-					JobType: "Purge",
-					Retry: 0,
-					JobID: uuid.New(),
-					Status: "Waiting in Job queue",
-				}
-				agent.IsPurged = true
-				agent.JobTrack[job.JobID] = job
-				for rule, status := range agent.Rules{
-					if status == "currentlyOk"{
-						agent.SetRule(rule, "to be deleted")
-					}
-				}
-				agent.JobCh <- job
-			}else{
-				http.Error(res, "No available rules present on the agent", http.StatusBadRequest)
-			}
-		}else{
-			http.Error(res, "Agent Not Found", http.StatusBadRequest)
+		if _, err := a.Purge(uid); err != nil{
+			WriteError(res, req, err)
 		}
 	})
 
@@ -140,88 +557,235 @@ func (a *AuditAgents)GetAuditLogs(logs []messages.AuditLog) http.HandlerFunc{
 			res.Header().Set("Content-Type","application/json")
 			res.Header().Set("Access-Control-Allow-Origin", "*")
 			res.Write(encoded)
-			
+
 		}else{
 			http.Error(res, "No available audit log", http.StatusBadRequest)
 		}
 	})
 }
 
-func (a *AuditAgents)NewAgent(data []byte) (Agent, bool, error){
-
-	var aMessage messages.AgentMessage
-	var m Agent
-
-	errU := json.Unmarshal(data, &aMessage)
-	if errU != nil{
-		return m, false, errU
-	}
-
-	if a.IsRegistered(aMessage.ID, aMessage.Hostname){
-		return m, false, nil
-	}
+func NewAgent(aMessage messages.AgentMessage) *Agent{
 
+	m := new(Agent)
 	log.Println("NewAgent is created:", aMessage.ID)
 	m.ID = aMessage.ID
 	m.Hostname = aMessage.Hostname
 	m.HostInfo = aMessage.HostInfo
-	m.Rules = make(map[string]string)
+	m.Labels = aMessage.Labels
+	m.Rules = make(map[string]messages.AgentRule)
 	m.AuditMessages = []string{}
 	m.lastSeen = time.Now()
+	m.registeredAt = m.lastSeen
 	for _, rule := range aMessage.Rules{
-		m.Rules[rule] = "currentlyOk"
+		if _, ok := m.Rules[rule]; !ok{
+			m.Rules[rule] = messages.AgentRule{Status: "currentlyOk", Position: len(m.Rules)}
+		}
 	}
 	m.JobTrack = make(map[uuid.UUID]messages.Job)
-	//increase job queue size
-	m.JobCh = make(chan messages.Job, 100)
+	m.inflight = make(map[uuid.UUID]bool)
+	m.notify = make(chan struct{}, 1)
 
-	return m, true, nil
+	return m
 }
 
+//ValidEnrollToken checks the pre-shared enrollment token sent by an agent.
+//Enrollment is open when the server has no token configured.
+func (a *AuditAgents)ValidEnrollToken(token string) bool{
+	if a.EnrollToken == ""{
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.EnrollToken)) == 1
+}
 
+/*
+enroll adds the agent or refreshes it when its ID is known. A known agent is only refreshed when certified, that is
+it presented a client certificate issued for its ID, otherwise anybody with the enrollment token could take it over.
+The lookup, the hostname check and the insert happen under one lock so two agents racing for a hostname cant both
+get it.
+*/
+func (a *AuditAgents)enroll(aMessage messages.AgentMessage, certified bool) (created bool, err *APIError){
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if agent, ok := a.agents[aMessage.ID]; ok{
+		agent.lock.Lock()
+		if !certified{
+			if !agent.reenrollApproved{
+				//its certificate expired or its state is gone, an operator decides whether it is the same host
+				agent.reenrollRequested = true
+				agent.lock.Unlock()
+				log.Printf("enrollment rejected, agent %s is registered and no certificate for it was presented, it waits for an operator to approve re-enrolling it", aMessage.ID)
+				return false, ErrReenrollment
+			}
+			log.Printf("agent %s re-enrolled with the approval of an operator", aMessage.ID)
+		}
+		agent.reenrollRequested = false
+		agent.reenrollApproved = false
+		log.Println("Agent re-registered:", aMessage.ID)
+		agent.Hostname = aMessage.Hostname
+		agent.HostInfo = aMessage.HostInfo
+		agent.Labels = aMessage.Labels
+		agent.lastSeen = time.Now()
+		agent.offline = false
+		agent.save()
+		agent.resetRules(aMessage.Rules)
+		agent.lock.Unlock()
+		return false, nil
+	}
+
+	if _, ok := a.checkAgent(aMessage.Hostname); ok{
+		return false, ErrHostnameTaken
+	}
+
+	m := NewAgent(aMessage)
+	m.repo = a.Repo
+	m.save()
+	m.resetRules(aMessage.Rules)
+	a.agents[m.ID] = m
+	return true, nil
+}
+
+//Register enrolls a new agent or refreshes a known one. A restarted agent
+//comes back with its stored ID and takes over its existing entry.
 func (a *AuditAgents)Register() http.HandlerFunc{
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
 
 		data, err := ioutil.ReadAll(req.Body)
 		if err != nil{
 			log.Printf("Error reading body: %v", err)
-			http.Error(res, "can't read body", http.StatusInternalServerError)
+			WriteError(res, req, ErrInvalidBody.Errorf("can't read body"))
 			return
 		}
-		
-		m, isRegistered, errR := a.NewAgent(data)
-		if errR != nil{
-			http.Error(res, "", http.StatusInternalServerError)
+
+		var aMessage messages.AgentMessage
+		errU := json.Unmarshal(data, &aMessage)
+		if errU != nil{
+			WriteError(res, req, ErrInvalidBody)
 			return
 		}
 
-		if !isRegistered{
-			http.Error(res, "already registered", http.StatusBadRequest)
+		if errL := validLabels(aMessage.Labels); errL != nil{
+			WriteError(res, req, errL)
 			return
 		}
-		log.Println(m)
-		a.Agents[m.ID] = &m
 
-		res.WriteHeader(http.StatusOK)
+		if !a.ValidEnrollToken(aMessage.EnrollToken){
+			log.Printf("enrollment rejected, invalid token from host: %s", aMessage.Hostname)
+			WriteError(res, req, ErrUnauthorized.Errorf("not authorized: invalid enrollment token"))
+			return
+		}
+
+		//an agent presenting a certificate can only register under the ID it was issued for
+		certified := false
+		if req.TLS != nil && len(req.TLS.VerifiedChains) > 0{
+			if req.TLS.VerifiedChains[0][0].Subject.CommonName != aMessage.ID.String(){
+				log.Printf("enrollment rejected, certificate doesnt match agent: %s", aMessage.ID)
+				WriteError(res, req, ErrUnauthorized.Errorf("not authorized: certificate doesnt match the agent id"))
+				return
+			}
+			certified = true
+		}
+
+		created, errE := a.enroll(aMessage, certified)
+		if errE != nil{
+			WriteError(res, req, errE)
+			return
+		}
+
+		//no certificate is issued for an enrollment that was turned down
+		var issued []byte
+		if aMessage.CSR != "" && a.CA != nil{
+			issued, errU = a.CA.SignCSR([]byte(aMessage.CSR), aMessage.ID.String())
+			if errU != nil{
+				log.Printf("couldnt issue a certificate for agent %s: %v", aMessage.ID, errU)
+				if created{
+					//without a certificate the agent couldnt come back under this ID
+					a.lock.Lock()
+					a.remove(aMessage.ID)
+					a.lock.Unlock()
+				}
+				WriteError(res, req, ErrInvalidArgument.Errorf("invalid certificate request"))
+				return
+			}
+		}
+
+		a.writeCertificate(res, req, issued)
 	})
 }
 
+func (a *AuditAgents)writeCertificate(res http.ResponseWriter, req *http.Request, issued []byte){
+	if issued == nil{
+		res.WriteHeader(http.StatusOK)
+		return
+	}
+	body, errM := json.Marshal(messages.CertificateMessage{Certificate: string(issued), CA: string(a.CA.CertPEM())})
+	if errM != nil{
+		WriteError(res, req, ErrInternal)
+		return
+	}
+	res.Header().Set("Content-Type","application/json")
+	res.Write(body)
+}
 
-func (a *AuditAgents) ListAll() http.HandlerFunc{
+//RenewCertificate issues a new client certificate to an agent authenticated with its current one
+func (a *AuditAgents)RenewCertificate(uid uuid.UUID) http.HandlerFunc{
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
-		agents := []*messages.AgentMessage{}
-		log.Println(a.Agents)
+		if _, ok := a.Get(uid); !ok{
+			WriteError(res, req, ErrAgentNotFound)
+			return
+		}
+		if a.CA == nil{
+			WriteError(res, req, ErrNotImplemented.Errorf("no certificate authority configured"))
+			return
+		}
 
-		//cant send chan
-		for _, agent := range a.Agents{
-			m := GetBaseMessage(agent, "AgentList")
-			log.Println(m.(*messages.AgentMessage).Rules)
-			agents = append(agents, m.(*messages.AgentMessage))
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil{
+			log.Printf("Error reading body: %v", err)
+			WriteError(res, req, ErrInvalidBody.Errorf("can't read body"))
+			return
 		}
-		
-		encoded, errM := json.Marshal(agents)
+		var csr messages.CertificateRequest
+		if errU := json.Unmarshal(data, &csr); errU != nil{
+			WriteError(res, req, ErrInvalidBody)
+			return
+		}
+
+		issued, errS := a.CA.SignCSR([]byte(csr.CSR), uid.String())
+		if errS != nil{
+			log.Printf("couldnt renew the certificate of agent %s: %v", uid, errS)
+			WriteError(res, req, ErrInvalidArgument.Errorf("invalid certificate request"))
+			return
+		}
+		log.Printf("certificate renewed for agent: %s", uid)
+		a.writeCertificate(res, req, issued)
+	})
+}
+
+
+//Summaries lists the agents the way ListAll shows them, ordered by hostname
+func (a *AuditAgents) Summaries() []*messages.AgentMessage{
+	agents := []*messages.AgentMessage{}
+
+	//cant send chan
+	for _, agent := range a.List(){
+		agent.lock.Lock()
+		m := GetBaseMessage(agent, "AgentList")
+		agent.lock.Unlock()
+		agents = append(agents, m.(*messages.AgentMessage))
+	}
+	sort.Slice(agents, func(i, j int) bool{
+		return agents[i].Hostname < agents[j].Hostname
+	})
+	return agents
+}
+
+func (a *AuditAgents) ListAll() http.HandlerFunc{
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
+		encoded, errM := json.Marshal(a.Summaries())
 		if errM != nil{
-			http.Error(res, "internal server error", http.StatusInternalServerError)
+			WriteError(res, req, ErrInternal)
+			return
 		}
 
 		res.Header().Set("Content-Type","application/json")
@@ -230,36 +794,43 @@ func (a *AuditAgents) ListAll() http.HandlerFunc{
 	})
 }
 
+/*
+DeleteEverywhere queues the deletion of rule on every agent having it loaded. It returns the hostnames of the agents
+where another job holds the rule, those are skipped.
+*/
+func (a *AuditAgents) DeleteEverywhere(rule string) (messages.Job, []string){
+	log.Printf("rule to be deleted: " + rule)
+	job := newJob("Delete", rule)
+
+	busy := []string{}
+	for _, agent := range a.List(){
+		agent.lock.Lock()
+		if !agent.IsPurged{
+			if current, ok := agent.Rules[rule]; ok{
+				if current.Status == "currentlyOk" && agent.enqueue(&job){
+					log.Printf("rule status ok")
+					agent.setRule(rule, "to be deleted")
+					agent.trackJob(job)
+				}else{
+					busy = append(busy, agent.Hostname)
+				}
+			}
+		}
+		agent.lock.Unlock()
+	}
+	return job, busy
+}
 
 func (a *AuditAgents) DeleteAll() http.HandlerFunc{
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
 		if _, ok := req.URL.Query()["rule"]; !ok{
-			http.Error(res,"missing parameter", http.StatusBadRequest)
-		}
-		log.Printf("rule to be deleted: " + req.URL.Query().Get("rule"))
-		rule := req.URL.Query().Get("rule")
-
-		job := messages.Job{
-			JobType: "Delete",
-			Rule:	rule,
-			Retry: 0,
-			JobID: uuid.New(),
-			Status: "Waiting in Job queue",
-		}
-
-		for _, agent := range a.Agents{
-			if !agent.IsPurged{
-				if status, ok := agent.GetRule(rule); ok{
-					if status == "currentlyOk"{
-						log.Printf("rule status ok")
-						agent.SetRule(rule, "to be deleted")
-						agent.JobTrack[job.JobID] = job
-						agent.JobCh <- job
-					}else{
-						http.Error(res, "there is another job currently assigned to this rule on this agent", http.StatusBadRequest)
-					}
-				}
-			}
+			WriteError(res, req, ErrMissingParam)
+			return
+		}
+
+		_, busy := a.DeleteEverywhere(req.URL.Query().Get("rule"))
+		if len(busy) > 0{
+			WriteError(res, req, ErrRuleBusy.Errorf("there is another job currently assigned to this rule on: %s", strings.Join(busy, ", ")))
 		}
 	})
 }
@@ -283,6 +854,10 @@ func GetBaseMessage(data interface{}, Type string) (interface{}){
 		agent.ID = data.(*Agent).ID
 		agent.RuleCount = len(data.(*Agent).Rules)
 		agent.HostInfo = data.(*Agent).HostInfo
+		agent.Labels = data.(*Agent).Labels
+		agent.RulesDrifted = data.(*Agent).Drift != nil && data.(*Agent).Drift.Drifted
+		agent.Offline = data.(*Agent).offline
+		agent.ReenrollRequested = data.(*Agent).reenrollRequested
 		return agent
 	default:
 		return nil
@@ -291,83 +866,124 @@ func GetBaseMessage(data interface{}, Type string) (interface{}){
 
 
 
+//QueueAddRule queues a job loading rule on the agent, at the end of its list or in front of it for -A rules
+func (a *AuditAgents)QueueAddRule(uid uuid.UUID, rule string) (messages.Job, *APIError){
+	return a.QueueInsertRule(uid, rule, "", "")
+}
+
+/*
+QueueInsertRule queues a job loading rule on the agent right before or after one of its rules, with neither it is
+appended. The rule is recorded at the position it is expected to get, the agent reports the one it got.
+*/
+func (a *AuditAgents)QueueInsertRule(uid uuid.UUID, rule string, before string, after string) (messages.Job, *APIError){
+	agent, ok := a.Get(uid)
+	if !ok{
+		return messages.Job{}, ErrAgentNotFound
+	}
+	log.Printf("rule to be added: " + rule)
+	if before != "" && after != ""{
+		return messages.Job{}, ErrInvalidArgument.Errorf("a rule goes either before or after another one")
+	}
+
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	if agent.IsPurged{
+		return messages.Job{}, ErrPurging
+	}
+	if current, ok := agent.Rules[rule]; ok{
+		if current.Status == "currentlyOk"{
+			return messages.Job{}, ErrRuleExists
+		}
+		return messages.Job{}, ErrRuleBusy.Errorf("this rule is currently %s", current.Status)
+	}
+
+	position := len(agent.Rules)
+	if strings.HasPrefix(strings.TrimSpace(rule), "-A "){
+		position = 0
+	}
+	if anchor := before + after; anchor != ""{
+		current, ok := agent.Rules[anchor]
+		if !ok{
+			return messages.Job{}, ErrRuleNotFound.Errorf("the agent has no rule %q to place it next to", anchor)
+		}
+		position = current.Position
+		if after != ""{
+			position++
+		}
+	}
+
+	job := newJob("AddRule", rule)
+	job.Before = before
+	job.After = after
+	if !agent.enqueue(&job){
+		return messages.Job{}, ErrQueueFull
+	}
+	agent.trackJob(job)
+	agent.insertRule(rule, "to be added", position)
+	return job, nil
+}
+
 func (a *AuditAgents)AddRule(uid uuid.UUID) http.HandlerFunc{
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
-		if agent, ok := a.Agents[uid]; ok{
-			if !agent.IsPurged{
-				if _, ok := req.URL.Query()["rule"]; !ok{
-					http.Error(res,"missing parameter", http.StatusBadRequest)
-				}
-				log.Printf("rule to be added: " + req.URL.Query().Get("rule"))
-				rule := req.URL.Query().Get("rule")
-			
-				if status,ok := agent.GetRule(rule); !ok{
-					job := messages.Job{
-						JobType: "AddRule",
-						Rule:	rule,
-						Retry: 0,
-						JobID: uuid.New(),
-						Status: "Waiting in Job queue",
-					}
-					agent.JobTrack[job.JobID] = job
-					agent.JobCh <- job
-					agent.SetRule(rule, "to be added") 
-				}else{
-					if status == "currentlyOk" {
-						http.Error(res, "this rule is already present on the agent", http.StatusBadRequest)
-						return
-					}else if status == "to be deleted" {
-						http.Error(res, "this rule is currently getting deleted", http.StatusBadRequest)
-						return
-					}
-				}
-			}else{
-				http.Error(res, "IsPurged : true", http.StatusBadRequest)
-			}
-			
-		}else{
-			http.Error(res, "Agent Not Found", http.StatusNotFound)
+		if _, ok := req.URL.Query()["rule"]; !ok{
+			WriteError(res, req, ErrMissingParam)
+			return
+		}
+		query := req.URL.Query()
+		if _, err := a.QueueInsertRule(uid, query.Get("rule"), query.Get("before"), query.Get("after")); err != nil{
+			WriteError(res, req, err)
 		}
 	})
 
 }
 
-func (a *AuditAgents)CheckAgent(hostname string)(*Agent, bool){
-	for _, agent := range a.Agents{
-		if agent.Hostname == hostname{
+//checkAgent looks an agent up by hostname, the caller holds the registry lock
+func (a *AuditAgents)checkAgent(hostname string)(*Agent, bool){
+	for _, agent := range a.agents{
+		agent.lock.Lock()
+		match := agent.Hostname == hostname
+		agent.lock.Unlock()
+		if match{
 			return agent, true
 		}
 	}
 	return nil, false
 }
 
+func (a *AuditAgents)CheckAgent(hostname string)(*Agent, bool){
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.checkAgent(hostname)
+}
+
 func (a *AuditAgents)GetRulesByHostname(hostname string) http.HandlerFunc{
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
 		agent, isAgent := a.CheckAgent(hostname)
 		if isAgent {
-			data, errM := json.Marshal(agent.Rules)
+			data, errM := json.Marshal(agent.RulesCopy())
 			if errM != nil{
 				log.Printf("Error reading body: %v", errM)
-				http.Error(res, "can't unmarshal into struct", http.StatusBadRequest)
+				WriteError(res, req, ErrInternal)
+				return
 			}
 			res.Header().Set("Content-Type","application/json")
 			res.Write(data)
 		}else{
-			http.Error(res, "Agent Not Found", http.StatusNotFound)
+			WriteError(res, req, ErrAgentNotFound)
 		}
-	})	
+	})
 }
 
 func (a *AuditAgents) StatusCheckIn(uid uuid.UUID) http.HandlerFunc{
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
-		if agent, ok := a.Agents[uid]; ok{
+		if agent, ok := a.Get(uid); ok{
 			log.Println("checking in:", uid)
-			if len(agent.JobCh) >= 1{
+			agent.touch()
+			agent.lock.Lock()
+			job, ok := agent.nextJob()
+			agent.lock.Unlock()
+			if ok{
 				log.Printf(uid.String())
-				job := <- agent.JobCh
-				j := agent.JobTrack[job.JobID]
-				j.Status = "Dispacted to agent"
-				agent.JobTrack[job.JobID] = j
 				message := GetBaseMessage(job, "Job")
 				b, errM := json.Marshal(message)
 				if errM != nil {
@@ -387,9 +1003,8 @@ func (a *AuditAgents) StatusCheckIn(uid uuid.UUID) http.HandlerFunc{
 				res.Header().Set("Access-Control-Allow-Origin", "*")
 				res.Write(b)
 			}
-			agent.lastSeen = time.Now()
 		}else{
-			http.Error(res, "Agent Not Found", http.StatusNotFound)
+			WriteError(res, req, ErrAgentNotFound)
 		}
 	})
 }
@@ -398,299 +1013,375 @@ func (a *AuditAgents) StatusCheckIn(uid uuid.UUID) http.HandlerFunc{
 
 func (a *AuditAgents)JobComplete(uid uuid.UUID) http.HandlerFunc{
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
-		if agent, ok := a.Agents[uid]; ok{
-			data, err := ioutil.ReadAll(req.Body)
-			if err != nil{
-				log.Printf("Error reading body: %v", err)
-				http.Error(res, "can't read body", http.StatusBadRequest)
-			}
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil{
+			log.Printf("Error reading body: %v", err)
+			WriteError(res, req, ErrInvalidBody.Errorf("can't read body"))
+			return
+		}
 
-			var JobResult messages.Job
-			errU := json.Unmarshal(data, &JobResult)
-			if errU != nil{
-				log.Printf("Error reading body: %v", err)
-				http.Error(res, "can't unmarshal into struct", http.StatusBadRequest)
-			}
-			fmt.Println(JobResult)
-			if job, ok := agent.JobTrack[JobResult.JobID]; ok{
-				switch JobResult.JobType {
-				case "Delete":
-					if _, ok := agent.GetRule(JobResult.Rule); ok{
-						if JobResult.Status == "JobSuccess" {
-							log.Printf("Delete job success")
-							job.Status = JobResult.Status
-							job.Message = "Rule was successfully deleted"
-							agent.DeleteRule(JobResult.Rule)
-							
-						}else{
-							agent.SetRule(JobResult.Rule, "DeleteFailed : retrying")
-							job.Status = JobResult.Status
-							job.Message = JobResult.Message
-							if job.Retry < 5{
-								job.Retry += 1
-								JobResult.Retry += 1
-								agent.JobCh <- JobResult
-								log.Printf("agent couldnt execute the job, agentID: %s", agent.ID)
-							}else{
-								agent.SetRule(JobResult.Rule,"Delete Operation failed : retrycount=5")
-							}
-						}
-					}
-				case "AddRule":
-					if _, ok := agent.GetRule(JobResult.Rule); ok{
-						if JobResult.Status == "JobSuccess"{
-							job.Status = JobResult.Status
-							job.Message = "Rule was sucessfully added"
-							agent.SetRule(JobResult.Rule,"currentlyOk")
-						}else{
-							job.Status = JobResult.Status
-							job.Message = JobResult.Message
-							if JobResult.Status == "InvalidRule"{
-								agent.DeleteRule(JobResult.Rule)
-								log.Printf("this is invalid rule: %s", JobResult.Rule)
-							}else if strings.Contains(JobResult.Message, "rule exists"){
-								agent.DeleteRule(JobResult.Rule)
-								log.Printf("this is a duplicated rule: %s", JobResult.Rule)
-							}else{
-								agent.SetRule(JobResult.Rule,"Addrule : retrying")
-								job.Status = JobResult.Status
-								job.Message = JobResult.Message
-								if JobResult.Retry < 5{
-									job.Retry += 1
-									agent.JobCh <- JobResult
-									log.Printf("agent couldnt execute the job, agentID: %s", agent.ID)
-								}else{
-									agent.DeleteRule(JobResult.Rule)
-								}
-							}
-						}
-					}
-				case "Purge":
-					if JobResult.Status == "JobSuccess"{
-						for rule := range agent.Rules{
-							agent.DeleteRule(rule)
-						}
-						agent.IsPurged = false
-						job.Status = JobResult.Status
-						job.Message = "Rules were successfully purged"
-					}else{
-						for rule, status := range agent.Rules{
-							if status == "currentlyOk"{
-								agent.SetRule(rule, "PurgeFailed: retrying")
-							}
-						}
-						job.Status = JobResult.Status
-						job.Message = JobResult.Message
-						if JobResult.Retry < 5{
-							job.Retry += 1
-							JobResult.Retry += 1
-							agent.JobCh <- JobResult
-							log.Printf("agent couldnt execute the job, agentID: %s", agent.ID)
-						}else{
-							agent.SetRule(JobResult.Rule, "Purge Operation failed : retrycount=5")
-						}
-					}
-				case "ShutDown":
-					if JobResult.Status == "JobSuccess"{
-						job.Status = JobResult.Status
-						job.Message = "Agent was successfully terminated"
-					}else{
-						job.Status = JobResult.Status
-						job.Message = JobResult.Message
-						if JobResult.Retry < 5{
-							job.Retry += 1
-							JobResult.Retry += 1
-							agent.JobCh <- JobResult
-							log.Printf("agent couldnt execute the job, agentID: %s", agent.ID)
-						}else{
-							job.Message = "ShutDown Operation failed : retrycount=5"
-						}
-					}
-				case "SaveConfig":
-					if JobResult.Status == "JobSuccess"{
-						job.Status = JobResult.Status
-						job.Message = "Current config was successfully changed"
-					}else{
-						job.Status = JobResult.Status
-						job.Message = JobResult.Message
-						if JobResult.Retry < 5{
-							job.Retry += 1
-							JobResult.Retry += 1
-							agent.JobCh <- JobResult
-							log.Printf("agent couldnt execute the job, agentID: %s", agent.ID)
-						}else{
-							job.Message = "Save config failed: retrycount=5"
-						}
-					}
-				case "StartAudit":
-					job.Status = JobResult.Status
-					job.Message = "Current config was successfully changed"
-				case "StopAudit":
-					job.Status = JobResult.Status
-					job.Message = "Current config was successfully changed"
+		var JobResult messages.Job
+		errU := json.Unmarshal(data, &JobResult)
+		if errU != nil{
+			log.Printf("Error reading body: %v", errU)
+			WriteError(res, req, ErrInvalidBody)
+			return
+		}
+		fmt.Println(JobResult)
 
-				}
+		if errC := a.CompleteJob(uid, JobResult); errC != nil{
+			WriteError(res, req, errC)
+		}
+	})
+}
 
-				agent.JobTrack[JobResult.JobID] = job
-			}else{
-				http.Error(res, "No such job was issued by the control server", http.StatusBadRequest)
-			}
-		}else{
-			http.Error(res, "Agent was not found", http.StatusNotFound)
+//CompleteJob records the result an agent sent for one of its jobs, whether it came from JobComplete or a job stream
+func (a *AuditAgents)CompleteJob(uid uuid.UUID, result messages.Job) *APIError{
+	agent, ok := a.Get(uid)
+	if !ok{
+		return ErrAgentNotFound
+	}
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	job, ok := agent.JobTrack[result.JobID]
+	if !ok{
+		return ErrUnknownJob
+	}
+	agent.complete(job, result)
+	return nil
+}
+
+//Summary returns the agent the way ListAll shows it
+func (a *AuditAgents)Summary(uid uuid.UUID) (*messages.AgentMessage, *APIError){
+	agent, ok := a.Get(uid)
+	if !ok{
+		return nil, ErrAgentNotFound
+	}
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	return GetBaseMessage(agent, "AgentList").(*messages.AgentMessage), nil
+}
+
+//Rules returns the rules of the agent with their status and position
+func (a *AuditAgents)Rules(uid uuid.UUID) (map[string]messages.AgentRule, *APIError){
+	agent, ok := a.Get(uid)
+	if !ok{
+		return nil, ErrAgentNotFound
+	}
+	return agent.RulesCopy(), nil
+}
+
+//Jobs returns the job history of the agent, oldest first
+func (a *AuditAgents)Jobs(uid uuid.UUID) ([]messages.Job, *APIError){
+	agent, ok := a.Get(uid)
+	if !ok{
+		return nil, ErrAgentNotFound
+	}
+	jobs := []messages.Job{}
+	for _, job := range agent.JobsCopy(){
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool{
+		if !jobs[i].Created.Equal(jobs[j].Created){
+			return jobs[i].Created.Before(jobs[j].Created)
 		}
+		return jobs[i].JobID.String() < jobs[j].JobID.String()
 	})
+	return jobs, nil
+}
+
+//Job returns a single job of the agent
+func (a *AuditAgents)Job(uid uuid.UUID, jobID uuid.UUID) (messages.Job, *APIError){
+	agent, ok := a.Get(uid)
+	if !ok{
+		return messages.Job{}, ErrAgentNotFound
+	}
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	job, ok := agent.JobTrack[jobID]
+	if !ok{
+		return messages.Job{}, ErrJobNotFound
+	}
+	return job, nil
+}
+
+//AuditStatusOf returns the audit status the agent reported last
+func (a *AuditAgents)AuditStatusOf(uid uuid.UUID) (*messages.AuditStatus, *APIError){
+	agent, ok := a.Get(uid)
+	if !ok{
+		return nil, ErrAgentNotFound
+	}
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	return agent.AuditStatus, nil
 }
 
 func (a *AuditAgents)GetJobs(uid uuid.UUID) http.HandlerFunc{
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
-		if agent, ok := a.Agents[uid]; ok{
-			if len(agent.JobTrack)>0{
-				data, errM := json.Marshal(agent.JobTrack)
+		if agent, ok := a.Get(uid); ok{
+			jobs := agent.JobsCopy()
+			if len(jobs)>0{
+				data, errM := json.Marshal(jobs)
 				if errM != nil{
 					log.Printf("Error reading body: %v", errM)
-					http.Error(res, "can't unmarshal into struct", http.StatusBadRequest)
+					WriteError(res, req, ErrInternal)
+					return
 				}
 				res.Header().Set("Content-Type","application/json")
 				res.Write(data)
 			}else{
-				http.Error(res, "No job to be tracked", http.StatusBadRequest)
+				WriteError(res, req, ErrJobNotFound.Errorf("No job to be tracked"))
 			}
-			
+
 		}else{
-			http.Error(res, "Agent Not Found", http.StatusNotFound)
+			WriteError(res, req, ErrAgentNotFound)
 		}
 	})
 }
 
 func (a *AuditAgents)GetRules(uid uuid.UUID) http.HandlerFunc{
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
-		if agent, ok := a.Agents[uid]; ok{
-			data, errM := json.Marshal(agent.Rules)
+		if agent, ok := a.Get(uid); ok{
+			data, errM := json.Marshal(agent.RulesCopy())
 			if errM != nil{
 				log.Printf("Error reading body: %v", errM)
-				http.Error(res, "can't unmarshal into struct", http.StatusBadRequest)
+				WriteError(res, req, ErrInternal)
+				return
 			}
 			res.Header().Set("Content-Type","application/json")
 			res.Write(data)
 		}else{
-			http.Error(res, "Agent Not Found", http.StatusNotFound)
+			WriteError(res, req, ErrAgentNotFound)
 		}
 	})
-	
+
 }
 
 func (a *AuditAgents)GetAuditStatus(uid uuid.UUID) http.HandlerFunc{
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
-		if agent, ok := a.Agents[uid]; ok{
+		if agent, ok := a.Get(uid); ok{
+			agent.lock.Lock()
 			data, errM := json.Marshal(agent.AuditStatus)
+			agent.lock.Unlock()
 			if errM != nil{
 				log.Printf("Error reading body: %v", errM)
-				http.Error(res, "can't unmarshal into struct", http.StatusBadRequest)
+				WriteError(res, req, ErrInternal)
+				return
 			}
 			res.Header().Set("Content-Type","application/json")
 			res.Write(data)
 		}else{
-			http.Error(res, "Agent Not Found", http.StatusNotFound)
+			WriteError(res, req, ErrAgentNotFound)
 		}
 	})
-	
-} 
+
+}
 
 func (a *AuditAgents)AuditStatus(uid uuid.UUID) http.HandlerFunc{
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
-		if agent, ok := a.Agents[uid]; ok{
+		if agent, ok := a.Get(uid); ok{
 			data, err := ioutil.ReadAll(req.Body)
 			if err != nil{
 				log.Printf("Error reading body: %v", err)
-				http.Error(res, "can't read body", http.StatusBadRequest)
+				WriteError(res, req, ErrInvalidBody.Errorf("can't read body"))
+				return
 			}
 
 			var status *messages.AuditStatus
 			errU := json.Unmarshal(data, &status)
 			if errU != nil{
-				log.Printf("Error unmarshaling data: %v", err)
-				http.Error(res, "body not valid", http.StatusBadRequest)
+				log.Printf("Error unmarshaling data: %v", errU)
+				WriteError(res, req, ErrInvalidBody)
+				return
 			}
+			agent.lock.Lock()
 			agent.AuditStatus = status
+			agent.checkDrift()
+			agent.lock.Unlock()
 
 		}else{
-			http.Error(res, "Agent Not Found", http.StatusNotFound)
+			WriteError(res, req, ErrAgentNotFound)
 		}
 	})
 }
 
+//RulesReloaded takes the report of an agent that reloaded its rules file, the agent's rules become the ones it has loaded now
+func (a *AuditAgents)RulesReloaded(uid uuid.UUID) http.HandlerFunc{
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
+		agent, ok := a.Get(uid)
+		if !ok{
+			WriteError(res, req, ErrAgentNotFound)
+			return
+		}
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil{
+			log.Printf("Error reading body: %v", err)
+			WriteError(res, req, ErrInvalidBody.Errorf("can't read body"))
+			return
+		}
+		var report messages.RulesReload
+		if errU := json.Unmarshal(data, &report); errU != nil{
+			log.Printf("Error unmarshaling data: %v", errU)
+			WriteError(res, req, ErrInvalidBody)
+			return
+		}
+		report.Received = time.Now().UTC()
+
+		agent.lock.Lock()
+		if report.Error == ""{
+			agent.resetRules(report.Rules)
+		}
+		if jobID, errP := uuid.Parse(report.RolledBack); errP == nil{
+			if job, ok := agent.JobTrack[jobID]; ok && job.State == JobSucceeded{
+				job.State = JobRolledBack
+				job.Message = "the agent rolled the rule set back, no status report reached the server in time"
+				agent.trackJob(job)
+			}
+		}
+		agent.LastReload = &report
+		agent.lock.Unlock()
+		log.Printf("agent %s reloaded its rules on %s: %d added, %d deleted, %d failed", uid, report.Source, len(report.Added), len(report.Deleted), len(report.Failed))
+	})
+}
+
+//LastReloadOf returns the rule reload the agent reported last
+func (a *AuditAgents)LastReloadOf(uid uuid.UUID) (*messages.RulesReload, *APIError){
+	agent, ok := a.Get(uid)
+	if !ok{
+		return nil, ErrAgentNotFound
+	}
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	return agent.LastReload, nil
+}
+
 func (a *AuditAgents)UpdateInfo(uid uuid.UUID) http.HandlerFunc{
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
-		if agent, ok := a.Agents[uid]; ok{
+		if agent, ok := a.Get(uid); ok{
 			data, err := ioutil.ReadAll(req.Body)
 			if err != nil{
 				log.Printf("Error reading body: %v", err)
-				http.Error(res, "can't read body", http.StatusBadRequest)
+				WriteError(res, req, ErrInvalidBody.Errorf("can't read body"))
+				return
 			}
 			var hostInfo *messages.Host
 			errU := json.Unmarshal(data, &hostInfo)
 			if errU != nil{
-				log.Printf("Error unmarshaling data: %v", err)
-				http.Error(res, "body not valid", http.StatusBadRequest)
+				log.Printf("Error unmarshaling data: %v", errU)
+				WriteError(res, req, ErrInvalidBody)
+				return
 			}
+			agent.lock.Lock()
 			agent.HostInfo = hostInfo
+			agent.save()
+			agent.lock.Unlock()
 
 		}else{
 			log.Printf("no agent found with this uid")
-			http.Error(res, "Agent Not Found", http.StatusNotFound)
+			WriteError(res, req, ErrAgentNotFound)
 		}
 	})
 }
 
 
+//QueueDeleteRule queues a job removing rule from the agent
+func (a *AuditAgents)QueueDeleteRule(uid uuid.UUID, rule string) (messages.Job, *APIError){
+	agent, ok := a.Get(uid)
+	if !ok{
+		return messages.Job{}, ErrAgentNotFound
+	}
+	log.Printf(rule)
+
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	if agent.IsPurged{
+		return messages.Job{}, ErrPurging
+	}
+	current, ok := agent.Rules[rule]
+	if !ok{
+		return messages.Job{}, ErrRuleNotFound
+	}
+	if current.Status != "currentlyOk"{
+		return messages.Job{}, ErrRuleBusy
+	}
+
+	job := newJob("Delete", rule)
+	if !agent.enqueue(&job){
+		return messages.Job{}, ErrQueueFull
+	}
+	agent.trackJob(job)
+	agent.setRule(rule, "to be deleted")
+	return job, nil
+}
+
 func (a *AuditAgents)DeleteRule(uid uuid.UUID) http.HandlerFunc{
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
-		if agent, ok := a.Agents[uid]; ok{
-			if !agent.IsPurged{
-				if _, ok := req.URL.Query()["rule"]; !ok{
-					http.Error(res,"missing parameter", http.StatusBadRequest)
-				}
-				log.Printf(req.URL.Query().Get("rule"))
-				rule := req.URL.Query().Get("rule")
-				if status,ok := agent.GetRule(rule); ok{
-					if status == "currentlyOk"{
-						job := messages.Job{
-							JobType: "Delete",
-							Rule:	rule,
-							Retry: 0,
-							JobID: uuid.New(),
-							Status: "Waiting in Job queue",
-						}
-						agent.JobTrack[job.JobID] = job
-						agent.JobCh <- job
-						agent.SetRule(rule, "to be deleted")
-					}else{
-						http.Error(res, "there is another job currently assigned to this rule on this agent", http.StatusBadRequest)
-					}
-				}else{
-					http.Error(res, "invalid rule", http.StatusBadRequest)
-				}
-			}else{
-				http.Error(res, "Purge: true", http.StatusBadRequest)
-			}
-		}else{
-			http.Error(res, "Agent Not Found", http.StatusNotFound)
+		if _, ok := req.URL.Query()["rule"]; !ok{
+			WriteError(res, req, ErrMissingParam)
+			return
+		}
+		if _, err := a.QueueDeleteRule(uid, req.URL.Query().Get("rule")); err != nil{
+			WriteError(res, req, err)
 		}
 	})
 }
 
+//DeRegister marks a stopping agent offline, it keeps its rules and job history for when it comes back
 func (a *AuditAgents) DeRegister(uid uuid.UUID) http.HandlerFunc{
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
-		if _, ok := a.Agents[uid]; ok{
-			delete(a.Agents, uid)
-			log.Printf("Agent deregistered")
-		}else{
+		agent, ok := a.Get(uid)
+		if !ok{
 			log.Printf("no agent found with this uid")
-			http.Error(res, "Agent Not Found", http.StatusNotFound)
+			WriteError(res, req, ErrAgentNotFound)
+			return
 		}
+		agent.lock.Lock()
+		agent.offline = true
+		agent.lock.Unlock()
+		log.Printf("Agent deregistered: %s", uid)
 	})
 }
 
+//ApproveReenrollment lets the agent enroll once more with the enrollment token alone and get a new certificate
+func (a *AuditAgents) ApproveReenrollment(uid uuid.UUID) *APIError{
+	agent, ok := a.Get(uid)
+	if !ok{
+		return ErrAgentNotFound
+	}
+	agent.lock.Lock()
+	agent.reenrollApproved = true
+	agent.lock.Unlock()
+	log.Printf("re-enrolling agent %s was approved", uid)
+	return nil
+}
+
+//Delete removes the agent together with its rules and job history, an agent coming back afterwards enrolls anew
+func (a *AuditAgents) Delete(uid uuid.UUID) *APIError{
+	a.lock.Lock()
+	removed := a.remove(uid)
+	a.lock.Unlock()
+	if !removed{
+		return ErrAgentNotFound
+	}
+	log.Printf("Agent deleted: %s", uid)
+	return nil
+}
+
+//Sweep marks the agents that didnt check in for longer than maxAge offline and returns how many it marked
+func (a *AuditAgents) Sweep(maxAge time.Duration) int{
+	marked := 0
+	for _, agent := range a.List(){
+		agent.lock.Lock()
+		if !agent.offline && time.Since(agent.lastSeen) > maxAge{
+			agent.offline = true
+			marked++
+			log.Printf("agent %s didnt check in since %s, it is offline", agent.ID, agent.lastSeen.Format(time.RFC3339))
+		}
+		agent.lock.Unlock()
+	}
+	return marked
+}
+
 func (a *AuditAgents) CleanUp(){
 
 	fmt.Println("clean up routine has started")
@@ -698,27 +1389,58 @@ func (a *AuditAgents) CleanUp(){
 
 		time.Sleep(2*time.Minute)
 
-		for uid, agent := range a.Agents{
-			agent.RulesLock.RLock()
-			if time.Since(agent.lastSeen) > 1 * time.Minute{
-				delete(a.Agents, uid)
-			}
-			agent.RulesLock.Unlock()
-		}
+		a.Sweep(1 * time.Minute)
 		fmt.Println("clean up routine continues ")
 
 	}
 }
 
-func (a *AuditAgents) IsRegistered(id uuid.UUID, hostname string) bool{
-	if _, ok := a.Agents[id]; ok{
-		return true
+/*
+Restore rebuilds the agents from the repository after a restart. Jobs that were still waiting in the queue are queued
+again, restored agents get a full clean up period to check in before they are marked offline.
+*/
+func (a *AuditAgents) Restore() error{
+	if a.Repo == nil{
+		return nil
+	}
+	if err := a.loadGroups(); err != nil{
+		return err
+	}
+	records, err := a.Repo.Agents()
+	if err != nil{
+		return err
 	}
 
-	for _, agent := range a.Agents{
-		if agent.Hostname == hostname{
-			return true
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, record := range records{
+		m := NewAgent(messages.AgentMessage{ID: record.ID, Hostname: record.Hostname, HostInfo: record.HostInfo, Labels: record.Labels})
+		m.IsPurged = record.IsPurged
+		m.registeredAt = record.RegisteredAt
+		m.repo = a.Repo
+
+		if m.Rules, err = a.Repo.Rules(record.ID); err != nil{
+			return err
+		}
+		renumber(m.Rules)
+		if m.JobTrack, err = a.Repo.Jobs(record.ID); err != nil{
+			return err
 		}
+		m.restoreJobs()
+		m.pruneJobs()
+		a.agents[m.ID] = m
+	}
+	log.Printf("restored %d agents from storage", len(records))
+	return nil
+}
+
+func (a *AuditAgents) IsRegistered(id uuid.UUID, hostname string) bool{
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if _, ok := a.agents[id]; ok{
+		return true
 	}
-	return false
+	_, ok := a.checkAgent(hostname)
+	return ok
 }
@@ -0,0 +1,363 @@
+package Agents
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"audit-control-server/Storage"
+	"audit-control-server/messages"
+
+	"github.com/google/uuid"
+)
+
+const testToken = "test-token"
+
+func TestMain(m *testing.M) {
+	//the handlers log every check-in
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func newTestAgents(t *testing.T) (*AuditAgents, Storage.Repository) {
+	t.Helper()
+	store, err := Storage.Open(filepath.Join(t.TempDir(), "agents.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := Storage.NewKVRepository(store)
+	return NewAuditAgents(testToken, nil, repo), repo
+}
+
+//register calls the Register handler, a non empty cn stands for a verified client certificate issued for it
+func register(a *AuditAgents, message messages.AgentMessage, cn string) int {
+	message.EnrollToken = testToken
+	body, _ := json.Marshal(message)
+	req := httptest.NewRequest("POST", "/Register", bytes.NewReader(body))
+	if cn != "" {
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+	}
+	rec := httptest.NewRecorder()
+	a.Register().ServeHTTP(rec, req)
+	return rec.Code
+}
+
+//checkIn calls the StatusCheckIn handler and returns the job it handed out, if any
+func checkIn(a *AuditAgents, uid uuid.UUID) (messages.Job, int) {
+	rec := httptest.NewRecorder()
+	a.StatusCheckIn(uid).ServeHTTP(rec, httptest.NewRequest("GET", "/StatusCheck", nil))
+	var message messages.BaseMessage
+	if rec.Code == http.StatusOK {
+		json.Unmarshal(rec.Body.Bytes(), &message)
+	}
+	if message.MessageType != "Job" {
+		return messages.Job{}, rec.Code
+	}
+	return message.Data, rec.Code
+}
+
+//completeJob sends a result through the JobComplete handler
+func completeJob(a *AuditAgents, uid uuid.UUID, result messages.Job) int {
+	body, _ := json.Marshal(result)
+	rec := httptest.NewRecorder()
+	a.JobComplete(uid).ServeHTTP(rec, httptest.NewRequest("POST", "/JobComplete", bytes.NewReader(body)))
+	return rec.Code
+}
+
+/*
+TestRegistryConcurrency hammers the registry the way a fleet does: agents register again and again, check in, take
+jobs and report them done while the clean up sweeps and operators list the agents. Run it with -race.
+*/
+func TestRegistryConcurrency(t *testing.T) {
+	a, repo := newTestAgents(t)
+	const agents, rounds = 8, 40
+
+	ids := make([]uuid.UUID, agents)
+	for i := range ids {
+		ids[i] = uuid.New()
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, agents*rounds)
+	for i, uid := range ids {
+		wg.Add(1)
+		go func(i int, uid uuid.UUID) {
+			defer wg.Done()
+			message := messages.AgentMessage{ID: uid, Hostname: fmt.Sprintf("host-%d", i), Rules: []string{"-w /etc/passwd -p wa"}}
+			for round := 0; round < rounds; round++ {
+				//only the first enrollment goes without the agent's certificate
+				cn := uid.String()
+				if round == 0 {
+					cn = ""
+				}
+				if code := register(a, message, cn); code != http.StatusOK {
+					errs <- fmt.Errorf("agent %d round %d: register got %d", i, round, code)
+					return
+				}
+				if _, err := a.QueueJob(uid, "SaveConfig"); err != nil {
+					errs <- fmt.Errorf("agent %d round %d: queue: %s", i, round, err.Message)
+					return
+				}
+				job, code := checkIn(a, uid)
+				if code != http.StatusOK {
+					errs <- fmt.Errorf("agent %d round %d: check in got %d", i, round, code)
+					return
+				}
+				if job.JobType != "" {
+					job.Status = "JobSuccess"
+					if code := completeJob(a, uid, job); code != http.StatusOK {
+						errs <- fmt.Errorf("agent %d round %d: job complete got %d", i, round, code)
+					}
+				}
+			}
+		}(i, uid)
+	}
+
+	stop := make(chan struct{})
+	var background sync.WaitGroup
+	background.Add(2)
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				a.Sweep(0)
+			}
+		}
+	}()
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				a.Summaries()
+				for _, uid := range ids {
+					a.Jobs(uid)
+				}
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(stop)
+	background.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if n := a.Len(); n != agents {
+		t.Fatalf("registry has %d agents, want %d", n, agents)
+	}
+	records, err := repo.Agents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != agents {
+		t.Fatalf("repository has %d agents, want %d, the sweep must not delete them", len(records), agents)
+	}
+	for _, uid := range ids {
+		jobs, _ := a.Jobs(uid)
+		if len(jobs) != rounds {
+			t.Errorf("agent %s has %d jobs, want %d", uid, len(jobs), rounds)
+		}
+	}
+}
+
+//TestRegisterHostnameRace lets agents with different IDs race for one hostname, exactly one of them may get it
+func TestRegisterHostnameRace(t *testing.T) {
+	a, _ := newTestAgents(t)
+	const agents = 16
+
+	codes := make(chan int, agents)
+	var wg sync.WaitGroup
+	for i := 0; i < agents; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- register(a, messages.AgentMessage{ID: uuid.New(), Hostname: "shared"}, "")
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	accepted := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			accepted++
+		case http.StatusConflict:
+		default:
+			t.Errorf("register got %d", code)
+		}
+	}
+	if accepted != 1 || a.Len() != 1 {
+		t.Fatalf("%d registrations accepted, %d agents registered, want one", accepted, a.Len())
+	}
+}
+
+//TestRegisterKnownAgentNeedsCertificate checks that the enrollment token alone cant take over a registered agent
+func TestRegisterKnownAgentNeedsCertificate(t *testing.T) {
+	a, _ := newTestAgents(t)
+	uid := uuid.New()
+	if code := register(a, messages.AgentMessage{ID: uid, Hostname: "db-1"}, ""); code != http.StatusOK {
+		t.Fatalf("enrollment got %d", code)
+	}
+
+	for _, c := range []struct {
+		name string
+		cn   string
+		want int
+	}{
+		{"no certificate", "", http.StatusUnauthorized},
+		{"another agent's certificate", uuid.New().String(), http.StatusUnauthorized},
+		{"its own certificate", uid.String(), http.StatusOK},
+	} {
+		if code := register(a, messages.AgentMessage{ID: uid, Hostname: "taken-over"}, c.cn); code != c.want {
+			t.Errorf("%s: register got %d, want %d", c.name, code, c.want)
+		}
+	}
+	summary, _ := a.Summary(uid)
+	if summary.Hostname != "taken-over" {
+		t.Errorf("hostname is %q, only the certified registration should have changed it", summary.Hostname)
+	}
+}
+
+//TestSweepKeepsAgents checks that stale agents are only marked offline and come back online when they check in
+func TestSweepKeepsAgents(t *testing.T) {
+	a, repo := newTestAgents(t)
+	uid := uuid.New()
+	register(a, messages.AgentMessage{ID: uid, Hostname: "web-1"}, "")
+	job, _ := a.QueueJob(uid, "SaveConfig")
+
+	agent, _ := a.Get(uid)
+	agent.lock.Lock()
+	agent.lastSeen = time.Now().Add(-time.Hour)
+	agent.lock.Unlock()
+
+	if marked := a.Sweep(time.Minute); marked != 1 {
+		t.Fatalf("sweep marked %d agents, want 1", marked)
+	}
+	if summary, err := a.Summary(uid); err != nil || !summary.Offline {
+		t.Fatalf("agent isnt offline after the sweep: %+v %v", summary, err)
+	}
+	if jobs, err := repo.Jobs(uid); err != nil || len(jobs) != 1 {
+		t.Fatalf("repository has %d jobs (%v), the sweep must keep the job history", len(jobs), err)
+	}
+
+	if got, _ := checkIn(a, uid); got.JobID != job.JobID {
+		t.Fatalf("check in handed out %v, want the queued job", got.JobID)
+	}
+	if summary, _ := a.Summary(uid); summary.Offline {
+		t.Fatal("agent is still offline after checking in")
+	}
+
+	if err := a.Delete(uid); err != nil {
+		t.Fatal(err.Message)
+	}
+	if records, _ := repo.Agents(); len(records) != 0 {
+		t.Fatalf("repository still has %d agents after the delete", len(records))
+	}
+}
+
+//TestJobHistoryIsBounded checks that the oldest final jobs are forgotten once the history is full
+func TestJobHistoryIsBounded(t *testing.T) {
+	a, repo := newTestAgents(t)
+	uid := uuid.New()
+	register(a, messages.AgentMessage{ID: uid, Hostname: "app-1"}, "")
+	agent, _ := a.Get(uid)
+
+	first, _ := a.QueueJob(uid, "SaveConfig")
+	agent.lock.Lock()
+	for i := 0; i < JobHistorySize+10; i++ {
+		job := newJob("SaveConfig", "")
+		job.State = JobSucceeded
+		job.Created = time.Now().Add(-time.Hour + time.Duration(i)*time.Second)
+		agent.trackJob(job)
+	}
+	agent.lock.Unlock()
+
+	jobs, _ := a.Jobs(uid)
+	stored, err := repo.Jobs(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != JobHistorySize || len(stored) != JobHistorySize {
+		t.Fatalf("history has %d jobs, repository %d, want %d", len(jobs), len(stored), JobHistorySize)
+	}
+	if _, err := a.Job(uid, first.JobID); err != nil {
+		t.Fatal("the queued job was forgotten, only final jobs may be")
+	}
+}
+
+//TestReenrollment checks that a registered agent without its certificate is flagged and gets back in once an operator approved it
+func TestReenrollment(t *testing.T) {
+	a, _ := newTestAgents(t)
+	uid := uuid.New()
+	register(a, messages.AgentMessage{ID: uid, Hostname: "db-1"}, "")
+
+	if code := register(a, messages.AgentMessage{ID: uid, Hostname: "db-1"}, ""); code != http.StatusUnauthorized {
+		t.Fatalf("re-enrollment without approval got %d", code)
+	}
+	if summary, _ := a.Summary(uid); !summary.ReenrollRequested {
+		t.Fatal("the refused re-enrollment isnt flagged for the operator")
+	}
+
+	if err := a.ApproveReenrollment(uuid.New()); err != ErrAgentNotFound {
+		t.Errorf("approving an unknown agent got %v", err)
+	}
+	if err := a.ApproveReenrollment(uid); err != nil {
+		t.Fatal(err.Message)
+	}
+	if code := register(a, messages.AgentMessage{ID: uid, Hostname: "db-1"}, ""); code != http.StatusOK {
+		t.Fatalf("approved re-enrollment got %d", code)
+	}
+	if summary, _ := a.Summary(uid); summary.ReenrollRequested {
+		t.Error("the agent is still flagged after re-enrolling")
+	}
+	if code := register(a, messages.AgentMessage{ID: uid, Hostname: "db-1"}, ""); code != http.StatusUnauthorized {
+		t.Fatalf("the approval let a second registration without certificate through, got %d", code)
+	}
+}
+
+//TestRulePositionsArePersisted checks that the positions moved by inserting and deleting rules reach the repository
+func TestRulePositionsArePersisted(t *testing.T) {
+	a, repo := newTestAgents(t)
+	uid := uuid.New()
+	register(a, messages.AgentMessage{ID: uid, Hostname: "web-1", Rules: []string{"-w /etc/passwd -p wa", "-w /etc/group -p wa"}}, "")
+	agent, _ := a.Get(uid)
+
+	agent.lock.Lock()
+	agent.insertRule("-w /etc/shadow -p wa", "Active", 0)
+	agent.insertRule("-w /etc/group -p wa", "Active", 0)
+	agent.deleteRule("-w /etc/passwd -p wa")
+	agent.lock.Unlock()
+
+	stored, err := repo.Rules(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := agent.RulesCopy(); !reflect.DeepEqual(stored, rules) {
+		t.Fatalf("repository has %v, the agent %v", stored, rules)
+	}
+	if stored["-w /etc/group -p wa"].Position != 0 || stored["-w /etc/shadow -p wa"].Position != 1 {
+		t.Fatalf("rules are stored at the wrong positions: %v", stored)
+	}
+}
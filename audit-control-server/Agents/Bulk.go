@@ -0,0 +1,225 @@
+package Agents
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"audit-control-server/messages"
+
+	"github.com/google/uuid"
+)
+
+//maxBulkOperations bounds the bulk operations kept in memory, the oldest are forgotten first
+const maxBulkOperations = 200
+
+//bulkJobTypes are the job types a bulk operation can issue, the ones touching a single rule need Rule
+var bulkJobTypes = map[string]bool{
+	"AddRule":    true,
+	"Delete":     true,
+	"Purge":      true,
+	"SaveConfig": true,
+	"ShutDown":   true,
+	"Uninstall":  true,
+	"StartAudit": true,
+	"StopAudit":  true,
+}
+
+/*
+BulkRequest issues one job type against every agent a selector or a group picks. Selector {} picks every agent, it
+has to be given explicitly so a missing selector cant hit the whole fleet.
+*/
+type BulkRequest struct {
+	JobType  string            `json:"job_type"`
+	Rule     string            `json:"rule,omitempty"`
+	Selector map[string]string `json:"selector,omitempty"`
+	Group    string            `json:"group,omitempty"`
+}
+
+/*
+BulkTarget is the progress of a bulk operation on one agent. State is the state of its job, retrying when a failed
+attempt waits to be queued again, rejected when the agent refused the job and lost when the job or agent is gone.
+*/
+type BulkTarget struct {
+	AgentID  uuid.UUID  `json:"agent_id"`
+	Hostname string     `json:"hostname"`
+	JobID    *uuid.UUID `json:"job_id,omitempty"`
+	State    string     `json:"state"`
+	Retry    int        `json:"retry"`
+	Message  string     `json:"message,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+//BulkOperation is a job issued against a set of agents. Progress counts the targets per state.
+type BulkOperation struct {
+	ID       uuid.UUID         `json:"id"`
+	JobType  string            `json:"job_type"`
+	Rule     string            `json:"rule,omitempty"`
+	Selector map[string]string `json:"selector"`
+	Group    string            `json:"group,omitempty"`
+	Created  time.Time         `json:"created"`
+	Targets  []BulkTarget      `json:"targets"`
+	Progress map[string]int    `json:"progress"`
+	Done     bool              `json:"done"`
+}
+
+func (r *BulkRequest) validate() *APIError {
+	if !bulkJobTypes[r.JobType] {
+		return ErrInvalidArgument.Errorf("job type %q cant be issued in bulk", r.JobType)
+	}
+	if (r.JobType == "AddRule" || r.JobType == "Delete") && r.Rule == "" {
+		return ErrMissingParam.Errorf("%s needs a rule", r.JobType)
+	}
+	if r.Selector == nil && r.Group == "" {
+		return ErrMissingParam.Errorf("a selector or a group is required")
+	}
+	if r.Selector != nil && r.Group != "" {
+		return ErrInvalidArgument.Errorf("give either a selector or a group, not both")
+	}
+	return nil
+}
+
+//issue queues the job of the request on a single agent
+func (a *AuditAgents) issue(uid uuid.UUID, r BulkRequest) (messages.Job, *APIError) {
+	switch r.JobType {
+	case "AddRule":
+		return a.QueueAddRule(uid, r.Rule)
+	case "Delete":
+		return a.QueueDeleteRule(uid, r.Rule)
+	case "Purge":
+		return a.Purge(uid)
+	default:
+		return a.QueueJob(uid, r.JobType)
+	}
+}
+
+//QueueBulk issues the request on every agent it selects. Agents refusing the job are reported as rejected, the others are tracked by job.
+func (a *AuditAgents) QueueBulk(r BulkRequest) (BulkOperation, *APIError) {
+	if err := r.validate(); err != nil {
+		return BulkOperation{}, err
+	}
+	selector := Selector(r.Selector)
+	if r.Group != "" {
+		group, err := a.Group(r.Group)
+		if err != nil {
+			return BulkOperation{}, err
+		}
+		selector = Selector(group.Selector)
+	}
+
+	op := &BulkOperation{
+		ID:       uuid.New(),
+		JobType:  r.JobType,
+		Rule:     r.Rule,
+		Selector: selector,
+		Group:    r.Group,
+		Created:  time.Now(),
+		Targets:  []BulkTarget{},
+	}
+	for _, uid := range a.Select(selector) {
+		target := BulkTarget{AgentID: uid}
+		if labels, err := a.Labels(uid); err == nil {
+			target.Hostname = labels["hostname"]
+		}
+		job, err := a.issue(uid, r)
+		if err != nil {
+			target.State = "rejected"
+			target.Error = err.Code
+			target.Message = err.Message
+		} else {
+			jobID := job.JobID
+			target.JobID = &jobID
+			target.State = JobQueued
+		}
+		op.Targets = append(op.Targets, target)
+	}
+	sort.Slice(op.Targets, func(i, j int) bool {
+		return op.Targets[i].Hostname < op.Targets[j].Hostname
+	})
+	log.Printf("bulk %s %s queued on %d agents matching %q", op.ID, op.JobType, len(op.Targets), selector.String())
+
+	a.bulkLock.Lock()
+	a.bulk[op.ID] = op
+	a.bulkOrder = append(a.bulkOrder, op.ID)
+	if len(a.bulkOrder) > maxBulkOperations {
+		delete(a.bulk, a.bulkOrder[0])
+		a.bulkOrder = a.bulkOrder[1:]
+	}
+	a.bulkLock.Unlock()
+
+	return a.progress(*op), nil
+}
+
+//jobState maps the tracked job of an agent to the state of a bulk target
+func jobState(job messages.Job) string {
+	if job.State == JobQueued && job.Retry > 0 {
+		return "retrying"
+	}
+	return job.State
+}
+
+//progress returns a copy of op with the targets updated from the jobs of the agents
+func (a *AuditAgents) progress(op BulkOperation) BulkOperation {
+	targets := make([]BulkTarget, len(op.Targets))
+	copy(targets, op.Targets)
+	op.Targets = targets
+	op.Progress = map[string]int{}
+	op.Done = true
+
+	for i := range op.Targets {
+		target := &op.Targets[i]
+		if target.JobID != nil {
+			agent, ok := a.Get(target.AgentID)
+			if !ok {
+				target.State = "lost"
+				target.Message = "agent was removed"
+			} else {
+				agent.lock.Lock()
+				job, tracked := agent.JobTrack[*target.JobID]
+				agent.lock.Unlock()
+				if tracked {
+					target.State = jobState(job)
+					target.Retry = job.Retry
+					target.Message = job.Message
+				} else {
+					target.State = "lost"
+				}
+			}
+		}
+		if target.State == JobQueued || target.State == JobDispatched || target.State == "retrying" {
+			op.Done = false
+		}
+		op.Progress[target.State]++
+	}
+	return op
+}
+
+//Bulk returns a bulk operation with the current progress of its targets
+func (a *AuditAgents) Bulk(id uuid.UUID) (BulkOperation, *APIError) {
+	a.bulkLock.Lock()
+	op, ok := a.bulk[id]
+	var snapshot BulkOperation
+	if ok {
+		snapshot = *op
+	}
+	a.bulkLock.Unlock()
+	if !ok {
+		return BulkOperation{}, ErrBulkNotFound
+	}
+	return a.progress(snapshot), nil
+}
+
+//BulkList returns the bulk operations still kept, newest first
+func (a *AuditAgents) BulkList() []BulkOperation {
+	a.bulkLock.Lock()
+	ops := make([]BulkOperation, 0, len(a.bulkOrder))
+	for i := len(a.bulkOrder) - 1; i >= 0; i-- {
+		ops = append(ops, *a.bulk[a.bulkOrder[i]])
+	}
+	a.bulkLock.Unlock()
+
+	for i := range ops {
+		ops[i] = a.progress(ops[i])
+	}
+	return ops
+}
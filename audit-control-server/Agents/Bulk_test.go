@@ -0,0 +1,201 @@
+package Agents
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"audit-control-server/messages"
+
+	"github.com/google/uuid"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Selector
+		bad   bool
+	}{
+		{"", Selector{}, false},
+		{"env=prod", Selector{"env": "prod"}, false},
+		{" env=prod , role=db ,", Selector{"env": "prod", "role": "db"}, false},
+		{"path=a=b", Selector{"path": "a=b"}, false},
+		{"env=", Selector{"env": ""}, false},
+		{"env", nil, true},
+		{"=prod", nil, true},
+		{"env=prod,role", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSelector(tt.value)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("%q parsed to %v, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q parsed to %v, %v, want %v", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+//newFleet registers one agent per hostname with the labels given, the first rule of every agent is loaded
+func newFleet(t *testing.T, a *AuditAgents, labels map[string]map[string]string) map[string]uuid.UUID {
+	t.Helper()
+	ids := make(map[string]uuid.UUID)
+	for hostname, l := range labels {
+		uid := uuid.New()
+		message := messages.AgentMessage{ID: uid, Hostname: hostname, Labels: l, Rules: []string{"-w /etc/passwd -p wa"}}
+		if code := register(a, message, ""); code != http.StatusOK {
+			t.Fatalf("register %s got %d", hostname, code)
+		}
+		ids[hostname] = uid
+	}
+	return ids
+}
+
+func TestQueueBulkValidates(t *testing.T) {
+	a, _ := newTestAgents(t)
+	tests := []struct {
+		name    string
+		request BulkRequest
+		code    string
+	}{
+		{"no selector", BulkRequest{JobType: "SaveConfig"}, ErrMissingParam.Code},
+		{"selector and group", BulkRequest{JobType: "SaveConfig", Selector: map[string]string{}, Group: "db"}, ErrInvalidArgument.Code},
+		{"unknown job type", BulkRequest{JobType: "Reboot", Selector: map[string]string{}}, ErrInvalidArgument.Code},
+		{"rule missing", BulkRequest{JobType: "AddRule", Selector: map[string]string{}}, ErrMissingParam.Code},
+		{"unknown group", BulkRequest{JobType: "SaveConfig", Group: "nope"}, ErrGroupNotFound.Code},
+	}
+	for _, tt := range tests {
+		if _, err := a.QueueBulk(tt.request); err == nil || err.Code != tt.code {
+			t.Errorf("%s: got %v, want %s", tt.name, err, tt.code)
+		}
+	}
+}
+
+func TestQueueBulkSelectsTargets(t *testing.T) {
+	a, _ := newTestAgents(t)
+	ids := newFleet(t, a, map[string]map[string]string{
+		"db-1":  {"env": "prod", "role": "db"},
+		"db-2":  {"env": "staging", "role": "db"},
+		"web-1": {"env": "prod", "role": "web"},
+	})
+
+	targets := func(op BulkOperation) []string {
+		hostnames := []string{}
+		for _, target := range op.Targets {
+			hostnames = append(hostnames, target.Hostname)
+		}
+		return hostnames
+	}
+
+	//{} has to be given to reach every agent
+	op, err := a.QueueBulk(BulkRequest{JobType: "SaveConfig", Selector: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := targets(op); !reflect.DeepEqual(got, []string{"db-1", "db-2", "web-1"}) {
+		t.Errorf("{} picked %v", got)
+	}
+
+	op, err = a.QueueBulk(BulkRequest{JobType: "SaveConfig", Selector: map[string]string{"env": "prod"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := targets(op); !reflect.DeepEqual(got, []string{"db-1", "web-1"}) {
+		t.Errorf("env=prod picked %v", got)
+	}
+	if op.Targets[0].AgentID != ids["db-1"] || op.Targets[0].JobID == nil {
+		t.Errorf("target %+v", op.Targets[0])
+	}
+
+	if _, err := a.PutGroup(messages.Group{Name: "databases", Selector: map[string]string{"role": "db"}}); err != nil {
+		t.Fatal(err)
+	}
+	op, err = a.QueueBulk(BulkRequest{JobType: "SaveConfig", Group: "databases"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := targets(op); !reflect.DeepEqual(got, []string{"db-1", "db-2"}) {
+		t.Errorf("group databases picked %v", got)
+	}
+	if !reflect.DeepEqual(op.Selector, map[string]string{"role": "db"}) || op.Group != "databases" {
+		t.Errorf("group operation has selector %v and group %q", op.Selector, op.Group)
+	}
+}
+
+func TestQueueBulkReportsRejectedTargets(t *testing.T) {
+	a, _ := newTestAgents(t)
+	ids := newFleet(t, a, map[string]map[string]string{"a": nil, "b": nil})
+
+	//b drops the rule every agent started with, adding it back is accepted there and refused on a
+	b, _ := a.Get(ids["b"])
+	b.DeleteRule("-w /etc/passwd -p wa")
+
+	op, err := a.QueueBulk(BulkRequest{JobType: "AddRule", Rule: "-w /etc/passwd -p wa", Selector: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(op.Targets) != 2 {
+		t.Fatalf("targets %+v", op.Targets)
+	}
+	rejected, queued := op.Targets[0], op.Targets[1]
+	if rejected.State != "rejected" || rejected.Error != ErrRuleExists.Code || rejected.JobID != nil {
+		t.Errorf("agent a got %+v, want it rejected with %s", rejected, ErrRuleExists.Code)
+	}
+	if queued.State != JobQueued || queued.JobID == nil {
+		t.Errorf("agent b got %+v, want it queued", queued)
+	}
+	if op.Progress["rejected"] != 1 || op.Progress[JobQueued] != 1 || op.Done {
+		t.Errorf("progress %v done %v", op.Progress, op.Done)
+	}
+}
+
+func TestBulkProgressFollowsJobs(t *testing.T) {
+	a, _ := newTestAgents(t)
+	ids := newFleet(t, a, map[string]map[string]string{"a": nil, "b": nil, "c": nil})
+
+	op, err := a.QueueBulk(BulkRequest{JobType: "SaveConfig", Selector: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a succeeds, b fails once and waits for its retry, c takes its job and keeps it
+	job, _ := checkIn(a, ids["a"])
+	job.Status = "JobSuccess"
+	completeJob(a, ids["a"], job)
+	job, _ = checkIn(a, ids["b"])
+	job.Status = "JobFailed"
+	completeJob(a, ids["b"], job)
+	checkIn(a, ids["c"])
+
+	op, err = a.Bulk(op.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{JobSucceeded: 1, "retrying": 1, JobDispatched: 1}
+	if !reflect.DeepEqual(op.Progress, want) || op.Done {
+		t.Fatalf("progress %v done %v, want %v", op.Progress, op.Done, want)
+	}
+	if op.Targets[1].Retry != 1 {
+		t.Errorf("agent b retry %d", op.Targets[1].Retry)
+	}
+
+	//c is removed and b runs out of its job
+	a.remove(ids["c"])
+	b, _ := a.Get(ids["b"])
+	b.lock.Lock()
+	b.finish(b.JobTrack[*op.Targets[1].JobID], JobFailed, "")
+	b.lock.Unlock()
+
+	op, _ = a.Bulk(op.ID)
+	want = map[string]int{JobSucceeded: 1, JobFailed: 1, "lost": 1}
+	if !reflect.DeepEqual(op.Progress, want) || !op.Done {
+		t.Errorf("progress %v done %v, want %v and done", op.Progress, op.Done, want)
+	}
+
+	if list := a.BulkList(); len(list) != 1 || list[0].ID != op.ID || !list[0].Done {
+		t.Errorf("bulk list %+v", list)
+	}
+}
@@ -0,0 +1,82 @@
+package Agents
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"audit-control-server/messages"
+
+	"github.com/google/uuid"
+)
+
+//rulesHash hashes a rule set the way the agents do, sorted and one rule per line
+func rulesHash(rules []string) string {
+	sorted := append([]string(nil), rules...)
+	sort.Strings(sorted)
+	h := sha256.New()
+	for _, rule := range sorted {
+		io.WriteString(h, rule)
+		io.WriteString(h, "\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+/*
+checkDrift compares the rule set in the audit status the agent reported last with its kernel rules and with the rules
+recorded for it. The recorded rules are only compared while no job is queued or running, until then they are expected
+to differ. The caller holds the agent lock.
+*/
+func (a *Agent) checkDrift() {
+	if a.AuditStatus == nil || a.AuditStatus.RuleSet == nil {
+		return
+	}
+	state := a.AuditStatus.RuleSet
+	drift := &messages.RuleDrift{
+		Version:    state.Version,
+		Hash:       state.Hash,
+		Missing:    state.Missing,
+		Unexpected: state.Unexpected,
+		Checked:    time.Now().UTC(),
+	}
+	switch {
+	case len(state.Missing) > 0 || len(state.Unexpected) > 0:
+		drift.Drifted = true
+		drift.Reason = "kernel rules differ from the ones the agent loaded"
+	case state.Error != "":
+		drift.Reason = "kernel rules couldnt be read: " + state.Error
+	}
+	if !drift.Drifted && len(a.queue) == 0 && len(a.inflight) == 0 {
+		recorded := make([]string, 0, len(a.Rules))
+		for rule := range a.Rules {
+			recorded = append(recorded, rule)
+		}
+		drift.Recorded = rulesHash(recorded)
+		if drift.Recorded != state.Hash {
+			drift.Drifted = true
+			drift.Reason = "agent holds other rules than the ones recorded for it"
+		}
+	}
+
+	was := a.Drift != nil && a.Drift.Drifted
+	if drift.Drifted && !was {
+		log.Printf("rules of agent %s drifted: %s", a.ID, drift.Reason)
+	} else if !drift.Drifted && was {
+		log.Printf("rules of agent %s are back in line", a.ID)
+	}
+	a.Drift = drift
+}
+
+//DriftOf returns the rule drift found in the audit status the agent reported last
+func (a *AuditAgents) DriftOf(uid uuid.UUID) (*messages.RuleDrift, *APIError) {
+	agent, ok := a.Get(uid)
+	if !ok {
+		return nil, ErrAgentNotFound
+	}
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	return agent.Drift, nil
+}
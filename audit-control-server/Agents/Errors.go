@@ -0,0 +1,93 @@
+package Agents
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+/*
+APIError is an error a handler answers with. Legacy routes write the message as plain text, requests marked with
+WithJSONErrors get a {"error": {"code", "message"}} body instead.
+*/
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+//Errorf returns a copy of e with a more specific message
+func (e *APIError) Errorf(format string, args ...interface{}) *APIError {
+	return &APIError{Status: e.Status, Code: e.Code, Message: fmt.Sprintf(format, args...)}
+}
+
+var (
+	ErrAgentNotFound = &APIError{http.StatusNotFound, "agent_not_found", "Agent Not Found"}
+	ErrJobNotFound   = &APIError{http.StatusNotFound, "job_not_found", "Job Not Found"}
+	ErrGroupNotFound = &APIError{http.StatusNotFound, "group_not_found", "Group Not Found"}
+	ErrBulkNotFound  = &APIError{http.StatusNotFound, "bulk_job_not_found", "Bulk Job Not Found"}
+	//agents treat a 404 as being unknown to the server and register again, so results of unknown jobs get a 400
+	ErrUnknownJob      = &APIError{http.StatusBadRequest, "unknown_job", "No such job was issued by the control server"}
+	ErrRuleNotFound    = &APIError{http.StatusNotFound, "rule_not_found", "invalid rule"}
+	ErrNotFound        = &APIError{http.StatusNotFound, "not_found", "Not Found"}
+	ErrMissingParam    = &APIError{http.StatusBadRequest, "missing_parameter", "missing parameter"}
+	ErrInvalidBody     = &APIError{http.StatusBadRequest, "invalid_body", "body not valid"}
+	ErrInvalidID       = &APIError{http.StatusBadRequest, "invalid_id", "invalid id"}
+	ErrRuleExists      = &APIError{http.StatusConflict, "rule_exists", "this rule is already present on the agent"}
+	ErrRuleBusy        = &APIError{http.StatusConflict, "rule_busy", "there is another job currently assigned to this rule on this agent"}
+	ErrNoRules         = &APIError{http.StatusBadRequest, "no_rules", "No available rules present on the agent"}
+	ErrNotCancellable  = &APIError{http.StatusConflict, "job_not_cancellable", "only queued jobs can be cancelled"}
+	ErrPurging         = &APIError{http.StatusConflict, "agent_purging", "rules of the agent are being purged"}
+	ErrHostnameTaken   = &APIError{http.StatusConflict, "hostname_taken", "hostname is already registered by another agent"}
+	ErrQueueFull       = &APIError{http.StatusServiceUnavailable, "queue_full", "job queue of the agent is full"}
+	ErrOverloaded      = &APIError{http.StatusServiceUnavailable, "overloaded", "event queue is full, retry later"}
+	ErrUnauthorized    = &APIError{http.StatusUnauthorized, "unauthorized", "not authorized"}
+	ErrReenrollment    = &APIError{http.StatusUnauthorized, "reenrollment_required", "the agent is registered, without its certificate an operator has to approve re-enrolling it"}
+	ErrForbidden       = &APIError{http.StatusForbidden, "forbidden", "not authorized"}
+	ErrMethod          = &APIError{http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed"}
+	ErrInternal        = &APIError{http.StatusInternalServerError, "internal", "internal server error"}
+	ErrNotImplemented  = &APIError{http.StatusNotImplemented, "not_implemented", "not implemented"}
+	ErrStreamHTTP2     = &APIError{http.StatusHTTPVersionNotSupported, "stream_unsupported", "job streams need HTTP/2, poll StatusCheck instead"}
+	ErrInvalidArgument = &APIError{http.StatusBadRequest, "invalid_argument", "invalid argument"}
+)
+
+type jsonErrorsKey struct{}
+
+//WithJSONErrors marks the request so errors are answered with a JSON body
+func WithJSONErrors(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), jsonErrorsKey{}, true))
+}
+
+func wantsJSON(req *http.Request) bool {
+	v, _ := req.Context().Value(jsonErrorsKey{}).(bool)
+	return v
+}
+
+//WriteError answers the request with err in the format the route uses
+func WriteError(res http.ResponseWriter, req *http.Request, err *APIError) {
+	if !wantsJSON(req) {
+		http.Error(res, err.Message, err.Status)
+		return
+	}
+
+	body, _ := json.Marshal(struct {
+		Error *APIError `json:"error"`
+	}{err})
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	res.WriteHeader(err.Status)
+	res.Write(body)
+}
+
+//MarshalJSON leaves the status out of the body, it is already the response status
+func (e *APIError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}{e.Code, e.Message})
+}
@@ -0,0 +1,113 @@
+package Agents
+
+import (
+	"log"
+	"regexp"
+	"sort"
+
+	"audit-control-server/messages"
+
+	"github.com/google/uuid"
+)
+
+var validGroupName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+//loadGroups reads the groups from the repository, it runs once from Restore
+func (a *AuditAgents) loadGroups() error {
+	groups, err := a.Repo.Groups()
+	if err != nil {
+		return err
+	}
+	a.groupLock.Lock()
+	defer a.groupLock.Unlock()
+	for _, group := range groups {
+		a.groups[group.Name] = group
+	}
+	return nil
+}
+
+//PutGroup creates or replaces a group. A group with an empty selector holds every agent.
+func (a *AuditAgents) PutGroup(group messages.Group) (messages.Group, *APIError) {
+	if !validGroupName.MatchString(group.Name) {
+		return group, ErrInvalidArgument.Errorf("group name must be 1-64 letters, digits, dots, dashes or underscores")
+	}
+	if group.Selector == nil {
+		group.Selector = map[string]string{}
+	}
+
+	a.groupLock.Lock()
+	defer a.groupLock.Unlock()
+	if a.Repo != nil {
+		if err := a.Repo.SaveGroup(group); err != nil {
+			log.Printf("couldnt persist group %s: %v", group.Name, err)
+			return group, ErrInternal
+		}
+	}
+	a.groups[group.Name] = group
+	return group, nil
+}
+
+func (a *AuditAgents) DeleteGroup(name string) *APIError {
+	a.groupLock.Lock()
+	defer a.groupLock.Unlock()
+	if _, ok := a.groups[name]; !ok {
+		return ErrGroupNotFound
+	}
+	if a.Repo != nil {
+		if err := a.Repo.DeleteGroup(name); err != nil {
+			log.Printf("couldnt remove group %s: %v", name, err)
+			return ErrInternal
+		}
+	}
+	delete(a.groups, name)
+	return nil
+}
+
+func (a *AuditAgents) Group(name string) (messages.Group, *APIError) {
+	a.groupLock.RLock()
+	defer a.groupLock.RUnlock()
+	group, ok := a.groups[name]
+	if !ok {
+		return group, ErrGroupNotFound
+	}
+	return group, nil
+}
+
+//Groups returns the groups ordered by name
+func (a *AuditAgents) Groups() []messages.Group {
+	a.groupLock.RLock()
+	groups := make([]messages.Group, 0, len(a.groups))
+	for _, group := range a.groups {
+		groups = append(groups, group)
+	}
+	a.groupLock.RUnlock()
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+//GroupMembers returns the agents the group currently selects
+func (a *AuditAgents) GroupMembers(name string) ([]uuid.UUID, *APIError) {
+	group, err := a.Group(name)
+	if err != nil {
+		return nil, err
+	}
+	return a.Select(Selector(group.Selector)), nil
+}
+
+//SummariesOf returns the agents matching selector the way ListAll shows them
+func (a *AuditAgents) SummariesOf(selector Selector) []*messages.AgentMessage {
+	agents := []*messages.AgentMessage{}
+	for _, agent := range a.Summaries() {
+		labels := map[string]string{"hostname": agent.Hostname, "id": agent.ID.String()}
+		for key, value := range agent.Labels {
+			labels[key] = value
+		}
+		if selector.Matches(labels) {
+			agents = append(agents, agent)
+		}
+	}
+	return agents
+}
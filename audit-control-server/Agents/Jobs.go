@@ -0,0 +1,474 @@
+package Agents
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"audit-control-server/messages"
+
+	"github.com/google/uuid"
+)
+
+//States of a job. Queued and dispatched jobs are still running, the others are final.
+const (
+	JobQueued     = "queued"
+	JobDispatched = "dispatched"
+	JobSucceeded  = "succeeded"
+	JobFailed     = "failed"
+	JobTimedOut   = "timed-out"
+	JobCancelled  = "cancelled"
+	//JobRolledBack is an ApplyRuleSet job that succeeded but was taken back by the agent, no status report confirmed it
+	JobRolledBack = "rolled-back"
+)
+
+//JobQueueSize bounds the jobs waiting for an agent, queueing more fails with ErrQueueFull
+const JobQueueSize = 100
+
+//clock tells the time to the job engine, the tests drive it by hand to step through backoffs and deadlines
+var clock = time.Now
+
+//JobHistorySize bounds the jobs kept in an agent's history, the oldest final ones are forgotten beyond it
+const JobHistorySize = 200
+
+/*
+JobPolicy says how a job type is retried and how long it may take. A failed attempt is queued again after Backoff,
+doubling on every retry up to MaxBackoff. A job still queued after QueueTimeout times out, so does a dispatched job
+whose result doesnt arrive within ResultTimeout once its retries are used up.
+*/
+type JobPolicy struct {
+	MaxRetries    int
+	Backoff       time.Duration
+	MaxBackoff    time.Duration
+	QueueTimeout  time.Duration
+	ResultTimeout time.Duration
+}
+
+func (p JobPolicy) delay(retry int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < retry && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
+
+var DefaultJobPolicy = JobPolicy{
+	MaxRetries:    5,
+	Backoff:       10 * time.Second,
+	MaxBackoff:    5 * time.Minute,
+	QueueTimeout:  time.Hour,
+	ResultTimeout: 5 * time.Minute,
+}
+
+/*
+JobHandler applies the results of one job type to the agent. The engine keeps the job state, retries and deadlines,
+handlers only keep the agent's rules in line with what happened. Every method is called with the agent lock held.
+*/
+type JobHandler interface {
+	Policy() JobPolicy
+	//Retryable tells whether a failed result is worth another attempt
+	Retryable(result messages.Job) bool
+	//Succeeded applies a successful result
+	Succeeded(agent *Agent, job *messages.Job)
+	//Retrying runs when a failed or unanswered attempt is queued again
+	Retrying(agent *Agent, job *messages.Job)
+	//Abandoned runs once when the job ends without success, job.State tells whether it failed, timed out or was cancelled
+	Abandoned(agent *Agent, job *messages.Job)
+}
+
+var (
+	handlerLock sync.RWMutex
+	jobHandlers = make(map[string]JobHandler)
+)
+
+//RegisterJobHandler plugs in the handler of a job type, replacing the built-in one if there is any
+func RegisterJobHandler(jobType string, handler JobHandler) {
+	handlerLock.Lock()
+	jobHandlers[jobType] = handler
+	handlerLock.Unlock()
+}
+
+func handlerFor(jobType string) JobHandler {
+	handlerLock.RLock()
+	defer handlerLock.RUnlock()
+	if handler, ok := jobHandlers[jobType]; ok {
+		return handler
+	}
+	return BaseJobHandler{JobPolicy: DefaultJobPolicy}
+}
+
+//BaseJobHandler retries every failure and leaves the agent alone, handlers embed it and override what they need
+type BaseJobHandler struct {
+	JobPolicy JobPolicy
+	Success   string
+}
+
+func (h BaseJobHandler) Policy() JobPolicy                         { return h.JobPolicy }
+func (h BaseJobHandler) Retryable(result messages.Job) bool        { return result.Code.Retryable() }
+func (h BaseJobHandler) Retrying(agent *Agent, job *messages.Job)  {}
+func (h BaseJobHandler) Abandoned(agent *Agent, job *messages.Job) {}
+
+func (h BaseJobHandler) Succeeded(agent *Agent, job *messages.Job) {
+	//the agent's own message says more, such as that there was nothing to do
+	if h.Success != "" && job.Message == "" {
+		job.Message = h.Success
+	}
+}
+
+type addRuleHandler struct{ BaseJobHandler }
+
+func (h addRuleHandler) Succeeded(agent *Agent, job *messages.Job) {
+	job.Message = "Rule was sucessfully added"
+	if job.Position != nil {
+		//the agent reports where it loaded the rule, older agents append it
+		agent.insertRule(job.Rule, "currentlyOk", *job.Position)
+		return
+	}
+	agent.setRule(job.Rule, "currentlyOk")
+}
+
+func (h addRuleHandler) Retrying(agent *Agent, job *messages.Job) {
+	agent.setRule(job.Rule, "Addrule : retrying")
+}
+
+func (h addRuleHandler) Abandoned(agent *Agent, job *messages.Job) {
+	if job.Code == messages.CodeDuplicate {
+		//the agent already has it loaded
+		agent.setRule(job.Rule, "currentlyOk")
+		return
+	}
+	log.Printf("rule %q wasnt added to agent %s: %s %s %s", job.Rule, agent.ID, job.State, job.Code, job.Message)
+	agent.deleteRule(job.Rule)
+}
+
+type deleteHandler struct{ BaseJobHandler }
+
+func (h deleteHandler) Succeeded(agent *Agent, job *messages.Job) {
+	job.Message = "Rule was successfully deleted"
+	agent.deleteRule(job.Rule)
+}
+
+func (h deleteHandler) Retrying(agent *Agent, job *messages.Job) {
+	agent.setRule(job.Rule, "DeleteFailed : retrying")
+}
+
+func (h deleteHandler) Abandoned(agent *Agent, job *messages.Job) {
+	if _, ok := agent.Rules[job.Rule]; !ok {
+		return
+	}
+	if job.Code == messages.CodeNotFound {
+		//nothing left to delete
+		agent.deleteRule(job.Rule)
+		return
+	}
+	if job.State == JobTimedOut {
+		//the agent may or may not have deleted it, the rules it reports on its next registration settle it
+		agent.setRule(job.Rule, "Delete Operation timed out")
+		return
+	}
+	agent.setRule(job.Rule, "currentlyOk")
+}
+
+type purgeHandler struct{ BaseJobHandler }
+
+func (h purgeHandler) Succeeded(agent *Agent, job *messages.Job) {
+	job.Message = "Rules were successfully purged"
+	agent.resetRules(nil)
+	agent.IsPurged = false
+	agent.save()
+}
+
+func (h purgeHandler) Retrying(agent *Agent, job *messages.Job) {
+	for rule, current := range agent.Rules {
+		if current.Status == "to be deleted" {
+			agent.setRule(rule, "PurgeFailed: retrying")
+		}
+	}
+}
+
+func (h purgeHandler) Abandoned(agent *Agent, job *messages.Job) {
+	for rule, current := range agent.Rules {
+		if current.Status == "to be deleted" || current.Status == "PurgeFailed: retrying" {
+			agent.setRule(rule, "currentlyOk")
+		}
+	}
+	agent.IsPurged = false
+	agent.save()
+}
+
+type applyRuleSetHandler struct{ BaseJobHandler }
+
+func (h applyRuleSetHandler) Succeeded(agent *Agent, job *messages.Job) {
+	job.Message = "Rule set was applied, the agent rolls it back unless a status report of it goes through"
+	agent.resetRules(job.Rules)
+}
+
+func (h applyRuleSetHandler) Abandoned(agent *Agent, job *messages.Job) {
+	//the agent applies all of the set or nothing, it still has the rules it had
+	for rule, current := range agent.Rules {
+		switch current.Status {
+		case "ApplyRuleSet: to be added":
+			agent.deleteRule(rule)
+		case "ApplyRuleSet: to be deleted":
+			agent.setRule(rule, "currentlyOk")
+		}
+	}
+}
+
+func init() {
+	RegisterJobHandler("AddRule", addRuleHandler{BaseJobHandler{JobPolicy: DefaultJobPolicy}})
+	RegisterJobHandler("Delete", deleteHandler{BaseJobHandler{JobPolicy: DefaultJobPolicy}})
+	RegisterJobHandler("Purge", purgeHandler{BaseJobHandler{JobPolicy: DefaultJobPolicy}})
+	RegisterJobHandler("ApplyRuleSet", applyRuleSetHandler{BaseJobHandler{JobPolicy: DefaultJobPolicy}})
+	RegisterJobHandler("SaveConfig", BaseJobHandler{JobPolicy: DefaultJobPolicy, Success: "Current config was successfully saved"})
+
+	shutdown := DefaultJobPolicy
+	shutdown.QueueTimeout = 10 * time.Minute
+	RegisterJobHandler("ShutDown", BaseJobHandler{JobPolicy: shutdown, Success: "Agent was successfully terminated"})
+	RegisterJobHandler("Uninstall", BaseJobHandler{JobPolicy: shutdown, Success: "Agent put back the host's audit configuration and was terminated"})
+
+	once := DefaultJobPolicy
+	once.MaxRetries = 0
+	RegisterJobHandler("StartAudit", BaseJobHandler{JobPolicy: once, Success: "Audit was started"})
+	RegisterJobHandler("StopAudit", BaseJobHandler{JobPolicy: once, Success: "Audit was stopped"})
+	RegisterJobHandler("SetAuditParams", BaseJobHandler{JobPolicy: DefaultJobPolicy, Success: "Audit settings were changed"})
+}
+
+//enqueue puts a job at the end of the agent's queue, it fails when the queue is full. The caller tracks the job.
+func (a *Agent) enqueue(job *messages.Job) bool {
+	if len(a.queue) >= JobQueueSize {
+		log.Printf("job queue of agent %s is full, dropping %s job %s", a.ID, job.JobType, job.JobID)
+		return false
+	}
+	now := clock()
+	job.State = JobQueued
+	job.Expires = now.Add(handlerFor(job.JobType).Policy().QueueTimeout)
+	a.queue = append(a.queue, job.JobID)
+	a.wake()
+	return true
+}
+
+//wake tells an open job stream of the agent that a job may be ready, it never blocks
+func (a *Agent) wake() {
+	select {
+	case a.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (a *Agent) dequeue(jobID uuid.UUID) {
+	for i, id := range a.queue {
+		if id == jobID {
+			a.queue = append(a.queue[:i], a.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+//nextJob takes the first queued job whose backoff is over and marks it dispatched, the caller holds the agent lock
+func (a *Agent) nextJob() (messages.Job, bool) {
+	now := clock()
+	for _, id := range append([]uuid.UUID(nil), a.queue...) {
+		job, ok := a.JobTrack[id]
+		if !ok || job.State != JobQueued {
+			a.dequeue(id)
+			continue
+		}
+		if now.Before(job.NotBefore) {
+			continue
+		}
+		a.dequeue(id)
+		job.State = JobDispatched
+		job.Status = "Dispacted to agent"
+		job.Dispatched = now
+		job.Deadline = now.Add(handlerFor(job.JobType).Policy().ResultTimeout)
+		a.inflight[id] = true
+		a.trackJob(job)
+		return job, true
+	}
+	return messages.Job{}, false
+}
+
+//finish ends a job without success
+func (a *Agent) finish(job messages.Job, state string, message string) {
+	job.State = state
+	job.Finished = clock()
+	if message != "" {
+		job.Message = message
+	}
+	delete(a.inflight, job.JobID)
+	handlerFor(job.JobType).Abandoned(a, &job)
+	a.trackJob(job)
+}
+
+//retry queues job again after the backoff of its policy, or finishes it in state when the retries are used up
+func (a *Agent) retry(job messages.Job, state string) {
+	handler := handlerFor(job.JobType)
+	policy := handler.Policy()
+	delete(a.inflight, job.JobID)
+	if job.Retry >= policy.MaxRetries {
+		a.finish(job, state, "")
+		return
+	}
+	job.Retry++
+	job.NotBefore = clock().Add(policy.delay(job.Retry))
+	if !a.enqueue(&job) {
+		a.finish(job, state, "couldnt retry, the job queue is full")
+		return
+	}
+	log.Printf("agent %s couldnt execute %s job %s, retry %d", a.ID, job.JobType, job.JobID, job.Retry)
+	handler.Retrying(a, &job)
+	a.trackJob(job)
+}
+
+/*
+complete applies a result the agent reported, the caller holds the agent lock. A success is taken even when the job
+already timed out or was cancelled, the agent did the work and the rules have to show it. Failures only count for
+the attempt that was dispatched.
+*/
+func (a *Agent) complete(job messages.Job, result messages.Job) {
+	if job.State == JobSucceeded || job.State == JobFailed || job.State == JobRolledBack {
+		return
+	}
+	job.Status = result.Status
+	job.Message = result.Message
+	job.Code = result.Code
+	job.Position = result.Position
+	job.Failed = result.Failed
+	if result.Status == "JobSuccess" && result.Rules != nil {
+		job.Rules = result.Rules
+	}
+	handler := handlerFor(job.JobType)
+
+	if result.Status == "JobSuccess" {
+		a.dequeue(job.JobID)
+		delete(a.inflight, job.JobID)
+		job.State = JobSucceeded
+		job.Finished = clock()
+		handler.Succeeded(a, &job)
+		a.trackJob(job)
+		return
+	}
+	if job.State != JobDispatched {
+		a.trackJob(job)
+		return
+	}
+	if !handler.Retryable(result) {
+		a.finish(job, JobFailed, "")
+		return
+	}
+	a.retry(job, JobFailed)
+}
+
+//expire times out the jobs that passed their deadline, the caller holds the agent lock
+func (a *Agent) expire(now time.Time) int {
+	expired := 0
+	for _, id := range append([]uuid.UUID(nil), a.queue...) {
+		job, ok := a.JobTrack[id]
+		if ok && job.State == JobQueued && now.After(job.Expires) {
+			a.dequeue(id)
+			a.finish(job, JobTimedOut, "the agent didnt pick the job up in time")
+			expired++
+		}
+	}
+	for id := range a.inflight {
+		job, ok := a.JobTrack[id]
+		if !ok || job.State != JobDispatched {
+			delete(a.inflight, id)
+			continue
+		}
+		if now.After(job.Deadline) {
+			job.Message = "the agent didnt report a result in time"
+			a.retry(job, JobTimedOut)
+			expired++
+		}
+	}
+	return expired
+}
+
+//pruneJobs forgets the oldest final jobs, in memory and in the repository, while the history is over JobHistorySize
+func (a *Agent) pruneJobs() {
+	over := len(a.JobTrack) - JobHistorySize
+	if over <= 0 {
+		return
+	}
+	finished := []messages.Job{}
+	for _, job := range a.JobTrack {
+		if job.State != JobQueued && job.State != JobDispatched && job.State != "" {
+			finished = append(finished, job)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].Created.Before(finished[j].Created) })
+	if over > len(finished) {
+		over = len(finished)
+	}
+	for _, job := range finished[:over] {
+		delete(a.JobTrack, job.JobID)
+		if a.persisted() {
+			a.storeError(a.repo.DeleteJob(a.ID, job.JobID))
+		}
+	}
+}
+
+//restoreJobs queues the jobs that were running when the server stopped again, the caller holds the agent lock
+func (a *Agent) restoreJobs() {
+	for _, job := range a.JobTrack {
+		switch {
+		case job.State == JobQueued, job.State == JobDispatched,
+			job.State == "" && (job.Status == "Waiting in Job queue" || job.Status == "Dispacted to agent"):
+			//a dispatched job may never have reached the agent, it is sent again
+			job.Status = "Waiting in Job queue"
+			if a.enqueue(&job) {
+				a.trackJob(job)
+			} else {
+				a.finish(job, JobFailed, "couldnt requeue after a restart, the job queue is full")
+			}
+		}
+	}
+}
+
+//Cancel stops a job that wasnt dispatched yet
+func (a *AuditAgents) Cancel(uid uuid.UUID, jobID uuid.UUID) (messages.Job, *APIError) {
+	agent, ok := a.Get(uid)
+	if !ok {
+		return messages.Job{}, ErrAgentNotFound
+	}
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	job, ok := agent.JobTrack[jobID]
+	if !ok {
+		return messages.Job{}, ErrJobNotFound
+	}
+	if job.State != JobQueued {
+		return job, ErrNotCancellable.Errorf("job is %s, only queued jobs can be cancelled", job.State)
+	}
+	agent.dequeue(jobID)
+	agent.finish(job, JobCancelled, "cancelled by an operator")
+	return agent.JobTrack[jobID], nil
+}
+
+//ExpireJobs times out the jobs of every agent that passed their deadline
+func (a *AuditAgents) ExpireJobs() int {
+	expired := 0
+	now := clock()
+	for _, agent := range a.List() {
+		agent.lock.Lock()
+		expired += agent.expire(now)
+		agent.lock.Unlock()
+	}
+	return expired
+}
+
+//WatchJobs runs ExpireJobs on every interval, it never returns
+func (a *AuditAgents) WatchJobs(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if expired := a.ExpireJobs(); expired > 0 {
+			log.Printf("%d jobs passed their deadline", expired)
+		}
+	}
+}
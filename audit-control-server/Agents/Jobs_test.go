@@ -0,0 +1,329 @@
+package Agents
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"audit-control-server/messages"
+
+	"github.com/google/uuid"
+)
+
+//fakeClock replaces the clock of the job engine until the test ends
+type fakeClock struct {
+	now time.Time
+}
+
+func useFakeClock(t *testing.T) *fakeClock {
+	c := &fakeClock{now: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+	clock = func() time.Time { return c.now }
+	t.Cleanup(func() { clock = time.Now })
+	return c
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+//recordingHandler counts the callbacks the engine makes for the job type it is registered for
+type recordingHandler struct {
+	BaseJobHandler
+	succeeded int
+	retrying  int
+	abandoned []string
+}
+
+func (h *recordingHandler) Succeeded(agent *Agent, job *messages.Job) { h.succeeded++ }
+func (h *recordingHandler) Retrying(agent *Agent, job *messages.Job)  { h.retrying++ }
+func (h *recordingHandler) Abandoned(agent *Agent, job *messages.Job) {
+	h.abandoned = append(h.abandoned, job.State)
+}
+
+var testPolicy = JobPolicy{
+	MaxRetries:    2,
+	Backoff:       10 * time.Second,
+	MaxBackoff:    15 * time.Second,
+	QueueTimeout:  time.Hour,
+	ResultTimeout: time.Minute,
+}
+
+//useHandler registers a recording handler for a job type of its own and an agent to run its jobs on
+func useHandler(t *testing.T, policy JobPolicy) (*AuditAgents, uuid.UUID, *recordingHandler, string) {
+	t.Helper()
+	jobType := "Test" + uuid.New().String()
+	handler := &recordingHandler{BaseJobHandler: BaseJobHandler{JobPolicy: policy}}
+	RegisterJobHandler(jobType, handler)
+	t.Cleanup(func() {
+		handlerLock.Lock()
+		delete(jobHandlers, jobType)
+		handlerLock.Unlock()
+	})
+
+	a, _ := newTestAgents(t)
+	uid := uuid.New()
+	if code := register(a, messages.AgentMessage{ID: uid, Hostname: "host"}, ""); code != http.StatusOK {
+		t.Fatalf("register got %d", code)
+	}
+	return a, uid, handler, jobType
+}
+
+func jobOf(t *testing.T, a *AuditAgents, uid uuid.UUID, jobID uuid.UUID) messages.Job {
+	t.Helper()
+	job, err := a.Job(uid, jobID)
+	if err != nil {
+		t.Fatalf("job %s: %s", jobID, err.Message)
+	}
+	return job
+}
+
+func TestJobPolicyDelay(t *testing.T) {
+	policy := JobPolicy{Backoff: 10 * time.Second, MaxBackoff: time.Minute}
+	want := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute}
+	for i, delay := range want {
+		if got := policy.delay(i + 1); got != delay {
+			t.Errorf("retry %d waits %v, want %v", i+1, got, delay)
+		}
+	}
+
+	policy = JobPolicy{Backoff: time.Minute, MaxBackoff: 30 * time.Second}
+	if got := policy.delay(1); got != 30*time.Second {
+		t.Errorf("a backoff over the cap waits %v", got)
+	}
+}
+
+//TestJobRetriesWithBackoff fails every attempt of a job until its retries are used up
+func TestJobRetriesWithBackoff(t *testing.T) {
+	c := useFakeClock(t)
+	a, uid, handler, jobType := useHandler(t, testPolicy)
+
+	queued, err := a.QueueJob(uid, jobType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backoffs := []time.Duration{10 * time.Second, 15 * time.Second}
+	for retry, backoff := range backoffs {
+		job, _ := checkIn(a, uid)
+		if job.JobID != queued.JobID {
+			t.Fatalf("attempt %d: check in handed out %+v", retry+1, job)
+		}
+		if got := jobOf(t, a, uid, job.JobID); got.State != JobDispatched || !got.Deadline.Equal(c.now.Add(testPolicy.ResultTimeout)) {
+			t.Fatalf("attempt %d: dispatched job %+v", retry+1, got)
+		}
+
+		job.Status = "JobFailed"
+		completeJob(a, uid, job)
+		job = jobOf(t, a, uid, job.JobID)
+		if job.State != JobQueued || job.Retry != retry+1 || !job.NotBefore.Equal(c.now.Add(backoff)) {
+			t.Fatalf("attempt %d: job %+v, want it queued again until %v", retry+1, job, c.now.Add(backoff))
+		}
+		if handler.retrying != retry+1 {
+			t.Errorf("attempt %d: Retrying ran %d times", retry+1, handler.retrying)
+		}
+
+		//the job stays back until its backoff is over
+		c.advance(backoff - time.Second)
+		if job, _ := checkIn(a, uid); job.JobType != "" {
+			t.Fatalf("attempt %d: job handed out %v early", retry+1, time.Second)
+		}
+		c.advance(time.Second)
+	}
+
+	job, _ := checkIn(a, uid)
+	job.Status = "JobFailed"
+	completeJob(a, uid, job)
+	job = jobOf(t, a, uid, job.JobID)
+	if job.State != JobFailed || job.Retry != testPolicy.MaxRetries || !job.Finished.Equal(c.now) {
+		t.Fatalf("last attempt left %+v", job)
+	}
+	if len(handler.abandoned) != 1 || handler.abandoned[0] != JobFailed || handler.succeeded != 0 {
+		t.Errorf("callbacks: abandoned %v succeeded %d", handler.abandoned, handler.succeeded)
+	}
+}
+
+func TestJobNotRetryableFailsAtOnce(t *testing.T) {
+	useFakeClock(t)
+	a, uid, handler, jobType := useHandler(t, testPolicy)
+
+	a.QueueJob(uid, jobType)
+	job, _ := checkIn(a, uid)
+	job.Status = "JobFailed"
+	job.Code = messages.CodeKernelRejected
+	completeJob(a, uid, job)
+
+	if job = jobOf(t, a, uid, job.JobID); job.State != JobFailed || job.Retry != 0 {
+		t.Fatalf("job %+v, want it failed without a retry", job)
+	}
+	if handler.retrying != 0 || len(handler.abandoned) != 1 {
+		t.Errorf("callbacks: retrying %d abandoned %v", handler.retrying, handler.abandoned)
+	}
+}
+
+func TestJobSucceeds(t *testing.T) {
+	c := useFakeClock(t)
+	a, uid, handler, jobType := useHandler(t, testPolicy)
+
+	a.QueueJob(uid, jobType)
+	job, _ := checkIn(a, uid)
+	c.advance(time.Second)
+	job.Status = "JobSuccess"
+	completeJob(a, uid, job)
+
+	if job = jobOf(t, a, uid, job.JobID); job.State != JobSucceeded || !job.Finished.Equal(c.now) {
+		t.Fatalf("job %+v", job)
+	}
+	if handler.succeeded != 1 || len(handler.abandoned) != 0 {
+		t.Errorf("callbacks: succeeded %d abandoned %v", handler.succeeded, handler.abandoned)
+	}
+}
+
+func TestExpireQueueTimeout(t *testing.T) {
+	c := useFakeClock(t)
+	a, uid, handler, jobType := useHandler(t, testPolicy)
+
+	queued, _ := a.QueueJob(uid, jobType)
+	if !queued.Expires.Equal(c.now.Add(testPolicy.QueueTimeout)) {
+		t.Fatalf("job expires at %v", queued.Expires)
+	}
+
+	c.advance(testPolicy.QueueTimeout)
+	if expired := a.ExpireJobs(); expired != 0 {
+		t.Fatalf("%d jobs expired right at their deadline", expired)
+	}
+	c.advance(time.Second)
+	if expired := a.ExpireJobs(); expired != 1 {
+		t.Fatalf("%d jobs expired", expired)
+	}
+
+	if job := jobOf(t, a, uid, queued.JobID); job.State != JobTimedOut {
+		t.Errorf("job %+v, want it timed out", job)
+	}
+	if job, _ := checkIn(a, uid); job.JobType != "" {
+		t.Errorf("timed out job was handed out")
+	}
+	if len(handler.abandoned) != 1 || handler.abandoned[0] != JobTimedOut || handler.retrying != 0 {
+		t.Errorf("callbacks: retrying %d abandoned %v", handler.retrying, handler.abandoned)
+	}
+}
+
+//TestExpireResultTimeout lets every attempt of a job go unanswered, each one is retried until the last times out
+func TestExpireResultTimeout(t *testing.T) {
+	c := useFakeClock(t)
+	policy := testPolicy
+	policy.MaxRetries = 1
+	a, uid, handler, jobType := useHandler(t, policy)
+
+	queued, _ := a.QueueJob(uid, jobType)
+	checkIn(a, uid)
+	c.advance(policy.ResultTimeout + time.Second)
+	if expired := a.ExpireJobs(); expired != 1 {
+		t.Fatalf("%d jobs expired", expired)
+	}
+	job := jobOf(t, a, uid, queued.JobID)
+	if job.State != JobQueued || job.Retry != 1 || job.Message != "the agent didnt report a result in time" {
+		t.Fatalf("job %+v, want it queued again", job)
+	}
+	if handler.retrying != 1 {
+		t.Errorf("Retrying ran %d times", handler.retrying)
+	}
+
+	c.advance(policy.Backoff)
+	if job, _ := checkIn(a, uid); job.JobID != queued.JobID {
+		t.Fatalf("retry wasnt handed out")
+	}
+	c.advance(policy.ResultTimeout + time.Second)
+	a.ExpireJobs()
+	if job = jobOf(t, a, uid, queued.JobID); job.State != JobTimedOut {
+		t.Fatalf("job %+v, want it timed out", job)
+	}
+	if len(handler.abandoned) != 1 || handler.abandoned[0] != JobTimedOut {
+		t.Errorf("Abandoned got %v", handler.abandoned)
+	}
+
+	//the agent did the work after all, the success is still taken
+	job.Status = "JobSuccess"
+	completeJob(a, uid, job)
+	if job = jobOf(t, a, uid, queued.JobID); job.State != JobSucceeded || handler.succeeded != 1 {
+		t.Errorf("late success left %+v, Succeeded ran %d times", job, handler.succeeded)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	useFakeClock(t)
+	a, uid, handler, jobType := useHandler(t, testPolicy)
+
+	dispatched, _ := a.QueueJob(uid, jobType)
+	queued, _ := a.QueueJob(uid, jobType)
+	checkIn(a, uid)
+
+	if _, err := a.Cancel(uid, dispatched.JobID); err == nil || err.Code != ErrNotCancellable.Code {
+		t.Errorf("cancelling a dispatched job got %v", err)
+	}
+	job, err := a.Cancel(uid, queued.JobID)
+	if err != nil || job.State != JobCancelled {
+		t.Fatalf("cancelling a queued job got %+v, %v", job, err)
+	}
+	if len(handler.abandoned) != 1 || handler.abandoned[0] != JobCancelled {
+		t.Errorf("Abandoned got %v", handler.abandoned)
+	}
+	if job, _ := checkIn(a, uid); job.JobType != "" {
+		t.Errorf("cancelled job was handed out")
+	}
+	if _, err := a.Cancel(uid, uuid.New()); err == nil || err.Code != ErrJobNotFound.Code {
+		t.Errorf("cancelling an unknown job got %v", err)
+	}
+}
+
+//TestLateFailureIsIgnored reports the failure of an attempt twice, the second copy mustnt fail the retry queued for it
+func TestLateFailureIsIgnored(t *testing.T) {
+	useFakeClock(t)
+	a, uid, handler, jobType := useHandler(t, testPolicy)
+
+	a.QueueJob(uid, jobType)
+	job, _ := checkIn(a, uid)
+	job.Status = "JobFailed"
+	completeJob(a, uid, job)
+	completeJob(a, uid, job)
+
+	if job = jobOf(t, a, uid, job.JobID); job.State != JobQueued || job.Retry != 1 {
+		t.Errorf("job %+v, want it queued for its first retry", job)
+	}
+	if handler.retrying != 1 || len(handler.abandoned) != 0 {
+		t.Errorf("callbacks: retrying %d abandoned %v", handler.retrying, handler.abandoned)
+	}
+}
+
+//TestRestoreJobs restarts the server with one job queued and one dispatched, both are queued again
+func TestRestoreJobs(t *testing.T) {
+	useFakeClock(t)
+	a, uid, _, jobType := useHandler(t, testPolicy)
+
+	dispatched, _ := a.QueueJob(uid, jobType)
+	queued, _ := a.QueueJob(uid, jobType)
+	checkIn(a, uid)
+	finished, _ := a.QueueJob(uid, jobType)
+	a.Cancel(uid, finished.JobID)
+
+	restarted := NewAuditAgents(testToken, nil, a.Repo)
+	if err := restarted.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uuid.UUID{dispatched.JobID, queued.JobID} {
+		if job := jobOf(t, restarted, uid, id); job.State != JobQueued {
+			t.Errorf("job %s restored as %+v", id, job)
+		}
+	}
+	if job := jobOf(t, restarted, uid, finished.JobID); job.State != JobCancelled {
+		t.Errorf("cancelled job restored as %+v", job)
+	}
+
+	//both come back out in turn
+	handed := map[uuid.UUID]bool{}
+	for i := 0; i < 2; i++ {
+		job, _ := checkIn(restarted, uid)
+		handed[job.JobID] = true
+	}
+	if !handed[dispatched.JobID] || !handed[queued.JobID] {
+		t.Errorf("restored jobs handed out: %v", handed)
+	}
+}
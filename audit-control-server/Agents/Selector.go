@@ -0,0 +1,106 @@
+package Agents
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const maxLabels = 32
+
+var (
+	labelKey   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]{0,62}$`)
+	labelValue = regexp.MustCompile(`^[A-Za-z0-9._-]{0,63}$`)
+)
+
+//validLabels checks the labels an agent declares, hostname and id are set by the server
+func validLabels(labels map[string]string) *APIError {
+	if len(labels) > maxLabels {
+		return ErrInvalidArgument.Errorf("an agent can declare at most %d labels", maxLabels)
+	}
+	for key, value := range labels {
+		if key == "hostname" || key == "id" {
+			return ErrInvalidArgument.Errorf("label %s is reserved", key)
+		}
+		if !labelKey.MatchString(key) || !labelValue.MatchString(value) {
+			return ErrInvalidArgument.Errorf("invalid label %s=%s", key, value)
+		}
+	}
+	return nil
+}
+
+//ParseSelector reads a selector written as "env=prod,role=db"
+func ParseSelector(value string) (Selector, *APIError) {
+	selector := Selector{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, ErrInvalidArgument.Errorf("selector term %q is not in key=value form", pair)
+		}
+		selector[parts[0]] = parts[1]
+	}
+	return selector, nil
+}
+
+//Selector picks agents by label, every key has to be present with the same value. An empty selector matches every agent.
+type Selector map[string]string
+
+func (s Selector) Matches(labels map[string]string) bool {
+	for key, value := range s {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	pairs := make([]string, 0, len(s))
+	for key, value := range s {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+//labels returns the labels selectors match against, the declared ones plus hostname and id. The caller holds the agent lock.
+func (a *Agent) labels() map[string]string {
+	labels := make(map[string]string, len(a.Labels)+2)
+	for key, value := range a.Labels {
+		labels[key] = value
+	}
+	labels["hostname"] = a.Hostname
+	labels["id"] = a.ID.String()
+	return labels
+}
+
+//Labels returns the labels of the agent
+func (a *AuditAgents) Labels(uid uuid.UUID) (map[string]string, *APIError) {
+	agent, ok := a.Get(uid)
+	if !ok {
+		return nil, ErrAgentNotFound
+	}
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	return agent.labels(), nil
+}
+
+//Select returns the IDs of the agents matching selector
+func (a *AuditAgents) Select(selector Selector) []uuid.UUID {
+	ids := []uuid.UUID{}
+	for _, agent := range a.List() {
+		agent.lock.Lock()
+		match := selector.Matches(agent.labels())
+		agent.lock.Unlock()
+		if match {
+			ids = append(ids, agent.ID)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,133 @@
+package Agents
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"audit-control-server/messages"
+
+	"github.com/google/uuid"
+)
+
+//streamKeepAlive is how often an idle job stream sends a Status line, the agent drops streams silent for longer than a minute
+var streamKeepAlive = 20 * time.Second
+
+const (
+	//streamRecheck is how often an idle stream looks for jobs whose retry backoff is over
+	streamRecheck = 5 * time.Second
+	//maxStreamLine bounds a single result line read from a job stream
+	maxStreamLine = 1 << 20
+)
+
+/*
+JobStream holds a job stream open for an agent. The response is NDJSON, every line a BaseMessage: Job lines carry a
+job as soon as it is queued and Status lines keep the stream alive. The agent writes the result of every job back as
+an NDJSON line of the request body, the same Job it sends to JobComplete. Both directions share one request, so the
+stream needs HTTP/2, agents on HTTP/1 get a 505 and keep polling StatusCheck.
+*/
+func (a *AuditAgents) JobStream(uid uuid.UUID) http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		agent, ok := a.Get(uid)
+		if !ok {
+			WriteError(res, req, ErrAgentNotFound)
+			return
+		}
+		if req.ProtoMajor < 2 {
+			WriteError(res, req, ErrStreamHTTP2)
+			return
+		}
+
+		//the server timeouts are meant for single requests, a stream lives as long as the agent keeps it
+		control := http.NewResponseController(res)
+		if err := control.SetReadDeadline(time.Time{}); err != nil {
+			log.Printf("cant hold a job stream open for agent %s: %v", uid, err)
+			WriteError(res, req, ErrStreamHTTP2)
+			return
+		}
+		res.Header().Set("Content-Type", "application/x-ndjson")
+		res.WriteHeader(http.StatusOK)
+
+		encoder := json.NewEncoder(res)
+		send := func(message interface{}) bool {
+			//HTTP/2 resets a stream whose write deadline passes even while it is idle, so it has to outlast the next keep-alive
+			control.SetWriteDeadline(time.Now().Add(2 * streamKeepAlive))
+			if err := encoder.Encode(message); err != nil {
+				log.Printf("job stream of agent %s broke: %v", uid, err)
+				return false
+			}
+			if err := control.Flush(); err != nil {
+				log.Printf("job stream of agent %s broke: %v", uid, err)
+				return false
+			}
+			return true
+		}
+		if !send(GetBaseMessage(nil, "Status")) {
+			return
+		}
+		log.Printf("agent %s opened a job stream", uid)
+		defer log.Printf("job stream of agent %s closed", uid)
+
+		results := make(chan error, 1)
+		go func() {
+			results <- a.readResults(uid, req.Body)
+		}()
+
+		keepAlive := time.NewTicker(streamKeepAlive)
+		defer keepAlive.Stop()
+		recheck := time.NewTicker(streamRecheck)
+		defer recheck.Stop()
+		for {
+			agent.lock.Lock()
+			job, ok := agent.nextJob()
+			agent.lock.Unlock()
+			if ok {
+				//a job lost with a broken stream stays dispatched until its deadline and is retried from there
+				if !send(GetBaseMessage(job, "Job")) {
+					return
+				}
+				continue
+			}
+
+			select {
+			case <-agent.notify:
+			case <-recheck.C:
+			case <-keepAlive.C:
+				agent.touch()
+				if !send(GetBaseMessage(nil, "Status")) {
+					return
+				}
+			case err := <-results:
+				if err != nil {
+					log.Printf("job stream of agent %s broke: %v", uid, err)
+				}
+				return
+			case <-req.Context().Done():
+				return
+			}
+		}
+	})
+}
+
+//readResults applies the results an agent writes to its job stream until the agent closes it
+func (a *AuditAgents) readResults(uid uuid.UUID, body io.Reader) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLine)
+	for scanner.Scan() {
+		var result messages.Job
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			log.Printf("agent %s sent an invalid job result: %v", uid, err)
+			continue
+		}
+		if err := a.CompleteJob(uid, result); err != nil {
+			log.Printf("agent %s sent a result for job %s: %s", uid, result.JobID, err.Message)
+			if err == ErrAgentNotFound {
+				return nil
+			}
+		}
+	}
+	return scanner.Err()
+}
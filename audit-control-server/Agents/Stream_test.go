@@ -0,0 +1,117 @@
+package Agents
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"audit-control-server/messages"
+
+	"github.com/google/uuid"
+)
+
+//openStream serves the job stream of uid over HTTP/2, results written to the returned pipe go up the request body
+func openStream(t *testing.T, a *AuditAgents, uid uuid.UUID) (*bufio.Scanner, *io.PipeWriter) {
+	t.Helper()
+	server := httptest.NewUnstartedServer(a.JobStream(uid))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	body, results := io.Pipe()
+	req, _ := http.NewRequest("POST", server.URL+"/JobStream", body)
+	res, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		results.Close()
+		res.Body.Close()
+	})
+	if res.StatusCode != http.StatusOK || res.ProtoMajor != 2 {
+		t.Fatalf("stream opened with %d over %s", res.StatusCode, res.Proto)
+	}
+	return bufio.NewScanner(res.Body), results
+}
+
+//nextLine reads the next message of a job stream
+func nextLine(t *testing.T, lines *bufio.Scanner) messages.BaseMessage {
+	t.Helper()
+	if !lines.Scan() {
+		t.Fatalf("stream ended: %v", lines.Err())
+	}
+	var message messages.BaseMessage
+	if err := json.Unmarshal(lines.Bytes(), &message); err != nil {
+		t.Fatalf("stream sent %q: %v", lines.Text(), err)
+	}
+	return message
+}
+
+func TestJobStream(t *testing.T) {
+	//restored after the stream is closed, cleanups run last first
+	interval := streamKeepAlive
+	t.Cleanup(func() { streamKeepAlive = interval })
+	streamKeepAlive = 100 * time.Millisecond
+
+	a, _ := newTestAgents(t)
+	uid := uuid.New()
+	if code := register(a, messages.AgentMessage{ID: uid, Hostname: "stream"}, ""); code != http.StatusOK {
+		t.Fatalf("register got %d", code)
+	}
+	lines, results := openStream(t, a, uid)
+
+	//the stream opens with a Status line and sends another one every keep-alive while there is no job
+	for i := 0; i < 2; i++ {
+		if message := nextLine(t, lines); message.MessageType != "Statusok" {
+			t.Fatalf("line %d is %q, want a Status line", i, message.MessageType)
+		}
+	}
+
+	queued, err := a.QueueJob(uid, "SaveConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := nextLine(t, lines)
+	for message.MessageType == "Statusok" {
+		message = nextLine(t, lines)
+	}
+	if message.MessageType != "Job" || message.Data.JobID != queued.JobID || message.Data.JobType != "SaveConfig" {
+		t.Fatalf("stream sent %+v, want job %s", message, queued.JobID)
+	}
+
+	result := message.Data
+	result.Status = "JobSuccess"
+	if err := json.NewEncoder(results).Encode(result); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, err := a.Job(uid, queued.JobID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State == JobSucceeded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job is %s, the result on the stream wasnt applied", job.State)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJobStreamNeedsHTTP2(t *testing.T) {
+	a, _ := newTestAgents(t)
+	uid := uuid.New()
+	register(a, messages.AgentMessage{ID: uid, Hostname: "stream"}, "")
+
+	rec := httptest.NewRecorder()
+	a.JobStream(uid).ServeHTTP(rec, httptest.NewRequest("POST", "/JobStream", nil))
+	if rec.Code != ErrStreamHTTP2.Status {
+		t.Errorf("HTTP/1 stream got %d, want %d", rec.Code, ErrStreamHTTP2.Status)
+	}
+}
@@ -0,0 +1,383 @@
+package Catalog
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"audit-control-server/Agents"
+	"audit-control-server/Storage"
+	"audit-control-server/messages"
+
+	"github.com/google/uuid"
+)
+
+var (
+	DefaultInterval = 30 * time.Second
+	maxRetryDelay   = time.Hour
+
+	ErrRuleSetNotFound = &Agents.APIError{Status: http.StatusNotFound, Code: "ruleset_not_found", Message: "Rule Set Not Found"}
+	ErrInvalidRuleSet  = &Agents.APIError{Status: http.StatusBadRequest, Code: "invalid_ruleset", Message: "invalid rule set"}
+
+	validName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+)
+
+//AgentState is the reconciliation status of one agent against the rule sets selecting it
+type AgentState struct {
+	AgentID   uuid.UUID      `json:"agent_id"`
+	Hostname  string         `json:"hostname"`
+	RuleSets  []string       `json:"rulesets"`
+	Converged bool           `json:"converged"`
+	Missing   []string       `json:"missing"`
+	Extra     []string       `json:"extra"`
+	Pending   []string       `json:"pending"`
+	Failing   map[string]int `json:"failing"`
+	Checked   time.Time      `json:"checked"`
+}
+
+type attempt struct {
+	count int
+	last  time.Time
+}
+
+/*
+Catalog keeps the named rule sets and reconciles the agents against them. On every pass each agent's rules are
+compared with the union of the rule sets whose selector matches it, and AddRule and Delete jobs are queued to close
+the gap. Rules the agent keeps rejecting are retried with a growing delay instead of on every pass.
+*/
+type Catalog struct {
+	agents   *Agents.AuditAgents
+	repo     Storage.Repository
+	interval time.Duration
+	trigger  chan struct{}
+
+	lock sync.RWMutex
+	sets map[string]messages.RuleSet
+
+	stateLock sync.Mutex
+	states    map[uuid.UUID]AgentState
+	attempts  map[uuid.UUID]map[string]*attempt
+}
+
+//New loads the rule sets from repo, repo may be nil to keep them in memory only
+func New(agents *Agents.AuditAgents, repo Storage.Repository, interval time.Duration) (*Catalog, error) {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	c := &Catalog{
+		agents:   agents,
+		repo:     repo,
+		interval: interval,
+		trigger:  make(chan struct{}, 1),
+		sets:     make(map[string]messages.RuleSet),
+		states:   make(map[uuid.UUID]AgentState),
+		attempts: make(map[uuid.UUID]map[string]*attempt),
+	}
+	if repo != nil {
+		sets, err := repo.RuleSets()
+		if err != nil {
+			return nil, err
+		}
+		for _, set := range sets {
+			c.sets[set.Name] = set
+		}
+	}
+	return c, nil
+}
+
+func validate(set *messages.RuleSet) *Agents.APIError {
+	if !validName.MatchString(set.Name) {
+		return ErrInvalidRuleSet.Errorf("rule set name must be 1-64 letters, digits, dots, dashes or underscores")
+	}
+	seen := make(map[string]bool)
+	rules := []string{}
+	for _, rule := range set.Rules {
+		rule = strings.TrimSpace(rule)
+		if rule == "" || seen[rule] {
+			continue
+		}
+		seen[rule] = true
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
+		return ErrInvalidRuleSet.Errorf("rule set %s has no rules", set.Name)
+	}
+	set.Rules = rules
+	return nil
+}
+
+//Put creates or replaces a rule set and starts a reconciliation pass
+func (c *Catalog) Put(set messages.RuleSet) (messages.RuleSet, *Agents.APIError) {
+	if err := validate(&set); err != nil {
+		return set, err
+	}
+
+	c.lock.Lock()
+	if c.repo != nil {
+		if err := c.repo.SaveRuleSet(set); err != nil {
+			c.lock.Unlock()
+			log.Printf("couldnt persist rule set %s: %v", set.Name, err)
+			return set, Agents.ErrInternal
+		}
+	}
+	c.sets[set.Name] = set
+	c.lock.Unlock()
+
+	log.Printf("rule set %s stored with %d rules for %q", set.Name, len(set.Rules), Agents.Selector(set.Selector).String())
+	c.Trigger()
+	return set, nil
+}
+
+//Delete removes a rule set. The rules stay on the agents unless another rule set prunes them.
+func (c *Catalog) Delete(name string) *Agents.APIError {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.sets[name]; !ok {
+		return ErrRuleSetNotFound
+	}
+	if c.repo != nil {
+		if err := c.repo.DeleteRuleSet(name); err != nil {
+			log.Printf("couldnt remove rule set %s: %v", name, err)
+			return Agents.ErrInternal
+		}
+	}
+	delete(c.sets, name)
+	c.Trigger()
+	return nil
+}
+
+func (c *Catalog) Get(name string) (messages.RuleSet, *Agents.APIError) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	set, ok := c.sets[name]
+	if !ok {
+		return set, ErrRuleSetNotFound
+	}
+	return set, nil
+}
+
+//List returns the rule sets ordered by name
+func (c *Catalog) List() []messages.RuleSet {
+	c.lock.RLock()
+	sets := make([]messages.RuleSet, 0, len(c.sets))
+	for _, set := range c.sets {
+		sets = append(sets, set)
+	}
+	c.lock.RUnlock()
+
+	sort.Slice(sets, func(i, j int) bool {
+		return sets[i].Name < sets[j].Name
+	})
+	return sets
+}
+
+//Trigger asks for a reconciliation pass without waiting for the interval
+func (c *Catalog) Trigger() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+//Run reconciles on every interval and whenever Trigger is called, it never returns
+func (c *Catalog) Run() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.Reconcile()
+		select {
+		case <-ticker.C:
+		case <-c.trigger:
+		}
+	}
+}
+
+//Reconcile runs a single pass over every agent
+func (c *Catalog) Reconcile() {
+	sets := c.List()
+	ids := c.agents.Select(Agents.Selector{})
+
+	seen := make(map[uuid.UUID]bool, len(ids))
+	for _, uid := range ids {
+		seen[uid] = true
+		labels, err := c.agents.Labels(uid)
+		if err != nil {
+			continue
+		}
+		state := c.reconcileAgent(uid, labels, sets)
+
+		c.stateLock.Lock()
+		c.states[uid] = state
+		c.stateLock.Unlock()
+	}
+
+	c.stateLock.Lock()
+	for uid := range c.states {
+		if !seen[uid] {
+			delete(c.states, uid)
+			delete(c.attempts, uid)
+		}
+	}
+	c.stateLock.Unlock()
+}
+
+//retryDelay doubles with every failed attempt, starting at the reconcile interval
+func (c *Catalog) retryDelay(count int) time.Duration {
+	delay := c.interval
+	for i := 1; i < count && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+func (c *Catalog) reconcileAgent(uid uuid.UUID, labels map[string]string, sets []messages.RuleSet) AgentState {
+	state := AgentState{
+		AgentID:  uid,
+		Hostname: labels["hostname"],
+		RuleSets: []string{},
+		Missing:  []string{},
+		Extra:    []string{},
+		Pending:  []string{},
+		Failing:  map[string]int{},
+		Checked:  time.Now(),
+	}
+
+	desired := []string{}
+	wanted := make(map[string]bool)
+	prune := false
+	for _, set := range sets {
+		if !Agents.Selector(set.Selector).Matches(labels) {
+			continue
+		}
+		state.RuleSets = append(state.RuleSets, set.Name)
+		prune = prune || set.Prune
+		for _, rule := range set.Rules {
+			if !wanted[rule] {
+				wanted[rule] = true
+				desired = append(desired, rule)
+			}
+		}
+	}
+	if len(state.RuleSets) == 0 {
+		//agents no rule set selects are left alone
+		state.Converged = true
+		return state
+	}
+
+	rules, err := c.agents.Rules(uid)
+	if err != nil {
+		return state
+	}
+
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	tries, ok := c.attempts[uid]
+	if !ok {
+		tries = make(map[string]*attempt)
+		c.attempts[uid] = tries
+	}
+
+	for _, rule := range desired {
+		current, loaded := rules[rule]
+		switch {
+		case loaded && current.Status == "currentlyOk":
+			delete(tries, rule)
+		case loaded:
+			state.Pending = append(state.Pending, rule)
+		default:
+			state.Missing = append(state.Missing, rule)
+			c.queue(uid, rule, tries, &state, c.agents.QueueAddRule)
+		}
+	}
+
+	if prune {
+		for rule, current := range rules {
+			if wanted[rule] {
+				continue
+			}
+			state.Extra = append(state.Extra, rule)
+			if current.Status == "currentlyOk" {
+				c.queue(uid, rule, tries, &state, c.agents.QueueDeleteRule)
+			}
+		}
+		sort.Strings(state.Extra)
+	}
+
+	//forget attempts for rules that reached the state they were queued for
+	for rule := range tries {
+		if !contains(state.Missing, rule) && !contains(state.Extra, rule) && !contains(state.Pending, rule) {
+			delete(tries, rule)
+		}
+	}
+
+	state.Converged = len(state.Missing) == 0 && len(state.Extra) == 0 && len(state.Pending) == 0
+	return state
+}
+
+//queue issues the job for rule unless an earlier attempt failed recently, the caller holds stateLock
+func (c *Catalog) queue(uid uuid.UUID, rule string, tries map[string]*attempt, state *AgentState, issue func(uuid.UUID, string) (messages.Job, *Agents.APIError)) {
+	try, ok := tries[rule]
+	if ok {
+		state.Failing[rule] = try.count
+		if time.Since(try.last) < c.retryDelay(try.count) {
+			return
+		}
+	} else {
+		try = &attempt{}
+		tries[rule] = try
+	}
+
+	if _, err := issue(uid, rule); err != nil {
+		if err != Agents.ErrQueueFull && err != Agents.ErrPurging {
+			log.Printf("reconcile of agent %s couldnt queue a job for %q: %v", uid, rule, err)
+		}
+		return
+	}
+	try.count++
+	try.last = time.Now()
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+//State returns the result of the last reconciliation pass for the agent
+func (c *Catalog) State(uid uuid.UUID) (AgentState, *Agents.APIError) {
+	if _, ok := c.agents.Get(uid); !ok {
+		return AgentState{}, Agents.ErrAgentNotFound
+	}
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	state, ok := c.states[uid]
+	if !ok {
+		return AgentState{}, Agents.ErrNotFound.Errorf("the agent wasnt reconciled yet")
+	}
+	return state, nil
+}
+
+//States returns the last reconciliation result of every agent ordered by hostname
+func (c *Catalog) States() []AgentState {
+	c.stateLock.Lock()
+	states := make([]AgentState, 0, len(c.states))
+	for _, state := range c.states {
+		states = append(states, state)
+	}
+	c.stateLock.Unlock()
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Hostname < states[j].Hostname
+	})
+	return states
+}
@@ -0,0 +1,227 @@
+package Catalog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"audit-control-server/Agents"
+	"audit-control-server/Storage"
+	"audit-control-server/messages"
+
+	"github.com/google/uuid"
+)
+
+const (
+	testToken = "test-token"
+	passwd    = "-w /etc/passwd -p wa"
+	shadow    = "-w /etc/shadow -p wa"
+	group     = "-w /etc/group -p wa"
+	tmp       = "-w /tmp -p x"
+)
+
+func TestMain(m *testing.M) {
+	//the registry logs every check-in and queued rule
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func newTestCatalog(t *testing.T) (*Catalog, *Agents.AuditAgents) {
+	t.Helper()
+	store, err := Storage.Open(filepath.Join(t.TempDir(), "server.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	agents := Agents.NewAuditAgents(testToken, nil, Storage.NewKVRepository(store))
+	c, err := New(agents, nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, agents
+}
+
+func register(t *testing.T, a *Agents.AuditAgents, hostname string, rules ...string) uuid.UUID {
+	t.Helper()
+	uid := uuid.New()
+	body, _ := json.Marshal(messages.AgentMessage{ID: uid, Hostname: hostname, Rules: rules, EnrollToken: testToken})
+	rec := httptest.NewRecorder()
+	a.Register().ServeHTTP(rec, httptest.NewRequest("POST", "/Register", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("registering %s got %d", hostname, rec.Code)
+	}
+	return uid
+}
+
+//takeJobs checks in until the agent has no job left and returns what it was handed
+func takeJobs(t *testing.T, a *Agents.AuditAgents, uid uuid.UUID) []messages.Job {
+	t.Helper()
+	var jobs []messages.Job
+	for {
+		rec := httptest.NewRecorder()
+		a.StatusCheckIn(uid).ServeHTTP(rec, httptest.NewRequest("GET", "/StatusCheck", nil))
+		var message messages.BaseMessage
+		json.Unmarshal(rec.Body.Bytes(), &message)
+		if rec.Code != http.StatusOK || message.MessageType != "Job" {
+			return jobs
+		}
+		jobs = append(jobs, message.Data)
+	}
+}
+
+func complete(t *testing.T, a *Agents.AuditAgents, uid uuid.UUID, job messages.Job, status string, code messages.ErrorCode) {
+	t.Helper()
+	job.Status = status
+	job.Code = code
+	body, _ := json.Marshal(job)
+	rec := httptest.NewRecorder()
+	a.JobComplete(uid).ServeHTTP(rec, httptest.NewRequest("POST", "/JobComplete", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("completing %s job got %d", job.JobType, rec.Code)
+	}
+}
+
+//summary lists the jobs as "<type> <rule>" in order
+func summary(jobs []messages.Job) []string {
+	list := []string{}
+	for _, job := range jobs {
+		list = append(list, job.JobType+" "+job.Rule)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func state(t *testing.T, c *Catalog, uid uuid.UUID) AgentState {
+	t.Helper()
+	s, err := c.State(uid)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	return s
+}
+
+func TestReconcileClosesTheGap(t *testing.T) {
+	c, agents := newTestCatalog(t)
+	web := register(t, agents, "web-1", passwd, tmp)
+	db := register(t, agents, "db-1", tmp)
+
+	set := messages.RuleSet{Name: "base", Selector: map[string]string{"hostname": "web-1"}, Rules: []string{passwd, shadow}, Prune: true}
+	if _, err := c.Put(set); err != nil {
+		t.Fatal(err.Message)
+	}
+	c.Reconcile()
+
+	s := state(t, c, web)
+	if s.Converged || !reflect.DeepEqual(s.Missing, []string{shadow}) || !reflect.DeepEqual(s.Extra, []string{tmp}) {
+		t.Fatalf("drifted agent has state %+v", s)
+	}
+	jobs := takeJobs(t, agents, web)
+	if want := []string{"AddRule " + shadow, "Delete " + tmp}; !reflect.DeepEqual(summary(jobs), want) {
+		t.Fatalf("reconcile queued %v, want %v", summary(jobs), want)
+	}
+	//no rule set selects the other agent, its extra rule stays
+	if s := state(t, c, db); !s.Converged || len(takeJobs(t, agents, db)) != 0 {
+		t.Errorf("unselected agent has state %+v", s)
+	}
+
+	//while the jobs run nothing is queued twice
+	c.Reconcile()
+	if s := state(t, c, web); s.Converged || !reflect.DeepEqual(s.Pending, []string{shadow}) || !reflect.DeepEqual(s.Extra, []string{tmp}) {
+		t.Errorf("agent with jobs in flight has state %+v", s)
+	}
+	if again := takeJobs(t, agents, web); len(again) != 0 {
+		t.Fatalf("reconcile queued %v again", summary(again))
+	}
+
+	for _, job := range jobs {
+		complete(t, agents, web, job, "JobSuccess", "")
+	}
+	c.Reconcile()
+	if s := state(t, c, web); !s.Converged || len(s.Missing)+len(s.Extra)+len(s.Pending)+len(s.Failing) != 0 {
+		t.Fatalf("agent didnt converge: %+v", s)
+	}
+	if rules, _ := agents.Rules(web); len(rules) != 2 || rules[passwd].Status != "currentlyOk" || rules[shadow].Status != "currentlyOk" {
+		t.Errorf("agent has rules %v", rules)
+	}
+	if again := takeJobs(t, agents, web); len(again) != 0 {
+		t.Errorf("converged agent got %v", summary(again))
+	}
+}
+
+func TestReconcileWithoutPruneKeepsExtraRules(t *testing.T) {
+	c, agents := newTestCatalog(t)
+	web := register(t, agents, "web-1", passwd, tmp)
+	c.Put(messages.RuleSet{Name: "base", Selector: map[string]string{"hostname": "web-1"}, Rules: []string{passwd}})
+	c.Reconcile()
+
+	if s := state(t, c, web); !s.Converged || len(s.Extra) != 0 {
+		t.Errorf("agent has state %+v", s)
+	}
+	if jobs := takeJobs(t, agents, web); len(jobs) != 0 {
+		t.Errorf("reconcile queued %v", summary(jobs))
+	}
+}
+
+func TestReconcileBacksOffARejectedRule(t *testing.T) {
+	c, agents := newTestCatalog(t)
+	web := register(t, agents, "web-1")
+	c.Put(messages.RuleSet{Name: "base", Selector: map[string]string{"hostname": "web-1"}, Rules: []string{group}})
+	c.Reconcile()
+
+	jobs := takeJobs(t, agents, web)
+	if len(jobs) != 1 {
+		t.Fatalf("reconcile queued %v", summary(jobs))
+	}
+	//the kernel rejecting it isnt retried by the job engine, the rule is dropped again
+	complete(t, agents, web, jobs[0], "JobFailed", messages.CodeKernelRejected)
+
+	c.Reconcile()
+	s := state(t, c, web)
+	if s.Converged || s.Failing[group] != 1 || !reflect.DeepEqual(s.Missing, []string{group}) {
+		t.Fatalf("agent with a rejected rule has state %+v", s)
+	}
+	if jobs := takeJobs(t, agents, web); len(jobs) != 0 {
+		t.Fatalf("the rejected rule was queued again right away: %v", summary(jobs))
+	}
+
+	//once the retry delay passed it is tried again, the next delay is twice as long
+	c.stateLock.Lock()
+	c.attempts[web][group].last = time.Now().Add(-c.retryDelay(1))
+	c.stateLock.Unlock()
+	c.Reconcile()
+	if jobs := takeJobs(t, agents, web); len(jobs) != 1 || jobs[0].Rule != group {
+		t.Fatalf("reconcile queued %v after the retry delay", summary(jobs))
+	}
+	c.stateLock.Lock()
+	count := c.attempts[web][group].count
+	c.stateLock.Unlock()
+	if count != 2 || c.retryDelay(2) != 2*c.retryDelay(1) {
+		t.Errorf("%d attempts, retry delays %v and %v", count, c.retryDelay(1), c.retryDelay(2))
+	}
+}
+
+func TestReconcileForgetsRemovedAgents(t *testing.T) {
+	c, agents := newTestCatalog(t)
+	web := register(t, agents, "web-1")
+	c.Put(messages.RuleSet{Name: "base", Selector: map[string]string{"hostname": "web-1"}, Rules: []string{group}})
+	c.Reconcile()
+
+	if err := agents.Delete(web); err != nil {
+		t.Fatal(err.Message)
+	}
+	c.Reconcile()
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if _, ok := c.states[web]; ok || c.attempts[web] != nil {
+		t.Error("the state of a removed agent is kept")
+	}
+}
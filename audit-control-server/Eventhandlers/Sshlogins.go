@@ -4,7 +4,7 @@ import(
 	"bytes"
 	//"log"
 
-	"../messages"
+	"audit-control-server/messages"
 
 )
 
@@ -6,7 +6,7 @@ import(
 	"encoding/json"
 	"reflect"
 
-	"../messages"
+	"audit-control-server/messages"
 
 )
 var(
@@ -151,8 +151,10 @@ func (s *Syscall) AnalyzeOpen(file *json.RawMessage, hostname string) string{
 	var path messages.Path
 	var message	bytes.Buffer
 
-	errP := json.Unmarshal(*file, &path)
-	if errP != nil{
+	//the open is reported even if the agent sent no PATH record for it
+	if file == nil{
+		path.Name = "an unknown file"
+	}else if errP := json.Unmarshal(*file, &path); errP != nil{
 		log.Fatal(errP)
 	}
 
@@ -0,0 +1,214 @@
+package Storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"audit-control-server/messages"
+
+	"github.com/google/uuid"
+)
+
+const (
+	agentsBucket   = "agents"
+	rulesBucket    = "rules"
+	jobsBucket     = "jobs"
+	ruleSetsBucket = "rulesets"
+	groupsBucket   = "groups"
+)
+
+//AgentRecord is the part of an agent that survives a server restart. Audit status is left out, agents resend it on every check-in.
+type AgentRecord struct {
+	ID           uuid.UUID
+	Hostname     string
+	HostInfo     *messages.Host
+	Labels       map[string]string
+	IsPurged     bool
+	RegisteredAt time.Time
+}
+
+//Repository persists agents, the status of their rules and their job history.
+type Repository interface {
+	SaveAgent(agent AgentRecord) error
+	DeleteAgent(uid uuid.UUID) error
+	Agents() ([]AgentRecord, error)
+
+	SaveRule(uid uuid.UUID, rule string, state messages.AgentRule) error
+	DeleteRule(uid uuid.UUID, rule string) error
+	ReplaceRules(uid uuid.UUID, rules map[string]messages.AgentRule) error
+	Rules(uid uuid.UUID) (map[string]messages.AgentRule, error)
+
+	SaveJob(uid uuid.UUID, job messages.Job) error
+	DeleteJob(uid uuid.UUID, jobID uuid.UUID) error
+	Jobs(uid uuid.UUID) (map[uuid.UUID]messages.Job, error)
+
+	SaveRuleSet(set messages.RuleSet) error
+	DeleteRuleSet(name string) error
+	RuleSets() ([]messages.RuleSet, error)
+
+	SaveGroup(group messages.Group) error
+	DeleteGroup(name string) error
+	Groups() ([]messages.Group, error)
+}
+
+//KVRepository keeps the repository in a Store. Rules and jobs are keyed by "<agent id>/<rule or job id>".
+type KVRepository struct {
+	store *Store
+}
+
+func NewKVRepository(store *Store) *KVRepository {
+	return &KVRepository{store: store}
+}
+
+func agentPrefix(uid uuid.UUID) string {
+	return uid.String() + "/"
+}
+
+func (r *KVRepository) SaveAgent(agent AgentRecord) error {
+	data, err := json.Marshal(agent)
+	if err != nil {
+		return err
+	}
+	return r.store.Put(agentsBucket, agent.ID.String(), data)
+}
+
+//DeleteAgent removes the agent together with its rules and jobs.
+func (r *KVRepository) DeleteAgent(uid uuid.UUID) error {
+	if err := r.store.DeletePrefix(rulesBucket, agentPrefix(uid)); err != nil {
+		return err
+	}
+	if err := r.store.DeletePrefix(jobsBucket, agentPrefix(uid)); err != nil {
+		return err
+	}
+	return r.store.Delete(agentsBucket, uid.String())
+}
+
+func (r *KVRepository) Agents() ([]AgentRecord, error) {
+	agents := []AgentRecord{}
+	err := r.store.ForEach(agentsBucket, "", func(key string, value []byte) error {
+		var agent AgentRecord
+		if err := json.Unmarshal(value, &agent); err != nil {
+			return fmt.Errorf("stored agent %s is corrupt: %v", key, err)
+		}
+		agents = append(agents, agent)
+		return nil
+	})
+	return agents, err
+}
+
+func (r *KVRepository) SaveRule(uid uuid.UUID, rule string, state messages.AgentRule) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return r.store.Put(rulesBucket, agentPrefix(uid)+rule, data)
+}
+
+func (r *KVRepository) DeleteRule(uid uuid.UUID, rule string) error {
+	return r.store.Delete(rulesBucket, agentPrefix(uid)+rule)
+}
+
+func (r *KVRepository) ReplaceRules(uid uuid.UUID, rules map[string]messages.AgentRule) error {
+	values := make(map[string][]byte, len(rules))
+	for rule, state := range rules {
+		data, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		values[agentPrefix(uid)+rule] = data
+	}
+	return r.store.Replace(rulesBucket, agentPrefix(uid), values)
+}
+
+//Rules reads the rules of an agent. Rules stored before positions were kept hold only their status, they get position -1.
+func (r *KVRepository) Rules(uid uuid.UUID) (map[string]messages.AgentRule, error) {
+	rules := make(map[string]messages.AgentRule)
+	err := r.store.ForEach(rulesBucket, agentPrefix(uid), func(key string, value []byte) error {
+		state := messages.AgentRule{Status: string(value), Position: -1}
+		if strings.HasPrefix(string(value), "{") {
+			if err := json.Unmarshal(value, &state); err != nil {
+				return fmt.Errorf("stored rule %s is corrupt: %v", key, err)
+			}
+		}
+		rules[strings.TrimPrefix(key, agentPrefix(uid))] = state
+		return nil
+	})
+	return rules, err
+}
+
+func (r *KVRepository) SaveJob(uid uuid.UUID, job messages.Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return r.store.Put(jobsBucket, agentPrefix(uid)+job.JobID.String(), data)
+}
+
+func (r *KVRepository) DeleteJob(uid uuid.UUID, jobID uuid.UUID) error {
+	return r.store.Delete(jobsBucket, agentPrefix(uid)+jobID.String())
+}
+
+func (r *KVRepository) Jobs(uid uuid.UUID) (map[uuid.UUID]messages.Job, error) {
+	jobs := make(map[uuid.UUID]messages.Job)
+	err := r.store.ForEach(jobsBucket, agentPrefix(uid), func(key string, value []byte) error {
+		var job messages.Job
+		if err := json.Unmarshal(value, &job); err != nil {
+			return fmt.Errorf("stored job %s is corrupt: %v", key, err)
+		}
+		jobs[job.JobID] = job
+		return nil
+	})
+	return jobs, err
+}
+
+func (r *KVRepository) SaveRuleSet(set messages.RuleSet) error {
+	data, err := json.Marshal(set)
+	if err != nil {
+		return err
+	}
+	return r.store.Put(ruleSetsBucket, set.Name, data)
+}
+
+func (r *KVRepository) DeleteRuleSet(name string) error {
+	return r.store.Delete(ruleSetsBucket, name)
+}
+
+func (r *KVRepository) RuleSets() ([]messages.RuleSet, error) {
+	sets := []messages.RuleSet{}
+	err := r.store.ForEach(ruleSetsBucket, "", func(key string, value []byte) error {
+		var set messages.RuleSet
+		if err := json.Unmarshal(value, &set); err != nil {
+			return fmt.Errorf("stored rule set %s is corrupt: %v", key, err)
+		}
+		sets = append(sets, set)
+		return nil
+	})
+	return sets, err
+}
+
+func (r *KVRepository) SaveGroup(group messages.Group) error {
+	data, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	return r.store.Put(groupsBucket, group.Name, data)
+}
+
+func (r *KVRepository) DeleteGroup(name string) error {
+	return r.store.Delete(groupsBucket, name)
+}
+
+func (r *KVRepository) Groups() ([]messages.Group, error) {
+	groups := []messages.Group{}
+	err := r.store.ForEach(groupsBucket, "", func(key string, value []byte) error {
+		var group messages.Group
+		if err := json.Unmarshal(value, &group); err != nil {
+			return fmt.Errorf("stored group %s is corrupt: %v", key, err)
+		}
+		groups = append(groups, group)
+		return nil
+	})
+	return groups, err
+}
@@ -0,0 +1,285 @@
+package Storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrClosed = errors.New("store is closed")
+
+type record struct {
+	Op     string `json:"op"`
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key,omitempty"`
+	Value  []byte `json:"value,omitempty"`
+	//Records are the changes of a batch, they are applied together
+	Records []record `json:"records,omitempty"`
+}
+
+/*
+Store is a small embedded key value store kept in a single journal file. Every change is appended as a JSON line
+and synced before it returns, the whole data set lives in memory. A change to several keys is a single batch line,
+it is loaded whole or not at all. The journal is compacted into a snapshot on open
+and whenever dead records outnumber live ones. A torn last line left by a crash is dropped on open.
+*/
+type Store struct {
+	filename string
+
+	lock    sync.Mutex
+	file    *os.File
+	data    map[string]map[string][]byte
+	records int
+	closed  bool
+}
+
+//Open loads the journal at filename, creating it if needed.
+func Open(filename string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, fmt.Errorf("couldnt create the storage directory: %v", err)
+	}
+
+	s := &Store{filename: filename, data: make(map[string]map[string][]byte)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) load() error {
+	f, err := os.Open(s.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("couldnt open the storage journal: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			//only the last line can be torn, anything before it means the journal is damaged
+			if scanner.Scan() {
+				return fmt.Errorf("storage journal %s is corrupt at line %d: %v", s.filename, line, err)
+			}
+			break
+		}
+		s.apply(r)
+	}
+	return scanner.Err()
+}
+
+func (s *Store) apply(r record) {
+	switch r.Op {
+	case "put":
+		bucket, ok := s.data[r.Bucket]
+		if !ok {
+			bucket = make(map[string][]byte)
+			s.data[r.Bucket] = bucket
+		}
+		bucket[r.Key] = r.Value
+	case "delete":
+		delete(s.data[r.Bucket], r.Key)
+	case "batch":
+		for _, change := range r.Records {
+			s.apply(change)
+		}
+	}
+}
+
+func (s *Store) live() int {
+	n := 0
+	for _, bucket := range s.data {
+		n += len(bucket)
+	}
+	return n
+}
+
+//compact rewrites the journal with one put per live key and reopens it for appending.
+func (s *Store) compact() error {
+	tmp := s.filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("couldnt compact the storage journal: %v", err)
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for name, bucket := range s.data {
+		for key, value := range bucket {
+			if err := enc.Encode(record{Op: "put", Bucket: name, Key: key, Value: value}); err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.filename); err != nil {
+		return fmt.Errorf("couldnt compact the storage journal: %v", err)
+	}
+	//the rename only survives a crash once the directory is synced too
+	if err := syncDir(filepath.Dir(s.filename)); err != nil {
+		return fmt.Errorf("couldnt compact the storage journal: %v", err)
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.filename, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("couldnt reopen the storage journal: %v", err)
+	}
+	s.records = s.live()
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *Store) write(records ...record) error {
+	if s.closed {
+		return ErrClosed
+	}
+
+	r := records[0]
+	if len(records) > 1 {
+		//a torn line is dropped on open, one line keeps the changes together
+		r = record{Op: "batch", Records: records}
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		//a partial line would swallow the next record, rewrite the journal from memory
+		s.compact()
+		return fmt.Errorf("couldnt write the storage journal: %v", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("couldnt sync the storage journal: %v", err)
+	}
+
+	s.apply(r)
+	s.records += len(records)
+	if s.records > 1000 && s.records > 2*s.live() {
+		return s.compact()
+	}
+	return nil
+}
+
+//Put stores value under key in bucket.
+func (s *Store) Put(bucket, key string, value []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.write(record{Op: "put", Bucket: bucket, Key: key, Value: value})
+}
+
+//Delete removes key from bucket, a missing key is not an error.
+func (s *Store) Delete(bucket, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.data[bucket][key]; !ok {
+		return nil
+	}
+	return s.write(record{Op: "delete", Bucket: bucket, Key: key})
+}
+
+//DeletePrefix removes every key of bucket starting with prefix in a single write.
+func (s *Store) DeletePrefix(bucket, prefix string) error {
+	return s.Replace(bucket, prefix, nil)
+}
+
+//Replace swaps the keys of bucket starting with prefix for values in a single write, so neither readers nor a
+//reopened store ever see a mix.
+func (s *Store) Replace(bucket, prefix string, values map[string][]byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var records []record
+	for key := range s.data[bucket] {
+		if _, ok := values[key]; !ok && strings.HasPrefix(key, prefix) {
+			records = append(records, record{Op: "delete", Bucket: bucket, Key: key})
+		}
+	}
+	for key, value := range values {
+		if !strings.HasPrefix(key, prefix) {
+			return fmt.Errorf("key %q is outside of prefix %q", key, prefix)
+		}
+		records = append(records, record{Op: "put", Bucket: bucket, Key: key, Value: value})
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	return s.write(records...)
+}
+
+//Get returns the value stored under key in bucket.
+func (s *Store) Get(bucket, key string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	value, ok := s.data[bucket][key]
+	return value, ok
+}
+
+//ForEach calls fn for the keys of bucket starting with prefix, in key order.
+func (s *Store) ForEach(bucket, prefix string, fn func(key string, value []byte) error) error {
+	s.lock.Lock()
+	keys := make([]string, 0, len(s.data[bucket]))
+	values := make(map[string][]byte)
+	for key, value := range s.data[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+			values[key] = value
+		}
+	}
+	s.lock.Unlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Close closes the journal, every write was already synced.
+func (s *Store) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.file.Close()
+}
@@ -0,0 +1,159 @@
+package Storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func openTestStore(t *testing.T, filename string) *Store {
+	t.Helper()
+	s, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+//expect checks bucket holds exactly want
+func expect(t *testing.T, s *Store, bucket string, want map[string]string) {
+	t.Helper()
+	got := make(map[string]string)
+	s.ForEach(bucket, "", func(key string, value []byte) error {
+		got[key] = string(value)
+		return nil
+	})
+	if len(got) != len(want) {
+		t.Fatalf("bucket %s holds %v, want %v", bucket, got, want)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Fatalf("bucket %s holds %v, want %v", bucket, got, want)
+		}
+	}
+}
+
+//appendJournal writes data to the end of the journal the way a crash in the middle of a write leaves it
+func appendJournal(t *testing.T, filename string, data string) {
+	t.Helper()
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReopenDropsATornLastLine(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "store.db")
+	s := openTestStore(t, filename)
+	s.Put("agents", "a", []byte("1"))
+	s.Put("agents", "b", []byte("2"))
+	s.Close()
+
+	appendJournal(t, filename, `{"op":"put","bucket":"agents","key":"c","val`)
+	s = openTestStore(t, filename)
+	expect(t, s, "agents", map[string]string{"a": "1", "b": "2"})
+
+	//the torn line was compacted away, the next write doesnt run into it
+	if err := s.Put("agents", "c", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	s = openTestStore(t, filename)
+	defer s.Close()
+	expect(t, s, "agents", map[string]string{"a": "1", "b": "2", "c": "3"})
+}
+
+func TestReopenRefusesACorruptJournal(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "store.db")
+	s := openTestStore(t, filename)
+	s.Put("agents", "a", []byte("1"))
+	s.Close()
+
+	appendJournal(t, filename, "garbage\n"+`{"op":"put","bucket":"agents","key":"b","value":"Mg=="}`+"\n")
+	if s, err := Open(filename); err == nil {
+		s.Close()
+		t.Fatal("a journal damaged before its last line was opened")
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "store.db")
+	s := openTestStore(t, filename)
+	for i := 0; i < 1500; i++ {
+		if err := s.Put("jobs", "job", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Put("jobs", "gone", []byte("x"))
+	s.Delete("jobs", "gone")
+
+	//dead records outnumbered live ones past 1000 records, the journal was rewritten on the way
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines > 1000 {
+		t.Errorf("journal has %d lines, it wasnt compacted", lines)
+	}
+	s.Close()
+
+	s = openTestStore(t, filename)
+	expect(t, s, "jobs", map[string]string{"job": "1499"})
+	s.Close()
+
+	//opening compacts too
+	data, err = ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 1 {
+		t.Errorf("journal has %d lines after opening, want 1", lines)
+	}
+}
+
+func TestReplaceIsOneUnit(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "store.db")
+	s := openTestStore(t, filename)
+	for _, key := range []string{"agent1/1", "agent1/2", "agent1/3", "agent2/1"} {
+		s.Put("rules", key, []byte("old"))
+	}
+	s.Close()
+	s = openTestStore(t, filename)
+
+	err := s.Replace("rules", "agent1/", map[string][]byte{"agent1/2": []byte("new"), "agent1/4": []byte("new")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"agent1/2": "new", "agent1/4": "new", "agent2/1": "old"}
+	expect(t, s, "rules", want)
+
+	if err := s.Replace("rules", "agent1/", map[string][]byte{"agent1/5": nil, "agent2/1": nil}); err == nil {
+		t.Error("Replace took a key outside of its prefix")
+	}
+	expect(t, s, "rules", want)
+	s.Close()
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the replace is the single line after the compacted puts
+	if lines := bytes.Count(data, []byte("\n")); lines != 5 {
+		t.Fatalf("journal has %d lines, want 4 puts and the replace", lines)
+	}
+
+	//a crash in the middle of the replace loses all of it
+	if err := os.Truncate(filename, int64(len(data)-10)); err != nil {
+		t.Fatal(err)
+	}
+	s = openTestStore(t, filename)
+	defer s.Close()
+	expect(t, s, "rules", map[string]string{"agent1/1": "old", "agent1/2": "old", "agent1/3": "old", "agent2/1": "old"})
+}
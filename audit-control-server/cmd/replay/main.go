@@ -0,0 +1,156 @@
+//replay runs a recorded audit log or an NDJSON dump of agent events through the analyzers of the workers and prints
+//what they make of it, so detections can be checked against a capture without a kernel or agents.
+//
+//	go run cmd/replay/main.go [-hostname name] [-quiet] [file|-]
+//
+//Audit log lines can be native auditd records ("type=SYSCALL msg=audit(...): ...") or whole events on one line like
+//the audit.log capture of the agent, lines starting with { are read as the events agents upload. The records are
+//parsed and grouped into events by the audit-log module the agent reads the auditd log with.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"audit-control-server/messages"
+	"audit-control-server/worker"
+
+	"audit-log"
+)
+
+var (
+	maxLine = 1 << 20
+	//only the first skipped lines are reported, the summary counts all of them
+	maxSkipReports = 10
+)
+
+type stats struct {
+	events      int
+	messages    int
+	processes   int
+	connections int
+	skipped     int
+}
+
+type replay struct {
+	hostname    string
+	quiet       bool
+	out         io.Writer
+	assembler   *auditlog.Assembler
+	processes   chan []byte
+	connections chan []byte
+	stats       stats
+}
+
+func main() {
+	hostname := flag.String("hostname", "", "host name of the events, overrides the one in NDJSON events")
+	quiet := flag.Bool("quiet", false, "print only first-seen processes and connections and the summary")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [file|-]\r\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	in := io.Reader(os.Stdin)
+	if flag.NArg() > 0 && flag.Arg(0) != "-" {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldnt open the log: %v\r\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	r := &replay{
+		hostname:    *hostname,
+		quiet:       *quiet,
+		out:         os.Stdout,
+		processes:   make(chan []byte, 1),
+		connections: make(chan []byte, 1),
+	}
+	r.assembler = auditlog.NewAssembler(r.complete)
+	if err := r.run(in); err != nil {
+		fmt.Fprintf(os.Stderr, "couldnt read the log: %v\r\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(r.out, "%d events, %d messages, %d new processes, %d new connections, %d lines skipped\n",
+		r.stats.events, r.stats.messages, r.stats.processes, r.stats.connections, r.stats.skipped)
+}
+
+func (r *replay) run(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), maxLine)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "{") {
+			var event messages.GeneralInfo
+			if err := json.Unmarshal([]byte(text), &event); err != nil || event.Data == nil {
+				r.skip(line, "not an event")
+				continue
+			}
+			r.analyze(&event)
+			continue
+		}
+		msgs, err := auditlog.ParseLine(text)
+		if err != nil {
+			r.skip(line, err.Error())
+			continue
+		}
+		//a recording has no timing to go by, events complete on EOE, on the open limit or at the end
+		for _, msg := range msgs {
+			if err := r.assembler.Add(msg, time.Time{}); err != nil {
+				r.skip(line, err.Error())
+			}
+		}
+	}
+	r.assembler.Expire(time.Time{})
+	return scanner.Err()
+}
+
+func (r *replay) skip(line int, reason string) {
+	r.stats.skipped++
+	if !r.quiet && r.stats.skipped <= maxSkipReports {
+		fmt.Fprintf(os.Stderr, "skipping line %d: %s\r\n", line, reason)
+	}
+}
+
+func (r *replay) complete(event auditlog.Event) {
+	r.analyze(&messages.GeneralInfo{Serial: event.Serial, Data: event.Data})
+}
+
+func (r *replay) analyze(event *messages.GeneralInfo) {
+	if r.hostname != "" {
+		event.HostName = r.hostname
+	}
+	r.stats.events++
+
+	//the analyzers send first-seen processes and connections before they return, the channels hold one each
+	ship := worker.Analyze(event, r.processes, r.connections)
+	if ship {
+		r.stats.messages++
+		if !r.quiet {
+			fmt.Fprintf(r.out, "%d: %s\n", event.Serial, event.Message)
+		}
+	}
+	select {
+	case proc := <-r.processes:
+		r.stats.processes++
+		fmt.Fprintf(r.out, "%d: new process: %s", event.Serial, proc)
+	case con := <-r.connections:
+		r.stats.connections++
+		fmt.Fprintf(r.out, "%d: new connection: %s", event.Serial, con)
+	default:
+	}
+}
@@ -0,0 +1,764 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"audit-control-server/Agents"
+	"audit-control-server/Catalog"
+	"audit-control-server/messages"
+
+	"github.com/google/uuid"
+)
+
+type access int
+
+const (
+	accessPublic access = iota
+	accessAgent
+	accessOperator
+)
+
+type params map[string]string
+
+/*
+apiRoute is one operation of the /api/v1 API. Paths use {name} for a segment parameter, {id} and {job} must be
+UUIDs. Stream routes exchange NDJSON lines of Body and Result instead of single JSON documents. The same table drives
+routing, the role the operator middleware requires and the OpenAPI document.
+*/
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	Access  access
+	Role    Role
+	Body    string
+	Status  int
+	Result  string
+	Paged   bool
+	Stream  bool
+	handle  func(r *Router, res http.ResponseWriter, req *http.Request, p params)
+}
+
+var apiRoutes []apiRoute
+
+func init() {
+	apiRoutes = []apiRoute{
+		{Method: "GET", Path: "/openapi.json", Summary: "This document", Access: accessPublic, Result: "object", handle: serveOpenAPI},
+
+		{Method: "GET", Path: "/agents", Summary: "List agents, filter with selector=env=prod,role=db", Access: accessOperator, Role: RoleViewer, Result: "Agent", Paged: true, handle: listAgents},
+		{Method: "GET", Path: "/agents/{id}", Summary: "Get an agent", Access: accessOperator, Role: RoleViewer, Result: "Agent", handle: getAgent},
+		{Method: "DELETE", Path: "/agents/{id}", Summary: "Delete an agent with its rules and job history, it enrolls anew if it comes back", Access: accessOperator, Role: RoleAdmin, Status: http.StatusNoContent, handle: deleteAgent},
+		{Method: "GET", Path: "/agents/{id}/host", Summary: "Processes and connections the agent reported", Access: accessOperator, Role: RoleViewer, Result: "object", handle: getHost},
+		{Method: "GET", Path: "/agents/{id}/audit-status", Summary: "Kernel audit status the agent reported", Access: accessOperator, Role: RoleViewer, Result: "object", handle: getAuditStatus},
+		{Method: "GET", Path: "/agents/{id}/rules/drift", Summary: "Whether the agent's kernel rules drifted from the ones recorded for it", Access: accessOperator, Role: RoleViewer, Result: "RuleDrift", handle: getRuleDrift},
+		{Method: "GET", Path: "/agents/{id}/rules/reload", Summary: "Last reload of its rules file the agent reported", Access: accessOperator, Role: RoleViewer, Result: "RulesReload", handle: getLastReload},
+		{Method: "GET", Path: "/agents/{id}/rules", Summary: "List the rules of an agent", Access: accessOperator, Role: RoleViewer, Result: "Rule", Paged: true, handle: listRules},
+		{Method: "POST", Path: "/agents/{id}/rules", Summary: "Add a rule to an agent", Access: accessOperator, Role: RoleRuleEditor, Body: "RuleRequest", Status: http.StatusAccepted, Result: "Job", handle: addRule},
+		{Method: "PUT", Path: "/agents/{id}/rules", Summary: "Replace every rule of an agent with a rule set, applied all at once and rolled back unless the agent reports within the confirmation window", Access: accessOperator, Role: RoleRuleEditor, Body: "RuleSetRequest", Status: http.StatusAccepted, Result: "Job", handle: applyRuleSet},
+		{Method: "DELETE", Path: "/agents/{id}/rules", Summary: "Delete the rule given in the rule query parameter from an agent", Access: accessOperator, Role: RoleRuleEditor, Status: http.StatusAccepted, Result: "Job", handle: deleteRule},
+		{Method: "GET", Path: "/agents/{id}/jobs", Summary: "List the jobs of an agent, oldest first", Access: accessOperator, Role: RoleViewer, Result: "Job", Paged: true, handle: listJobs},
+		{Method: "GET", Path: "/agents/{id}/jobs/{job}", Summary: "Get a job of an agent", Access: accessOperator, Role: RoleViewer, Result: "Job", handle: getJob},
+		{Method: "POST", Path: "/agents/{id}/jobs/{job}/cancel", Summary: "Cancel a job that wasnt dispatched yet", Access: accessOperator, Role: RoleRuleEditor, Result: "Job", handle: cancelJob},
+		{Method: "POST", Path: "/agents/{id}/actions/purge-rules", Summary: "Remove every rule from an agent", Access: accessOperator, Role: RoleRuleEditor, Status: http.StatusAccepted, Result: "Job", handle: purgeRules},
+		{Method: "POST", Path: "/agents/{id}/actions/save-config", Summary: "Save the loaded rules as the agent's rules file", Access: accessOperator, Role: RoleRuleEditor, Status: http.StatusAccepted, Result: "Job", handle: operationalJob("SaveConfig")},
+		{Method: "POST", Path: "/agents/{id}/actions/shutdown", Summary: "Stop the agent", Access: accessOperator, Role: RoleAdmin, Status: http.StatusAccepted, Result: "Job", handle: operationalJob("ShutDown")},
+		{Method: "POST", Path: "/agents/{id}/actions/uninstall", Summary: "Put back the audit configuration the host had before the agent and stop the agent", Access: accessOperator, Role: RoleAdmin, Status: http.StatusAccepted, Result: "Job", handle: operationalJob("Uninstall")},
+		{Method: "POST", Path: "/agents/{id}/actions/approve-reenrollment", Summary: "Let an agent that lost or let expire its certificate enroll once more with the enrollment token", Access: accessOperator, Role: RoleAdmin, Status: http.StatusNoContent, handle: approveReenrollment},
+		{Method: "POST", Path: "/agents/{id}/actions/start-audit", Summary: "Start receiving audit events", Access: accessOperator, Role: RoleAdmin, Status: http.StatusAccepted, Result: "Job", handle: operationalJob("StartAudit")},
+		{Method: "POST", Path: "/agents/{id}/actions/stop-audit", Summary: "Stop receiving audit events", Access: accessOperator, Role: RoleAdmin, Status: http.StatusAccepted, Result: "Job", handle: operationalJob("StopAudit")},
+		{Method: "POST", Path: "/agents/{id}/actions/audit-params", Summary: "Change the kernel audit settings of an agent, the ones left out stay as they are", Access: accessOperator, Role: RoleAdmin, Body: "AuditParams", Status: http.StatusAccepted, Result: "Job", handle: setAuditParams},
+		{Method: "DELETE", Path: "/rules", Summary: "Delete the rule given in the rule query parameter from every agent", Access: accessOperator, Role: RoleRuleEditor, Status: http.StatusAccepted, Result: "BulkJob", handle: deleteEverywhere},
+
+		{Method: "GET", Path: "/groups", Summary: "List the agent groups", Access: accessOperator, Role: RoleViewer, Result: "Group", Paged: true, handle: listGroups},
+		{Method: "GET", Path: "/groups/{name}", Summary: "Get an agent group", Access: accessOperator, Role: RoleViewer, Result: "Group", handle: getGroup},
+		{Method: "PUT", Path: "/groups/{name}", Summary: "Create or replace an agent group", Access: accessOperator, Role: RoleRuleEditor, Body: "Group", Result: "Group", handle: putGroup},
+		{Method: "DELETE", Path: "/groups/{name}", Summary: "Delete an agent group, its agents are left alone", Access: accessOperator, Role: RoleRuleEditor, Status: http.StatusNoContent, handle: deleteGroup},
+		{Method: "GET", Path: "/groups/{name}/agents", Summary: "List the agents the group selects", Access: accessOperator, Role: RoleViewer, Result: "Agent", Paged: true, handle: listGroupAgents},
+		{Method: "POST", Path: "/bulk-jobs", Summary: "Issue a job on every agent a selector or group picks, ShutDown, Uninstall, StartAudit and StopAudit need the admin role", Access: accessOperator, Role: RoleRuleEditor, Body: "BulkRequest", Status: http.StatusAccepted, Result: "BulkOperation", handle: postBulk},
+		{Method: "GET", Path: "/bulk-jobs", Summary: "List recent bulk jobs, newest first", Access: accessOperator, Role: RoleViewer, Result: "BulkOperation", Paged: true, handle: listBulk},
+		{Method: "GET", Path: "/bulk-jobs/{job}", Summary: "Get a bulk job with the progress on every agent", Access: accessOperator, Role: RoleViewer, Result: "BulkOperation", handle: getBulk},
+
+		{Method: "GET", Path: "/rulesets", Summary: "List the rule sets of the catalog", Access: accessOperator, Role: RoleViewer, Result: "RuleSet", Paged: true, handle: listRuleSets},
+		{Method: "GET", Path: "/rulesets/{name}", Summary: "Get a rule set", Access: accessOperator, Role: RoleViewer, Result: "RuleSet", handle: getRuleSet},
+		{Method: "PUT", Path: "/rulesets/{name}", Summary: "Create or replace a rule set", Access: accessOperator, Role: RoleRuleEditor, Body: "RuleSet", Result: "RuleSet", handle: putRuleSet},
+		{Method: "DELETE", Path: "/rulesets/{name}", Summary: "Delete a rule set, its rules stay on the agents", Access: accessOperator, Role: RoleRuleEditor, Status: http.StatusNoContent, handle: deleteRuleSet},
+		{Method: "GET", Path: "/drift", Summary: "Reconciliation status of every agent, filter with converged=true or false", Access: accessOperator, Role: RoleViewer, Result: "AgentState", Paged: true, handle: listDrift},
+		{Method: "GET", Path: "/agents/{id}/drift", Summary: "Reconciliation status of an agent", Access: accessOperator, Role: RoleViewer, Result: "AgentState", handle: getDrift},
+		{Method: "POST", Path: "/reconcile", Summary: "Start a reconciliation pass now", Access: accessOperator, Role: RoleRuleEditor, Status: http.StatusAccepted, handle: reconcile},
+
+		{Method: "POST", Path: "/agent/register", Summary: "Enroll or re-register the calling agent", Access: accessAgent, Body: "AgentMessage", Result: "CertificateMessage", handle: agentHandler(func(r *Router) http.Handler { return r.Agents.Register() })},
+		{Method: "POST", Path: "/agent/certificate", Summary: "Renew the client certificate of the calling agent", Access: accessAgent, Body: "CertificateRequest", Result: "CertificateMessage", handle: agentAuthHandler(func(r *Router) func(uuid.UUID) http.HandlerFunc { return r.Agents.RenewCertificate })},
+		{Method: "GET", Path: "/agent/jobs/next", Summary: "Check in and take the next job", Access: accessAgent, Result: "BaseMessage", handle: agentAuthHandler(func(r *Router) func(uuid.UUID) http.HandlerFunc { return r.Agents.StatusCheckIn })},
+		{Method: "POST", Path: "/agent/jobs/result", Summary: "Report the result of a job", Access: accessAgent, Body: "Job", handle: agentAuthHandler(func(r *Router) func(uuid.UUID) http.HandlerFunc { return r.Agents.JobComplete })},
+		{Method: "POST", Path: "/agent/jobs/stream", Summary: "Hold a job stream open over HTTP/2: jobs arrive as NDJSON BaseMessages, results go back as NDJSON Jobs on the request body", Access: accessAgent, Body: "Job", Result: "BaseMessage", Stream: true, handle: agentAuthHandler(func(r *Router) func(uuid.UUID) http.HandlerFunc { return r.Agents.JobStream })},
+		{Method: "PUT", Path: "/agent/host", Summary: "Report processes and connections", Access: accessAgent, Body: "object", handle: agentAuthHandler(func(r *Router) func(uuid.UUID) http.HandlerFunc { return r.Agents.UpdateInfo })},
+		{Method: "PUT", Path: "/agent/audit-status", Summary: "Report the kernel audit status", Access: accessAgent, Body: "object", handle: agentAuthHandler(func(r *Router) func(uuid.UUID) http.HandlerFunc { return r.Agents.AuditStatus })},
+		{Method: "POST", Path: "/agent/rules/reload", Summary: "Report a reload of the rules file, the agent's rules are replaced with the ones it loaded", Access: accessAgent, Body: "RulesReload", handle: agentAuthHandler(func(r *Router) func(uuid.UUID) http.HandlerFunc { return r.Agents.RulesReloaded })},
+		{Method: "POST", Path: "/agent/events", Summary: "Upload an audit event", Access: accessAgent, Body: "object", handle: postEvent},
+		{Method: "POST", Path: "/agent/events/batch", Summary: "Upload audit events as NDJSON, gzip compressed with Content-Encoding: gzip. Answers 503 with Retry-After while the server is overloaded", Access: accessAgent, Body: "object", Result: "BatchAck", handle: agentAuthHandler(func(r *Router) func(uuid.UUID) http.HandlerFunc { return r.EventBatch })},
+		{Method: "DELETE", Path: "/agent", Summary: "Deregister the calling agent", Access: accessAgent, handle: agentAuthHandler(func(r *Router) func(uuid.UUID) http.HandlerFunc { return r.Agents.DeRegister })},
+	}
+}
+
+//apiPath returns the part of a request path below /api/v1
+func apiPath(p string) (string, bool) {
+	head, tail := ShiftPath(p)
+	if head != "api" {
+		return "", false
+	}
+	version, tail := ShiftPath(tail)
+	if version != "v1" {
+		return "", false
+	}
+	return tail, true
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+/*
+matchRoute finds the route for method and path. When only the path matches, route is nil and allowed lists the
+methods the path supports.
+*/
+func matchRoute(method string, p string) (route *apiRoute, values params, allowed []string) {
+	segments := splitPath(p)
+	for i := range apiRoutes {
+		candidate := &apiRoutes[i]
+		pattern := splitPath(candidate.Path)
+		if len(pattern) != len(segments) {
+			continue
+		}
+
+		match := params{}
+		for j, part := range pattern {
+			if strings.HasPrefix(part, "{") {
+				match[strings.Trim(part, "{}")] = segments[j]
+			} else if part != segments[j] {
+				match = nil
+				break
+			}
+		}
+		if match == nil {
+			continue
+		}
+		if candidate.Method == method {
+			return candidate, match, nil
+		}
+		allowed = append(allowed, candidate.Method)
+	}
+	return nil, nil, allowed
+}
+
+func (r *Router) serveAPI(res http.ResponseWriter, req *http.Request, p string) {
+	req = Agents.WithJSONErrors(req)
+
+	route, values, allowed := matchRoute(req.Method, p)
+	if route == nil {
+		if len(allowed) > 0 {
+			res.Header().Set("Allow", strings.Join(allowed, ", "))
+			Agents.WriteError(res, req, Agents.ErrMethod)
+			return
+		}
+		Agents.WriteError(res, req, Agents.ErrNotFound)
+		return
+	}
+
+	for _, name := range []string{"id", "job"} {
+		if value, ok := values[name]; ok {
+			if _, err := uuid.Parse(value); err != nil {
+				Agents.WriteError(res, req, Agents.ErrInvalidID.Errorf("invalid %s: %s", name, value))
+				return
+			}
+		}
+	}
+	route.handle(r, res, req, values)
+}
+
+func writeJSON(res http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("couldnt encode response: %v", err)
+		http.Error(res, `{"error":{"code":"internal","message":"internal server error"}}`, http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(body)
+}
+
+type page struct {
+	Items  interface{} `json:"items"`
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+}
+
+var (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+//pageBounds reads the offset and limit query parameters and returns the slice bounds of a list of total items
+func pageBounds(req *http.Request, total int) (start int, end int, limit int, err *Agents.APIError) {
+	query := req.URL.Query()
+	limit = defaultPageSize
+	if v := query.Get("limit"); v != "" {
+		n, errA := strconv.Atoi(v)
+		if errA != nil || n < 1 || n > maxPageSize {
+			return 0, 0, 0, Agents.ErrInvalidArgument.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		limit = n
+	}
+	if v := query.Get("offset"); v != "" {
+		n, errA := strconv.Atoi(v)
+		if errA != nil || n < 0 {
+			return 0, 0, 0, Agents.ErrInvalidArgument.Errorf("offset must be a non negative number")
+		}
+		start = n
+	}
+	if start > total {
+		start = total
+	}
+	end = start + limit
+	if end > total {
+		end = total
+	}
+	return start, end, limit, nil
+}
+
+func uuidParam(p params, name string) uuid.UUID {
+	//serveAPI already checked the format
+	uid, _ := uuid.Parse(p[name])
+	return uid
+}
+
+func serveOpenAPI(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	writeJSON(res, http.StatusOK, openAPIDocument())
+}
+
+func listAgents(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	agents := r.Agents.Summaries()
+	if value := req.URL.Query().Get("selector"); value != "" {
+		selector, errS := Agents.ParseSelector(value)
+		if errS != nil {
+			Agents.WriteError(res, req, errS)
+			return
+		}
+		agents = r.Agents.SummariesOf(selector)
+	}
+	start, end, limit, err := pageBounds(req, len(agents))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, page{Items: agents[start:end], Total: len(agents), Offset: start, Limit: limit})
+}
+
+func getAgent(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	agent, err := r.Agents.Summary(uuidParam(p, "id"))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, agent)
+}
+
+func deleteAgent(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	if err := r.Agents.Delete(uuidParam(p, "id")); err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func approveReenrollment(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	if err := r.Agents.ApproveReenrollment(uuidParam(p, "id")); err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func getHost(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	host, err := r.Agents.HostInfo(uuidParam(p, "id"))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, host)
+}
+
+func getAuditStatus(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	status, err := r.Agents.AuditStatusOf(uuidParam(p, "id"))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	if status == nil {
+		Agents.WriteError(res, req, Agents.ErrNotFound.Errorf("the agent didnt report its audit status yet"))
+		return
+	}
+	writeJSON(res, http.StatusOK, status)
+}
+
+func getRuleDrift(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	drift, err := r.Agents.DriftOf(uuidParam(p, "id"))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	if drift == nil {
+		Agents.WriteError(res, req, Agents.ErrNotFound.Errorf("the agent didnt report its rule set yet"))
+		return
+	}
+	writeJSON(res, http.StatusOK, drift)
+}
+
+func getLastReload(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	reload, err := r.Agents.LastReloadOf(uuidParam(p, "id"))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	if reload == nil {
+		Agents.WriteError(res, req, Agents.ErrNotFound.Errorf("the agent didnt reload its rules yet"))
+		return
+	}
+	writeJSON(res, http.StatusOK, reload)
+}
+
+type ruleView struct {
+	Rule     string `json:"rule"`
+	Status   string `json:"status"`
+	Position int    `json:"position"`
+}
+
+func listRules(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	rules, err := r.Agents.Rules(uuidParam(p, "id"))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+
+	//in the order the agent has them loaded
+	views := make([]ruleView, 0, len(rules))
+	for _, rule := range Agents.OrderedRules(rules) {
+		views = append(views, ruleView{Rule: rule, Status: rules[rule].Status, Position: rules[rule].Position})
+	}
+
+	start, end, limit, err := pageBounds(req, len(views))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, page{Items: views[start:end], Total: len(views), Offset: start, Limit: limit})
+}
+
+type ruleRequest struct {
+	Rule   string `json:"rule"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+func addRule(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	data, errR := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, 1<<20))
+	if errR != nil {
+		Agents.WriteError(res, req, Agents.ErrInvalidBody.Errorf("can't read body"))
+		return
+	}
+	var body ruleRequest
+	if errU := json.Unmarshal(data, &body); errU != nil || strings.TrimSpace(body.Rule) == "" {
+		Agents.WriteError(res, req, Agents.ErrInvalidBody.Errorf(`body must be {"rule": "<auditctl rule>"}`))
+		return
+	}
+
+	job, err := r.Agents.QueueInsertRule(uuidParam(p, "id"), body.Rule, body.Before, body.After)
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusAccepted, job)
+}
+
+type ruleSetRequest struct {
+	Rules   []string `json:"rules"`
+	Confirm int      `json:"confirm"`
+}
+
+func applyRuleSet(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	data, errR := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, 1<<20))
+	if errR != nil {
+		Agents.WriteError(res, req, Agents.ErrInvalidBody.Errorf("can't read body"))
+		return
+	}
+	var body ruleSetRequest
+	if errU := json.Unmarshal(data, &body); errU != nil || body.Rules == nil {
+		Agents.WriteError(res, req, Agents.ErrInvalidBody.Errorf(`body must be {"rules": ["<auditctl rule>", ...]}`))
+		return
+	}
+
+	job, err := r.Agents.QueueApplyRuleSet(uuidParam(p, "id"), body.Rules, body.Confirm)
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusAccepted, job)
+}
+
+func ruleQuery(res http.ResponseWriter, req *http.Request) (string, bool) {
+	rule := req.URL.Query().Get("rule")
+	if rule == "" {
+		Agents.WriteError(res, req, Agents.ErrMissingParam.Errorf("missing parameter: rule"))
+		return "", false
+	}
+	return rule, true
+}
+
+func deleteRule(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	rule, ok := ruleQuery(res, req)
+	if !ok {
+		return
+	}
+	job, err := r.Agents.QueueDeleteRule(uuidParam(p, "id"), rule)
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusAccepted, job)
+}
+
+func deleteEverywhere(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	rule, ok := ruleQuery(res, req)
+	if !ok {
+		return
+	}
+	job, busy := r.Agents.DeleteEverywhere(rule)
+	writeJSON(res, http.StatusAccepted, struct {
+		Job     interface{} `json:"job"`
+		Skipped []string    `json:"skipped"`
+	}{job, busy})
+}
+
+func listJobs(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	jobs, err := r.Agents.Jobs(uuidParam(p, "id"))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	start, end, limit, err := pageBounds(req, len(jobs))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, page{Items: jobs[start:end], Total: len(jobs), Offset: start, Limit: limit})
+}
+
+func getJob(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	job, err := r.Agents.Job(uuidParam(p, "id"), uuidParam(p, "job"))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, job)
+}
+
+func cancelJob(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	job, err := r.Agents.Cancel(uuidParam(p, "id"), uuidParam(p, "job"))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, job)
+}
+
+func purgeRules(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	job, err := r.Agents.Purge(uuidParam(p, "id"))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusAccepted, job)
+}
+
+func setAuditParams(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	data, errR := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, 1<<20))
+	if errR != nil {
+		Agents.WriteError(res, req, Agents.ErrInvalidBody.Errorf("can't read body"))
+		return
+	}
+	var body messages.AuditParams
+	if errU := json.Unmarshal(data, &body); errU != nil {
+		Agents.WriteError(res, req, Agents.ErrInvalidBody)
+		return
+	}
+
+	job, err := r.Agents.QueueSetAuditParams(uuidParam(p, "id"), body)
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusAccepted, job)
+}
+
+func operationalJob(jobType string) func(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	return func(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+		job, err := r.Agents.QueueJob(uuidParam(p, "id"), jobType)
+		if err != nil {
+			Agents.WriteError(res, req, err)
+			return
+		}
+		writeJSON(res, http.StatusAccepted, job)
+	}
+}
+
+func agentHandler(h func(r *Router) http.Handler) func(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	return func(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+		h(r).ServeHTTP(res, req)
+	}
+}
+
+func agentAuthHandler(h func(r *Router) func(uuid.UUID) http.HandlerFunc) func(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	return func(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+		AgentAuth(h(r)).ServeHTTP(res, req)
+	}
+}
+
+func postEvent(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	AgentAuth(func(uid uuid.UUID) http.HandlerFunc {
+		return func(res http.ResponseWriter, req *http.Request) {
+			if _, ok := r.Agents.Get(uid); !ok {
+				Agents.WriteError(res, req, Agents.ErrAgentNotFound)
+				return
+			}
+			r.Sys.ServeHTTP(res, req)
+		}
+	}).ServeHTTP(res, req)
+}
+
+func listRuleSets(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	sets := r.Catalog.List()
+	start, end, limit, err := pageBounds(req, len(sets))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, page{Items: sets[start:end], Total: len(sets), Offset: start, Limit: limit})
+}
+
+func getRuleSet(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	set, err := r.Catalog.Get(p["name"])
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, set)
+}
+
+func putRuleSet(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	data, errR := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, 4<<20))
+	if errR != nil {
+		Agents.WriteError(res, req, Agents.ErrInvalidBody.Errorf("can't read body"))
+		return
+	}
+	var set messages.RuleSet
+	if errU := json.Unmarshal(data, &set); errU != nil {
+		Agents.WriteError(res, req, Agents.ErrInvalidBody)
+		return
+	}
+	if set.Name != "" && set.Name != p["name"] {
+		Agents.WriteError(res, req, Catalog.ErrInvalidRuleSet.Errorf("name in the body doesnt match the path"))
+		return
+	}
+	set.Name = p["name"]
+
+	stored, err := r.Catalog.Put(set)
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, stored)
+}
+
+func deleteRuleSet(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	if err := r.Catalog.Delete(p["name"]); err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func listDrift(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	states := r.Catalog.States()
+	if v := req.URL.Query().Get("converged"); v != "" {
+		want, errP := strconv.ParseBool(v)
+		if errP != nil {
+			Agents.WriteError(res, req, Agents.ErrInvalidArgument.Errorf("converged must be true or false"))
+			return
+		}
+		filtered := states[:0]
+		for _, state := range states {
+			if state.Converged == want {
+				filtered = append(filtered, state)
+			}
+		}
+		states = filtered
+	}
+
+	start, end, limit, err := pageBounds(req, len(states))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, page{Items: states[start:end], Total: len(states), Offset: start, Limit: limit})
+}
+
+func getDrift(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	state, err := r.Catalog.State(uuidParam(p, "id"))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, state)
+}
+
+func reconcile(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	r.Catalog.Trigger()
+	res.WriteHeader(http.StatusAccepted)
+}
+
+func listGroups(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	groups := r.Agents.Groups()
+	start, end, limit, err := pageBounds(req, len(groups))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, page{Items: groups[start:end], Total: len(groups), Offset: start, Limit: limit})
+}
+
+func getGroup(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	group, err := r.Agents.Group(p["name"])
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, group)
+}
+
+func putGroup(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	data, errR := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, 1<<20))
+	if errR != nil {
+		Agents.WriteError(res, req, Agents.ErrInvalidBody.Errorf("can't read body"))
+		return
+	}
+	var group messages.Group
+	if errU := json.Unmarshal(data, &group); errU != nil {
+		Agents.WriteError(res, req, Agents.ErrInvalidBody)
+		return
+	}
+	if group.Name != "" && group.Name != p["name"] {
+		Agents.WriteError(res, req, Agents.ErrInvalidArgument.Errorf("name in the body doesnt match the path"))
+		return
+	}
+	group.Name = p["name"]
+
+	stored, err := r.Agents.PutGroup(group)
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, stored)
+}
+
+func deleteGroup(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	if err := r.Agents.DeleteGroup(p["name"]); err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func listGroupAgents(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	group, err := r.Agents.Group(p["name"])
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	agents := r.Agents.SummariesOf(Agents.Selector(group.Selector))
+	start, end, limit, err := pageBounds(req, len(agents))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, page{Items: agents[start:end], Total: len(agents), Offset: start, Limit: limit})
+}
+
+//bulkRoutes names the legacy route of each bulk job type, the role that route needs applies to the bulk job as well
+var bulkRoutes = map[string]string{
+	"AddRule":    "AddRule",
+	"Delete":     "DeleteRule",
+	"Purge":      "PurgeRules",
+	"SaveConfig": "SaveConfig",
+	"ShutDown":   "ShutDown",
+	"Uninstall":  "Uninstall",
+	"StartAudit": "StartAudit",
+	"StopAudit":  "StopAudit",
+}
+
+func postBulk(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	data, errR := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, 1<<20))
+	if errR != nil {
+		Agents.WriteError(res, req, Agents.ErrInvalidBody.Errorf("can't read body"))
+		return
+	}
+	var body Agents.BulkRequest
+	if errU := json.Unmarshal(data, &body); errU != nil {
+		Agents.WriteError(res, req, Agents.ErrInvalidBody)
+		return
+	}
+
+	if required, ok := operatorRoutes[bulkRoutes[body.JobType]]; ok {
+		op, _ := OperatorFromContext(req.Context())
+		if roleNames[op.Role] < required {
+			deny(res, req, Agents.ErrForbidden, fmt.Sprintf("operator %s with role %s needs role %s for %s", op.Name, op.Role, required, body.JobType))
+			return
+		}
+	}
+
+	bulk, err := r.Agents.QueueBulk(body)
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusAccepted, bulk)
+}
+
+func listBulk(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	ops := r.Agents.BulkList()
+	start, end, limit, err := pageBounds(req, len(ops))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, page{Items: ops[start:end], Total: len(ops), Offset: start, Limit: limit})
+}
+
+func getBulk(r *Router, res http.ResponseWriter, req *http.Request, p params) {
+	bulk, err := r.Agents.Bulk(uuidParam(p, "job"))
+	if err != nil {
+		Agents.WriteError(res, req, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, bulk)
+}
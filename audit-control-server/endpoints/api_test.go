@@ -0,0 +1,208 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"audit-control-server/Agents"
+
+	"github.com/google/uuid"
+)
+
+type errorBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder) errorBody {
+	t.Helper()
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("error Content-Type is %q", ct)
+	}
+	var body errorBody
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("error body %q isnt JSON: %v", rec.Body.String(), err)
+	}
+	return body
+}
+
+func TestMatchRoute(t *testing.T) {
+	id, job := uuid.New().String(), uuid.New().String()
+
+	route, values, _ := matchRoute("GET", "/agents/"+id+"/jobs/"+job)
+	if route == nil || route.Path != "/agents/{id}/jobs/{job}" {
+		t.Fatalf("matched %+v", route)
+	}
+	if values["id"] != id || values["job"] != job {
+		t.Errorf("values %v", values)
+	}
+
+	if route, _, _ := matchRoute("GET", "/agents/"+id+"/rules/drift"); route == nil || route.Path != "/agents/{id}/rules/drift" {
+		t.Errorf("drift matched %+v", route)
+	}
+
+	route, _, allowed := matchRoute("PATCH", "/agents/"+id+"/rules")
+	if route != nil {
+		t.Fatalf("PATCH matched %+v", route)
+	}
+	if strings.Join(allowed, ", ") != "GET, POST, PUT, DELETE" {
+		t.Errorf("allowed %v", allowed)
+	}
+
+	if route, _, allowed := matchRoute("GET", "/nothing/here"); route != nil || len(allowed) > 0 {
+		t.Errorf("unknown path matched %+v, allowed %v", route, allowed)
+	}
+}
+
+func TestServeAPIErrors(t *testing.T) {
+	r := &Router{}
+	tests := []struct {
+		method string
+		path   string
+		status int
+		code   string
+		allow  string
+	}{
+		{"PATCH", "/api/v1/groups/db", http.StatusMethodNotAllowed, "method_not_allowed", "GET, PUT, DELETE"},
+		{"GET", "/api/v1/reconcile", http.StatusMethodNotAllowed, "method_not_allowed", "POST"},
+		{"GET", "/api/v1/nothing", http.StatusNotFound, "not_found", ""},
+		{"GET", "/api/v1/agents/not-a-uuid", http.StatusBadRequest, "invalid_id", ""},
+		{"GET", "/api/v1/agents/" + uuid.New().String() + "/jobs/1", http.StatusBadRequest, "invalid_id", ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+
+		if rec.Code != tt.status {
+			t.Errorf("%s %s got %d, want %d", tt.method, tt.path, rec.Code, tt.status)
+			continue
+		}
+		if body := decodeError(t, rec); body.Error.Code != tt.code || body.Error.Message == "" {
+			t.Errorf("%s %s got error %+v, want code %s", tt.method, tt.path, body.Error, tt.code)
+		}
+		if allow := rec.Header().Get("Allow"); allow != tt.allow {
+			t.Errorf("%s %s got Allow %q, want %q", tt.method, tt.path, allow, tt.allow)
+		}
+	}
+}
+
+func TestPageBounds(t *testing.T) {
+	tests := []struct {
+		query      string
+		total      int
+		start, end int
+		limit      int
+		bad        bool
+	}{
+		{"", 250, 0, defaultPageSize, defaultPageSize, false},
+		{"?limit=10&offset=5", 250, 5, 15, 10, false},
+		{"?limit=10&offset=245", 250, 245, 250, 10, false},
+		{"?offset=300", 250, 250, 250, defaultPageSize, false},
+		{"?limit=1000", 5, 0, 5, 1000, false},
+		{"?limit=0", 250, 0, 0, 0, true},
+		{"?limit=1001", 250, 0, 0, 0, true},
+		{"?limit=ten", 250, 0, 0, 0, true},
+		{"?offset=-1", 250, 0, 0, 0, true},
+		{"?offset=x", 250, 0, 0, 0, true},
+	}
+	for _, tt := range tests {
+		start, end, limit, err := pageBounds(httptest.NewRequest("GET", "/api/v1/agents"+tt.query, nil), tt.total)
+		if tt.bad {
+			if err == nil || err.Status != http.StatusBadRequest {
+				t.Errorf("%q got %v, want a bad request", tt.query, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if start != tt.start || end != tt.end || limit != tt.limit {
+			t.Errorf("%q got [%d:%d] limit %d, want [%d:%d] limit %d", tt.query, start, end, limit, tt.start, tt.end, tt.limit)
+		}
+	}
+}
+
+//TestOpenAPIListsEveryRoute fetches the document through the router and looks up every route of apiRoutes in it
+func TestOpenAPIListsEveryRoute(t *testing.T) {
+	rec := httptest.NewRecorder()
+	(&Router{}).ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("openapi.json got %d", rec.Code)
+	}
+
+	var doc struct {
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	operations := 0
+	for _, item := range doc.Paths {
+		operations += len(item)
+	}
+	if operations != len(apiRoutes) {
+		t.Errorf("document has %d operations, apiRoutes has %d", operations, len(apiRoutes))
+	}
+	for _, route := range apiRoutes {
+		if _, ok := doc.Paths["/api/v1"+route.Path][strings.ToLower(route.Method)]; !ok {
+			t.Errorf("%s %s is missing from the document", route.Method, route.Path)
+		}
+		for _, name := range []string{route.Body, route.Result} {
+			if name == "" || name == "object" {
+				continue
+			}
+			if _, ok := doc.Components.Schemas[name]; !ok {
+				t.Errorf("%s %s refers to the missing schema %s", route.Method, route.Path, name)
+			}
+		}
+	}
+}
+
+//TestPostBulkNeedsTheRoleOfItsJobType checks bulk jobs need the role their single agent route needs
+func TestPostBulkNeedsTheRoleOfItsJobType(t *testing.T) {
+	agents := Agents.NewAuditAgents("", nil, nil)
+	handler := testOperators().Middleware(&Router{Agents: agents})
+
+	tests := []struct {
+		key     string
+		jobType string
+		status  int
+	}{
+		{"viewer-key", "SaveConfig", http.StatusForbidden},
+		{"editor-key", "SaveConfig", http.StatusAccepted},
+		{"editor-key", "Purge", http.StatusAccepted},
+		{"editor-key", "ShutDown", http.StatusForbidden},
+		{"editor-key", "Uninstall", http.StatusForbidden},
+		{"editor-key", "StartAudit", http.StatusForbidden},
+		{"editor-key", "StopAudit", http.StatusForbidden},
+		{"admin-key", "ShutDown", http.StatusAccepted},
+		{"admin-key", "StopAudit", http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		body := `{"job_type":"` + tt.jobType + `","selector":{}}`
+		req := httptest.NewRequest("POST", "/api/v1/bulk-jobs", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+tt.key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tt.status {
+			t.Errorf("%s with %s got %d, want %d: %s", tt.jobType, tt.key, rec.Code, tt.status, rec.Body.String())
+			continue
+		}
+		if tt.status == http.StatusForbidden {
+			if body := decodeError(t, rec); body.Error.Code != "forbidden" {
+				t.Errorf("%s with %s got error %+v", tt.jobType, tt.key, body.Error)
+			}
+		}
+	}
+}
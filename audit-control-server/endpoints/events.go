@@ -0,0 +1,108 @@
+package endpoints
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"audit-control-server/Agents"
+	"audit-control-server/messages"
+	"audit-control-server/worker"
+
+	"github.com/google/uuid"
+)
+
+const (
+	//maxBatchBytes bounds a batch after decompression, larger batches are cut off and the rest is rejected
+	maxBatchBytes = 32 << 20
+	//maxEventBytes bounds a single event line of a batch
+	maxEventBytes = 1 << 20
+	//batchRetryAfter is the Retry-After agents get while the event queue is too full to take a batch
+	batchRetryAfter = 5
+)
+
+/*
+ServeBatch takes a batch of audit events, one GeneralInfo JSON per line, gzip compressed when Content-Encoding says
+so. Lines that dont parse are rejected and counted, the agent cant fix them by sending them again. While the event
+queue is more than three quarters full the batch is refused with a 503 and a Retry-After hint so agents back off and
+keep the events in their spool. A queue that fills up while the batch is read cuts it off there, the ack is Truncated
+and carries the same Retry-After hint, the agent spools the events after Accepted plus Rejected lines and sends them
+again once it passed. A batch cut off at the size limit gets no hint, the rest wouldnt fit the next time either.
+*/
+func (sys *SyscallHandler) ServeBatch(uid uuid.UUID) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if len(sys.Queue) >= cap(sys.Queue)*3/4 {
+			res.Header().Set("Retry-After", strconv.Itoa(batchRetryAfter))
+			Agents.WriteError(res, req, Agents.ErrOverloaded)
+			return
+		}
+
+		var body io.Reader = req.Body
+		switch req.Header.Get("Content-Encoding") {
+		case "":
+		case "gzip":
+			gz, err := gzip.NewReader(req.Body)
+			if err != nil {
+				Agents.WriteError(res, req, Agents.ErrInvalidBody.Errorf("batch is not gzip compressed: %v", err))
+				return
+			}
+			defer gz.Close()
+			body = gz
+		default:
+			Agents.WriteError(res, req, Agents.ErrInvalidBody.Errorf("unsupported content encoding %q", req.Header.Get("Content-Encoding")))
+			return
+		}
+
+		ack := messages.BatchAck{Batch: req.Header.Get("Batch-ID")}
+		scanner := bufio.NewScanner(io.LimitReader(body, maxBatchBytes))
+		scanner.Buffer(make([]byte, 0, 64*1024), maxEventBytes)
+		full := false
+		for !full && scanner.Scan() {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			m := new(messages.GeneralInfo)
+			m.Data = make(map[string]*json.RawMessage)
+			if err := json.Unmarshal(scanner.Bytes(), m); err != nil {
+				ack.Rejected++
+				continue
+			}
+			job := worker.NewJob(m, "SYSCALL")
+			select {
+			case sys.Queue <- job:
+				ack.Accepted++
+			default:
+				job.DecrementReferenceCount()
+				full = true
+			}
+		}
+		if full {
+			log.Printf("batch %s of agent %s was cut off after %d events, the event queue is full", ack.Batch, uid, ack.Accepted+ack.Rejected)
+			res.Header().Set("Retry-After", strconv.Itoa(batchRetryAfter))
+			ack.Truncated = true
+		} else if err := scanner.Err(); err != nil {
+			//the rest of the batch is lost, acking what was queued keeps the agent from sending it twice
+			log.Printf("batch %s of agent %s was cut off after %d events: %v", ack.Batch, uid, ack.Accepted+ack.Rejected, err)
+			ack.Truncated = true
+		}
+		if ack.Rejected > 0 {
+			log.Printf("batch %s of agent %s had %d invalid events", ack.Batch, uid, ack.Rejected)
+		}
+		writeJSON(res, http.StatusOK, ack)
+	}
+}
+
+//EventBatch checks the agent is registered before taking its batch
+func (r *Router) EventBatch(uid uuid.UUID) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if _, ok := r.Agents.Get(uid); !ok {
+			Agents.WriteError(res, req, Agents.ErrAgentNotFound)
+			return
+		}
+		r.Sys.ServeBatch(uid).ServeHTTP(res, req)
+	}
+}
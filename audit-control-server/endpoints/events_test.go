@@ -0,0 +1,59 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"audit-control-server/messages"
+	"audit-control-server/worker"
+
+	"github.com/google/uuid"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	//NewJob takes its jobs from the pool NewPool sets up
+	worker.NewPool(1, nil)
+	os.Exit(m.Run())
+}
+
+//TestServeBatchCutsOffAtAFullQueue sends a batch larger than the free space of the event queue
+func TestServeBatchCutsOffAtAFullQueue(t *testing.T) {
+	sys := &SyscallHandler{Queue: make(chan *worker.Job, 4)}
+	body := strings.Repeat(`{"Serial":1,"Data":{}}`+"\n", 6)
+	req := httptest.NewRequest("POST", "/agent/events/batch", strings.NewReader(body))
+	req.Header.Set("Batch-ID", "batch-1")
+	rec := httptest.NewRecorder()
+	sys.ServeBatch(uuid.New()).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("batch got %d", rec.Code)
+	}
+	var ack messages.BatchAck
+	if err := json.Unmarshal(rec.Body.Bytes(), &ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack.Accepted != cap(sys.Queue) || !ack.Truncated {
+		t.Fatalf("ack %+v, want %d events accepted and the batch truncated", ack, cap(sys.Queue))
+	}
+	if len(sys.Queue) != cap(sys.Queue) {
+		t.Errorf("queue holds %d jobs, want %d", len(sys.Queue), cap(sys.Queue))
+	}
+	if rec.Header().Get("Retry-After") != strconv.Itoa(batchRetryAfter) {
+		t.Errorf("Retry-After is %q", rec.Header().Get("Retry-After"))
+	}
+
+	//the queue is over three quarters full now, the next batch is refused as a whole
+	rec = httptest.NewRecorder()
+	sys.ServeBatch(uuid.New()).ServeHTTP(rec, httptest.NewRequest("POST", "/agent/events/batch", strings.NewReader(body)))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("batch to a full queue got %d", rec.Code)
+	}
+}
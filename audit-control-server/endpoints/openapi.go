@@ -0,0 +1,382 @@
+package endpoints
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type object = map[string]interface{}
+
+func schemaRef(name string) object {
+	if name == "object" {
+		return object{"type": "object"}
+	}
+	return object{"$ref": "#/components/schemas/" + name}
+}
+
+var openAPISchemas = object{
+	"Error": object{
+		"type":     "object",
+		"required": []string{"error"},
+		"properties": object{
+			"error": object{
+				"type": "object",
+				"properties": object{
+					"code":    object{"type": "string", "description": "stable machine readable code such as agent_not_found or queue_full"},
+					"message": object{"type": "string"},
+				},
+			},
+		},
+	},
+	"Agent": object{
+		"type": "object",
+		"properties": object{
+			"ID":                object{"type": "string", "format": "uuid"},
+			"Hostname":          object{"type": "string"},
+			"RuleCount":         object{"type": "integer"},
+			"HostInfo":          object{"type": "object"},
+			"Labels":            object{"type": "object", "additionalProperties": object{"type": "string"}},
+			"RulesDrifted":      object{"type": "boolean", "description": "the agent's kernel rules drifted from the recorded ones"},
+			"Offline":           object{"type": "boolean", "description": "the agent deregistered or stopped checking in, it is kept until deleted"},
+			"ReenrollRequested": object{"type": "boolean", "description": "the agent tries to enroll again without its certificate, approve-reenrollment lets it"},
+		},
+	},
+	"Rule": object{
+		"type": "object",
+		"properties": object{
+			"rule":     object{"type": "string"},
+			"status":   object{"type": "string"},
+			"position": object{"type": "integer", "description": "place in the agent's rule list counting from 0, the kernel evaluates rules in this order"},
+		},
+	},
+	"RuleRequest": object{
+		"type":     "object",
+		"required": []string{"rule"},
+		"properties": object{
+			"rule":   object{"type": "string", "example": "-w /etc/passwd -p wa -k passwd", "description": "-A rules go in front of their filter list"},
+			"before": object{"type": "string", "description": "load the rule right before this one"},
+			"after":  object{"type": "string", "description": "load the rule right after this one"},
+		},
+	},
+	"AuditParams": object{
+		"type":        "object",
+		"description": "settings left out stay as they are, Enabled goes last so 2 doesnt lock the others out",
+		"properties": object{
+			"RateLimit":       object{"type": "integer", "minimum": 0, "description": "audit messages per second, 0 for no limit"},
+			"BacklogLimit":    object{"type": "integer", "minimum": 0},
+			"BacklogWaitTime": object{"type": "integer", "minimum": 0},
+			"Failure":         object{"type": "integer", "enum": []int{0, 1, 2}, "description": "0 silent, 1 printk, 2 panic"},
+			"Enabled":         object{"type": "integer", "enum": []int{0, 1, 2}, "description": "2 makes the audit configuration immutable until reboot"},
+		},
+	},
+	"RuleSetRequest": object{
+		"type":     "object",
+		"required": []string{"rules"},
+		"properties": object{
+			"rules":   object{"type": "array", "items": object{"type": "string"}, "description": "every rule the agent is to have, in load order"},
+			"confirm": object{"type": "integer", "description": "seconds the agent waits for a status report to go through before it rolls the set back, the agent's default when left out"},
+		},
+	},
+	"Job": object{
+		"type": "object",
+		"properties": object{
+			"JobID":      object{"type": "string", "format": "uuid"},
+			"JobType":    object{"type": "string"},
+			"Rule":       object{"type": "string"},
+			"Before":     object{"type": "string", "description": "an AddRule job loads the rule right before this one"},
+			"After":      object{"type": "string", "description": "an AddRule job loads the rule right after this one"},
+			"Position":   object{"type": "integer", "description": "where the agent loaded the rule, set once an AddRule job succeeded"},
+			"Rules":      object{"type": "array", "items": object{"type": "string"}, "description": "the set an ApplyRuleSet job loads, in the order the agent loaded it once the job succeeded"},
+			"Confirm":    object{"type": "integer", "description": "confirmation window of an ApplyRuleSet job in seconds"},
+			"Failed":     object{"type": "array", "items": schemaRef("RuleFailure"), "description": "the rules that made an ApplyRuleSet job fail, the agent kept its rules"},
+			"Params":     schemaRef("AuditParams"),
+			"Retry":      object{"type": "integer"},
+			"Status":     object{"type": "string"},
+			"Message":    object{"type": "string"},
+			"Code":       object{"type": "string", "enum": []string{"parse_error", "build_error", "kernel_rejected", "duplicate", "not_found", "permission_denied", "unavailable", "io_error", "unsupported", "internal"}, "description": "why the agent failed the job, the codes other than unavailable, io_error and internal are not retried"},
+			"Created":    object{"type": "string", "format": "date-time"},
+			"State":      object{"type": "string", "enum": []string{"queued", "dispatched", "succeeded", "failed", "timed-out", "cancelled", "rolled-back"}, "description": "rolled-back is an ApplyRuleSet job the agent took back since no status report confirmed it"},
+			"NotBefore":  object{"type": "string", "format": "date-time", "description": "a retried job waits for its backoff until then"},
+			"Expires":    object{"type": "string", "format": "date-time", "description": "a queued job times out when it isnt dispatched by then"},
+			"Dispatched": object{"type": "string", "format": "date-time"},
+			"Deadline":   object{"type": "string", "format": "date-time", "description": "the agent has to report the result by then"},
+			"Finished":   object{"type": "string", "format": "date-time"},
+		},
+	},
+	"BulkJob": object{
+		"type": "object",
+		"properties": object{
+			"job":     schemaRef("Job"),
+			"skipped": object{"type": "array", "items": object{"type": "string"}, "description": "hostnames where another job holds the rule"},
+		},
+	},
+	"AgentMessage": object{
+		"type": "object",
+		"properties": object{
+			"ID":          object{"type": "string", "format": "uuid"},
+			"Hostname":    object{"type": "string"},
+			"Rules":       object{"type": "array", "items": object{"type": "string"}},
+			"HostInfo":    object{"type": "object"},
+			"Labels":      object{"type": "object", "additionalProperties": object{"type": "string"}, "description": "hostname and id are reserved"},
+			"EnrollToken": object{"type": "string"},
+			"CSR":         object{"type": "string"},
+		},
+	},
+	"Group": object{
+		"type": "object",
+		"properties": object{
+			"Name":        object{"type": "string", "pattern": "^[A-Za-z0-9._-]{1,64}$"},
+			"Description": object{"type": "string"},
+			"Selector":    object{"type": "object", "additionalProperties": object{"type": "string"}, "description": "labels an agent must have, hostname and id are always set, empty selects every agent"},
+		},
+	},
+	"BulkRequest": object{
+		"type":     "object",
+		"required": []string{"job_type"},
+		"properties": object{
+			"job_type": object{"type": "string", "enum": []string{"AddRule", "Delete", "Purge", "SaveConfig", "ShutDown", "Uninstall", "StartAudit", "StopAudit"}},
+			"rule":     object{"type": "string", "description": "required for AddRule and Delete"},
+			"selector": object{"type": "object", "additionalProperties": object{"type": "string"}, "description": "{} selects every agent"},
+			"group":    object{"type": "string", "description": "use the selector of this group instead"},
+		},
+	},
+	"BulkOperation": object{
+		"type": "object",
+		"properties": object{
+			"id":       object{"type": "string", "format": "uuid"},
+			"job_type": object{"type": "string"},
+			"rule":     object{"type": "string"},
+			"selector": object{"type": "object", "additionalProperties": object{"type": "string"}},
+			"group":    object{"type": "string"},
+			"created":  object{"type": "string", "format": "date-time"},
+			"targets": object{"type": "array", "items": object{
+				"type": "object",
+				"properties": object{
+					"agent_id": object{"type": "string", "format": "uuid"},
+					"hostname": object{"type": "string"},
+					"job_id":   object{"type": "string", "format": "uuid"},
+					"state":    object{"type": "string", "enum": []string{"queued", "retrying", "dispatched", "succeeded", "failed", "timed-out", "cancelled", "rejected", "lost"}},
+					"retry":    object{"type": "integer"},
+					"message":  object{"type": "string"},
+					"error":    object{"type": "string", "description": "error code when the agent rejected the job"},
+				},
+			}},
+			"progress": object{"type": "object", "additionalProperties": object{"type": "integer"}, "description": "targets per state"},
+			"done":     object{"type": "boolean"},
+		},
+	},
+	"RuleSet": object{
+		"type":     "object",
+		"required": []string{"Rules"},
+		"properties": object{
+			"Name":        object{"type": "string", "pattern": "^[A-Za-z0-9._-]{1,64}$"},
+			"Description": object{"type": "string"},
+			"Rules":       object{"type": "array", "items": object{"type": "string"}},
+			"Selector":    object{"type": "object", "additionalProperties": object{"type": "string"}, "description": "labels an agent must have, empty selects every agent"},
+			"Prune":       object{"type": "boolean", "description": "also remove rules the selected agents have outside of their rule sets"},
+		},
+	},
+	"AgentState": object{
+		"type": "object",
+		"properties": object{
+			"agent_id":  object{"type": "string", "format": "uuid"},
+			"hostname":  object{"type": "string"},
+			"rulesets":  object{"type": "array", "items": object{"type": "string"}},
+			"converged": object{"type": "boolean"},
+			"missing":   object{"type": "array", "items": object{"type": "string"}},
+			"extra":     object{"type": "array", "items": object{"type": "string"}},
+			"pending":   object{"type": "array", "items": object{"type": "string"}},
+			"failing":   object{"type": "object", "additionalProperties": object{"type": "integer"}, "description": "failed attempts per rule"},
+			"checked":   object{"type": "string", "format": "date-time"},
+		},
+	},
+	"CertificateRequest": object{
+		"type":       "object",
+		"properties": object{"CSR": object{"type": "string"}},
+	},
+	"CertificateMessage": object{
+		"type": "object",
+		"properties": object{
+			"Certificate": object{"type": "string"},
+			"CA":          object{"type": "string"},
+		},
+	},
+	"BaseMessage": object{
+		"type": "object",
+		"properties": object{
+			"MessageType": object{"type": "string", "enum": []string{"Statusok", "Job"}},
+			"Data":        schemaRef("Job"),
+		},
+	},
+	"RuleDrift": object{
+		"type": "object",
+		"properties": object{
+			"Drifted":    object{"type": "boolean"},
+			"Reason":     object{"type": "string"},
+			"Version":    object{"type": "integer", "description": "changes the agent made to its rules"},
+			"Hash":       object{"type": "string", "description": "SHA-256 of the agent's rules, sorted, one per line"},
+			"Recorded":   object{"type": "string", "description": "the same hash of the rules recorded for the agent, empty while jobs are pending"},
+			"Missing":    object{"type": "array", "items": object{"type": "string"}, "description": "rules the kernel lost"},
+			"Unexpected": object{"type": "array", "items": object{"type": "string"}, "description": "kernel rules the agent didnt load"},
+			"Checked":    object{"type": "string", "format": "date-time"},
+		},
+	},
+	"RulesReload": object{
+		"type": "object",
+		"properties": object{
+			"Source":     object{"type": "string", "description": "what triggered the reload, SIGHUP, a change of the rules file or a rollback"},
+			"Added":      object{"type": "array", "items": object{"type": "string"}},
+			"Deleted":    object{"type": "array", "items": object{"type": "string"}},
+			"Failed":     object{"type": "array", "items": schemaRef("RuleFailure")},
+			"Error":      object{"type": "string", "description": "set when the rules file couldnt be read, the agent kept its rules"},
+			"Rules":      object{"type": "array", "items": object{"type": "string"}, "description": "every rule loaded after the reload"},
+			"RolledBack": object{"type": "string", "format": "uuid", "description": "set when the agent rolled back the rule set of this ApplyRuleSet job since no status report went through"},
+			"Received":   object{"type": "string", "format": "date-time"},
+		},
+	},
+	"RuleFailure": object{
+		"type": "object",
+		"properties": object{
+			"Rule":    object{"type": "string"},
+			"Code":    object{"type": "string"},
+			"Message": object{"type": "string"},
+		},
+	},
+	"BatchAck": object{
+		"type": "object",
+		"properties": object{
+			"Batch":     object{"type": "string", "description": "Batch-ID header of the upload"},
+			"Accepted":  object{"type": "integer"},
+			"Rejected":  object{"type": "integer", "description": "events that didnt parse and were dropped"},
+			"Truncated": object{"type": "boolean", "description": "the batch was cut off at the size limit or because the event queue filled up, for a full queue Retry-After is set and the events after the cut should be sent again"},
+		},
+	},
+}
+
+//openAPIDocument describes the /api/v1 routes, it is built from apiRoutes so it cant drift from the router
+func openAPIDocument() object {
+	paths := object{}
+	for _, route := range apiRoutes {
+		op := object{
+			"summary":     route.Summary,
+			"operationId": operationID(route),
+		}
+
+		var parameters []object
+		for _, part := range splitPath(route.Path) {
+			if strings.HasPrefix(part, "{") {
+				name := strings.Trim(part, "{}")
+				schema := object{"type": "string"}
+				if name == "id" || name == "job" {
+					schema["format"] = "uuid"
+				}
+				parameters = append(parameters, object{
+					"name":     name,
+					"in":       "path",
+					"required": true,
+					"schema":   schema,
+				})
+			}
+		}
+		if route.Method == "DELETE" && strings.HasSuffix(route.Path, "/rules") {
+			parameters = append(parameters, object{"name": "rule", "in": "query", "required": true, "schema": object{"type": "string"}})
+		}
+		if route.Paged {
+			parameters = append(parameters,
+				object{"name": "offset", "in": "query", "schema": object{"type": "integer", "minimum": 0, "default": 0}},
+				object{"name": "limit", "in": "query", "schema": object{"type": "integer", "minimum": 1, "maximum": maxPageSize, "default": defaultPageSize}},
+			)
+		}
+		if len(parameters) > 0 {
+			op["parameters"] = parameters
+		}
+
+		mediaType := "application/json"
+		if route.Stream {
+			mediaType = "application/x-ndjson"
+		}
+		if route.Body != "" {
+			op["requestBody"] = object{
+				"required": true,
+				"content":  object{mediaType: object{"schema": schemaRef(route.Body)}},
+			}
+		}
+
+		status := route.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := object{"description": http.StatusText(status)}
+		if route.Result != "" {
+			schema := schemaRef(route.Result)
+			if route.Paged {
+				schema = object{
+					"type": "object",
+					"properties": object{
+						"items":  object{"type": "array", "items": schemaRef(route.Result)},
+						"total":  object{"type": "integer"},
+						"offset": object{"type": "integer"},
+						"limit":  object{"type": "integer"},
+					},
+				}
+			}
+			success["content"] = object{mediaType: object{"schema": schema}}
+		}
+		op["responses"] = object{
+			strconv.Itoa(status): success,
+			"default": object{
+				"description": "error",
+				"content":     object{"application/json": object{"schema": schemaRef("Error")}},
+			},
+		}
+
+		switch route.Access {
+		case accessPublic:
+			op["security"] = []object{}
+		case accessAgent:
+			op["security"] = []object{{"agentCertificate": []string{}}}
+			op["tags"] = []string{"agent"}
+		case accessOperator:
+			op["security"] = []object{{"operatorKey": []string{}}}
+			op["tags"] = []string{"operator"}
+			op["description"] = "Requires the " + route.Role.String() + " role or higher."
+		}
+
+		item, ok := paths["/api/v1"+route.Path].(object)
+		if !ok {
+			item = object{}
+			paths["/api/v1"+route.Path] = item
+		}
+		item[strings.ToLower(route.Method)] = op
+	}
+
+	return object{
+		"openapi": "3.1.0",
+		"info": object{
+			"title":   "Go-Audit control server",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": object{
+			"schemas": openAPISchemas,
+			"securitySchemes": object{
+				"operatorKey":      object{"type": "http", "scheme": "bearer", "description": "operator API key"},
+				"agentCertificate": object{"type": "mutualTLS", "description": "client certificate issued at enrollment"},
+			},
+		},
+	}
+}
+
+func operationID(route apiRoute) string {
+	id := strings.ToLower(route.Method)
+	for _, part := range splitPath(route.Path) {
+		if strings.HasPrefix(part, "{") {
+			part = "by-" + strings.Trim(part, "{}")
+		}
+		for _, word := range strings.FieldsFunc(part, func(r rune) bool { return r == '-' || r == '.' }) {
+			id += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return id
+}
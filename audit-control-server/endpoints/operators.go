@@ -0,0 +1,230 @@
+package endpoints
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"audit-control-server/Agents"
+)
+
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleViewer
+	RoleRuleEditor
+	RoleAdmin
+)
+
+var roleNames = map[string]Role{
+	"viewer":      RoleViewer,
+	"rule-editor": RoleRuleEditor,
+	"admin":       RoleAdmin,
+}
+
+func (r Role) String() string {
+	for name, role := range roleNames {
+		if role == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+//agentRoutes authenticate agents with their client certificate or enrollment token, not operators
+var agentRoutes = map[string]bool{
+	"Syscall":           true,
+	"SyscallBatch":      true,
+	"Register":          true,
+	"RenewCertificate":  true,
+	"StatusCheck":       true,
+	"JobComplete":       true,
+	"JobStream":         true,
+	"DeRegister":        true,
+	"UpdateProcessInfo": true,
+	"UpdataProcessInfo": true,
+	"AuditStatus":       true,
+	"RulesReloaded":     true,
+}
+
+//operatorRoutes maps every operator route to the least role allowed to call it, roles include the ones below them
+var operatorRoutes = map[string]Role{
+	"ListAll":          RoleViewer,
+	"GetRules":         RoleViewer,
+	"GetRulesHostname": RoleViewer,
+	"GetProcesses":     RoleViewer,
+	"GetJobs":          RoleViewer,
+	"GetAuditStatus":   RoleViewer,
+	"AddRule":          RoleRuleEditor,
+	"DeleteRule":       RoleRuleEditor,
+	"DeleteFromAll":    RoleRuleEditor,
+	"PurgeRules":       RoleRuleEditor,
+	"SaveConfig":       RoleRuleEditor,
+	"ShutDown":         RoleAdmin,
+	"Uninstall":        RoleAdmin,
+	"StartAudit":       RoleAdmin,
+	"StopAudit":        RoleAdmin,
+}
+
+type Operator struct {
+	Name    string `json:"name"`
+	Role    string `json:"role"`
+	KeyHash string `json:"key_hash"`
+}
+
+type operatorKey struct{}
+
+//OperatorFromContext returns the operator that made the request, if any
+func OperatorFromContext(ctx context.Context) (Operator, bool) {
+	o, ok := ctx.Value(operatorKey{}).(Operator)
+	return o, ok
+}
+
+/*
+Operators holds the API keys operators use against the control server. Only the sha256 of a key is stored, in a
+JSON file of {"name", "role", "key_hash"} entries. Requests carry the key as "Authorization: Bearer <key>".
+*/
+type Operators struct {
+	filename string
+	lock     sync.RWMutex
+	byHash   map[string]Operator
+}
+
+//HashKey returns the value stored as key_hash for an API key
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+LoadOperators reads the operator file. When it doesnt exist an admin operator is created and its key is printed
+once, it cant be recovered later.
+*/
+func LoadOperators(filename string) (*Operators, error) {
+	o := &Operators{filename: filename, byHash: make(map[string]Operator)}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		key, errB := o.bootstrap()
+		if errB != nil {
+			return nil, errB
+		}
+		fmt.Fprintf(os.Stderr, "Created operator \"admin\" in %s, API key: %s\r\n", filename, key)
+		return o, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldnt read the operators file: %v", err)
+	}
+
+	var operators []Operator
+	if errU := json.Unmarshal(data, &operators); errU != nil {
+		return nil, fmt.Errorf("couldnt parse the operators file: %v", errU)
+	}
+	for _, op := range operators {
+		if _, ok := roleNames[op.Role]; !ok {
+			return nil, fmt.Errorf("operator %s has an unknown role: %q", op.Name, op.Role)
+		}
+		o.byHash[strings.ToLower(op.KeyHash)] = op
+	}
+	return o, nil
+}
+
+func (o *Operators) bootstrap() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(raw)
+	admin := Operator{Name: "admin", Role: "admin", KeyHash: HashKey(key)}
+
+	data, err := json.MarshalIndent([]Operator{admin}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(o.filename, data, 0600); err != nil {
+		return "", fmt.Errorf("couldnt write the operators file: %v", err)
+	}
+	o.byHash[admin.KeyHash] = admin
+	return key, nil
+}
+
+func (o *Operators) authenticate(req *http.Request) (Operator, bool) {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return Operator{}, false
+	}
+	key := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	if key == "" {
+		return Operator{}, false
+	}
+
+	o.lock.RLock()
+	op, ok := o.byHash[HashKey(key)]
+	o.lock.RUnlock()
+	return op, ok
+}
+
+func deny(res http.ResponseWriter, req *http.Request, err *Agents.APIError, reason string) {
+	log.Printf("access denied: %s %s from %s: %s", req.Method, req.URL.Path, req.RemoteAddr, reason)
+	Agents.WriteError(res, req, err.Errorf("not authorized: %s", reason))
+}
+
+/*
+requiredRole returns the role an operator needs for the request, public and agent routes need none. A legacy route
+missing from both tables needs an admin, so one added to the router without a role isnt left open.
+*/
+func requiredRole(req *http.Request) (Role, bool) {
+	if p, ok := apiPath(req.URL.Path); ok {
+		route, _, _ := matchRoute(req.Method, p)
+		if route == nil || route.Access != accessOperator {
+			return RoleNone, false
+		}
+		return route.Role, true
+	}
+
+	head, _ := ShiftPath(req.URL.Path)
+	if agentRoutes[head] {
+		return RoleNone, false
+	}
+	if required, ok := operatorRoutes[head]; ok {
+		return required, true
+	}
+	return RoleAdmin, true
+}
+
+//Middleware checks the operator key and role before a request reaches the router
+func (o *Operators) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if _, ok := apiPath(req.URL.Path); ok {
+			req = Agents.WithJSONErrors(req)
+		}
+
+		required, ok := requiredRole(req)
+		if !ok {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		op, ok := o.authenticate(req)
+		if !ok {
+			deny(res, req, Agents.ErrUnauthorized, "missing or invalid API key")
+			return
+		}
+		if roleNames[op.Role] < required {
+			deny(res, req, Agents.ErrForbidden, fmt.Sprintf("operator %s with role %s needs role %s", op.Name, op.Role, required))
+			return
+		}
+
+		next.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), operatorKey{}, op)))
+	})
+}
@@ -0,0 +1,148 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func testOperators() *Operators {
+	o := &Operators{byHash: make(map[string]Operator)}
+	for _, op := range []Operator{
+		{Name: "alice", Role: "viewer", KeyHash: HashKey("viewer-key")},
+		{Name: "bob", Role: "rule-editor", KeyHash: HashKey("editor-key")},
+		{Name: "carol", Role: "admin", KeyHash: HashKey("admin-key")},
+	} {
+		o.byHash[op.KeyHash] = op
+	}
+	return o
+}
+
+//serve sends one request through the middleware and reports the operator the next handler saw, if it was reached
+func serve(o *Operators, method string, path string, authorization string) (*httptest.ResponseRecorder, string, bool) {
+	var seen string
+	reached := false
+	next := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		reached = true
+		if op, ok := OperatorFromContext(req.Context()); ok {
+			seen = op.Name
+		}
+	})
+
+	req := httptest.NewRequest(method, path, nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	o.Middleware(next).ServeHTTP(rec, req)
+	return rec, seen, reached
+}
+
+func TestMiddlewareRejectsMissingOrBadKeys(t *testing.T) {
+	o := testOperators()
+	for _, authorization := range []string{"", "Bearer ", "Bearer wrong-key", "Basic admin-key", "admin-key"} {
+		rec, _, reached := serve(o, "GET", "/ListAll", authorization)
+		if reached {
+			t.Errorf("Authorization %q reached the router", authorization)
+		}
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q got %d, want %d", authorization, rec.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestMiddlewareOrdersRoles(t *testing.T) {
+	o := testOperators()
+	keys := map[string]string{"viewer": "viewer-key", "rule-editor": "editor-key", "admin": "admin-key"}
+	tests := []struct {
+		path    string
+		allowed []string
+	}{
+		{"/ListAll", []string{"viewer", "rule-editor", "admin"}},
+		{"/AddRule", []string{"rule-editor", "admin"}},
+		{"/ShutDown/" + uuid.New().String(), []string{"admin"}},
+	}
+	for _, tt := range tests {
+		for role, key := range keys {
+			want := false
+			for _, r := range tt.allowed {
+				want = want || r == role
+			}
+
+			rec, _, reached := serve(o, "GET", tt.path, "Bearer "+key)
+			if reached != want {
+				t.Errorf("%s with role %s reached the router: %v, want %v", tt.path, role, reached, want)
+			}
+			if !want && rec.Code != http.StatusForbidden {
+				t.Errorf("%s with role %s got %d, want %d", tt.path, role, rec.Code, http.StatusForbidden)
+			}
+		}
+	}
+}
+
+func TestMiddlewarePassesTheOperator(t *testing.T) {
+	_, seen, reached := serve(testOperators(), "GET", "/GetJobs/"+uuid.New().String(), "Bearer editor-key")
+	if !reached || seen != "bob" {
+		t.Fatalf("router reached %v with operator %q, want bob", reached, seen)
+	}
+}
+
+func TestMiddlewareLeavesAgentRoutesAlone(t *testing.T) {
+	for _, path := range []string{"/Register", "/StatusCheck", "/JobStream", "/api/v1/openapi.json"} {
+		if _, _, reached := serve(testOperators(), "GET", path, ""); !reached {
+			t.Errorf("%s didnt reach the router without a key", path)
+		}
+	}
+}
+
+//TestMiddlewareDeniesUnknownLegacyRoutes checks a route missing from both tables is left to admins
+func TestMiddlewareDeniesUnknownLegacyRoutes(t *testing.T) {
+	o := testOperators()
+	if rec, _, reached := serve(o, "GET", "/Debug", ""); reached || rec.Code != http.StatusUnauthorized {
+		t.Errorf("unknown route without a key got %d, reached the router: %v", rec.Code, reached)
+	}
+	if rec, _, reached := serve(o, "GET", "/Debug", "Bearer editor-key"); reached || rec.Code != http.StatusForbidden {
+		t.Errorf("unknown route as a rule editor got %d, reached the router: %v", rec.Code, reached)
+	}
+	if _, _, reached := serve(o, "GET", "/Debug", "Bearer admin-key"); !reached {
+		t.Errorf("unknown route as an admin didnt reach the router")
+	}
+}
+
+//TestMiddlewareAPIErrors checks /api/v1 routes take their role from apiRoutes and get JSON errors
+func TestMiddlewareAPIErrors(t *testing.T) {
+	o := testOperators()
+	path := "/api/v1/agents/" + uuid.New().String()
+
+	if _, _, reached := serve(o, "GET", path, "Bearer viewer-key"); !reached {
+		t.Fatalf("viewer couldnt get an agent")
+	}
+
+	tests := []struct {
+		authorization string
+		status        int
+		code          string
+	}{
+		{"", http.StatusUnauthorized, "unauthorized"},
+		{"Bearer wrong-key", http.StatusUnauthorized, "unauthorized"},
+		{"Bearer viewer-key", http.StatusForbidden, "forbidden"},
+	}
+	for _, tt := range tests {
+		rec, _, reached := serve(o, "DELETE", path, tt.authorization)
+		if reached || rec.Code != tt.status {
+			t.Errorf("DELETE with %q got %d, reached the router: %v, want %d", tt.authorization, rec.Code, reached, tt.status)
+			continue
+		}
+		var body struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error.Code != tt.code {
+			t.Errorf("DELETE with %q got body %s, want error code %s", tt.authorization, rec.Body.String(), tt.code)
+		}
+	}
+}
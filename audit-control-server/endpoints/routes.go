@@ -10,9 +10,10 @@ import (
 	"strings"
 	"fmt"
 
-	"../messages"
-	"../Agents"
-	"../worker"
+	"audit-control-server/messages"
+	"audit-control-server/Agents"
+	"audit-control-server/Catalog"
+	"audit-control-server/worker"
 	
 	"github.com/google/uuid"
 )
@@ -23,6 +24,7 @@ import (
 type Router struct{
 	Sys			*SyscallHandler
 	Agents		*Agents.AuditAgents
+	Catalog		*Catalog.Catalog
 }
 
 type SyscallHandler struct{
@@ -43,14 +45,29 @@ func WebAuth(h func(uid uuid.UUID) http.HandlerFunc) http.HandlerFunc{
 	})
 }
 
+//AgentID returns the agent ID from the verified client certificate. The certificate was checked against the
+//server CA during the handshake, its common name is the ID the CA issued it for.
+func AgentID(req *http.Request) (uuid.UUID, error){
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0{
+		return uuid.Nil, fmt.Errorf("no verified client certificate")
+	}
+	uid, errU := uuid.Parse(req.TLS.VerifiedChains[0][0].Subject.CommonName)
+	if errU != nil{
+		return uuid.Nil, fmt.Errorf("client certificate doesnt name an agent: %v", errU)
+	}
+	if id := req.Header.Get("Auth"); id != "" && id != uid.String(){
+		return uuid.Nil, fmt.Errorf("auth header %s doesnt match the client certificate %s", id, uid)
+	}
+	return uid, nil
+}
+
 //AgentAuth middleware 
 func AgentAuth(h func(uid uuid.UUID) http.HandlerFunc) http.HandlerFunc{
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request){
-		id := req.Header.Get("Auth")
-		uid, errU := uuid.Parse(id)
+		uid, errU := AgentID(req)
 		if errU != nil{
-			log.Printf(fmt.Errorf("couldnt parse auth token: %v", errU).Error())
-			http.Error(res,"not authorized: invalid token", http.StatusUnauthorized)
+			log.Printf("agent authentication failed: %v", errU)
+			Agents.WriteError(res, req, Agents.ErrUnauthorized.Errorf("not authorized: client certificate required"))
 			return
 		}
 		h(uid).ServeHTTP(res,req)
@@ -78,33 +95,33 @@ func (sys *SyscallHandler) ServeHTTP(res http.ResponseWriter, req *http.Request)
 
 func (r *Router) ServeHTTP(res http.ResponseWriter, req *http.Request){
 
+	if tail, ok := apiPath(req.URL.Path); ok{
+		r.serveAPI(res, req, tail)
+		return
+	}
+
 	var head string
 	head, req.URL.Path = ShiftPath(req.URL.Path)
 	
 	switch head {
 	case "Syscall":
-		id := req.Header.Get("Auth")
-		if id != "" {
-			uid, errU := uuid.Parse(id)
-			if errU != nil{
-				log.Printf(fmt.Errorf("couldnt parse auth token: %v", errU).Error())
-				http.Error(res,"not authorized: invalid token", http.StatusUnauthorized)
-				return
-			}
-			if _, ok := r.Agents.Agents[uid]; ok{
-				r.Sys.ServeHTTP(res,req)
-			}else{
-				log.Printf("No such agent was found")
-				http.Error(res,"No such agent was found", http.StatusBadRequest)
-				return
-			}
+		uid, errU := AgentID(req)
+		if errU != nil{
+			log.Printf("agent authentication failed: %v", errU)
+			http.Error(res,"not authorized: client certificate required", http.StatusUnauthorized)
+			return
+		}
+		if _, ok := r.Agents.Get(uid); ok{
+			r.Sys.ServeHTTP(res,req)
 		}else{
-			log.Printf("no auth token was found")
-			http.Error(res,"not authorized: no token", http.StatusUnauthorized)
+			log.Printf("No such agent was found")
+			http.Error(res,"No such agent was found", http.StatusBadRequest)
 			return
 		}
 	case "Register":
 		r.Agents.Register().ServeHTTP(res,req)
+	case "RenewCertificate":
+		AgentAuth(r.Agents.RenewCertificate).ServeHTTP(res,req)
 	case "ListAll":
 		r.Agents.ListAll().ServeHTTP(res,req)
 	case "DeleteFromAll":
@@ -115,13 +132,18 @@ func (r *Router) ServeHTTP(res http.ResponseWriter, req *http.Request){
 		AgentAuth(r.Agents.StatusCheckIn).ServeHTTP(res,req)
 	case "JobComplete":
 		AgentAuth(r.Agents.JobComplete).ServeHTTP(res,req)
+	case "SyscallBatch":
+		AgentAuth(r.EventBatch).ServeHTTP(res,req)
+	case "JobStream":
+		AgentAuth(r.Agents.JobStream).ServeHTTP(res,req)
 	case "DeleteRule":
 		WebAuth(r.Agents.DeleteRule).ServeHTTP(res,req)
 	case "DeRegister":
 		AgentAuth(r.Agents.DeRegister).ServeHTTP(res,req)
 	case "GetProcesses":
 		WebAuth(r.Agents.GetProcesses).ServeHTTP(res,req)
-	case "UpdataProcessInfo":
+	//UpdataProcessInfo is the old misspelled route, agents call UpdateProcessInfo
+	case "UpdateProcessInfo", "UpdataProcessInfo":
 		AgentAuth(r.Agents.UpdateInfo).ServeHTTP(res,req)
 	case "GetRulesHostname":
 		head, _ := ShiftPath(req.URL.Path)
@@ -147,6 +169,15 @@ func (r *Router) ServeHTTP(res http.ResponseWriter, req *http.Request){
 			http.Error(res,"not authorized", http.StatusBadRequest)
 		}
 		r.Agents.OperationalJobs(uid, "ShutDown").ServeHTTP(res,req)
+	case "Uninstall":
+		head, _ = ShiftPath(req.URL.Path)
+		uid, errU := uuid.Parse(head)
+		if errU != nil{
+			log.Println(errU)
+			http.Error(res,"not authorized", http.StatusBadRequest)
+			return
+		}
+		r.Agents.OperationalJobs(uid, "Uninstall").ServeHTTP(res,req)
 	case "PurgeRules":
 		head, _ := ShiftPath(req.URL.Path)
 		uid, errU := uuid.Parse(head)
@@ -183,6 +214,8 @@ func (r *Router) ServeHTTP(res http.ResponseWriter, req *http.Request){
 		WebAuth(r.Agents.GetAuditStatus).ServeHTTP(res,req)
 	case "AuditStatus":
 		AgentAuth(r.Agents.AuditStatus).ServeHTTP(res,req)
+	case "RulesReloaded":
+		AgentAuth(r.Agents.RulesReloaded).ServeHTTP(res,req)
 	default:
 		http.Error(res, "Not Found", http.StatusNotFound)
 	}
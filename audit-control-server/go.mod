@@ -0,0 +1,17 @@
+module audit-control-server
+
+// Stream.go holds job streams open through http.ResponseController
+go 1.20
+
+require (
+	audit-log v0.0.0-00010101000000-000000000000
+	github.com/google/uuid v1.1.1
+)
+
+require (
+	github.com/elastic/go-libaudit/v2 v2.5.0 // indirect
+	golang.org/x/sys v0.11.0 // indirect
+)
+
+// the replay tool reads audit logs with the parser the agent uses
+replace audit-log => ../audit-log
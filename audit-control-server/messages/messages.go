@@ -2,6 +2,7 @@ package messages
 
 import(
 	"encoding/json"
+	"time"
 	"github.com/google/uuid"
 )
 
@@ -57,6 +58,71 @@ type AgentMessage struct{
 	RuleCount 	int
 	Rules		[]string
 	HostInfo	*Host
+	Labels		map[string]string	`json:",omitempty"`
+	RulesDrifted	bool		`json:",omitempty"`
+	Offline		bool		`json:",omitempty"`
+	//ReenrollRequested is set while the agent tries to enroll again without its certificate
+	ReenrollRequested	bool	`json:",omitempty"`
+	EnrollToken	string		`json:",omitempty"`
+	CSR			string		`json:",omitempty"`
+}
+
+//RuleSet is a named set of rules the control server keeps loaded on every agent matching Selector.
+//With Prune set, rules an agent has loaded outside of its rule sets are removed as well.
+type RuleSet struct{
+	Name		string
+	Description	string
+	Rules		[]string
+	Selector	map[string]string
+	Prune		bool
+}
+
+//Group names a label selector so operators can target the same agents again without repeating it
+type Group struct{
+	Name		string
+	Description	string
+	Selector	map[string]string
+}
+
+//BatchAck answers an uploaded event batch. Accepted events are queued, rejected ones didnt parse and are dropped.
+//Truncated is set when the batch was cut off at the size limit or a full event queue, the events after the cut are
+//neither accepted nor rejected. Agents send them again when the ack came with a Retry-After hint, which only a full
+//queue gives.
+type BatchAck struct{
+	Batch		string
+	Accepted	int
+	Rejected	int
+	Truncated	bool	`json:",omitempty"`
+}
+
+//RulesReload is what an agent reports after re-reading its rules file: the rules added and deleted to match it,
+//the ones that failed and every rule loaded afterwards. Error is set when the file couldnt be read at all. An agent
+//that rolled back a rule set no status report confirmed reports it the same way, RolledBack is the job of the set.
+type RulesReload struct{
+	Source		string
+	Added		[]string
+	Deleted		[]string
+	Failed		[]RuleFailure	`json:",omitempty"`
+	Error		string			`json:",omitempty"`
+	Rules		[]string
+	RolledBack	string			`json:",omitempty"`
+	Received	time.Time
+}
+
+type RuleFailure struct{
+	Rule		string
+	Code		ErrorCode
+	Message		string
+}
+
+//CertificateMessage carries a freshly issued agent certificate and the CA that signed it
+type CertificateMessage struct{
+	Certificate	string
+	CA			string
+}
+
+type CertificateRequest struct{
+	CSR		string
 }
 
 type BaseMessage struct{
@@ -70,13 +136,77 @@ type JobResultMessage struct{
 	Data		interface{}
 }
 
+//Job is a unit of work for an agent. Status and Message hold what the agent reported, State is kept by the control
+//server: queued, dispatched, succeeded, failed, timed-out, cancelled or rolled-back.
 type Job struct{
-	JobType string
-	Rule 	string
-	Retry 	int
-	Status	string
-	Message	string
-	JobID   uuid.UUID
+	JobType 	string
+	Rule 		string
+	Retry 		int
+	Status		string
+	Message		string
+	Code		ErrorCode	`json:",omitempty"`
+	JobID   	uuid.UUID
+	Created		time.Time
+	State		string		`json:",omitempty"`
+	NotBefore	time.Time
+	Expires		time.Time
+	Dispatched	time.Time
+	Deadline	time.Time
+	Finished	time.Time
+	//Before and After place an AddRule rule next to a loaded one, Position is where the agent loaded it
+	Before		string		`json:",omitempty"`
+	After		string		`json:",omitempty"`
+	Position	*int		`json:",omitempty"`
+	//Rules is the set an ApplyRuleSet job loads in place of the agent's rules, the agent reports them back in load
+	//order. Confirm is how many seconds the agent waits for a status report to go through before it rolls the set
+	//back, 0 leaves it to the agent. Failed lists the rules that made the job fail.
+	Rules		[]string		`json:",omitempty"`
+	Confirm		int				`json:",omitempty"`
+	Failed		[]RuleFailure	`json:",omitempty"`
+	//Params are the kernel audit settings a SetAuditParams job changes
+	Params		*AuditParams	`json:",omitempty"`
+}
+
+//AuditParams are kernel audit settings, the ones left out stay as they are. Failure is 0 silent, 1 printk or 2 panic,
+//Enabled 0 disabled, 1 enabled or 2 enabled and immutable until the agent's host reboots.
+type AuditParams struct{
+	RateLimit		*int	`json:",omitempty"`
+	BacklogLimit	*int	`json:",omitempty"`
+	BacklogWaitTime	*int	`json:",omitempty"`
+	Failure			*int	`json:",omitempty"`
+	Enabled			*int	`json:",omitempty"`
+}
+
+//AgentRule is a rule recorded for an agent. Position is its place in the agent's rule list counting from 0, the kernel
+//evaluates the rules of a filter list in that order.
+type AgentRule struct{
+	Status		string
+	Position	int
+}
+
+//ErrorCode is why an agent failed a job, the agents send the same codes
+type ErrorCode string
+
+const(
+	CodeParse			ErrorCode = "parse_error"
+	CodeBuild			ErrorCode = "build_error"
+	CodeKernelRejected	ErrorCode = "kernel_rejected"
+	CodeDuplicate		ErrorCode = "duplicate"
+	CodeNotFound		ErrorCode = "not_found"
+	CodePermission		ErrorCode = "permission_denied"
+	CodeUnavailable		ErrorCode = "unavailable"
+	CodeIO				ErrorCode = "io_error"
+	CodeUnsupported		ErrorCode = "unsupported"
+	CodeInternal		ErrorCode = "internal"
+)
+
+//Retryable tells whether another attempt can succeed. The rule or the agent has to change before the others do, results without a code are retried.
+func (c ErrorCode) Retryable() bool{
+	switch c{
+	case CodeParse, CodeBuild, CodeKernelRejected, CodeDuplicate, CodeNotFound, CodePermission, CodeUnsupported:
+		return false
+	}
+	return true
 }
 
 type DiskStat struct {
@@ -117,6 +247,43 @@ type AuditStatus struct {
 	Backlog         uint32          // Messages waiting in queue.
 	FeatureBitmap   uint32          // Bitmap of kernel audit features (previously to 3.19 it was the audit api version number).
 	BacklogWaitTime uint32          // Message queue wait timeout.
+	RuleSet         *RuleSetState   `json:",omitempty"` // Rules the agent loaded and how the kernel differs from them.
+	Sinks           []SinkStats     // Health and spool depth of the agent's event sinks.
+}
+
+//RuleSetState is the rule set an agent reports with its audit status. Hash covers the rules the agent recorded, sorted,
+//Missing and Unexpected list how its kernel rules differ from them. Error is set when the kernel rules couldnt be read.
+type RuleSetState struct {
+	Version    uint64
+	Hash       string
+	KernelHash string   `json:",omitempty"`
+	Missing    []string `json:",omitempty"`
+	Unexpected []string `json:",omitempty"`
+	Error      string   `json:",omitempty"`
+}
+
+//RuleDrift tells whether an agent's rules drifted, either its kernel lost or gained rules behind its back or the agent
+//holds other rules than the control server recorded for it
+type RuleDrift struct {
+	Drifted    bool
+	Reason     string   `json:",omitempty"`
+	Version    uint64
+	Hash       string
+	Recorded   string   `json:",omitempty"`
+	Missing    []string `json:",omitempty"`
+	Unexpected []string `json:",omitempty"`
+	Checked    time.Time
+}
+
+type SinkStats struct {
+	Name        string
+	Queued      int
+	Written     uint64
+	Dropped     uint64
+	Errors      uint64
+	SpoolEvents int
+	SpoolBytes  int64
+	Evicted     uint64
 }
 
 type Meminfo struct {
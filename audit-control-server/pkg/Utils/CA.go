@@ -0,0 +1,295 @@
+package Utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	caValidity     = 10 * 365 * 24 * time.Hour
+	serverValidity = 365 * 24 * time.Hour
+	agentValidity  = 30 * 24 * time.Hour
+)
+
+/*
+CertificateAuthority is the control server's own CA. Its key and certificate are kept in dir so agents
+can pin it across restarts. It issues the server certificate, renewing it before it expires, and signs the
+client certificates agents get at enrollment. The common name of an agent certificate is the agent ID.
+*/
+type CertificateAuthority struct {
+	dir         string
+	cert        *x509.Certificate
+	certPEM     []byte
+	key         *ecdsa.PrivateKey
+	serverNames []string
+
+	lock   sync.Mutex
+	server *tls.Certificate
+}
+
+//LoadOrCreateCA loads the CA from dir, creating a new one on first start.
+func LoadOrCreateCA(dir string, serverNames []string) (*CertificateAuthority, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("couldnt create the ca directory: %v", err)
+	}
+
+	ca := &CertificateAuthority{dir: dir, serverNames: serverNames}
+	certFile := filepath.Join(dir, "ca.crt")
+	keyFile := filepath.Join(dir, "ca.key")
+
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		if err := ca.create(certFile, keyFile); err != nil {
+			return nil, err
+		}
+		return ca, nil
+	}
+
+	tlsCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldnt load the ca: %v", err)
+	}
+	key, ok := tlsCert.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("ca key is not an ecdsa key")
+	}
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("couldnt parse the ca certificate: %v", err)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, fmt.Errorf("ca certificate expired on %v, remove %s to create a new one", cert.NotAfter, dir)
+	}
+
+	ca.cert = cert
+	ca.key = key
+	ca.certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	return ca, nil
+}
+
+func (ca *CertificateAuthority) create(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	tpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Go-Audit control server CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tpl, &tpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	ca.cert = cert
+	ca.key = key
+	ca.certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	if err := writeKey(keyFile, key); err != nil {
+		return err
+	}
+	return writeFile(certFile, ca.certPEM, 0644)
+}
+
+//CertPEM returns the CA certificate agents have to pin.
+func (ca *CertificateAuthority) CertPEM() []byte {
+	return ca.certPEM
+}
+
+//Pool returns a cert pool holding only this CA, used to verify agent certificates.
+func (ca *CertificateAuthority) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+/*
+GetCertificate is meant for tls.Config.GetCertificate. It hands out the server certificate stored next to the CA
+and issues a new one when it is missing, expiring or doesnt match the configured server names.
+*/
+func (ca *CertificateAuthority) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	ca.lock.Lock()
+	defer ca.lock.Unlock()
+
+	if ca.server != nil && !NeedsRenewal(ca.server.Leaf, time.Now()) {
+		return ca.server, nil
+	}
+
+	certFile := filepath.Join(ca.dir, "server.crt")
+	keyFile := filepath.Join(ca.dir, "server.key")
+	if ca.server == nil {
+		if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+			if leaf, errP := x509.ParseCertificate(cert.Certificate[0]); errP == nil {
+				cert.Leaf = leaf
+				if !NeedsRenewal(leaf, time.Now()) && ca.matchesNames(leaf) && leaf.CheckSignatureFrom(ca.cert) == nil {
+					ca.server = &cert
+					return ca.server, nil
+				}
+			}
+		}
+	}
+
+	cert, err := ca.issueServerCert(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldnt issue the server certificate: %v", err)
+	}
+	ca.server = cert
+	return ca.server, nil
+}
+
+func (ca *CertificateAuthority) matchesNames(leaf *x509.Certificate) bool {
+	for _, name := range ca.serverNames {
+		if leaf.VerifyHostname(name) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (ca *CertificateAuthority) issueServerCert(certFile, keyFile string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tpl := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "Go-Audit control server"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(serverValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, name := range ca.serverNames {
+		if ip := net.ParseIP(name); ip != nil {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+		} else {
+			tpl.DNSNames = append(tpl.DNSNames, name)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeKey(keyFile, key); err != nil {
+		return nil, err
+	}
+	if err := writeFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+/*
+SignCSR issues a client certificate for the PEM encoded certificate request. Only the public key of the
+request is used, the subject is always set to commonName so an agent cant ask for another agent's identity.
+*/
+func (ca *CertificateAuthority) SignCSR(csrPEM []byte, commonName string) ([]byte, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("no certificate request found")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldnt parse the certificate request: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request signature: %v", err)
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tpl := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(agentValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tpl, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("couldnt sign the certificate: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+//NeedsRenewal reports whether less than a third of the certificate's lifetime is left.
+func NeedsRenewal(cert *x509.Certificate, now time.Time) bool {
+	if cert == nil {
+		return true
+	}
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotAfter.Sub(now) < lifetime/3
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writeKey(filename string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writeFile(filename, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+//writeFile replaces filename atomically so a crash never leaves a half written key behind.
+func writeFile(filename string, data []byte, mode os.FileMode) error {
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -8,13 +8,15 @@ import (
 	"time"
 	"strconv"
 	"net"
-
-	"./endpoints"
-	"./Agents"
-	"./pkg/Utils"
-	"./worker"
-
-	"github.com/google/uuid"
+	"strings"
+	"path/filepath"
+
+	"audit-control-server/endpoints"
+	"audit-control-server/Agents"
+	"audit-control-server/Catalog"
+	"audit-control-server/pkg/Utils"
+	"audit-control-server/Storage"
+	"audit-control-server/worker"
 )
 
 type Server struct {
@@ -29,44 +31,121 @@ var (
 	port = 8081
 )
 
+//serverNames are the names agents use to reach the server, they end up in the server certificate
+func serverNames() []string{
+	if names := os.Getenv("server_names"); names != ""{
+		return strings.Split(names, ",")
+	}
+	names := []string{"localhost", "127.0.0.1"}
+	if hostname, err := os.Hostname(); err == nil{
+		names = append(names, hostname)
+	}
+	return names
+}
+
+//durationFromEnv reads a duration such as "30s" from the environment, falling back to def
+func durationFromEnv(key string, def time.Duration) time.Duration{
+	value := os.Getenv(key)
+	if value == ""{
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0{
+		fmt.Fprintf(os.Stderr, "Ignoring invalid %s=%q, using %v\r\n", key, value, def)
+		return def
+	}
+	return d
+}
+
 func NewServer(jobQueue chan *worker.Job) (*Server, error){
-		
-	cerp, err := Utils.GenerateTLSCert(nil, nil, nil, nil, nil, nil, true)
+
+	caDir := os.Getenv("ca_dir")
+	if caDir == ""{
+		caDir = "./ca"
+	}
+	ca, err := Utils.LoadOrCreateCA(caDir, serverNames())
 	if err != nil{
-		fmt.Fprintf(os.Stderr, "Couldnt create a tls certificate%v\r\n", err)
+		fmt.Fprintf(os.Stderr, "Couldnt load the certificate authority: %v\r\n", err)
+		return nil, err
+	}
+	if _, err := ca.GetCertificate(nil); err != nil{
+		fmt.Fprintf(os.Stderr, "Couldnt create a tls certificate: %v\r\n", err)
 		return nil, err
 	}
 
+	//Register is reached without a client certificate, AgentAuth rejects every other agent request lacking one
 	TLSConfig := &tls.Config{
-		Certificates:             []tls.Certificate{*cerp},
+		GetCertificate:           ca.GetCertificate,
+		ClientAuth:               tls.VerifyClientCertIfGiven,
+		ClientCAs:                ca.Pool(),
 		MinVersion:               tls.VersionTLS12,
 		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
 		PreferServerCipherSuites: true,
 		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
 			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
 			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
 			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
 		},
 	}
 
+	dataDir := os.Getenv("data_dir")
+	if dataDir == ""{
+		dataDir = "./data"
+	}
+	store, err := Storage.Open(filepath.Join(dataDir, "agents.journal"))
+	if err != nil{
+		fmt.Fprintf(os.Stderr, "Couldnt open the storage: %v\r\n", err)
+		return nil, err
+	}
+
+	repo := Storage.NewKVRepository(store)
+
 	s := &Server{
 		router : &endpoints.Router{
 			Sys : &endpoints.SyscallHandler{
 				Queue : jobQueue,
 			},
-			Agents: &Agents.AuditAgents{
-				Agents: make(map[uuid.UUID]*Agents.Agent),
-			},
+			Agents: Agents.NewAuditAgents(os.Getenv("enroll_token"), ca, repo),
 		},
 		Interface : server,
 		Port : port,
 	}
 
+	if err := s.router.Agents.Restore(); err != nil{
+		fmt.Fprintf(os.Stderr, "Couldnt restore the agents: %v\r\n", err)
+		return nil, err
+	}
+
+	catalog, err := Catalog.New(s.router.Agents, repo, durationFromEnv("reconcile_interval", Catalog.DefaultInterval))
+	if err != nil{
+		fmt.Fprintf(os.Stderr, "Couldnt load the rule catalog: %v\r\n", err)
+		return nil, err
+	}
+	s.router.Catalog = catalog
+
+	if s.router.Agents.EnrollToken == ""{
+		fmt.Fprintf(os.Stderr, "No enroll_token configured, any agent can register\r\n")
+	}
+
+	operatorsFile := os.Getenv("operators_file")
+	if operatorsFile == ""{
+		operatorsFile = "./operators.json"
+	}
+	operators, err := endpoints.LoadOperators(operatorsFile)
+	if err != nil{
+		fmt.Fprintf(os.Stderr, "Couldnt load the operators: %v\r\n", err)
+		return nil, err
+	}
+
 	go s.router.Agents.CleanUp()
+	go s.router.Agents.WatchJobs(10*time.Second)
+	go s.router.Catalog.Run()
 
 	srv := &http.Server{
 		Addr:           server + ":" + strconv.Itoa(port),
-		Handler:        s.router,
+		Handler:        operators.Middleware(s.router),
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
@@ -86,7 +165,7 @@ func (s *Server) Start() {
 	if err != http.ErrServerClosed{
 		fmt.Fprintf(os.Stderr, "Http server closed unexpectedly: %v\r\n", err)
 	}else{
-		fmt.Fprintf(os.Stderr, "Http server closed gracefully: %v\r\n")
+		fmt.Fprintf(os.Stderr, "Http server closed gracefully: %v\r\n", err)
 	}
 
 }
@@ -109,7 +188,7 @@ func main() {
 	fmt.Println("server is being created")
 	instance, errS := NewServer(jobQueue)
 	if errS != nil{
-		fmt.Fprintf(os.Stderr, "Server object couldnt created\r\n", errS)
+		fmt.Fprintf(os.Stderr, "Server object couldnt created: %v\r\n", errS)
 		os.Exit(1)
 	}
 	fmt.Println("server is created")
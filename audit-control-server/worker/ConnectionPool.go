@@ -56,7 +56,7 @@ type ConnectionPool	struct{
 func (p *ConnectionPool)Init() error{
 	fmt.Println("sockets are being created")
 	for i := 0; i < p.MinNumber; i++ {
-		fmt.Println("socket: %d", i)
+		fmt.Printf("socket: %d\n", i)
 		if conn, err := p.CreateConn(); err == nil{
 			p.ConnPool <- conn
 		}else{
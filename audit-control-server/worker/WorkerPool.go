@@ -10,9 +10,9 @@ import (
 	"sync"
 	"time"
 
-	"../Eventhandlers"
-	"../Objectpool"
-	"../messages"
+	"audit-control-server/Eventhandlers"
+	"audit-control-server/Objectpool"
+	"audit-control-server/messages"
 )
 
 var (
@@ -49,7 +49,7 @@ func (e *Job) Reset() {
 func ResetEvent(i interface{}) error {
 	obj, ok := i.(*Job)
 	if !ok {
-		errors.New("illegal object sent to ResetEvent")
+		return errors.New("illegal object sent to ResetEvent")
 	}
 	obj.Reset()
 	return nil
@@ -180,6 +180,56 @@ func SendLogToKibana(data *messages.GeneralInfo) {
 
 }
 
+/*
+Analyze runs the analyzer matching the event and stores its message in data.Message. Processes and connections seen
+for the first time are sent to processes and connections. It reports whether the event should be shipped to Kibana.
+*/
+func Analyze(data *messages.GeneralInfo, processes, connections chan []byte) bool {
+	for k, v := range data.Data {
+		if k == "SYSCALL" {
+			var sys Eventhandlers.Syscall
+			err := json.Unmarshal(*v, &sys)
+			if err != nil {
+				log.Printf("unmarshall error: " + err.Error())
+			}
+			switch sys.Syscall {
+			case "execve":
+				if _, ok := data.Data["EXECVE"]; ok {
+					data.Message = sys.AnalyzeExecve(data.HostName, data.Data["EXECVE"], processes)
+					//data.Message = sys.AnalyzeExecve(data.HostName ,data.Data["EXECVE"], job.MessageQueue)
+					// _, err := mailClient.SendMail(data.Message, data.HostName ,"server.php", false, "POST")
+					// if err != nil{
+					// 	log.Println("couldnt send email: %v", err)
+					// }
+					return true
+				}
+
+			case "clone":
+			case "connect":
+				if _, ok := data.Data["SOCKADDR"]; ok {
+					data.Message = sys.AnalyzeConnect(data.Data["SOCKADDR"], data.HostName, connections)
+					//data.Message = sys.AnalyzeConnect(data.Data["SOCKADDR"], data.HostName, job.MessageQueue)
+					return data.Message != ""
+				}
+			case "open":
+				data.Message = sys.AnalyzeOpen(data.Data["PATH"], data.HostName)
+				return true
+			}
+			return false
+		} else if k == "USER_LOGIN" {
+			var login Eventhandlers.Sshlogin
+			err := json.Unmarshal(*v, &login)
+			if err != nil {
+				log.Printf("Unmarshall error: " + err.Error())
+			}
+
+			data.Message = login.AnalyzeLogin(data.HostName)
+			return true
+		}
+	}
+	return false
+}
+
 func (w *Worker) Start() {
 	go func() {
 		for {
@@ -187,50 +237,8 @@ func (w *Worker) Start() {
 			select {
 			case job := <-w.JobChannel:
 				//log.Printf("new event has arrived")
-				for k, v := range job.Data.Data {
-					if k == "SYSCALL" {
-						var sys Eventhandlers.Syscall
-						err := json.Unmarshal(*v, &sys)
-						if err != nil {
-							log.Printf("unmarshall error: " + err.Error())
-						}
-						switch sys.Syscall {
-						case "execve":
-							if _, ok := job.Data.Data["EXECVE"]; ok {
-								job.Data.Message = sys.AnalyzeExecve(job.Data.HostName, job.Data.Data["EXECVE"], processes)
-								//job.Data.Message = sys.AnalyzeExecve(job.Data.HostName ,job.Data.Data["EXECVE"], job.MessageQueue)
-								// _, err := mailClient.SendMail(job.Data.Message, job.Data.HostName ,"server.php", false, "POST")
-								// if err != nil{
-								// 	log.Println("couldnt send email: %v", err)
-								// }
-								SendLogToKibana(job.Data)
-							}
-
-						case "clone":
-						case "connect":
-							if _, ok := job.Data.Data["SOCKADDR"]; ok {
-								job.Data.Message = sys.AnalyzeConnect(job.Data.Data["SOCKADDR"], job.Data.HostName, connections)
-								//job.Data.Message = sys.AnalyzeConnect(job.Data.Data["SOCKADDR"], job.Data.HostName, job.MessageQueue)
-								if job.Data.Message != "" {
-									SendLogToKibana(job.Data)
-								}
-							}
-						case "open":
-							job.Data.Message = sys.AnalyzeOpen(job.Data.Data["PATH"], job.Data.HostName)
-							SendLogToKibana(job.Data)
-						}
-						break
-					} else if k == "USER_LOGIN" {
-						var login Eventhandlers.Sshlogin
-						err := json.Unmarshal(*v, &login)
-						if err != nil {
-							log.Printf("Unmarshall error: " + err.Error())
-						}
-
-						job.Data.Message = login.AnalyzeLogin(job.Data.HostName)
-						SendLogToKibana(job.Data)
-						break
-					}
+				if Analyze(job.Data, processes, connections) {
+					SendLogToKibana(job.Data)
 				}
 				job.DecrementReferenceCount()
 
@@ -0,0 +1,102 @@
+package worker
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"audit-control-server/messages"
+)
+
+//event builds an event from records given as JSON objects keyed by record type
+func event(records map[string]string) *messages.GeneralInfo {
+	data := make(map[string]*json.RawMessage, len(records))
+	for typ, record := range records {
+		raw := json.RawMessage(record)
+		data[typ] = &raw
+	}
+	return &messages.GeneralInfo{Serial: 1, HostName: "web-1", Data: data}
+}
+
+func TestAnalyze(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		records map[string]string
+		ship    bool
+		message string
+	}{
+		{
+			name: "open",
+			records: map[string]string{
+				"SYSCALL": `{"syscall":"open","uid":"0","success":"yes"}`,
+				"PATH":    `{"name":"/etc/shadow"}`,
+			},
+			ship:    true,
+			message: "User: 0 opened /etc/shadow: with the Success: yes on host web-1",
+		},
+		{
+			//the agent keeps the first PATH record only and an event can lose it, the open is still reported
+			name: "open without a PATH record",
+			records: map[string]string{
+				"SYSCALL": `{"syscall":"open","uid":"0","success":"no"}`,
+			},
+			ship:    true,
+			message: "User: 0 opened an unknown file: with the Success: no on host web-1",
+		},
+		{
+			name: "execve",
+			records: map[string]string{
+				"SYSCALL": `{"syscall":"execve","uid":"1000"}`,
+				"EXECVE":  `{"a0":"ls","a1":"-l"}`,
+			},
+			ship:    true,
+			message: `User: 1000 executed "ls -l " on host: web-1`,
+		},
+		{
+			name: "execve without an EXECVE record",
+			records: map[string]string{
+				"SYSCALL": `{"syscall":"execve","uid":"1000"}`,
+			},
+		},
+		{
+			name: "connect",
+			records: map[string]string{
+				"SYSCALL":  `{"syscall":"connect","uid":"33"}`,
+				"SOCKADDR": `{"ip":"10.0.0.1","port":"443"}`,
+			},
+			ship:    true,
+			message: "User: 33 tried to connect to 10.0.0.1:443 on host: web-1",
+		},
+		{
+			name: "connect to a socket without address",
+			records: map[string]string{
+				"SYSCALL":  `{"syscall":"connect","uid":"33"}`,
+				"SOCKADDR": `{}`,
+			},
+		},
+		{
+			name: "ssh login",
+			records: map[string]string{
+				"USER_LOGIN": `{"addr":"192.0.2.7","res":"failed"}`,
+			},
+			ship:    true,
+			message: "This IP: 192.0.2.7 failed to connect to ssh",
+		},
+		{
+			name: "syscall without analyzer",
+			records: map[string]string{
+				"SYSCALL": `{"syscall":"clone"}`,
+			},
+		},
+	} {
+		//first-seen processes and connections are sent before Analyze returns
+		processes, connections := make(chan []byte, 1), make(chan []byte, 1)
+		data := event(c.records)
+		if ship := Analyze(data, processes, connections); ship != c.ship {
+			t.Errorf("%s: Analyze returned %v, want %v", c.name, ship, c.ship)
+		}
+		if strings.TrimSpace(data.Message) != c.message {
+			t.Errorf("%s: message %q, want %q", c.name, data.Message, c.message)
+		}
+	}
+}
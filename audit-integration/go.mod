@@ -0,0 +1,28 @@
+module audit-integration
+
+go 1.20
+
+require (
+	audit-client v0.0.0-00010101000000-000000000000
+	audit-control-server v0.0.0-00010101000000-000000000000
+	github.com/google/uuid v1.1.1
+)
+
+require (
+	audit-log v0.0.0-00010101000000-000000000000 // indirect
+	github.com/elastic/go-libaudit v1.0.0 // indirect
+	github.com/elastic/go-libaudit/v2 v2.5.0 // indirect
+	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51 // indirect
+	go.uber.org/atomic v1.7.0 // indirect
+	go.uber.org/multierr v1.7.0 // indirect
+	golang.org/x/sys v0.11.0 // indirect
+)
+
+// the agent and the control server are run together in-process, replaces of
+// the modules themselves dont carry over, so the agent's are repeated here
+replace (
+	audit-client => ../audit-client
+	audit-control-server => ../audit-control-server
+	audit-log => ../audit-log
+	github.com/elastic/go-libaudit => /root/elastic/go-libaudit
+)
@@ -0,0 +1,398 @@
+//go:build integration
+// +build integration
+
+// Package integration runs the agent against the real control server. The
+// router of audit-control-server is served in-process over TLS with its CA,
+// storage and job engine, the agent enrolls with a CSR, takes its jobs over
+// the HTTP/2 job stream and uploads events, with the fake audit daemon of the
+// agent in place of the kernel:
+//
+//	go test -tags integration ./... [-v]
+//
+// It is a module of its own because neither module can link the other. The
+// agent's integration test in audit-client/integration covers the agent's
+// side in depth against a scripted server, this one checks that both sides
+// still speak the same protocol.
+package integration
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"audit-client/Infrastructure"
+	"audit-client/Interfaces"
+	"audit-client/Usecases"
+
+	"audit-control-server/Agents"
+	"audit-control-server/Storage"
+	"audit-control-server/endpoints"
+	"audit-control-server/messages"
+	"audit-control-server/pkg/Utils"
+	"audit-control-server/worker"
+
+	"github.com/google/uuid"
+)
+
+var (
+	enrollToken = "integration-token"
+	stepTimeout = 10 * time.Second
+
+	initialRules = []string{
+		"-a always,exit -F arch=b64 -S execve -k exec",
+		"-w /etc/passwd -p wa -k identity",
+	}
+	addedRule  = "-a always,exit -F arch=b64 -S connect -k network"
+	ptraceRule = "-A always,exit -F arch=b64 -S ptrace -k tracing"
+	filesRule  = "-a always,exit -F arch=b64 -S open -k files"
+)
+
+type stack struct {
+	t      *testing.T
+	dir    string
+	agents *Agents.AuditAgents
+	server *httptest.Server
+	daemon *Infrastructure.FakeAuditdHandler
+	agent  *Usecases.Agent
+	uid    uuid.UUID
+	exited chan int
+
+	lock   sync.Mutex
+	events []uint64
+}
+
+func TestAgentAgainstServer(t *testing.T) {
+	s := &stack{t: t, exited: make(chan int, 1)}
+	defer s.stop()
+
+	if err := s.startServer(); err != nil {
+		t.Fatalf("couldnt start the control server: %v", err)
+	}
+	if err := s.startAgent(); err != nil {
+		t.Fatalf("couldnt start the agent: %v", err)
+	}
+	s.run()
+}
+
+func (s *stack) stop() {
+	if s.server != nil {
+		// the agent doesnt exit here, its job stream is still open
+		s.server.CloseClientConnections()
+		s.server.Close()
+	}
+	os.RemoveAll(s.dir)
+}
+
+// startServer serves the router the way server-main.go does, without the
+// operator API keys the agent routes dont need.
+func (s *stack) startServer() error {
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+	dir, err := ioutil.TempDir("", "go-audit-server-integration")
+	if err != nil {
+		return err
+	}
+	s.dir = dir
+
+	ca, err := Utils.LoadOrCreateCA(filepath.Join(dir, "ca"), []string{"127.0.0.1", "localhost"})
+	if err != nil {
+		return err
+	}
+	store, err := Storage.Open(filepath.Join(dir, "agents.journal"))
+	if err != nil {
+		return err
+	}
+	s.agents = Agents.NewAuditAgents(enrollToken, ca, Storage.NewKVRepository(store))
+
+	operatorsFile := filepath.Join(dir, "operators.json")
+	if err := ioutil.WriteFile(operatorsFile, []byte("[]"), 0600); err != nil {
+		return err
+	}
+	operators, err := endpoints.LoadOperators(operatorsFile)
+	if err != nil {
+		return err
+	}
+
+	// NewPool sets up the jobs the handler takes events in, the workers that
+	// would analyze them arent started
+	queue := make(chan *worker.Job, 100)
+	worker.NewPool(1, queue)
+	go func() {
+		for job := range queue {
+			s.lock.Lock()
+			s.events = append(s.events, job.Data.Serial)
+			s.lock.Unlock()
+		}
+	}()
+	router := &endpoints.Router{Sys: &endpoints.SyscallHandler{Queue: queue}, Agents: s.agents}
+
+	cert, err := ca.GetCertificate(nil)
+	if err != nil {
+		return err
+	}
+	s.server = httptest.NewUnstartedServer(operators.Middleware(router))
+	s.server.EnableHTTP2 = true
+	s.server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    ca.Pool(),
+		MinVersion:   tls.VersionTLS12,
+	}
+	s.server.StartTLS()
+	return ioutil.WriteFile(filepath.Join(dir, "ca.crt"), ca.CertPEM(), 0600)
+}
+
+// startAgent wires an agent the way audit.go does, with the fake audit daemon.
+func (s *stack) startAgent() error {
+	rulesFile := filepath.Join(s.dir, "audit.rules")
+	if err := ioutil.WriteFile(rulesFile, []byte(initialRules[0]+"\n"+initialRules[1]+"\n"), 0600); err != nil {
+		return err
+	}
+	stateDir := filepath.Join(s.dir, "state")
+	var err error
+	s.uid, err = Usecases.LoadAgentID(stateDir)
+	if err != nil {
+		return err
+	}
+	creds, err := Infrastructure.NewCertStore(stateDir, filepath.Join(s.dir, "ca.crt"), s.uid.String())
+	if err != nil {
+		return err
+	}
+	client := Infrastructure.NewClient(s.server.Listener.Addr().String(), creds)
+
+	var wait sync.WaitGroup
+	eventQueue := make(chan Usecases.Event, 100)
+	s.daemon = Infrastructure.NewFakeAuditHandler(&wait, eventQueue)
+	auditManager := Interfaces.NewAuditd(s.daemon, make(chan bool, 1))
+	auditManager.HostFile = filepath.Join(stateDir, Usecases.HostAuditFile)
+	jobManager := Interfaces.NewAPIClient(&client, creds, s.uid.String())
+	if err := auditManager.Init(rulesFile, true); err != nil {
+		return fmt.Errorf("audit init failed: %v", err)
+	}
+
+	cfg := Usecases.SinkConfig{Type: "server", FlushInterval: "100ms"}
+	sink, err := Infrastructure.NewEventSink(cfg, &client, s.uid.String())
+	if err != nil {
+		return err
+	}
+	sinks := Usecases.NewSinkDispatcher()
+	if err := sinks.Add(sink, cfg, nil); err != nil {
+		return err
+	}
+	pool := Usecases.NewPool(4, eventQueue)
+	pool.InitializeWorkers(&jobManager, sinks)
+
+	logs := ioutil.Discard
+	if testing.Verbose() {
+		logs = os.Stderr
+	}
+	logger := Usecases.LoggerInit(logs, logs, logs)
+	s.agent, err = Usecases.NewAgent(&auditManager, &jobManager, &wait, &logger, s.uid)
+	if err != nil {
+		return err
+	}
+	s.agent.Pool = pool
+	s.agent.EnrollToken = enrollToken
+	s.agent.PollInterval = 50 * time.Millisecond
+	s.agent.MaxBackoff = time.Second
+	s.agent.Stream = true
+	s.agent.Exit = func(code int) {
+		s.exited <- code
+	}
+	go s.agent.Run()
+	return nil
+}
+
+func (s *stack) check(name string, err error) {
+	if err != nil {
+		s.t.Errorf("%s: %v", name, err)
+		return
+	}
+	s.t.Logf("ok   %s", name)
+}
+
+// waitFor polls cond until it holds or stepTimeout passes.
+func waitFor(what string, cond func() bool) error {
+	deadline := time.Now().Add(stepTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil
+}
+
+// finished waits for a queued job to reach a final state on the server and
+// returns it.
+func (s *stack) finished(queued messages.Job, errQ *Agents.APIError) (messages.Job, error) {
+	if errQ != nil {
+		return queued, errQ
+	}
+	var job messages.Job
+	err := waitFor("job "+queued.JobType, func() bool {
+		var errJ *Agents.APIError
+		job, errJ = s.agents.Job(s.uid, queued.JobID)
+		if errJ != nil {
+			return false
+		}
+		switch job.State {
+		case Agents.JobQueued, Agents.JobDispatched:
+			return false
+		}
+		return true
+	})
+	return job, err
+}
+
+// succeeded runs a job through the server and checks that it succeeded.
+func (s *stack) succeeded(queued messages.Job, errQ *Agents.APIError) error {
+	job, err := s.finished(queued, errQ)
+	if err != nil {
+		return err
+	}
+	if job.State != Agents.JobSucceeded {
+		return fmt.Errorf("job %s ended %s with %q (%s)", job.JobType, job.State, job.Code, job.Message)
+	}
+	return nil
+}
+
+// rulesAgree checks the rules the server recorded for the agent against the
+// fake kernel, in order.
+func (s *stack) rulesAgree(want []string) error {
+	recorded, errR := s.agents.Rules(s.uid)
+	if errR != nil {
+		return errR
+	}
+	got := make([]string, len(recorded))
+	for rule, state := range recorded {
+		if state.Position < 0 || state.Position >= len(got) {
+			return fmt.Errorf("server has %s at %d of %d rules", rule, state.Position, len(got))
+		}
+		got[state.Position] = rule
+	}
+	if !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("server has %q, want %q", got, want)
+	}
+
+	listed := make([]string, 0, len(want))
+	for _, rule := range want {
+		normal, err := s.daemon.NormalizeRule(rule)
+		if err != nil {
+			return err
+		}
+		listed = append(listed, normal)
+	}
+	if kernel, err := s.daemon.GetRules(); err != nil || !reflect.DeepEqual(kernel, listed) {
+		return fmt.Errorf("kernel has %q (%v), want %q", kernel, err, listed)
+	}
+	return nil
+}
+
+func (s *stack) run() {
+	s.check("register", waitFor("the agent to enroll and report its audit status", func() bool {
+		status, err := s.agents.AuditStatusOf(s.uid)
+		return err == nil && status != nil
+	}))
+	if s.t.Failed() {
+		return
+	}
+	s.check("registered rules", s.rulesAgree(initialRules))
+
+	s.check("AddRule", func() error {
+		if err := s.succeeded(s.agents.QueueAddRule(s.uid, addedRule)); err != nil {
+			return err
+		}
+		return s.rulesAgree([]string{initialRules[0], initialRules[1], addedRule})
+	}())
+
+	s.check("AddRule prepend", func() error {
+		if err := s.succeeded(s.agents.QueueAddRule(s.uid, ptraceRule)); err != nil {
+			return err
+		}
+		return s.rulesAgree([]string{ptraceRule, initialRules[0], initialRules[1], addedRule})
+	}())
+
+	s.check("AddRule before another rule", func() error {
+		if err := s.succeeded(s.agents.QueueInsertRule(s.uid, filesRule, initialRules[1], "")); err != nil {
+			return err
+		}
+		return s.rulesAgree([]string{ptraceRule, initialRules[0], filesRule, initialRules[1], addedRule})
+	}())
+
+	s.check("AddRule duplicate", func() error {
+		if _, err := s.agents.QueueAddRule(s.uid, addedRule); err == nil || err.Code != Agents.ErrRuleExists.Code {
+			return fmt.Errorf("queued with %v, want %s", err, Agents.ErrRuleExists.Code)
+		}
+		return nil
+	}())
+
+	s.check("DeleteRule", func() error {
+		for _, rule := range []string{filesRule, ptraceRule} {
+			if err := s.succeeded(s.agents.QueueDeleteRule(s.uid, rule)); err != nil {
+				return err
+			}
+		}
+		return s.rulesAgree([]string{initialRules[0], initialRules[1], addedRule})
+	}())
+
+	s.check("AddRule kernel rejected", func() error {
+		s.daemon.FailNext("AddRule", syscall.EINVAL)
+		job, err := s.finished(s.agents.QueueAddRule(s.uid, filesRule))
+		if err != nil {
+			return err
+		}
+		if job.State != Agents.JobFailed || job.Code != messages.CodeKernelRejected || job.Retry != 0 {
+			return fmt.Errorf("job ended %s with %q after %d retries, want it failed with %s", job.State, job.Code, job.Retry, messages.CodeKernelRejected)
+		}
+		return s.rulesAgree([]string{initialRules[0], initialRules[1], addedRule})
+	}())
+
+	s.check("events", func() error {
+		data := json.RawMessage(`{"syscall":"execve","success":"yes","exe":"/bin/true"}`)
+		for _, serial := range []uint64{7, 8} {
+			event := Usecases.GeneralInfo{Serial: serial, Data: map[string]*json.RawMessage{"SYSCALL": &data}}
+			if err := s.daemon.Script(event); err != nil {
+				return err
+			}
+		}
+		return waitFor("the events to reach the workers", func() bool {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			// the agent uploads with several workers, in no particular order
+			got := append([]uint64(nil), s.events...)
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			return reflect.DeepEqual(got, []uint64{7, 8})
+		})
+	}())
+
+	s.check("ShutDown", func() error {
+		if err := s.succeeded(s.agents.QueueJob(s.uid, "ShutDown")); err != nil {
+			return err
+		}
+		select {
+		case code := <-s.exited:
+			if code != 0 {
+				return fmt.Errorf("agent exited with %d", code)
+			}
+		case <-time.After(stepTimeout):
+			return fmt.Errorf("agent didnt exit")
+		}
+		return waitFor("the agent to deregister", func() bool {
+			summary, err := s.agents.Summary(s.uid)
+			return err == nil && summary.Offline
+		})
+	}())
+}
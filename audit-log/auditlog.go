@@ -0,0 +1,256 @@
+// Package auditlog reads auditd logs into the events agents upload. The agent
+// reads the system auditd log with it when the audit netlink socket belongs to
+// auditd, and the replay tool of the control server runs recorded logs through
+// the analyzers with it, so both see the same events.
+package auditlog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-libaudit/v2/auparse"
+)
+
+const (
+	// DefaultTimeout completes an event without an EOE record once no record
+	// arrived for it this long, auditd writes the records of an event right
+	// after each other.
+	DefaultTimeout = 2 * time.Second
+	// DefaultMaxOpen is how many events wait for their records at most.
+	DefaultMaxOpen = 256
+)
+
+// combinedRecords are the fields that start a new record in a line holding a
+// whole event without record types, like the audit.log sample of the agent.
+var combinedRecords = map[string]auparse.AuditMessageType{
+	"argc":      auparse.AUDIT_EXECVE,
+	"item":      auparse.AUDIT_PATH,
+	"saddr":     auparse.AUDIT_SOCKADDR,
+	"proctitle": auparse.AUDIT_PROCTITLE,
+	"fver":      auparse.AUDIT_BPRM_FCAPS,
+}
+
+// ParseLine parses a line of an auditd log into its records. Native lines
+// hold one record, "type=SYSCALL msg=audit(...): ...". Lines holding a whole
+// event, optionally quoted, are split into records at the fields that start
+// EXECVE, PATH, SOCKADDR, PROCTITLE and BPRM_FCAPS records.
+func ParseLine(line string) ([]*auparse.AuditMessage, error) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, `"`) {
+		unquoted, err := strconv.Unquote(line)
+		if err != nil {
+			return nil, fmt.Errorf("couldnt unquote the line: %v", err)
+		}
+		line = strings.TrimSpace(unquoted)
+	}
+	if line == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(line, "type=") {
+		msg, err := auparse.ParseLogLine(line)
+		if err != nil {
+			return nil, err
+		}
+		return []*auparse.AuditMessage{msg}, nil
+	}
+	return splitCombined(line)
+}
+
+func splitCombined(line string) ([]*auparse.AuditMessage, error) {
+	end := strings.Index(line, "):")
+	if !strings.HasPrefix(line, "audit(") || end < 0 {
+		return nil, errors.New("line has no audit header")
+	}
+	header := line[:end+2]
+
+	var msgs []*auparse.AuditMessage
+	typ := auparse.AUDIT_SYSCALL
+	var fields []string
+	add := func() error {
+		if len(fields) == 0 {
+			return nil
+		}
+		msg, err := auparse.Parse(typ, header+" "+strings.Join(fields, " "))
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, msg)
+		fields = nil
+		return nil
+	}
+	for _, field := range splitFields(line[end+2:]) {
+		key := field
+		if i := strings.IndexByte(field, '='); i > 0 {
+			key = field[:i]
+		}
+		if next, ok := combinedRecords[key]; ok {
+			if err := add(); err != nil {
+				return nil, err
+			}
+			typ = next
+		}
+		fields = append(fields, field)
+	}
+	if err := add(); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// splitFields splits key=value fields at spaces outside of double quotes.
+func splitFields(s string) []string {
+	var fields []string
+	quoted := false
+	start := -1
+	for i, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			if start < 0 {
+				start = i
+			}
+		case r == ' ' && !quoted:
+			if start >= 0 {
+				fields = append(fields, s[start:i])
+				start = -1
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, s[start:])
+	}
+	return fields
+}
+
+// Event is an assembled event, Data holds its records by type the way agents
+// upload them.
+type Event struct {
+	Serial uint64
+	Data   map[string]*json.RawMessage
+}
+
+type openEvent struct {
+	serial  uint32
+	records map[string]map[string]string
+	seen    time.Time
+}
+
+// Assembler groups records into events by the serial of their
+// audit(ts:serial) header. An event is emitted on its EOE record, once it went
+// Timeout without a new record or when MaxOpen are open.
+type Assembler struct {
+	Timeout time.Duration
+	MaxOpen int
+	open    map[uint32]*openEvent
+	emit    func(Event)
+}
+
+// NewAssembler returns an Assembler with the default timeout and limit that
+// hands the events it completes to emit.
+func NewAssembler(emit func(Event)) *Assembler {
+	return &Assembler{
+		Timeout: DefaultTimeout,
+		MaxOpen: DefaultMaxOpen,
+		open:    map[uint32]*openEvent{},
+		emit:    emit,
+	}
+}
+
+// Add adds a record to its event, now is when it was read. Records auparse
+// cant read the fields of are returned as errors and dropped.
+func (a *Assembler) Add(msg *auparse.AuditMessage, now time.Time) error {
+	if msg.RecordType == auparse.AUDIT_EOE {
+		if event, ok := a.open[msg.Sequence]; ok {
+			a.complete(event)
+		}
+		return nil
+	}
+
+	data, err := msg.Data()
+	if err != nil && data == nil {
+		return fmt.Errorf("audit record %d: %v", msg.Sequence, err)
+	}
+	switch msg.RecordType {
+	case auparse.AUDIT_SOCKADDR:
+		// the control server reads the address as ip
+		if addr, ok := data["addr"]; ok {
+			data["ip"] = addr
+			delete(data, "addr")
+		}
+	case auparse.AUDIT_SYSCALL:
+		// auparse turns success=yes into result=success, the control server
+		// reads success
+		if result, ok := data["result"]; ok {
+			data["success"] = "no"
+			if result == "success" {
+				data["success"] = "yes"
+			}
+		}
+	default:
+		// auparse turns res=failed into result=fail, the control server reads res
+		if result, ok := data["result"]; ok {
+			if result == "fail" {
+				result = "failed"
+			}
+			data["res"] = result
+		}
+	}
+
+	event, ok := a.open[msg.Sequence]
+	if !ok {
+		if len(a.open) >= a.MaxOpen {
+			a.Expire(time.Time{})
+		}
+		event = &openEvent{serial: msg.Sequence, records: map[string]map[string]string{}}
+		a.open[msg.Sequence] = event
+	}
+	event.seen = now
+	// of repeated records such as PATH the first one is kept
+	if _, ok := event.records[msg.RecordType.String()]; !ok {
+		event.records[msg.RecordType.String()] = data
+	}
+	return nil
+}
+
+func (a *Assembler) complete(event *openEvent) {
+	delete(a.open, event.serial)
+	info := Event{
+		Serial: uint64(event.serial),
+		Data:   make(map[string]*json.RawMessage, len(event.records)),
+	}
+	for typ, record := range event.records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			continue
+		}
+		raw := json.RawMessage(data)
+		info.Data[typ] = &raw
+	}
+	a.emit(info)
+}
+
+// Expire completes the events last seen before now-Timeout, a zero now
+// completes all of them. Events are completed in serial order.
+func (a *Assembler) Expire(now time.Time) {
+	var done []*openEvent
+	for _, event := range a.open {
+		if now.IsZero() || now.Sub(event.seen) >= a.Timeout {
+			done = append(done, event)
+		}
+	}
+	sort.Slice(done, func(i, j int) bool {
+		return done[i].serial < done[j].serial
+	})
+	for _, event := range done {
+		a.complete(event)
+	}
+}
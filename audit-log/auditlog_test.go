@@ -0,0 +1,242 @@
+package auditlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-libaudit/v2/auparse"
+)
+
+// sampleLines returns the lines of the audit.log sample of the agent holding
+// whole events, the JSON lines after them are events the old agent already sent.
+func sampleLines(t *testing.T) []string {
+	t.Helper()
+	file, err := os.Open("../audit-client/audit.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), `"audit(`) {
+			lines = append(lines, scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func recordTypes(msgs []*auparse.AuditMessage) []string {
+	var types []string
+	for _, msg := range msgs {
+		types = append(types, msg.RecordType.String())
+	}
+	return types
+}
+
+// record decodes one record of an emitted event.
+func record(t *testing.T, event Event, typ string) map[string]string {
+	t.Helper()
+	raw, ok := event.Data[typ]
+	if !ok {
+		t.Fatalf("event %d has no %s record", event.Serial, typ)
+	}
+	var data map[string]string
+	if err := json.Unmarshal(*raw, &data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseLine(t *testing.T) {
+	lines := sampleLines(t)
+
+	msgs, err := ParseLine(lines[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"SYSCALL", "EXECVE", "PATH", "PATH", "PROCTITLE"}
+	if got := recordTypes(msgs); !reflect.DeepEqual(got, want) {
+		t.Errorf("combined line split into %v, want %v", got, want)
+	}
+	for _, msg := range msgs {
+		if msg.Sequence != 2929117304 {
+			t.Errorf("%s record has serial %d", msg.RecordType, msg.Sequence)
+		}
+	}
+
+	msgs, err = ParseLine(`type=SYSCALL msg=audit(1618919474.839:42): arch=c000003e syscall=2 success=no exit=-2 pid=1 comm="cat" exe="/bin/cat"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].RecordType != auparse.AUDIT_SYSCALL || msgs[0].Sequence != 42 {
+		t.Errorf("native line parsed to %v", recordTypes(msgs))
+	}
+
+	if msgs, err := ParseLine("  \r"); msgs != nil || err != nil {
+		t.Errorf("blank line parsed to %v, %v", msgs, err)
+	}
+	for _, bad := range []string{`"audit(1:2): unterminated`, `{"syscall":"open"}`, `audit(1:2) no colon`} {
+		if _, err := ParseLine(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+func TestSplitCombined(t *testing.T) {
+	msgs, err := splitCombined(`audit(1618919477.451:7): arch=c000003e syscall=42 success=no exit=-115 saddr=02000050D4164D4F0000000000000000 proctitle="curl"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := recordTypes(msgs); !reflect.DeepEqual(got, []string{"SYSCALL", "SOCKADDR", "PROCTITLE"}) {
+		t.Fatalf("split into %v", got)
+	}
+	if _, err := splitCombined("arch=c000003e syscall=42"); err == nil {
+		t.Errorf("line without a header split")
+	}
+}
+
+func TestSplitFields(t *testing.T) {
+	got := splitFields(`  comm="a b"  exe="/bin/x y" key=(null) `)
+	want := []string{`comm="a b"`, `exe="/bin/x y"`, "key=(null)"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("split into %q, want %q", got, want)
+	}
+}
+
+// TestAssembleSample assembles every event of the sample, one per line.
+func TestAssembleSample(t *testing.T) {
+	lines := sampleLines(t)
+	var events []Event
+	a := NewAssembler(func(event Event) { events = append(events, event) })
+	now := time.Now()
+	for _, line := range lines {
+		msgs, err := ParseLine(line)
+		if err != nil {
+			t.Fatalf("%.60s: %v", line, err)
+		}
+		for _, msg := range msgs {
+			a.Add(msg, now)
+		}
+	}
+	a.Expire(time.Time{})
+
+	if len(events) != len(lines) {
+		t.Fatalf("assembled %d events from %d lines", len(events), len(lines))
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].Serial < events[i-1].Serial {
+			t.Fatalf("event %d came after %d", events[i].Serial, events[i-1].Serial)
+		}
+	}
+
+	execve := events[1]
+	if execve.Serial != 2929117304 {
+		t.Fatalf("second event is %d", execve.Serial)
+	}
+	if syscall := record(t, execve, "SYSCALL"); syscall["success"] != "yes" || syscall["syscall"] != "execve" {
+		t.Errorf("SYSCALL record %v", syscall)
+	}
+	// of the two PATH records the first one is kept
+	if path := record(t, execve, "PATH"); path["name"] != "/bin/sleep" {
+		t.Errorf("PATH record %v", path)
+	}
+}
+
+func TestAssemblerRenamesFields(t *testing.T) {
+	var events []Event
+	a := NewAssembler(func(event Event) { events = append(events, event) })
+	for _, line := range []string{
+		`type=SYSCALL msg=audit(1618919477.451:7): arch=c000003e syscall=42 success=no exit=-115 a0=3 a1=0 a2=10 a3=0 items=0 pid=1 comm="curl" exe="/usr/bin/curl"`,
+		`type=SOCKADDR msg=audit(1618919477.451:7): saddr=02000050D4164D4F0000000000000000`,
+		`type=USER_LOGIN msg=audit(1618919477.451:7): pid=1 uid=0 msg='op=login acct="root" res=failed'`,
+		`type=EOE msg=audit(1618919477.451:7): `,
+	} {
+		msgs, err := ParseLine(line)
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		a.Add(msgs[0], time.Now())
+	}
+	if len(events) != 1 {
+		t.Fatalf("%d events", len(events))
+	}
+	if syscall := record(t, events[0], "SYSCALL"); syscall["success"] != "no" {
+		t.Errorf("SYSCALL record %v", syscall)
+	}
+	if sockaddr := record(t, events[0], "SOCKADDR"); sockaddr["ip"] != "212.22.77.79" || sockaddr["addr"] != "" {
+		t.Errorf("SOCKADDR record %v", sockaddr)
+	}
+	if login := record(t, events[0], "USER_LOGIN"); login["res"] != "failed" {
+		t.Errorf("USER_LOGIN record %v", login)
+	}
+}
+
+func syscallRecord(t *testing.T, serial string) *auparse.AuditMessage {
+	t.Helper()
+	msg, err := auparse.ParseLogLine("type=SYSCALL msg=audit(1618919477.451:" + serial + "): arch=c000003e syscall=2 success=yes exit=3 a0=1 a1=0 a2=0 a3=0 items=0 pid=1 comm=\"cat\" exe=\"/bin/cat\"")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestAssemblerCompletesEvents(t *testing.T) {
+	var serials []uint64
+	a := NewAssembler(func(event Event) { serials = append(serials, event.Serial) })
+	start := time.Now()
+
+	// EOE completes its event at once, an EOE of no open event is dropped
+	a.Add(syscallRecord(t, "1"), start)
+	eoe, _ := auparse.ParseLogLine("type=EOE msg=audit(1618919477.451:1): ")
+	a.Add(eoe, start)
+	a.Add(eoe, start)
+	if !reflect.DeepEqual(serials, []uint64{1}) {
+		t.Fatalf("EOE completed %v", serials)
+	}
+
+	// without EOE an event completes once no record came for DefaultTimeout
+	a.Add(syscallRecord(t, "3"), start)
+	a.Add(syscallRecord(t, "2"), start.Add(time.Second))
+	a.Expire(start.Add(DefaultTimeout - time.Millisecond))
+	if len(serials) != 1 {
+		t.Fatalf("completed %v before the timeout", serials)
+	}
+	a.Expire(start.Add(DefaultTimeout))
+	a.Expire(start.Add(time.Second + DefaultTimeout))
+	if !reflect.DeepEqual(serials, []uint64{1, 3, 2}) {
+		t.Fatalf("timeout completed %v", serials)
+	}
+}
+
+func TestAssemblerBoundsOpenEvents(t *testing.T) {
+	var serials []uint64
+	a := NewAssembler(func(event Event) { serials = append(serials, event.Serial) })
+	a.MaxOpen = 3
+	now := time.Now()
+	for _, serial := range []string{"12", "10", "11"} {
+		a.Add(syscallRecord(t, serial), now)
+	}
+	if len(serials) != 0 {
+		t.Fatalf("completed %v under the limit", serials)
+	}
+	// another record of an open event doesnt open a new one
+	a.Add(syscallRecord(t, "10"), now)
+	if len(serials) != 0 {
+		t.Fatalf("completed %v on a known serial", serials)
+	}
+	a.Add(syscallRecord(t, "13"), now)
+	if !reflect.DeepEqual(serials, []uint64{10, 11, 12}) || len(a.open) != 1 {
+		t.Errorf("completed %v with %d left open", serials, len(a.open))
+	}
+}
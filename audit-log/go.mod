@@ -0,0 +1,5 @@
+module audit-log
+
+go 1.15
+
+require github.com/elastic/go-libaudit/v2 v2.5.0